@@ -0,0 +1,146 @@
+// Package breaker is a circuit breaker for calls to an upstream
+// dependency. After threshold calls in a row fail it opens, and callers
+// fail fast instead of each sitting through a dial or request timeout.
+// Once cooldown has passed, the next call is let through as a probe:
+// success closes the breaker, failure opens it for another cooldown.
+package breaker
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "../clock"
+)
+
+// ErrOpen is returned instead of making a call while the breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// State is where a breaker is in its cycle.
+type State int
+
+const (
+    Closed   State = iota // calling normally
+    Open                  // failing fast until the cooldown ends
+    HalfOpen              // one probe is in flight
+)
+
+func (s State) String() string {
+    switch s {
+    case Closed:
+        return "closed"
+    case Open:
+        return "open"
+    case HalfOpen:
+        return "half-open"
+    }
+    return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Breaker guards one dependency. A nil *Breaker lets everything through.
+type Breaker struct {
+    name      string // what it guards, for the log
+    threshold int
+    cooldown  time.Duration
+    clock     clock.Clock
+
+    mu       sync.Mutex
+    state    State
+    failures int // in a row
+    openedAt time.Time
+    opens    int64 // times it has opened
+    rejected int64 // calls refused, in all
+    refused  int64 // calls refused since it last opened
+}
+
+// New returns a closed breaker for the dependency called name that opens
+// after threshold failures in a row and probes again after cooldown, as
+// measured by clk.
+func New(name string, threshold int, cooldown time.Duration, clk clock.Clock) *Breaker {
+    return &Breaker{name: name, threshold: threshold, cooldown: cooldown, clock: clk}
+}
+
+// Allow reports whether to make the call. Every allowed call must be
+// followed by Done with its result.
+func (b *Breaker) Allow() bool {
+    if b == nil {
+        return true
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    switch b.state {
+    case Open:
+        if b.clock.Since(b.openedAt) >= b.cooldown {
+            b.state = HalfOpen
+            fmt.Printf("[BREAKER] %s: half-open, probing\n", b.name)
+            return true
+        }
+    case Closed:
+        return true
+    }
+    b.rejected++
+    b.refused++
+    return false
+}
+
+// Done records the result of an allowed call.
+func (b *Breaker) Done(err error) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if err == nil {
+        if b.state != Closed {
+            fmt.Printf("[BREAKER] %s: closed, it is back (%d calls refused while open)\n", b.name, b.refused)
+        }
+        b.state, b.failures = Closed, 0
+        return
+    }
+    b.failures++
+    if b.state == Open {
+        return // a call that started before it opened
+    }
+    if b.state == HalfOpen || b.failures >= b.threshold {
+        if b.state == Closed {
+            b.refused = 0
+        }
+        b.state = Open
+        b.openedAt = b.clock.Now()
+        b.opens++
+        fmt.Printf("[BREAKER] %s: open after %d failures in a row, failing fast for %v (opened %d times): %v\n", b.name, b.failures, b.cooldown, b.opens, err)
+    }
+}
+
+// RetryAfter returns how long until the breaker will let a probe through:
+// zero unless it is open.
+func (b *Breaker) RetryAfter() time.Duration {
+    if b == nil {
+        return 0
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.state != Open {
+        return 0
+    }
+    return max(0, b.cooldown-b.clock.Since(b.openedAt))
+}
+
+// Stats is a breaker's state and counters, as published on the servers'
+// admin listeners.
+type Stats struct {
+    State    string `json:"state"`
+    Failures int    `json:"failures"` // in a row
+    Opens    int64  `json:"opens"`
+    Rejected int64  `json:"rejected"`
+}
+
+func (b *Breaker) Stats() Stats {
+    if b == nil {
+        return Stats{State: Closed.String()}
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return Stats{State: b.state.String(), Failures: b.failures, Opens: b.opens, Rejected: b.rejected}
+}
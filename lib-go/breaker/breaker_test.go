@@ -0,0 +1,95 @@
+package breaker
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "../clock"
+)
+
+var errDown = errors.New("down")
+
+func TestCycle(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    b := New("test", 2, 50*time.Millisecond, clk)
+
+    for i := 0; i < 2; i++ {
+        if !b.Allow() {
+            t.Fatalf("call %d refused while closed", i)
+        }
+        b.Done(errDown)
+    }
+    if got := b.Stats().State; got != "open" {
+        t.Fatalf("after 2 failures: state %s, want open", got)
+    }
+    if b.Allow() {
+        t.Fatal("call allowed while open")
+    }
+    clk.Advance(20 * time.Millisecond)
+    if d := b.RetryAfter(); d != 30*time.Millisecond {
+        t.Fatalf("RetryAfter %v 20ms into a 50ms cooldown, want 30ms", d)
+    }
+
+    clk.Advance(30 * time.Millisecond)
+    if !b.Allow() {
+        t.Fatal("probe refused after the cooldown")
+    }
+    if b.Allow() {
+        t.Fatal("second call allowed while the probe is in flight")
+    }
+    b.Done(errDown)
+    if got := b.Stats(); got.State != "open" || got.Opens != 2 {
+        t.Fatalf("after a failed probe: %+v, want open twice", got)
+    }
+
+    clk.Advance(60 * time.Millisecond)
+    if !b.Allow() {
+        t.Fatal("probe refused after the second cooldown")
+    }
+    b.Done(nil)
+    want := Stats{State: "closed", Failures: 0, Opens: 2, Rejected: 2}
+    if got := b.Stats(); got != want {
+        t.Fatalf("after a good probe: %+v, want %+v", got, want)
+    }
+    if b.RetryAfter() != 0 {
+        t.Fatal("RetryAfter nonzero while closed")
+    }
+}
+
+func TestSuccessResetsFailures(t *testing.T) {
+    b := New("test", 3, time.Minute, clock.Real)
+    for i := 0; i < 10; i++ {
+        b.Allow()
+        b.Done(errDown)
+        b.Allow()
+        b.Done(errDown)
+        b.Allow()
+        b.Done(nil)
+    }
+    if got := b.Stats().State; got != "closed" {
+        t.Fatalf("state %s, want closed: failures were never 3 in a row", got)
+    }
+}
+
+func TestLateFailureWhileOpen(t *testing.T) {
+    b := New("test", 1, time.Minute, clock.Real)
+    b.Allow()
+    b.Allow() // a second call starts before the first fails
+    b.Done(errDown)
+    b.Done(errDown)
+    if got := b.Stats().Opens; got != 1 {
+        t.Fatalf("opened %d times, want 1", got)
+    }
+}
+
+func TestNil(t *testing.T) {
+    var b *Breaker
+    if !b.Allow() {
+        t.Fatal("nil breaker refused a call")
+    }
+    b.Done(errDown)
+    if b.RetryAfter() != 0 || b.Stats().State != "closed" {
+        t.Fatal("nil breaker is not permanently closed")
+    }
+}
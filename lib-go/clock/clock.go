@@ -0,0 +1,68 @@
+// Package clock is the time source for code that schedules work or times
+// things out: heartbeats, expiries, reapers, backoff, breaker cooldowns.
+// Taking time from a Clock rather than the time package lets tests drive
+// it with a Fake instead of sleeping.
+//
+// Deadlines on connections are not scheduling and always come from
+// time.Now: the runtime enforces them against the real time, so a fake
+// one would fire at once or never.
+package clock
+
+import "time"
+
+// Clock is the part of the time package that servers schedule with.
+type Clock interface {
+    Now() time.Time
+    Since(t time.Time) time.Duration
+    Sleep(d time.Duration)
+    After(d time.Duration) <-chan time.Time
+    NewTimer(d time.Duration) Timer
+    AfterFunc(d time.Duration, f func()) Timer
+    NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a *time.Timer. For one made by AfterFunc, C is nil.
+type Timer interface {
+    C() <-chan time.Time
+    Stop() bool
+    Reset(d time.Duration) bool
+}
+
+// Ticker is a *time.Ticker.
+type Ticker interface {
+    C() <-chan time.Time
+    Stop()
+}
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+    return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+    return realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+    return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,226 @@
+package clock
+
+import (
+    "sync"
+    "time"
+)
+
+// Fake is a Clock for tests that only moves when Advance is called.
+//
+// Timers and tickers fire in time order as Advance passes them. A timer's
+// channel holds one value, as a real timer's does, but a ticker's ticks
+// are never dropped: Advance waits for each to be received, so a test that
+// advances by ten ticks knows the receiver took all ten. AfterFunc
+// functions run on the goroutine calling Advance, before it moves on.
+// Anything set to fire at once (a duration of zero or less) fires when it
+// is set, as it would with the real clock.
+type Fake struct {
+    mu      sync.Mutex
+    cond    sync.Cond // signalled when pending changes
+    now     time.Time
+    pending []*fakeTimer // armed timers and tickers
+}
+
+// NewFake returns a fake clock reading now.
+func NewFake(now time.Time) *Fake {
+    c := &Fake{now: now}
+    c.cond.L = &c.mu
+    return c
+}
+
+func (c *Fake) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.now
+}
+
+func (c *Fake) Since(t time.Time) time.Duration {
+    return c.Now().Sub(t)
+}
+
+// Sleep returns once Advance has moved the clock on by d.
+func (c *Fake) Sleep(d time.Duration) {
+    if d > 0 {
+        <-c.After(d)
+    }
+}
+
+func (c *Fake) After(d time.Duration) <-chan time.Time {
+    return c.NewTimer(d).C()
+}
+
+func (c *Fake) NewTimer(d time.Duration) Timer {
+    t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+    t.Reset(d)
+    return t
+}
+
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+    t := &fakeTimer{clock: c, f: f}
+    t.Reset(d)
+    return t
+}
+
+func (c *Fake) NewTicker(d time.Duration) Ticker {
+    if d <= 0 {
+        panic("clock: non-positive interval for NewTicker")
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    t := &fakeTimer{clock: c, c: make(chan time.Time), period: d, stop: make(chan struct{})}
+    c.arm(t, c.now.Add(d))
+    return fakeTicker{t}
+}
+
+// BlockUntil waits until at least n timers, tickers and sleepers are
+// pending, so that advancing the clock doesn't race with a goroutine that
+// has not yet set the timer it should fire.
+func (c *Fake) BlockUntil(n int) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for len(c.pending) < n {
+        c.cond.Wait()
+    }
+}
+
+// Advance moves the clock on by d, firing everything that falls due on
+// the way in order.
+func (c *Fake) Advance(d time.Duration) {
+    c.mu.Lock()
+    end := c.now.Add(d)
+    for {
+        var due *fakeTimer
+        for _, t := range c.pending {
+            if !t.when.After(end) && (due == nil || t.when.Before(due.when)) {
+                due = t
+            }
+        }
+        if due == nil {
+            break
+        }
+        at := due.when
+        c.now = at
+        if due.period > 0 {
+            due.when = at.Add(due.period)
+        } else {
+            c.disarm(due)
+        }
+        c.mu.Unlock()
+        due.fire(at)
+        c.mu.Lock()
+    }
+    c.now = end
+    c.mu.Unlock()
+}
+
+// arm and disarm add and remove t from pending. The caller must hold c.mu.
+func (c *Fake) arm(t *fakeTimer, when time.Time) {
+    t.when = when
+    if !t.armed {
+        t.armed = true
+        c.pending = append(c.pending, t)
+        c.cond.Broadcast()
+    }
+}
+
+func (c *Fake) disarm(t *fakeTimer) bool {
+    if !t.armed {
+        return false
+    }
+    t.armed = false
+    for i, p := range c.pending {
+        if p == t {
+            c.pending = append(c.pending[:i], c.pending[i+1:]...)
+            break
+        }
+    }
+    c.cond.Broadcast()
+    return true
+}
+
+// fakeTimer is a Fake's timer, AfterFunc timer or, with period set, the
+// workings of a ticker.
+type fakeTimer struct {
+    clock  *Fake
+    c      chan time.Time
+    f      func()
+    period time.Duration
+    stop   chan struct{} // closed when a ticker is stopped
+
+    // Guarded by the clock's mu.
+    when  time.Time
+    armed bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) fire(at time.Time) {
+    switch {
+    case t.f != nil:
+        t.f()
+    case t.period > 0:
+        select {
+        case t.c <- at:
+        case <-t.stop:
+        }
+    default:
+        select {
+        case t.c <- at:
+        default:
+        }
+    }
+}
+
+// Stop disarms the timer. As with the real clock since Go 1.23, no value
+// sent before the Stop is received after it.
+func (t *fakeTimer) Stop() bool {
+    t.clock.mu.Lock()
+    defer t.clock.mu.Unlock()
+    t.drain()
+    return t.clock.disarm(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+    c := t.clock
+    c.mu.Lock()
+    t.drain()
+    if d > 0 {
+        defer c.mu.Unlock()
+        was := t.armed
+        c.arm(t, c.now.Add(d))
+        return was
+    }
+    was := c.disarm(t)
+    at := c.now
+    c.mu.Unlock()
+    if t.f != nil {
+        go t.f()
+    } else {
+        t.fire(at)
+    }
+    return was
+}
+
+func (t *fakeTimer) drain() {
+    if t.c == nil {
+        return
+    }
+    select {
+    case <-t.c:
+    default:
+    }
+}
+
+// fakeTicker is a fakeTimer with a period.
+type fakeTicker struct {
+    *fakeTimer
+}
+
+// Stop stops the ticks, including one Advance is waiting to deliver.
+func (t fakeTicker) Stop() {
+    t.clock.mu.Lock()
+    defer t.clock.mu.Unlock()
+    if t.clock.disarm(t.fakeTimer) {
+        close(t.stop)
+    }
+}
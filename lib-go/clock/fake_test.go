@@ -0,0 +1,129 @@
+package clock
+
+import (
+    "testing"
+    "time"
+)
+
+var epoch = time.Unix(0, 0)
+
+func TestFakeTimersFireInOrder(t *testing.T) {
+    c := NewFake(epoch)
+    var fired []int
+    for _, n := range []int{3, 1, 2} {
+        c.AfterFunc(time.Duration(n)*time.Second, func() {
+            fired = append(fired, n)
+            if got := c.Since(epoch); got != time.Duration(n)*time.Second {
+                t.Errorf("timer %d ran at %v", n, got)
+            }
+        })
+    }
+    late := c.NewTimer(10 * time.Second)
+
+    c.Advance(2 * time.Second)
+    if len(fired) != 2 || fired[0] != 1 || fired[1] != 2 {
+        t.Fatalf("after 2s fired %v, want [1 2]", fired)
+    }
+    c.Advance(time.Second)
+    if len(fired) != 3 {
+        t.Fatalf("after 3s fired %v", fired)
+    }
+    select {
+    case <-late.C():
+        t.Fatal("10s timer fired after 3s")
+    default:
+    }
+    c.Advance(7 * time.Second)
+    select {
+    case at := <-late.C():
+        if !at.Equal(epoch.Add(10 * time.Second)) {
+            t.Fatalf("10s timer sent %v", at)
+        }
+    default:
+        t.Fatal("10s timer did not fire")
+    }
+}
+
+func TestFakeTimerStopAndReset(t *testing.T) {
+    c := NewFake(epoch)
+    tm := c.NewTimer(time.Second)
+    if !tm.Stop() {
+        t.Fatal("Stop of a pending timer reported it had already fired")
+    }
+    c.Advance(time.Minute)
+    select {
+    case <-tm.C():
+        t.Fatal("stopped timer fired")
+    default:
+    }
+
+    // A value sent before Reset is not received after it.
+    tm.Reset(time.Second)
+    c.Advance(time.Second)
+    tm.Reset(time.Second)
+    select {
+    case <-tm.C():
+        t.Fatal("received a value sent before the Reset")
+    default:
+    }
+    c.Advance(time.Second)
+    <-tm.C()
+
+    // Set to fire at once, it does.
+    select {
+    case <-c.After(0):
+    default:
+        t.Fatal("After(0) did not fire at once")
+    }
+}
+
+func TestFakeTickerDeliversEveryTick(t *testing.T) {
+    c := NewFake(epoch)
+    tk := c.NewTicker(100 * time.Millisecond)
+    got := make(chan int)
+    go func() {
+        n := 0
+        for range tk.C() {
+            n++
+            if n == 25 {
+                got <- n
+                return
+            }
+        }
+    }()
+
+    // Each tick waits for the receiver, so none is dropped.
+    c.Advance(2500 * time.Millisecond)
+    if n := <-got; n != 25 {
+        t.Fatalf("received %d ticks, want 25", n)
+    }
+
+    // Stopping the ticker frees an Advance blocked on a tick nobody takes.
+    done := make(chan struct{})
+    go func() {
+        c.Advance(time.Second)
+        close(done)
+    }()
+    time.Sleep(10 * time.Millisecond)
+    tk.Stop()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("Advance still blocked after the ticker was stopped")
+    }
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+    c := NewFake(epoch)
+    woke := make(chan time.Time)
+    go func() {
+        c.Sleep(time.Hour)
+        woke <- c.Now()
+    }()
+
+    c.BlockUntil(1)
+    c.Advance(time.Hour)
+    if at := <-woke; !at.Equal(epoch.Add(time.Hour)) {
+        t.Fatalf("woke at %v, want an hour in", at)
+    }
+}
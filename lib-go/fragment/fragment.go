@@ -0,0 +1,54 @@
+// Package fragment splits writes into random pieces sent one at a time,
+// so that a server which assumes one Read per message sees its framing
+// fall apart. The tools use it against a running server, and the
+// solutions' tests against their handlers.
+package fragment
+
+import (
+    "io"
+    "math/rand"
+    "net"
+    "time"
+)
+
+// Writer splits every Write into random pieces of 1 to Max bytes and
+// writes them to W one by one, pausing Delay in between. Rand picks the
+// piece sizes and must not be shared with another goroutine.
+type Writer struct {
+    W     io.Writer
+    Max   int
+    Delay time.Duration
+    Rand  *rand.Rand
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := min(len(p), 1+w.Rand.Intn(w.Max))
+        if written > 0 && w.Delay > 0 {
+            time.Sleep(w.Delay)
+        }
+        if _, err := w.W.Write(p[:n]); err != nil {
+            return written, err
+        }
+        written += n
+        p = p[n:]
+    }
+    return written, nil
+}
+
+// Conn is a net.Conn whose writes go through a Writer.
+type Conn struct {
+    net.Conn
+    w *Writer
+}
+
+// NewConn returns conn with its writes split into pieces of at most max
+// bytes, delay apart, sized by rng.
+func NewConn(conn net.Conn, max int, delay time.Duration, rng *rand.Rand) *Conn {
+    return &Conn{Conn: conn, w: &Writer{W: conn, Max: max, Delay: delay, Rand: rng}}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+    return c.w.Write(p)
+}
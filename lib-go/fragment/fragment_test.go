@@ -0,0 +1,37 @@
+package fragment
+
+import (
+    "bytes"
+    "math/rand"
+    "testing"
+)
+
+// pieces records each write it is given.
+type pieces struct {
+    writes [][]byte
+}
+
+func (p *pieces) Write(b []byte) (int, error) {
+    p.writes = append(p.writes, append([]byte(nil), b...))
+    return len(b), nil
+}
+
+func TestWriterSplitsIntoBoundedPieces(t *testing.T) {
+    var got pieces
+    w := &Writer{W: &got, Max: 3, Rand: rand.New(rand.NewSource(1))}
+    msg := []byte("a message long enough to be cut many times")
+    if n, err := w.Write(msg); n != len(msg) || err != nil {
+        t.Fatalf("wrote %d bytes, %v", n, err)
+    }
+    if len(got.writes) < len(msg)/3 {
+        t.Fatalf("%d pieces for %d bytes", len(got.writes), len(msg))
+    }
+    for _, piece := range got.writes {
+        if len(piece) < 1 || len(piece) > 3 {
+            t.Fatalf("piece of %d bytes", len(piece))
+        }
+    }
+    if joined := bytes.Join(got.writes, nil); !bytes.Equal(joined, msg) {
+        t.Fatalf("pieces join to %q", joined)
+    }
+}
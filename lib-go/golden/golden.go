@@ -0,0 +1,111 @@
+// Package golden reads golden transcripts: recorded client connections
+// that a server's replies are diffed against. A transcript is text:
+//
+//    # prime-time: a prime and a malformed request
+//    > "{\"method\":\"isPrime\",\"number\":7}\n"
+//    < "{\"method\":\"isPrime\",\"prime\":true}\n"
+//
+// Lines starting with > are sent to the server and lines starting with <
+// are the bytes it must reply with, both as Go quoted strings. "> EOF"
+// closes the client's side of the connection, and "< EOF" means the server
+// must close its side at that point.
+//
+// The transcripts for each solution live in
+// tools-go/protohackers/golden/<problem>/. Those named malformed-*.txt are
+// the problem's corpus of nasty inputs (truncated frames, huge lengths,
+// bad checksums, ...), each pinning down the error the server answers
+// with. All of a problem's transcripts are replayed against one server, so
+// none may depend on what another stored.
+package golden
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Step is one line of a transcript.
+type Step struct {
+    Send bool // sent by the client, rather than replied by the server
+    Data []byte
+    EOF  bool
+}
+
+// Parse reads the transcript at path.
+func Parse(path string) ([]Step, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var steps []Step
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        dir, rest, _ := strings.Cut(line, " ")
+        if dir != ">" && dir != "<" {
+            return nil, fmt.Errorf("%s:%d: line must start with > or <", path, n)
+        }
+        if rest == "EOF" {
+            steps = append(steps, Step{Send: dir == ">", EOF: true})
+            continue
+        }
+        data, err := strconv.Unquote(rest)
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+        }
+        steps = append(steps, Step{Send: dir == ">", Data: []byte(data)})
+    }
+    return steps, scanner.Err()
+}
+
+// Paths expands each argument, a transcript or a directory of *.txt
+// transcripts, into transcript paths.
+func Paths(args []string) ([]string, error) {
+    var paths []string
+    for _, arg := range args {
+        info, err := os.Stat(arg)
+        if err != nil {
+            return nil, err
+        }
+        if !info.IsDir() {
+            paths = append(paths, arg)
+            continue
+        }
+        matches, _ := filepath.Glob(filepath.Join(arg, "*.txt"))
+        paths = append(paths, matches...)
+    }
+    return paths, nil
+}
+
+// Sent returns everything the client sends in each transcript in dir, one
+// stream per transcript. Fuzz tests seed their corpora with it.
+func Sent(dir string) ([][]byte, error) {
+    paths, err := Paths([]string{dir})
+    if err != nil {
+        return nil, err
+    }
+    var streams [][]byte
+    for _, path := range paths {
+        steps, err := Parse(path)
+        if err != nil {
+            return nil, err
+        }
+        var sent []byte
+        for _, s := range steps {
+            if s.Send {
+                sent = append(sent, s.Data...)
+            }
+        }
+        streams = append(streams, sent)
+    }
+    return streams, nil
+}
@@ -0,0 +1,87 @@
+package lines
+
+import (
+    "bufio"
+    "io"
+    "testing"
+)
+
+// segmented reads data a TCP segment at a time, as a connection would.
+type segmented struct {
+    data []byte
+}
+
+func (s *segmented) Read(p []byte) (int, error) {
+    if len(s.data) == 0 {
+        return 0, io.EOF
+    }
+    n := copy(p[:min(len(p), 1460)], s.data)
+    s.data = s.data[n:]
+    return n, nil
+}
+
+// sink keeps the benchmarks' work from being optimized away.
+var sink int
+
+// Benchmark reads traffic into lines with bufio.Scanner,
+// bufio.Reader.ReadBytes and a Splitter, each as a sub-benchmark of b, so
+// a solution can weigh them on its own protocol's traffic. The traffic
+// arrives a TCP segment at a time, and each strategy reuses its buffers
+// from one run to the next, as a pool would let it.
+func Benchmark(b *testing.B, traffic []byte) {
+    b.Run("Scanner", func(b *testing.B) {
+        b.SetBytes(int64(len(traffic)))
+        b.ReportAllocs()
+        buf := make([]byte, 4096)
+        total := 0
+        for i := 0; i < b.N; i++ {
+            sc := bufio.NewScanner(&segmented{traffic})
+            sc.Buffer(buf, bufio.MaxScanTokenSize)
+            for sc.Scan() {
+                total += len(sc.Bytes())
+            }
+        }
+        sink = total
+    })
+
+    b.Run("ReadBytes", func(b *testing.B) {
+        b.SetBytes(int64(len(traffic)))
+        b.ReportAllocs()
+        br := bufio.NewReaderSize(nil, 4096)
+        total := 0
+        for i := 0; i < b.N; i++ {
+            br.Reset(&segmented{traffic})
+            for {
+                line, err := br.ReadBytes('\n')
+                if err != nil {
+                    break
+                }
+                total += len(line) - 1
+            }
+        }
+        sink = total
+    })
+
+    b.Run("Splitter", func(b *testing.B) {
+        b.SetBytes(int64(len(traffic)))
+        b.ReportAllocs()
+        buf := make([]byte, 4096)
+        var s Splitter
+        total := 0
+        count := func(line []byte) error {
+            total += len(line)
+            return nil
+        }
+        for i := 0; i < b.N; i++ {
+            src := &segmented{traffic}
+            for {
+                n, err := src.Read(buf)
+                s.Split(buf[:n], count)
+                if err != nil {
+                    break
+                }
+            }
+        }
+        sink = total
+    })
+}
@@ -0,0 +1,47 @@
+// Package lines cuts a byte stream, read in arbitrary chunks, into lines.
+// It is for a caller that does its own reads: a Splitter keeps only the
+// partial line between chunks and does not own the reader, so a server
+// can drive several streams from one goroutine. bufio.Scanner remains the
+// simpler choice for a goroutine that owns its reader; Benchmark compares
+// the two on a protocol's traffic.
+package lines
+
+import "bytes"
+
+// Splitter holds the partial line between chunks. Unlike bufio it copies
+// nothing but a line split across two chunks, and once warmed up it
+// allocates nothing at all. The zero value is ready to use.
+type Splitter struct {
+    partial []byte // bytes read after the last complete line
+}
+
+// Split calls line for each line that data completes, without its
+// newline. The slice is only valid until line returns. The bytes after
+// the last newline are kept, to start the first line of the next chunk.
+// Split stops at the first error line returns.
+func (s *Splitter) Split(data []byte, line func([]byte) error) error {
+    for {
+        i := bytes.IndexByte(data, '\n')
+        if i < 0 {
+            break
+        }
+        l := data[:i]
+        data = data[i+1:]
+        if len(s.partial) > 0 {
+            s.partial = append(s.partial, l...)
+            l = s.partial
+            s.partial = s.partial[:0]
+        }
+        if err := line(l); err != nil {
+            return err
+        }
+    }
+    s.partial = append(s.partial, data...)
+    return nil
+}
+
+// Partial returns the bytes after the last complete line, which a stream
+// ending now would leave unterminated.
+func (s *Splitter) Partial() []byte {
+    return s.partial
+}
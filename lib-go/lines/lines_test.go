@@ -0,0 +1,75 @@
+package lines
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+// randomLines is lines of every length from empty to well over a chunk,
+// with a partial line at the end.
+func randomLines(rng *rand.Rand, n int) []byte {
+    var b bytes.Buffer
+    for i := 0; i < n; i++ {
+        size := rng.Intn(80)
+        if rng.Intn(20) == 0 {
+            size = rng.Intn(10000)
+        }
+        b.WriteString(strings.Repeat(string(rune('a'+i%26)), size))
+        b.WriteByte('\n')
+    }
+    b.WriteString("unterminated")
+    return b.Bytes()
+}
+
+func TestSplitterMatchesScanner(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    traffic := randomLines(rng, 2000)
+    var want []string
+    sc := bufio.NewScanner(bytes.NewReader(traffic))
+    for sc.Scan() {
+        want = append(want, sc.Text())
+    }
+    want = want[:len(want)-1] // the Scanner returns the partial line too
+
+    var got []string
+    var s Splitter
+    for data := traffic; len(data) > 0; {
+        n := min(len(data), 1+rng.Intn(3000))
+        s.Split(data[:n], func(line []byte) error {
+            got = append(got, string(line))
+            return nil
+        })
+        data = data[n:]
+    }
+    if len(got) != len(want) {
+        t.Fatalf("split %d lines, want %d", len(got), len(want))
+    }
+    for i := range want {
+        if got[i] != want[i] {
+            t.Fatalf("line %d: %q, want %q", i, got[i], want[i])
+        }
+    }
+    if string(s.Partial()) != "unterminated" {
+        t.Fatalf("partial line %q", s.Partial())
+    }
+}
+
+func TestSplitterStopsAtError(t *testing.T) {
+    var s Splitter
+    stop := errors.New("stop")
+    var got []string
+    err := s.Split([]byte("one\ntwo\nthree\n"), func(line []byte) error {
+        got = append(got, string(line))
+        if len(got) == 2 {
+            return stop
+        }
+        return nil
+    })
+    if err != stop || len(got) != 2 {
+        t.Fatalf("got %q and %v, want two lines and the error", got, err)
+    }
+}
@@ -0,0 +1,150 @@
+// Package quota is the resource limits of every protocol, kept in one
+// table so that each solution takes its limits the same way: the defaults
+// come from here, and the same -max-* flags override them.
+package quota
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "io"
+    "math"
+    "time"
+)
+
+// Quota is the limits one server enforces. A zero limit is no limit.
+type Quota struct {
+    // Message is the most bytes in one message: a request line or a
+    // datagram.
+    Message int
+    // Handshake is the most bytes a session may open with before its first
+    // message, such as a cipher spec.
+    Handshake int
+    // Items is the most things the server stores at once: keys or jobs.
+    Items int
+    // Pending is the most responses the server may owe at once, such as
+    // requests waiting for a job.
+    Pending int
+    // Session is how long one client may stay connected.
+    Session time.Duration
+}
+
+// Limit picks out the limits a protocol enforces, and so gets flags for.
+type Limit int
+
+// The limits, one per Quota field.
+const (
+    MaxMessage Limit = 1 << iota
+    MaxHandshake
+    MaxItems
+    MaxPending
+    MaxSession
+)
+
+// protocol is one protocol's entry in the table.
+type protocol struct {
+    limits   Limit
+    defaults Quota
+    items    string // what Items counts, for the flag help
+}
+
+// protocols is every protocol's quotas. The defaults are the limits its
+// spec sets, or the ones its solution has always used where the spec
+// sets none.
+var protocols = map[string]protocol{
+    "insecure-sockets-layer": {
+        limits:   MaxMessage | MaxHandshake,
+        defaults: Quota{Message: 5000, Handshake: 80},
+    },
+    "job-centre": {
+        limits:   MaxMessage | MaxItems | MaxPending | MaxSession,
+        defaults: Quota{Message: 1 << 20},
+        items:    "jobs",
+    },
+    "unusual-db": {
+        // Requests and responses must be shorter than 1000 bytes.
+        limits:   MaxMessage | MaxItems,
+        defaults: Quota{Message: 999},
+        items:    "keys",
+    },
+}
+
+// For returns name's default quotas. It panics if name has no entry.
+func For(name string) Quota {
+    return lookup(name).defaults
+}
+
+func lookup(name string) protocol {
+    p, ok := protocols[name]
+    if !ok {
+        panic(fmt.Sprintf("quota: no entry for protocol %q", name))
+    }
+    return p
+}
+
+// Flags defines a -max-* flag in fs for each limit name enforces, with
+// name's defaults, and returns the Quota they set once fs is parsed.
+func Flags(fs *flag.FlagSet, name string) *Quota {
+    p := lookup(name)
+    q := p.defaults
+    if p.limits&MaxMessage != 0 {
+        fs.IntVar(&q.Message, "max-message", q.Message, "most bytes in one message (0 = unlimited)")
+    }
+    if p.limits&MaxHandshake != 0 {
+        fs.IntVar(&q.Handshake, "max-handshake", q.Handshake, "most bytes a session may open with before its first message (0 = unlimited)")
+    }
+    if p.limits&MaxItems != 0 {
+        fs.IntVar(&q.Items, "max-items", q.Items, fmt.Sprintf("most %s stored at once (0 = unlimited)", p.items))
+    }
+    if p.limits&MaxPending != 0 {
+        fs.IntVar(&q.Pending, "max-pending", q.Pending, "most responses owed to clients at once (0 = unlimited)")
+    }
+    if p.limits&MaxSession != 0 {
+        fs.DurationVar(&q.Session, "max-session", q.Session, "longest a client may stay connected (0 = unlimited)")
+    }
+    return &q
+}
+
+// Validate reports a limit set below zero.
+func (q Quota) Validate() error {
+    for _, l := range []struct {
+        flag  string
+        value int64
+    }{
+        {"max-message", int64(q.Message)},
+        {"max-handshake", int64(q.Handshake)},
+        {"max-items", int64(q.Items)},
+        {"max-pending", int64(q.Pending)},
+        {"max-session", int64(q.Session)},
+    } {
+        if l.value < 0 {
+            return fmt.Errorf("-%s must not be negative", l.flag)
+        }
+    }
+    return nil
+}
+
+// Max returns limit, or a number too large to reach if it is 0, for code
+// that needs a bound either way.
+func Max(limit int) int {
+    if limit == 0 {
+        return math.MaxInt32
+    }
+    return limit
+}
+
+// Within reports whether n is within limit.
+func Within(n, limit int) bool {
+    return limit == 0 || n <= limit
+}
+
+// NewScanner returns a line scanner over r that fails with
+// bufio.ErrTooLong on a line longer than Message bytes. It starts out
+// reading into buf, cut down to the limit if it is larger.
+func (q Quota) NewScanner(r io.Reader, buf []byte) *bufio.Scanner {
+    limit := Max(q.Message) + 1 // room for the newline
+    n := min(len(buf), limit)
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(buf[:n:n], limit)
+    return scanner
+}
@@ -0,0 +1,72 @@
+package quota
+
+import (
+    "bufio"
+    "flag"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestFlagsOnlyForEnforcedLimits(t *testing.T) {
+    fs := flag.NewFlagSet("unusual-db", flag.ContinueOnError)
+    q := Flags(fs, "unusual-db")
+    if *q != For("unusual-db") {
+        t.Fatalf("before parsing: %+v, want the defaults %+v", *q, For("unusual-db"))
+    }
+    if err := fs.Parse([]string{"-max-items", "10", "-max-message", "0"}); err != nil {
+        t.Fatal(err)
+    }
+    if q.Items != 10 || q.Message != 0 {
+        t.Fatalf("after parsing: %+v", *q)
+    }
+    for _, name := range []string{"max-handshake", "max-pending", "max-session"} {
+        if fs.Lookup(name) != nil {
+            t.Errorf("-%s defined for a protocol that doesn't enforce it", name)
+        }
+    }
+}
+
+func TestForUnknownPanics(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Fatal("For of an unknown protocol did not panic")
+        }
+    }()
+    For("no-such-protocol")
+}
+
+func TestValidate(t *testing.T) {
+    if err := For("job-centre").Validate(); err != nil {
+        t.Fatalf("defaults: %v", err)
+    }
+    for _, q := range []Quota{{Message: -1}, {Items: -1}, {Session: -time.Second}} {
+        if q.Validate() == nil {
+            t.Errorf("%+v passed", q)
+        }
+    }
+}
+
+func TestNewScanner(t *testing.T) {
+    for _, tc := range []struct {
+        message int
+        buf     int
+        input   string
+        lines   int
+        tooLong bool
+    }{
+        {message: 5, buf: 4096, input: "12345\nab\n", lines: 2},
+        {message: 5, buf: 4096, input: "12345\n123456\n", lines: 1, tooLong: true},
+        {message: 5, buf: 0, input: "123456", lines: 0, tooLong: true},
+        {message: 0, buf: 16, input: strings.Repeat("x", 100000) + "\n", lines: 1},
+    } {
+        scanner := Quota{Message: tc.message}.NewScanner(strings.NewReader(tc.input), make([]byte, tc.buf))
+        lines := 0
+        for scanner.Scan() {
+            lines++
+        }
+        if lines != tc.lines || (scanner.Err() == bufio.ErrTooLong) != tc.tooLong {
+            t.Errorf("Message %d, %q: %d lines, error %v", tc.message, tc.input, lines, scanner.Err())
+        }
+    }
+}
@@ -0,0 +1,134 @@
+// Package retry is the timeouts and retries for outbound connections,
+// kept in one place so that the solutions' upstream dials and the tools'
+// clients cope the same way with a peer that is slow to start or briefly
+// refuses connections.
+package retry
+
+import (
+    "math"
+    "math/rand"
+    "net"
+    "sync"
+    "time"
+
+    "../clock"
+)
+
+// Timeout presets.
+const (
+    // DialTimeout bounds connecting to a server, and any handshake or
+    // lookup that goes with it.
+    DialTimeout = 10 * time.Second
+    // RequestTimeout bounds one request to an upstream server and its
+    // response.
+    RequestTimeout = 10 * time.Second
+    // ReplyTimeout is the tools' default -timeout: connecting to the
+    // server under test, and waiting for each reply.
+    ReplyTimeout = 5 * time.Second
+    // StopTimeout is how long a server is given to exit after SIGTERM.
+    StopTimeout = 5 * time.Second
+)
+
+// Backoff is bounded exponential backoff with full jitter: the wait before
+// retry n (from 0) is random up to Base<<n, capped at Max. The jitter
+// keeps a swarm of clients from retrying in lockstep.
+type Backoff struct {
+    Base time.Duration
+    Max  time.Duration
+}
+
+func (b Backoff) Delay(retry int) time.Duration {
+    // Base is compared with Max shifted down rather than shifted up
+    // itself, which could overflow.
+    d := b.Max
+    if retry < 63 && b.Base <= b.Max>>retry {
+        d = b.Base << retry
+    }
+    n := int64(d)
+    if n < math.MaxInt64 {
+        n++ // up to and including d
+    }
+    return time.Duration(rand.Int63n(n))
+}
+
+// Budget caps retries at a fraction of first attempts, plus a few to
+// start with, so that when a server is down a swarm of clients gives up
+// rather than multiplying the load on it.
+type Budget struct {
+    ratio float64 // retries earned by each first attempt
+    max   float64
+
+    mu     sync.Mutex
+    tokens float64
+}
+
+func NewBudget(ratio float64, initial int) *Budget {
+    return &Budget{ratio: ratio, max: float64(initial), tokens: float64(initial)}
+}
+
+// Attempt records a first attempt, earning a fraction of a retry.
+func (b *Budget) Attempt() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.tokens = min(b.max, b.tokens+b.ratio)
+}
+
+// Spend takes one retry from the budget, reporting false if it is used up.
+func (b *Budget) Spend() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// Policy runs an operation up to Attempts times in all, waiting out the
+// Backoff between tries on Clock and drawing each retry from Budget. A
+// nil Budget allows every retry.
+type Policy struct {
+    Attempts int
+    Backoff  Backoff
+    Budget   *Budget
+    Clock    clock.Clock
+}
+
+// DialPolicy is the policy for connecting to a server: five attempts,
+// backing off from 100ms up to 2s, and a budget of a tenth of first
+// attempts plus ten. Each call has a budget of its own.
+func DialPolicy(clk clock.Clock) Policy {
+    return Policy{
+        Attempts: 5,
+        Backoff:  Backoff{Base: 100 * time.Millisecond, Max: 2 * time.Second},
+        Budget:   NewBudget(0.1, 10),
+        Clock:    clk,
+    }
+}
+
+// Do runs op until it succeeds or the policy gives up, and returns its
+// last error.
+func (p Policy) Do(op func() error) error {
+    if p.Budget != nil {
+        p.Budget.Attempt()
+    }
+    for retry := 0; ; retry++ {
+        err := op()
+        if err == nil || retry+1 >= p.Attempts || p.Budget != nil && !p.Budget.Spend() {
+            return err
+        }
+        p.Clock.Sleep(p.Backoff.Delay(retry))
+    }
+}
+
+// Dial is net.DialTimeout retried under p. Nothing has been sent when a
+// dial fails, so it is always safe to try again.
+func (p Policy) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+    var conn net.Conn
+    err := p.Do(func() error {
+        var err error
+        conn, err = net.DialTimeout(network, addr, timeout)
+        return err
+    })
+    return conn, err
+}
@@ -0,0 +1,95 @@
+package retry
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "../clock"
+)
+
+func TestBackoffBounds(t *testing.T) {
+    b := Backoff{Base: 100 * time.Millisecond, Max: time.Second}
+    for retry := 0; retry < 40; retry++ {
+        limit := b.Max
+        if retry < 4 {
+            limit = b.Base << retry
+        }
+        for i := 0; i < 100; i++ {
+            if d := b.Delay(retry); d < 0 || d > limit {
+                t.Fatalf("retry %d waited %v, want at most %v", retry, d, limit)
+            }
+        }
+    }
+}
+
+// TestBackoffLargeValues checks a large Base or retry caps at Max rather
+// than overflowing into a negative wait.
+func TestBackoffLargeValues(t *testing.T) {
+    for _, bc := range []struct {
+        b     Backoff
+        retry int
+    }{
+        {Backoff{Base: 5 * time.Second, Max: time.Minute}, 31},
+        {Backoff{Base: 5 * time.Second, Max: time.Minute}, 62},
+        {Backoff{Base: 5 * time.Second, Max: time.Minute}, 1000},
+        {Backoff{Base: time.Hour, Max: 24 * time.Hour}, 40},
+        {Backoff{Base: time.Nanosecond, Max: 1<<63 - 1}, 62},
+        {Backoff{Base: 1<<62 - 1, Max: 1<<63 - 1}, 2},
+    } {
+        for i := 0; i < 100; i++ {
+            if d := bc.b.Delay(bc.retry); d < 0 || d > bc.b.Max {
+                t.Fatalf("%+v retry %d waited %v", bc.b, bc.retry, d)
+            }
+        }
+    }
+}
+
+func TestBudgetCapsRetries(t *testing.T) {
+    b := NewBudget(0.5, 2)
+    if !b.Spend() || !b.Spend() || b.Spend() {
+        t.Fatal("want exactly the initial two retries")
+    }
+    b.Attempt()
+    if b.Spend() {
+        t.Fatal("half a retry was spent")
+    }
+    b.Attempt()
+    if !b.Spend() {
+        t.Fatal("two attempts did not earn a retry")
+    }
+}
+
+func TestPolicyRetriesOnClock(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    p := Policy{Attempts: 3, Backoff: Backoff{Base: time.Second, Max: time.Second}, Clock: clk}
+    fail := errors.New("refused")
+
+    calls := 0
+    done := make(chan error)
+    go func() {
+        done <- p.Do(func() error {
+            calls++
+            return fail
+        })
+    }()
+    for i := 0; i < 2; i++ {
+        clk.BlockUntil(1)
+        clk.Advance(time.Second)
+    }
+    if err := <-done; err != fail || calls != 3 {
+        t.Fatalf("gave up after %d calls with %v, want 3 calls", calls, err)
+    }
+}
+
+func TestPolicyStopsWhenBudgetSpent(t *testing.T) {
+    p := Policy{Attempts: 5, Budget: NewBudget(0, 1), Clock: clock.Real}
+    calls := 0
+    p.Do(func() error {
+        calls++
+        return errors.New("refused")
+    })
+    if calls != 2 {
+        t.Fatalf("%d calls, want the first and the one retry budgeted", calls)
+    }
+}
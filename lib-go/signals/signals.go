@@ -0,0 +1,62 @@
+// Package signals is the signal handling shared by the solutions and the
+// tools, written against portable names so that everything builds and
+// shuts down the same way on Linux, macOS and Windows. A signal the system
+// doesn't have is nil, and asking to handle it does nothing.
+//
+// Solutions import it by relative path ("../../lib-go/signals"), which
+// only GOPATH mode allows: build them with GO111MODULE=off go build.
+package signals
+
+import (
+    "os"
+    "os/signal"
+)
+
+// Set by the per-system files.
+var (
+    // Terminate is SIGTERM: what kill and service managers send, and what
+    // Windows sends when the console is closed or the user logs off.
+    Terminate os.Signal
+    // Hangup is SIGHUP, conventionally "reread your configuration".
+    Hangup os.Signal
+    // User1 and User2 are SIGUSR1 and SIGUSR2, for each server to give a
+    // meaning of its own.
+    User1, User2 os.Signal
+)
+
+// Shutdown returns the signals that ask a server or tool to stop: Ctrl-C,
+// and Terminate where there is one.
+func Shutdown() []os.Signal {
+    sigs := []os.Signal{os.Interrupt}
+    if Terminate != nil {
+        sigs = append(sigs, Terminate)
+    }
+    return sigs
+}
+
+// OnShutdown calls f, on its own goroutine, when the first shutdown signal
+// arrives.
+func OnShutdown(f func()) {
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, Shutdown()...)
+    go func() {
+        <-c // Block until signal is received
+        f()
+    }()
+}
+
+// On calls f each time sig arrives, and reports whether it will: a nil sig
+// is ignored.
+func On(sig os.Signal, f func()) bool {
+    if sig == nil {
+        return false
+    }
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, sig)
+    go func() {
+        for range c {
+            f()
+        }
+    }()
+    return true
+}
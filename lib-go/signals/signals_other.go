@@ -0,0 +1,5 @@
+//go:build !unix && !windows
+
+package signals
+
+// Other systems (Plan 9, wasm) get Ctrl-C only.
@@ -0,0 +1,12 @@
+//go:build unix
+
+package signals
+
+import "syscall"
+
+func init() {
+    Terminate = syscall.SIGTERM
+    Hangup = syscall.SIGHUP
+    User1 = syscall.SIGUSR1
+    User2 = syscall.SIGUSR2
+}
@@ -0,0 +1,10 @@
+package signals
+
+import "syscall"
+
+// Windows delivers console close, logoff and shutdown events as SIGTERM.
+// It has no hangup or user signals; the servers' admin endpoints do their
+// jobs there.
+func init() {
+    Terminate = syscall.SIGTERM
+}
@@ -0,0 +1,172 @@
+package testnet
+
+import (
+    "bytes"
+    "io"
+    "net"
+    "os"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Read is one step of a Conn's read script: the next Read call returns
+// (some of) Data, then Err. Data longer than the caller's buffer is
+// handed out over as many calls as it takes, and Err comes with the last
+// of it.
+type Read struct {
+    Data []byte
+    Err  error
+}
+
+// Write is one step of a Conn's write script: the next Write call takes
+// the first N bytes (all of them if N is negative or more than there
+// are) and returns Err.
+type Write struct {
+    N   int
+    Err error
+}
+
+// Data is a read step returning s.
+func Data(s string) Read { return Read{Data: []byte(s)} }
+
+// Bytewise is a read step per byte of s, so every read is short.
+func Bytewise(s string) []Read {
+    steps := make([]Read, len(s))
+    for i := range s {
+        steps[i] = Read{Data: []byte{s[i]}}
+    }
+    return steps
+}
+
+var (
+    // ErrTimeout is what a connection returns once its deadline passes.
+    ErrTimeout error = os.ErrDeadlineExceeded
+
+    // ErrTransient is an error that is neither a timeout nor the end of
+    // the connection, such as a reset by the peer.
+    ErrTransient error = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+)
+
+// Conn is a net.Conn double whose reads and writes follow a script, to
+// reach error handling that a real connection rarely takes. Once its read
+// script runs out it reads io.EOF; once its write script runs out it
+// takes every write in full. After Close both fail with net.ErrClosed.
+type Conn struct {
+    mu      sync.Mutex
+    reads   []Read
+    writes  []Write
+    written bytes.Buffer
+    closed  bool
+
+    readDeadline time.Time
+}
+
+// NewConn returns a Conn that reads reads, in order.
+func NewConn(reads ...Read) *Conn {
+    return &Conn{reads: reads}
+}
+
+// ScriptWrites sets what the next writes do.
+func (c *Conn) ScriptWrites(writes ...Write) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.writes = append(c.writes, writes...)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return 0, net.ErrClosed
+    }
+    if len(c.reads) == 0 {
+        return 0, io.EOF
+    }
+    step := &c.reads[0]
+    n := copy(p, step.Data)
+    step.Data = step.Data[n:]
+    if len(step.Data) > 0 {
+        return n, nil
+    }
+    err := step.Err
+    c.reads = c.reads[1:]
+    return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return 0, net.ErrClosed
+    }
+    if len(c.writes) == 0 {
+        return c.written.Write(p)
+    }
+    step := c.writes[0]
+    c.writes = c.writes[1:]
+    n := len(p)
+    if step.N >= 0 && step.N < n {
+        n = step.N
+    }
+    c.written.Write(p[:n])
+    if step.Err == nil && n < len(p) {
+        return n, io.ErrShortWrite
+    }
+    return n, step.Err
+}
+
+// Written returns everything written so far.
+func (c *Conn) Written() []byte {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return bytes.Clone(c.written.Bytes())
+}
+
+func (c *Conn) Close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return net.ErrClosed
+    }
+    c.closed = true
+    return nil
+}
+
+// Closed reports whether Close has been called.
+func (c *Conn) Closed() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.closed
+}
+
+// Deadlines are not enforced: the script decides when a read or write
+// times out. The read deadline is kept for tests to check.
+
+func (c *Conn) SetDeadline(t time.Time) error {
+    c.SetReadDeadline(t)
+    return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.readDeadline = t
+    return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+    return nil
+}
+
+// ReadDeadline returns the read deadline last set.
+func (c *Conn) ReadDeadline() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.readDeadline
+}
+
+var scriptAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (c *Conn) LocalAddr() net.Addr  { return scriptAddr }
+func (c *Conn) RemoteAddr() net.Addr { return scriptAddr }
@@ -0,0 +1,66 @@
+package testnet
+
+import (
+    "bufio"
+    "errors"
+    "io"
+    "net"
+    "os"
+    "syscall"
+    "testing"
+)
+
+func TestConnFollowsReadScript(t *testing.T) {
+    c := NewConn(Data("hello"), Read{Data: []byte("wor"), Err: ErrTransient}, Read{Err: ErrTimeout})
+    buf := make([]byte, 3)
+
+    for _, want := range []string{"hel", "lo"} {
+        if n, err := c.Read(buf); err != nil || string(buf[:n]) != want {
+            t.Fatalf("read %q, %v; want %q", buf[:n], err, want)
+        }
+    }
+    n, err := c.Read(buf)
+    if string(buf[:n]) != "wor" || !errors.Is(err, syscall.ECONNRESET) {
+        t.Fatalf("read %q, %v; want the data and a reset", buf[:n], err)
+    }
+    var netErr net.Error
+    if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Fatalf("read %v, want a timeout", err)
+    }
+    if _, err := c.Read(buf); err != io.EOF {
+        t.Fatalf("read %v after the script, want EOF", err)
+    }
+}
+
+func TestConnBytewise(t *testing.T) {
+    r := bufio.NewReader(NewConn(Bytewise("one\ntwo\n")...))
+    for _, want := range []string{"one\n", "two\n"} {
+        if line, err := r.ReadString('\n'); err != nil || line != want {
+            t.Fatalf("read %q, %v; want %q", line, err, want)
+        }
+    }
+}
+
+func TestConnFollowsWriteScript(t *testing.T) {
+    c := NewConn()
+    c.ScriptWrites(Write{N: 2}, Write{N: 1, Err: ErrTransient}, Write{N: -1})
+    if n, err := c.Write([]byte("abcd")); n != 2 || err != io.ErrShortWrite {
+        t.Fatalf("short write: %d, %v", n, err)
+    }
+    if n, err := c.Write([]byte("cd")); n != 1 || err != ErrTransient {
+        t.Fatalf("failed write: %d, %v", n, err)
+    }
+    c.Write([]byte("d"))
+    c.Write([]byte("ef"))
+    if got := string(c.Written()); got != "abcdef" {
+        t.Fatalf("written %q", got)
+    }
+
+    c.Close()
+    if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+        t.Fatalf("write after close: %v", err)
+    }
+    if _, err := c.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+        t.Fatalf("read after close: %v", err)
+    }
+}
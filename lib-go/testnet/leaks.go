@@ -0,0 +1,77 @@
+package testnet
+
+import (
+    "fmt"
+    "os"
+    "runtime"
+    "testing"
+    "time"
+)
+
+// CheckLeaks fails the test if, once it ends, this process has more
+// goroutines or open files than it had when CheckLeaks was called.
+// Cleanups run last-in first-out, so call it before starting what it
+// should watch. Goroutines and files that are still being released get
+// until the Timeout to go. The counts are for the whole process, so it
+// can't be used by tests that run in parallel.
+func CheckLeaks(t testing.TB) {
+    t.Helper()
+    goroutines, fds := runtime.NumGoroutine(), OpenFiles(os.Getpid())
+    t.Cleanup(func() {
+        released := waitFor(func() bool {
+            return runtime.NumGoroutine() <= goroutines && OpenFiles(os.Getpid()) <= fds
+        })
+        if released {
+            return
+        }
+        if n := runtime.NumGoroutine(); n > goroutines {
+            buf := make([]byte, 1<<16)
+            buf = buf[:runtime.Stack(buf, true)]
+            t.Errorf("testnet: %d goroutines at the start, %d at the end:\n%s", goroutines, n, buf)
+        }
+        if n := OpenFiles(os.Getpid()); n > fds {
+            t.Errorf("testnet: %d open files at the start, %d at the end", fds, n)
+        }
+    })
+}
+
+// CheckProcessLeaks fails the test if, once it ends, process pid has more
+// open files than it had when CheckProcessLeaks was called. It is for a
+// server run as a child process, whose goroutines can't be counted from
+// here, and must run before the process is stopped.
+func CheckProcessLeaks(t testing.TB, pid int) {
+    t.Helper()
+    fds := OpenFiles(pid)
+    t.Cleanup(func() {
+        if !waitFor(func() bool { return OpenFiles(pid) <= fds }) {
+            t.Errorf("testnet: process %d had %d open files at the start, %d at the end", pid, fds, OpenFiles(pid))
+        }
+    })
+}
+
+// OpenFiles returns how many files process pid has open, or -1 where
+// /proc can't tell (anywhere but Linux).
+func OpenFiles(pid int) int {
+    fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+    if err != nil {
+        return -1
+    }
+    return len(fds)
+}
+
+// leakWait is how long leaked goroutines and files get to go away. Tests
+// of the checks themselves shorten it.
+var leakWait = Timeout
+
+// waitFor polls ok until it holds or leakWait passes, and reports whether
+// it held.
+func waitFor(ok func() bool) bool {
+    deadline := time.Now().Add(leakWait)
+    for !ok() {
+        if time.Now().After(deadline) {
+            return false
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return true
+}
@@ -0,0 +1,79 @@
+package testnet
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// leakRecorder keeps the cleanups a check registers so the test can run
+// them when it likes, and notes an Errorf instead of failing the test.
+type leakRecorder struct {
+    testing.TB
+    cleanups []func()
+    errors   []string
+}
+
+func (r *leakRecorder) Cleanup(f func()) {
+    r.cleanups = append(r.cleanups, f)
+}
+
+func (r *leakRecorder) Errorf(format string, args ...any) {
+    r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// end runs the cleanups as the end of a test would.
+func (r *leakRecorder) end() {
+    for i := len(r.cleanups) - 1; i >= 0; i-- {
+        r.cleanups[i]()
+    }
+}
+
+func shortLeakWait(t *testing.T) {
+    old := leakWait
+    leakWait = 200 * time.Millisecond
+    t.Cleanup(func() { leakWait = old })
+}
+
+func TestCheckLeaksGoroutine(t *testing.T) {
+    shortLeakWait(t)
+    r := &leakRecorder{TB: t}
+    CheckLeaks(r)
+    stop := make(chan struct{})
+    go func() { <-stop }()
+    r.end()
+    close(stop)
+    if len(r.errors) != 1 {
+        t.Fatalf("a goroutine left running: errors %q, want one", r.errors)
+    }
+}
+
+func TestCheckLeaksOpenFile(t *testing.T) {
+    if OpenFiles(os.Getpid()) < 0 {
+        t.Skip("open files can't be counted here")
+    }
+    shortLeakWait(t)
+    r := &leakRecorder{TB: t}
+    CheckLeaks(r)
+    f, err := os.Create(filepath.Join(t.TempDir(), "leak"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.end()
+    f.Close()
+    if len(r.errors) != 1 {
+        t.Fatalf("a file left open: errors %q, want one", r.errors)
+    }
+}
+
+func TestCheckLeaksWaitsForRelease(t *testing.T) {
+    r := &leakRecorder{TB: t}
+    CheckLeaks(r)
+    go time.Sleep(50 * time.Millisecond)
+    r.end()
+    if len(r.errors) != 0 {
+        t.Fatalf("a goroutine that ends soon after the test: errors %q", r.errors)
+    }
+}
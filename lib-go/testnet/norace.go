@@ -0,0 +1,7 @@
+//go:build !race
+
+package testnet
+
+// RaceEnabled reports whether the race detector is on. It allocates, so
+// tests that count allocations skip under it.
+const RaceEnabled = false
@@ -0,0 +1,155 @@
+package testnet
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "io"
+    "math/rand"
+    "net"
+    "testing"
+    "time"
+
+    "../fragment"
+)
+
+// Timeout is how long a Client waits on each send or expect, and for the
+// handler to return once the test is over, unless SetTimeout changes it.
+const Timeout = 5 * time.Second
+
+// Client is a test's end of a net.Pipe whose other end a handler serves.
+// Its methods fail the test on an error or timeout, so they must be
+// called from the test's goroutine. The net.Conn is there for anything
+// they don't cover.
+//
+// A net.Pipe has no buffer: a write waits until the other side reads it.
+// A test must read what the handler writes before sending more, or both
+// sides wait until the timeout.
+type Client struct {
+    net.Conn
+    t       testing.TB
+    r       *bufio.Reader
+    timeout time.Duration
+    done    chan struct{}
+}
+
+// Pipe runs handle on one end of a net.Pipe and returns a Client on the
+// other. When the test ends the Client is closed, and the test fails if
+// handle has not returned within the timeout, or if it left goroutines or
+// open files behind (see CheckLeaks).
+func Pipe(t testing.TB, handle func(net.Conn)) *Client {
+    CheckLeaks(t)
+    server, peer := net.Pipe()
+    c := &Client{Conn: peer, t: t, r: bufio.NewReader(peer), timeout: Timeout, done: make(chan struct{})}
+    go func() {
+        defer close(c.done)
+        handle(server)
+    }()
+    t.Cleanup(func() {
+        peer.Close()
+        select {
+        case <-c.done:
+        case <-time.After(c.timeout):
+            t.Errorf("testnet: handler still running %v after its client closed", c.timeout)
+            server.Close()
+        }
+    })
+    return c
+}
+
+// SetTimeout changes how long each later call waits.
+func (c *Client) SetTimeout(d time.Duration) {
+    c.timeout = d
+}
+
+// Fragment makes every later Send reach the handler in random pieces of
+// at most max bytes, each a write of its own, so that a handler assuming
+// one Read per message fails. seed picks the pieces, so a failure repeats.
+func (c *Client) Fragment(max int, seed int64) {
+    c.Conn = fragment.NewConn(c.Conn, max, 0, rand.New(rand.NewSource(seed)))
+}
+
+// Send writes data to the handler.
+func (c *Client) Send(data []byte) {
+    c.t.Helper()
+    c.SetWriteDeadline(time.Now().Add(c.timeout))
+    if _, err := c.Write(data); err != nil {
+        c.t.Fatalf("sending %q: %v", data, err)
+    }
+}
+
+// SendLine writes line and a newline.
+func (c *Client) SendLine(line string) {
+    c.t.Helper()
+    c.Send([]byte(line + "\n"))
+}
+
+// ReadFull reads exactly n bytes from the handler.
+func (c *Client) ReadFull(n int) []byte {
+    c.t.Helper()
+    c.SetReadDeadline(time.Now().Add(c.timeout))
+    buf := make([]byte, n)
+    if got, err := io.ReadFull(c.r, buf); err != nil {
+        c.t.Fatalf("reading %d bytes: %v after %q", n, err, buf[:got])
+    }
+    return buf
+}
+
+// ReadLine reads a line from the handler and returns it without the
+// newline.
+func (c *Client) ReadLine() string {
+    c.t.Helper()
+    c.SetReadDeadline(time.Now().Add(c.timeout))
+    line, err := c.r.ReadString('\n')
+    if err != nil {
+        c.t.Fatalf("reading a line: %v after %q", err, line)
+    }
+    return line[:len(line)-1]
+}
+
+// Expect reads as many bytes as want has and fails the test unless they
+// are want. It reads no further, so the handler can still be writing.
+func (c *Client) Expect(want []byte) {
+    c.t.Helper()
+    if got := c.ReadFull(len(want)); !bytes.Equal(got, want) {
+        c.t.Fatalf("got %q, want %q", got, want)
+    }
+}
+
+// ExpectLine reads a line and fails the test unless it is want.
+func (c *Client) ExpectLine(want string) {
+    c.t.Helper()
+    if got := c.ReadLine(); got != want {
+        c.t.Fatalf("got line %q, want %q", got, want)
+    }
+}
+
+// ExpectClosed fails the test unless the handler closes the connection
+// without writing anything more.
+func (c *Client) ExpectClosed() {
+    c.t.Helper()
+    c.SetReadDeadline(time.Now().Add(c.timeout))
+    n, err := c.r.Read(make([]byte, 1))
+    switch {
+    case n > 0:
+        c.t.Fatal("got more data, want the connection closed")
+    case !errors.Is(err, io.EOF):
+        c.t.Fatalf("got %v, want the connection closed", err)
+    }
+}
+
+// Wait closes the test's end and waits for the handler to return.
+func (c *Client) Wait() {
+    c.t.Helper()
+    c.Close()
+    select {
+    case <-c.done:
+    case <-time.After(c.timeout):
+        c.t.Fatalf("handler still running %v after its client closed", c.timeout)
+    }
+}
+
+// Done is closed once the handler has returned.
+func (c *Client) Done() <-chan struct{} {
+    return c.done
+}
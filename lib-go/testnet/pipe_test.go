@@ -0,0 +1,75 @@
+package testnet
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// upper answers each line in upper case until it reads "bye".
+func upper(conn net.Conn) {
+    defer conn.Close()
+    sc := bufio.NewScanner(conn)
+    for sc.Scan() {
+        if sc.Text() == "bye" {
+            return
+        }
+        fmt.Fprintln(conn, strings.ToUpper(sc.Text()))
+    }
+}
+
+func TestPipeSendExpect(t *testing.T) {
+    c := Pipe(t, upper)
+    c.SendLine("hello")
+    c.ExpectLine("HELLO")
+    c.Send([]byte("split "))
+    c.Send([]byte("line\n"))
+    c.Expect([]byte("SPLIT"))
+    c.Expect([]byte(" LINE\n"))
+    c.SendLine("bye")
+    c.ExpectClosed()
+    select {
+    case <-c.Done():
+    case <-time.After(Timeout):
+        t.Fatal("handler did not return after closing")
+    }
+}
+
+func TestPipeWaitEndsHandler(t *testing.T) {
+    c := Pipe(t, upper)
+    c.SendLine("x")
+    c.ExpectLine("X")
+    c.Wait()
+}
+
+func TestPipeFragment(t *testing.T) {
+    reads := make(chan int, 100)
+    c := Pipe(t, func(conn net.Conn) {
+        defer close(reads)
+        buf := make([]byte, 64)
+        for {
+            n, err := conn.Read(buf)
+            if err != nil {
+                return
+            }
+            reads <- n
+        }
+    })
+    c.Fragment(3, 1)
+    msg := "arrives three bytes at most at a time"
+    c.Send([]byte(msg))
+    c.Wait()
+    total := 0
+    for n := range reads {
+        if n > 3 {
+            t.Fatalf("handler read %d bytes at once", n)
+        }
+        total += n
+    }
+    if total != len(msg) {
+        t.Fatalf("handler read %d bytes of %d", total, len(msg))
+    }
+}
@@ -0,0 +1,74 @@
+// Package testnet has helpers for tests that talk to servers: free ports
+// for servers started as separate processes, and in-memory connections for
+// exercising handlers without sockets.
+package testnet
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+)
+
+// Port returns a loopback port that is free for both TCP and UDP, for a
+// server the test is about to start. The port stays reserved for the rest
+// of the test.
+//
+// The kernel picks the port, so it is not one a hardcoded test uses. A
+// reservation file in the temp directory keeps every other caller of Port,
+// in this process or in another package's test binary running alongside,
+// from being handed it as well. Nothing stops an unrelated program taking
+// it before the server binds, but the kernel cycles through the whole
+// ephemeral range before offering the same port again.
+func Port(t testing.TB) string {
+    t.Helper()
+    for attempt := 0; attempt < 100; attempt++ {
+        port, err := freePort()
+        if err != nil {
+            t.Fatalf("testnet: finding a free port: %v", err)
+        }
+        if release, ok := reserve(port); ok {
+            t.Cleanup(release)
+            return port
+        }
+    }
+    t.Fatal("testnet: every free port found was already reserved")
+    return ""
+}
+
+// Addr is Port on the loopback address, as host:port.
+func Addr(t testing.TB) string {
+    t.Helper()
+    return net.JoinHostPort("127.0.0.1", Port(t))
+}
+
+// freePort asks the kernel for a TCP port and checks UDP has it free too.
+func freePort() (string, error) {
+    for {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            return "", err
+        }
+        port := l.Addr().(*net.TCPAddr).Port
+        pc, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(port))
+        l.Close()
+        if err == nil {
+            pc.Close()
+            return strconv.Itoa(port), nil
+        }
+    }
+}
+
+// reserve creates port's reservation file, failing if it exists already.
+// A file left behind by a crashed run only ever makes Port skip its port.
+func reserve(port string) (release func(), ok bool) {
+    path := filepath.Join(os.TempDir(), fmt.Sprintf("protohackers-testnet-port-%s", port))
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+    if err != nil {
+        return nil, false
+    }
+    f.Close()
+    return func() { os.Remove(path) }, true
+}
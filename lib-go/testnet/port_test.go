@@ -0,0 +1,53 @@
+package testnet
+
+import (
+    "net"
+    "sync"
+    "testing"
+)
+
+func TestPortsAreDistinctAndFree(t *testing.T) {
+    var mu sync.Mutex
+    seen := make(map[string]bool)
+    t.Run("group", func(t *testing.T) {
+        for i := 0; i < 20; i++ {
+            t.Run("", func(t *testing.T) {
+                t.Parallel()
+                port := Port(t)
+                mu.Lock()
+                dup := seen[port]
+                seen[port] = true
+                mu.Unlock()
+                if dup {
+                    t.Fatalf("port %s handed out twice", port)
+                }
+
+                l, err := net.Listen("tcp", "127.0.0.1:"+port)
+                if err != nil {
+                    t.Fatalf("listening on the port: %v", err)
+                }
+                l.Close()
+                pc, err := net.ListenPacket("udp", "127.0.0.1:"+port)
+                if err != nil {
+                    t.Fatalf("listening for UDP on the port: %v", err)
+                }
+                pc.Close()
+            })
+        }
+    })
+}
+
+func TestReservationReleasedAfterTest(t *testing.T) {
+    var port string
+    t.Run("reserve", func(t *testing.T) {
+        port = Port(t)
+        if _, ok := reserve(port); ok {
+            t.Fatal("a reserved port could be reserved again")
+        }
+    })
+    release, ok := reserve(port)
+    if !ok {
+        t.Fatal("port still reserved after its test finished")
+    }
+    release()
+}
@@ -0,0 +1,166 @@
+// Package testserver runs the Go solutions for end-to-end tests. Start
+// builds a solution, runs it on a free loopback port for the rest of the
+// test, and stops it when the test ends, so a test only has to talk to the
+// address it gets back.
+//
+// The solutions are package main, so each runs as its own process, built
+// from sol-go/<problem> in GOPATH mode as it is by hand.
+package testserver
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "../retry"
+    "../signals"
+    "../testnet"
+)
+
+// solutions is every Go solution Start can run, by problem, and the
+// network it serves. Each takes -port and prints a [LISTENING] line once
+// it is bound.
+var solutions = map[string]string{
+    "VCS":                    "tcp",
+    "insecure-sockets-layer": "tcp",
+    "job-centre":             "tcp",
+    "mob-in-the-middle":      "tcp",
+    "pest-control":           "tcp",
+    "prime-time":             "tcp",
+    "smoke-test":             "tcp",
+    "speed-daemon":           "tcp",
+    "unusual-db":             "udp",
+}
+
+// Solutions returns the problems Start can run, sorted.
+func Solutions() []string {
+    var names []string
+    for name := range solutions {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Network returns the network problem's solution serves: tcp or udp.
+func Network(problem string) string {
+    return solutions[problem]
+}
+
+// startTimeout is how long a solution has to bind after starting.
+const startTimeout = 10 * time.Second
+
+// solDir is sol-go, found relative to this file.
+func solDir() string {
+    _, file, _, _ := runtime.Caller(0)
+    return filepath.Join(filepath.Dir(file), "..", "..", "sol-go")
+}
+
+// Build builds the solution in src to bin. It is built as a package in
+// GOPATH mode, which applies build constraints (netpoll_linux.go and the
+// like) and allows the relative imports of lib-go.
+func Build(src, bin string) error {
+    build := exec.Command("go", "build", "-o", bin, ".")
+    build.Dir = src
+    build.Env = append(os.Environ(), "GO111MODULE=off")
+    if out, err := build.CombinedOutput(); err != nil {
+        return fmt.Errorf("building %s: %v\n%s", src, err, out)
+    }
+    return nil
+}
+
+// Start runs problem's solution with args and a -port of its own, and
+// returns the loopback host:port it serves on. The server is stopped when
+// the test ends, and its output is logged if the test failed. The test
+// also fails if the server still has more files open by then than it had
+// when it started listening: the test's connections are closed, so theirs
+// should be too.
+func Start(t testing.TB, problem string, args ...string) string {
+    t.Helper()
+    if _, ok := solutions[problem]; !ok {
+        t.Fatalf("testserver: no solution registered for %q", problem)
+    }
+    bin := filepath.Join(t.TempDir(), problem)
+    if err := Build(filepath.Join(solDir(), problem), bin); err != nil {
+        t.Fatalf("testserver: %v", err)
+    }
+
+    port := testnet.Port(t)
+    out := &output{listening: make(chan struct{})}
+    server := exec.Command(bin, append([]string{"-port", port}, args...)...)
+    server.Stdout = out
+    server.Stderr = out
+    if err := server.Start(); err != nil {
+        t.Fatalf("testserver: starting %s: %v", problem, err)
+    }
+    exited := make(chan struct{})
+    go func() {
+        server.Wait()
+        close(exited)
+    }()
+    t.Cleanup(func() {
+        stop(server, exited)
+        if t.Failed() {
+            t.Logf("%s output:\n%s", problem, out)
+        }
+    })
+
+    select {
+    case <-out.listening:
+    case <-exited:
+        t.Fatalf("testserver: %s exited before listening:\n%s", problem, out)
+    case <-time.After(startTimeout):
+        t.Fatalf("testserver: %s did not listen within %v", problem, startTimeout)
+    }
+    testnet.CheckProcessLeaks(t, server.Process.Pid)
+    return net.JoinHostPort("127.0.0.1", port)
+}
+
+// stop shuts the server down the way an operator would, and kills it if
+// it is still running after retry.StopTimeout or can't be sent a signal
+// (Windows).
+func stop(server *exec.Cmd, exited <-chan struct{}) {
+    if err := server.Process.Signal(signals.Terminate); err != nil {
+        server.Process.Kill()
+    }
+    select {
+    case <-exited:
+    case <-time.After(retry.StopTimeout):
+        server.Process.Kill()
+        <-exited
+    }
+}
+
+// output collects a server's output and notices its [LISTENING] line.
+type output struct {
+    mu        sync.Mutex
+    buf       bytes.Buffer
+    listening chan struct{}
+    seen      bool
+}
+
+func (o *output) Write(p []byte) (int, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    o.buf.Write(p)
+    if !o.seen && strings.Contains(o.buf.String(), "[LISTENING]") {
+        o.seen = true
+        close(o.listening)
+    }
+    return len(p), nil
+}
+
+func (o *output) String() string {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    return o.buf.String()
+}
@@ -0,0 +1,105 @@
+package testserver
+
+import (
+    "bufio"
+    "io"
+    "net"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+)
+
+// exchanges checks a solution answers one request correctly. Solutions
+// without one here are only checked to accept a connection.
+var exchanges = map[string]func(t *testing.T, addr string){
+    "smoke-test": func(t *testing.T, addr string) {
+        conn := dial(t, "tcp", addr)
+        io.WriteString(conn, "echo me")
+        conn.(*net.TCPConn).CloseWrite()
+        if got, err := io.ReadAll(conn); err != nil || string(got) != "echo me" {
+            t.Errorf("echoed %q (%v)", got, err)
+        }
+    },
+    "prime-time": func(t *testing.T, addr string) {
+        conn := dial(t, "tcp", addr)
+        io.WriteString(conn, `{"method":"isPrime","number":7}`+"\n")
+        line, err := bufio.NewReader(conn).ReadString('\n')
+        if err != nil || !strings.Contains(line, `"prime":true`) {
+            t.Errorf("replied %q (%v)", line, err)
+        }
+    },
+    "unusual-db": func(t *testing.T, addr string) {
+        conn := dial(t, "udp", addr)
+        io.WriteString(conn, "version")
+        buf := make([]byte, 1000)
+        n, err := conn.Read(buf)
+        if err != nil || !strings.HasPrefix(string(buf[:n]), "version=") {
+            t.Errorf("replied %q (%v)", buf[:n], err)
+        }
+    },
+}
+
+func dial(t *testing.T, network, addr string) net.Conn {
+    t.Helper()
+    conn, err := net.Dial(network, addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    return conn
+}
+
+func TestEverySolutionServes(t *testing.T) {
+    if testing.Short() {
+        t.Skip("builds every solution")
+    }
+    for _, problem := range Solutions() {
+        t.Run(problem, func(t *testing.T) {
+            t.Parallel()
+            var args []string
+            if problem == "mob-in-the-middle" {
+                // It won't start without an upstream to resolve.
+                upstream, err := net.Listen("tcp", "127.0.0.1:0")
+                if err != nil {
+                    t.Fatal(err)
+                }
+                t.Cleanup(func() { upstream.Close() })
+                args = []string{"-upstream", upstream.Addr().String()}
+            }
+
+            addr := Start(t, problem, args...)
+            if check := exchanges[problem]; check != nil {
+                check(t, addr)
+            } else if Network(problem) == "tcp" {
+                dial(t, "tcp", addr)
+            }
+        })
+    }
+}
+
+func TestStartUnknownSolution(t *testing.T) {
+    ft := &fatalRecorder{TB: t}
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        Start(ft, "no-such-problem")
+    }()
+    <-done
+    if !ft.fatal {
+        t.Fatal("Start of an unregistered problem did not fail the test")
+    }
+}
+
+// fatalRecorder notes a Fatalf instead of failing the real test. Fatalf
+// ends the goroutine, as the real one would.
+type fatalRecorder struct {
+    testing.TB
+    fatal bool
+}
+
+func (r *fatalRecorder) Fatalf(format string, args ...any) {
+    r.fatal = true
+    runtime.Goexit()
+}
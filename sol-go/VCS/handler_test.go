@@ -0,0 +1,114 @@
+package main
+
+import (
+    "net"
+    "strings"
+    "testing"
+
+    "./store"
+    "../../lib-go/testnet"
+)
+
+func startSession(t *testing.T, files *store.Store) *testnet.Client {
+    c := testnet.Pipe(t, func(conn net.Conn) { handleClient(files, conn) })
+    c.ExpectLine("READY")
+    return c
+}
+
+func TestSessionPutGetList(t *testing.T) {
+    c := startSession(t, store.New(false))
+
+    c.Send([]byte("PUT /dir/a.txt 6\nhello\n"))
+    c.ExpectLine("OK r1")
+    c.ExpectLine("READY")
+    c.Send([]byte("put /dir/a.txt 4\nbye\n"))
+    c.ExpectLine("OK r2")
+    c.ExpectLine("READY")
+
+    c.SendLine("GET /dir/a.txt r1")
+    c.ExpectLine("OK 6")
+    c.Expect([]byte("hello\n"))
+    c.ExpectLine("READY")
+
+    c.SendLine("LIST /")
+    c.ExpectLine("OK 1")
+    c.ExpectLine("dir/ DIR")
+    c.ExpectLine("READY")
+    c.SendLine("LIST /dir")
+    c.ExpectLine("OK 1")
+    c.ExpectLine("a.txt r2")
+    c.ExpectLine("READY")
+}
+
+// TestSessionFragmented sends commands and file data in pieces of a few
+// bytes, which must be put back together into the same session.
+func TestSessionFragmented(t *testing.T) {
+    c := startSession(t, store.New(false))
+    c.Fragment(3, 1)
+
+    c.Send([]byte("PUT /f.txt 12\nhello, world"))
+    c.ExpectLine("OK r1")
+    c.ExpectLine("READY")
+    c.SendLine("GET /f.txt")
+    c.ExpectLine("OK 12")
+    c.Expect([]byte("hello, world"))
+    c.ExpectLine("READY")
+    c.SendLine("LIST /")
+    c.ExpectLine("OK 1")
+    c.ExpectLine("f.txt r1")
+    c.ExpectLine("READY")
+}
+
+// TestSessionRejectedPutStaysInStep checks the data of a put that is
+// refused is still consumed, so it isn't read as commands.
+func TestSessionRejectedPutStaysInStep(t *testing.T) {
+    c := startSession(t, store.New(false))
+    for _, put := range []string{
+        "PUT /bad//name 9\nHELP\nWAT\n",
+        "PUT /binary 5\n\x00HELP",
+        "PUT no-slash 4\nWAT\n",
+    } {
+        c.Send([]byte(put))
+        if line := c.ReadLine(); !strings.HasPrefix(line, "ERR ") {
+            t.Fatalf("%q: got %q, want an error", put, line)
+        }
+        c.ExpectLine("READY")
+    }
+    c.SendLine("HELP")
+    c.ExpectLine("OK usage: HELP|GET|PUT|LIST")
+    c.ExpectLine("READY")
+}
+
+func TestSessionEndsOnEOF(t *testing.T) {
+    c := startSession(t, store.New(false))
+    c.SendLine("GET /missing")
+    c.ExpectLine("ERR no such file")
+    c.ExpectLine("READY")
+    c.Wait()
+}
+
+// TestSessionShortReads sends a put and a get a byte at a time.
+func TestSessionShortReads(t *testing.T) {
+    conn := testnet.NewConn(testnet.Bytewise("PUT /f 3\nabcGET /f\n")...)
+    handleClient(store.New(false), conn)
+    if got, want := string(conn.Written()), "READY\nOK r1\nREADY\nOK 3\nabcREADY\n"; got != want {
+        t.Fatalf("wrote %q, want %q", got, want)
+    }
+}
+
+// TestSessionWriteError checks a failed write ends the session, without
+// reading the commands still to come.
+func TestSessionWriteError(t *testing.T) {
+    conn := testnet.NewConn(testnet.Data("HELP\n"), testnet.Data("HELP\n"))
+    conn.ScriptWrites(testnet.Write{N: -1}, testnet.Write{N: 3, Err: testnet.ErrTransient})
+    handleClient(store.New(false), conn)
+    if !conn.Closed() {
+        t.Fatal("connection left open")
+    }
+    if got := string(conn.Written()); got != "READY\nOK " {
+        t.Fatalf("wrote %q", got)
+    }
+    if n, _ := conn.Read(make([]byte, 10)); n != 0 {
+        t.Fatal("read on after a write failed")
+    }
+}
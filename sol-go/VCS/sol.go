@@ -0,0 +1,213 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "sync"
+
+    "./store"
+    "../../lib-go/signals"
+)
+
+// --- Protocol ---
+
+// session is one client's connection to the store.
+type session struct {
+    reader *bufio.Reader
+    writer *bufio.Writer
+    files  *store.Store
+}
+
+func (s *session) sendLine(text string) {
+    s.writer.WriteString(text + "\n")
+}
+
+// handle runs one command line. It returns an error only if the
+// connection is no longer usable.
+func (s *session) handle(line string) error {
+    parts := strings.Fields(line)
+    switch strings.ToUpper(parts[0]) {
+    case "PUT":
+        if len(parts) != 3 {
+            s.sendLine("ERR usage: PUT file length newline data")
+            return nil
+        }
+        length, err := parseLength(parts[2])
+        if err != nil {
+            s.sendLine("ERR " + err.Error())
+            return nil
+        }
+
+        // The data follows regardless of whether the put is valid, and has
+        // to be consumed to stay in step with the client.
+        if length > maxFileSize {
+            if _, err := io.CopyN(io.Discard, s.reader, length); err != nil {
+                return err
+            }
+            s.sendLine("ERR " + errTooLarge.Error())
+            return nil
+        }
+        data := make([]byte, length)
+        if _, err := io.ReadFull(s.reader, data); err != nil {
+            return err
+        }
+
+        if err := validateFileName(parts[1]); err != nil {
+            s.sendLine("ERR " + err.Error())
+        } else if err := validateText(data); err != nil {
+            s.sendLine("ERR " + err.Error())
+        } else {
+            s.sendLine(fmt.Sprintf("OK r%d", s.files.Put(parts[1], data)))
+        }
+
+    case "GET":
+        if len(parts) < 2 {
+            s.sendLine("ERR usage: GET file [revision]")
+            return nil
+        }
+        if err := validateFileName(parts[1]); err != nil {
+            s.sendLine("ERR " + err.Error())
+            return nil
+        }
+
+        rev := 0
+        if len(parts) >= 3 {
+            n, err := parseRevision(parts[2])
+            if err != nil {
+                s.sendLine("ERR " + err.Error())
+                return nil
+            }
+            rev = n
+        }
+
+        data, err := s.files.Get(parts[1], rev)
+        if err != nil {
+            s.sendLine("ERR " + err.Error())
+            return nil
+        }
+        s.sendLine(fmt.Sprintf("OK %d", len(data)))
+        s.writer.Write(data)
+
+    case "LIST":
+        if len(parts) < 2 {
+            s.sendLine("ERR usage: LIST dir")
+            return nil
+        }
+        if err := validateDirName(parts[1]); err != nil {
+            s.sendLine("ERR " + err.Error())
+            return nil
+        }
+        entries := s.files.List(parts[1])
+        s.sendLine(fmt.Sprintf("OK %d", len(entries)))
+        for _, e := range entries {
+            s.sendLine(e.String())
+        }
+
+    case "HELP":
+        s.sendLine("OK usage: HELP|GET|PUT|LIST")
+
+    default:
+        s.sendLine("ERR unknown command")
+    }
+    return nil
+}
+
+// Buffered readers and writers are reused across connections, so clients
+// that connect, PUT one file and leave don't each allocate fresh ones.
+var (
+    readers = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+    writers = sync.Pool{New: func() any { return bufio.NewWriter(nil) }}
+)
+
+func handleClient(files *store.Store, conn net.Conn) {
+    defer conn.Close()
+
+    addr := conn.RemoteAddr()
+    fmt.Printf("[NEW CONNECTION] %s connected.\n", addr)
+
+    s := &session{
+        reader: readers.Get().(*bufio.Reader),
+        writer: writers.Get().(*bufio.Writer),
+        files:  files,
+    }
+    s.reader.Reset(conn)
+    s.writer.Reset(conn)
+    defer func() {
+        // Drop the references to conn before handing them back.
+        s.reader.Reset(nil)
+        s.writer.Reset(nil)
+        readers.Put(s.reader)
+        writers.Put(s.writer)
+    }()
+
+    for {
+        s.sendLine("READY")
+        if err := s.writer.Flush(); err != nil {
+            fmt.Printf("[ERROR] Write error with %s: %v\n", addr, err)
+            return
+        }
+
+        line, err := s.reader.ReadString('\n')
+        if err != nil {
+            break
+        }
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+
+        if err := s.handle(line); err != nil {
+            break
+        }
+    }
+
+    fmt.Printf("[DISCONNECTED] %s disconnected.\n", addr)
+}
+
+func startServer(host string, port string, deltas bool) {
+    files := store.New(deltas)
+
+    address := host + ":" + port
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer listener.Close()
+
+    fmt.Printf("[LISTENING] VCS Server listening on %s\n", address)
+
+    // Handle graceful shutdown
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        blobs, size := files.Usage()
+        fmt.Printf("[STORE] %d distinct blobs, %d bytes\n", blobs, size)
+        listener.Close()
+    })
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            fmt.Printf("[ERROR] Accept error: %v\n", err)
+            continue
+        }
+
+        go handleClient(files, conn)
+    }
+}
+
+func main() {
+    port := flag.String("port", "65432", "TCP port to listen on")
+    deltas := flag.Bool("deltas", false, "store revisions as deltas against the previous revision where that saves space")
+    flag.Parse()
+
+    startServer("0.0.0.0", *port, *deltas)
+}
@@ -0,0 +1,221 @@
+// Package store is the VCS server's revisioned file store, kept apart
+// from the wire protocol so other tools can import it.
+package store
+
+import (
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Store is the revisioned file store. Every Put of new contents adds a
+// revision to the file, numbered r1, r2, ...; putting the same contents as
+// the latest revision again does not.
+//
+// Contents are stored once per distinct hash, so re-uploading the same
+// blob under many paths or revisions costs only a hash per revision. With
+// deltas enabled, a revision that differs only slightly from the one before
+// it is instead kept as a delta against it and rebuilt on read.
+//
+// It knows nothing about the wire protocol and trusts its callers to pass
+// paths that have already been validated.
+type Store struct {
+    mu     sync.RWMutex
+    files  map[string]*fileHistory
+    blobs  map[blobID][]byte
+    deltas bool
+    size   int64 // total bytes held in blobs and deltas
+}
+
+// maxDeltaChain bounds how many deltas a read may have to apply: every
+// maxDeltaChain revisions a full copy is stored again.
+const maxDeltaChain = 16
+
+// blobID is the SHA-256 of a file's contents.
+type blobID [sha256.Size]byte
+
+// delta rebuilds a revision from the previous one by keeping prefix bytes
+// from its start and suffix bytes from its end, with middle between them.
+type delta struct {
+    prefix int
+    suffix int
+    middle []byte
+}
+
+func (d *delta) apply(base []byte) []byte {
+    out := make([]byte, 0, d.prefix+len(d.middle)+d.suffix)
+    out = append(out, base[:d.prefix]...)
+    out = append(out, d.middle...)
+    return append(out, base[len(base)-d.suffix:]...)
+}
+
+// diff returns the delta that turns base into data.
+func diff(base, data []byte) *delta {
+    limit := min(len(base), len(data))
+    prefix := 0
+    for prefix < limit && base[prefix] == data[prefix] {
+        prefix++
+    }
+    suffix := 0
+    for suffix < limit-prefix && base[len(base)-1-suffix] == data[len(data)-1-suffix] {
+        suffix++
+    }
+    return &delta{
+        prefix: prefix,
+        suffix: suffix,
+        middle: append([]byte(nil), data[prefix:len(data)-suffix]...),
+    }
+}
+
+// revision is one stored version of a file. Its contents are either the
+// blob id, or, if delta is set, the previous revision with delta applied.
+type revision struct {
+    id    blobID
+    delta *delta
+    depth int // number of deltas back to a full copy
+}
+
+// fileHistory holds every revision of one file, oldest first.
+type fileHistory struct {
+    revs []revision
+}
+
+func New(deltas bool) *Store {
+    return &Store{
+        files:  make(map[string]*fileHistory),
+        blobs:  make(map[blobID][]byte),
+        deltas: deltas,
+    }
+}
+
+// contents materializes revision i of h. The caller must hold s.mu.
+func (s *Store) contents(h *fileHistory, i int) []byte {
+    base := i
+    for h.revs[base].delta != nil {
+        base--
+    }
+    data := s.blobs[h.revs[base].id]
+    for j := base + 1; j <= i; j++ {
+        data = h.revs[j].delta.apply(data)
+    }
+    return data
+}
+
+// Put stores data as the latest revision of path and returns its number.
+func (s *Store) Put(path string, data []byte) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    h := s.files[path]
+    if h == nil {
+        h = &fileHistory{}
+        s.files[path] = h
+    }
+    id := blobID(sha256.Sum256(data))
+    n := len(h.revs)
+    if n > 0 && h.revs[n-1].id == id {
+        return n
+    }
+
+    // A delta only pays off if the blob isn't already shared and the
+    // change is small compared to the file.
+    if _, shared := s.blobs[id]; s.deltas && !shared && n > 0 && h.revs[n-1].depth < maxDeltaChain {
+        d := diff(s.contents(h, n-1), data)
+        if len(d.middle) < len(data)/2 {
+            h.revs = append(h.revs, revision{id: id, delta: d, depth: h.revs[n-1].depth + 1})
+            s.size += int64(len(d.middle))
+            return n + 1
+        }
+    }
+
+    if _, ok := s.blobs[id]; !ok {
+        s.blobs[id] = append([]byte(nil), data...)
+        s.size += int64(len(data))
+    }
+    h.revs = append(h.revs, revision{id: id})
+    return n + 1
+}
+
+// Errors returned by Get.
+var (
+    ErrNoSuchFile     = errors.New("no such file")
+    ErrNoSuchRevision = errors.New("no such revision")
+)
+
+// Get returns revision rev of path, or the latest revision if rev is 0.
+func (s *Store) Get(path string, rev int) ([]byte, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    h := s.files[path]
+    if h == nil {
+        return nil, ErrNoSuchFile
+    }
+    if rev == 0 {
+        rev = len(h.revs)
+    }
+    if rev < 1 || rev > len(h.revs) {
+        return nil, ErrNoSuchRevision
+    }
+    return s.contents(h, rev-1), nil
+}
+
+// Usage reports how many distinct blobs are stored and the total size of
+// the blobs and deltas.
+func (s *Store) Usage() (blobs int, size int64) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return len(s.blobs), s.size
+}
+
+// Entry is one line of a directory listing: either a file with its
+// latest revision or a subdirectory.
+type Entry struct {
+    Name string
+    Rev  int // latest revision; 0 for a directory
+    Dir  bool
+}
+
+func (e Entry) String() string {
+    if e.Dir {
+        return e.Name + "/ DIR"
+    }
+    return fmt.Sprintf("%s r%d", e.Name, e.Rev)
+}
+
+// List returns the files and subdirectories directly inside dir, sorted
+// by name. A name can appear twice if it is both a file and a directory.
+func (s *Store) List(dir string) []Entry {
+    prefix := dir
+    if !strings.HasSuffix(prefix, "/") {
+        prefix += "/"
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    seen := make(map[Entry]bool)
+    var entries []Entry
+    for path, h := range s.files {
+        rel, ok := strings.CutPrefix(path, prefix)
+        if !ok {
+            continue
+        }
+        e := Entry{Name: rel, Rev: len(h.revs)}
+        if name, _, nested := strings.Cut(rel, "/"); nested {
+            e = Entry{Name: name, Dir: true}
+        }
+        if !seen[e] {
+            seen[e] = true
+            entries = append(entries, e)
+        }
+    }
+
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].String() < entries[j].String()
+    })
+    return entries
+}
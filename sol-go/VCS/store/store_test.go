@@ -0,0 +1,192 @@
+package store
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "slices"
+    "strings"
+    "testing"
+)
+
+func TestPutGet(t *testing.T) {
+    s := New(false)
+    if got := s.Put("/a.txt", []byte("one\n")); got != 1 {
+        t.Fatalf("first put: r%d, want r1", got)
+    }
+    if got := s.Put("/a.txt", []byte("two\n")); got != 2 {
+        t.Fatalf("second put: r%d, want r2", got)
+    }
+
+    for rev, want := range map[int]string{0: "two\n", 1: "one\n", 2: "two\n"} {
+        data, err := s.Get("/a.txt", rev)
+        if err != nil || string(data) != want {
+            t.Errorf("get r%d: %q, %v; want %q", rev, data, err, want)
+        }
+    }
+    if _, err := s.Get("/a.txt", 3); err != ErrNoSuchRevision {
+        t.Errorf("get r3: %v, want %v", err, ErrNoSuchRevision)
+    }
+    if _, err := s.Get("/b.txt", 0); err != ErrNoSuchFile {
+        t.Errorf("get of a missing file: %v, want %v", err, ErrNoSuchFile)
+    }
+}
+
+func TestPutCopiesData(t *testing.T) {
+    s := New(false)
+    data := []byte("original")
+    s.Put("/f", data)
+    copy(data, "CHANGED!")
+    if got, _ := s.Get("/f", 1); string(got) != "original" {
+        t.Fatalf("stored contents changed with the caller's buffer: %q", got)
+    }
+}
+
+func TestRevisionDedup(t *testing.T) {
+    s := New(false)
+    s.Put("/f", []byte("a"))
+    if got := s.Put("/f", []byte("a")); got != 1 {
+        t.Fatalf("re-putting the latest contents: r%d, want r1", got)
+    }
+    s.Put("/f", []byte("b"))
+    if got := s.Put("/f", []byte("a")); got != 3 {
+        t.Fatalf("putting an older revision's contents: r%d, want r3", got)
+    }
+
+    // Identical contents under other paths share one blob.
+    s.Put("/g", []byte("a"))
+    s.Put("/dir/h", []byte("a"))
+    if blobs, size := s.Usage(); blobs != 2 || size != 2 {
+        t.Fatalf("usage: %d blobs, %d bytes; want 2 blobs, 2 bytes", blobs, size)
+    }
+}
+
+func TestList(t *testing.T) {
+    s := New(false)
+    s.Put("/a", []byte("1"))
+    s.Put("/a", []byte("2"))
+    s.Put("/b/c", []byte("x"))
+    s.Put("/b/d/e", []byte("x"))
+    s.Put("/b", []byte("file and dir"))
+    s.Put("/bb", []byte("x"))
+
+    tests := map[string][]string{
+        "/":     {"a r2", "b r1", "b/ DIR", "bb r1"},
+        "/b":    {"c r1", "d/ DIR"},
+        "/b/":   {"c r1", "d/ DIR"},
+        "/b/d":  {"e r1"},
+        "/none": nil,
+    }
+    for dir, want := range tests {
+        var got []string
+        for _, e := range s.List(dir) {
+            got = append(got, e.String())
+        }
+        if !slices.Equal(got, want) {
+            t.Errorf("list %s: %q, want %q", dir, got, want)
+        }
+    }
+}
+
+func TestDeltaChain(t *testing.T) {
+    s := New(true)
+    base := strings.Repeat("line of a file that is edited a little at a time\n", 100)
+    var versions []string
+    for i := 0; i < 3*maxDeltaChain+5; i++ {
+        v := fmt.Sprintf("%s edit %d\n%s", base[:len(base)/2], i, base[len(base)/2:])
+        versions = append(versions, v)
+        if got := s.Put("/big", []byte(v)); got != i+1 {
+            t.Fatalf("put %d: r%d", i, got)
+        }
+    }
+
+    h := s.files["/big"]
+    for i, r := range h.revs {
+        if r.depth > maxDeltaChain {
+            t.Fatalf("r%d is %d deltas deep, over %d", i+1, r.depth, maxDeltaChain)
+        }
+        if (r.delta == nil) != (r.depth == 0) {
+            t.Fatalf("r%d: delta %v at depth %d", i+1, r.delta != nil, r.depth)
+        }
+    }
+    if h.revs[1].delta == nil {
+        t.Fatal("a small edit was stored as a full copy")
+    }
+    for i, want := range versions {
+        got, err := s.Get("/big", i+1)
+        if err != nil || string(got) != want {
+            t.Fatalf("r%d does not rebuild to what was put", i+1)
+        }
+    }
+
+    // Full copies every maxDeltaChain+1 revisions, deltas in between.
+    _, size := s.Usage()
+    if full := int64(len(versions[0])) * int64(len(versions)); size >= full/4 {
+        t.Fatalf("%d bytes stored for %d revisions of %d bytes", size, len(versions), len(versions[0]))
+    }
+}
+
+func TestDeltaSkippedForBigChangesAndSharedBlobs(t *testing.T) {
+    s := New(true)
+    s.Put("/f", []byte("aaaaaaaaaaaaaaaaaaaa"))
+    s.Put("/f", []byte("bbbbbbbbbbbbbbbbbbbb"))
+    if s.files["/f"].revs[1].delta != nil {
+        t.Fatal("a complete rewrite was stored as a delta")
+    }
+
+    s.Put("/shared", []byte("aaaaaaaaaaaaaaaaaaab"))
+    s.Put("/f", []byte("aaaaaaaaaaaaaaaaaaab"))
+    if s.files["/f"].revs[2].delta != nil {
+        t.Fatal("contents already stored as a blob were stored again as a delta")
+    }
+}
+
+// TestStoreMatchesModel puts random edits with and without deltas and
+// checks every revision against a plain list of what was put.
+func TestStoreMatchesModel(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    paths := []string{"/a", "/b", "/d/c"}
+    for _, deltas := range []bool{false, true} {
+        s := New(deltas)
+        model := make(map[string][][]byte)
+        for i := 0; i < 2000; i++ {
+            path := paths[rng.Intn(len(paths))]
+            var data []byte
+            if revs := model[path]; len(revs) > 0 && rng.Intn(4) > 0 {
+                data = mutate(rng, revs[len(revs)-1])
+            } else {
+                data = randomText(rng, rng.Intn(200))
+            }
+            if revs := model[path]; len(revs) == 0 || !bytes.Equal(revs[len(revs)-1], data) {
+                model[path] = append(model[path], data)
+            }
+            if got := s.Put(path, data); got != len(model[path]) {
+                t.Fatalf("deltas=%v put %d: r%d, want r%d", deltas, i, got, len(model[path]))
+            }
+        }
+        for path, revs := range model {
+            for i, want := range revs {
+                if got, err := s.Get(path, i+1); err != nil || !bytes.Equal(got, want) {
+                    t.Fatalf("deltas=%v %s r%d: %q, %v; want %q", deltas, path, i+1, got, err, want)
+                }
+            }
+        }
+    }
+}
+
+func randomText(rng *rand.Rand, n int) []byte {
+    b := make([]byte, n)
+    for i := range b {
+        b[i] = byte('a' + rng.Intn(4))
+    }
+    return b
+}
+
+// mutate returns data with a random span replaced, possibly by nothing.
+func mutate(rng *rand.Rand, data []byte) []byte {
+    i := rng.Intn(len(data) + 1)
+    j := i + rng.Intn(len(data)-i+1)
+    out := append([]byte(nil), data[:i]...)
+    out = append(out, randomText(rng, rng.Intn(5))...)
+    return append(out, data[j:]...)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "errors"
+    "strconv"
+    "strings"
+
+    "./store"
+)
+
+// Everything a client sends is checked here before it reaches the store.
+// Each check returns the error whose text follows "ERR " on the wire.
+
+// maxFileSize caps a single PUT so a bogus length can't exhaust memory.
+const maxFileSize = 16 << 20
+
+var (
+    errIllegalFileName = errors.New("illegal filename")
+    errIllegalDirName  = errors.New("illegal dir name")
+    errNotText         = errors.New("text files only")
+    errBadLength       = errors.New("length must be integer")
+    errTooLarge        = errors.New("file too large")
+    errBadRevision     = errors.New("invalid revision")
+)
+
+// isValidPath applies the checks shared by file and directory names: an
+// absolute path of [A-Za-z0-9._/-] with no empty, "." or ".." segments.
+func isValidPath(path string) bool {
+    if !strings.HasPrefix(path, "/") || strings.Contains(path, "//") {
+        return false
+    }
+    for i := 0; i < len(path); i++ {
+        switch c := path[i]; {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case c == '.', c == '_', c == '/', c == '-':
+        default:
+            return false
+        }
+    }
+    for _, part := range strings.Split(path, "/") {
+        if part == "." || part == ".." {
+            return false
+        }
+    }
+    return true
+}
+
+// validateFileName is for PUT and GET: files cannot be the root or end in /.
+func validateFileName(name string) error {
+    if !isValidPath(name) || strings.HasSuffix(name, "/") {
+        return errIllegalFileName
+    }
+    return nil
+}
+
+// validateDirName is for LIST: the root and a trailing / are allowed.
+func validateDirName(name string) error {
+    if !isValidPath(name) {
+        return errIllegalDirName
+    }
+    return nil
+}
+
+// validateText accepts printable ASCII plus \n, \r and \t.
+func validateText(data []byte) error {
+    for _, b := range data {
+        if (b < 32 || b > 126) && b != '\n' && b != '\r' && b != '\t' {
+            return errNotText
+        }
+    }
+    return nil
+}
+
+// parseLength parses a PUT length: a plain decimal number of bytes.
+func parseLength(s string) (int64, error) {
+    n, err := strconv.ParseInt(s, 10, 64)
+    if err != nil || n < 0 {
+        return 0, errBadLength
+    }
+    return n, nil
+}
+
+// parseRevision parses a GET revision, "r3" or "3". Revisions start at 1.
+func parseRevision(s string) (int, error) {
+    if strings.HasPrefix(s, "r") || strings.HasPrefix(s, "R") {
+        s = s[1:]
+    }
+    n, err := strconv.Atoi(s)
+    if err != nil {
+        return 0, errBadRevision
+    }
+    if n < 1 {
+        // 0 would mean "latest" to the store.
+        return 0, store.ErrNoSuchRevision
+    }
+    return n, nil
+}
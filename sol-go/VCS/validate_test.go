@@ -0,0 +1,154 @@
+package main
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+
+    "./store"
+)
+
+// pathSeeds are names from the protocol's edge cases.
+var pathSeeds = []string{
+    "/", "/a", "/a/", "/a/b.txt", "//a", "/a//b", "a", "", "/.", "/..", "/a/./b", "/a/../b",
+    "/.hidden", "/a..b", "/-_.", "/a b", "/a\x00", "/ä", "/a/b/c/d/e/f/g/h",
+}
+
+// checkPath verifies what every accepted name must satisfy.
+func checkPath(t *testing.T, name string) {
+    t.Helper()
+    if !strings.HasPrefix(name, "/") {
+        t.Fatalf("accepted %q: not absolute", name)
+    }
+    for i := 0; i < len(name); i++ {
+        c := name[i]
+        if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("._/-", c) >= 0) {
+            t.Fatalf("accepted %q: byte 0x%02x", name, c)
+        }
+    }
+    for i, part := range strings.Split(name, "/") {
+        if part == "." || part == ".." {
+            t.Fatalf("accepted %q: segment %q", name, part)
+        }
+        if part == "" && i > 0 && i < strings.Count(name, "/") {
+            t.Fatalf("accepted %q: empty segment", name)
+        }
+    }
+}
+
+func FuzzValidateFileName(f *testing.F) {
+    for _, s := range pathSeeds {
+        f.Add(s)
+    }
+    f.Fuzz(func(t *testing.T, name string) {
+        if validateFileName(name) != nil {
+            return
+        }
+        checkPath(t, name)
+        if strings.HasSuffix(name, "/") {
+            t.Fatalf("accepted file name %q ends in /", name)
+        }
+        if validateDirName(name) != nil {
+            t.Fatalf("file name %q is not a valid dir name", name)
+        }
+
+        // An accepted name is stored under exactly that name, and shows up
+        // in its directory's listing.
+        s := store.New(true)
+        s.Put(name, []byte("x"))
+        if data, err := s.Get(name, 1); err != nil || string(data) != "x" {
+            t.Fatalf("get %q: %q, %v", name, data, err)
+        }
+        dir, base := name[:strings.LastIndexByte(name, '/')+1], name[strings.LastIndexByte(name, '/')+1:]
+        entries := s.List(dir)
+        if len(entries) != 1 || entries[0].Name != base || entries[0].Dir {
+            t.Fatalf("list %q after putting %q: %v", dir, name, entries)
+        }
+    })
+}
+
+func FuzzValidateDirName(f *testing.F) {
+    for _, s := range pathSeeds {
+        f.Add(s)
+    }
+    f.Fuzz(func(t *testing.T, name string) {
+        if validateDirName(name) != nil {
+            return
+        }
+        checkPath(t, name)
+        s := store.New(false)
+        s.Put("/a/b", []byte("x"))
+        s.List(name)
+    })
+}
+
+func FuzzValidateRevision(f *testing.F) {
+    for _, s := range []string{"r1", "1", "R7", "r0", "0", "r-1", "-1", "r", "", "rr1", "r1 ", " r1", "r99999999999999999999", "r+1", "r0x10", "r٣"} {
+        f.Add(s)
+    }
+    f.Fuzz(func(t *testing.T, s string) {
+        n, err := parseRevision(s)
+        if err != nil {
+            if err != errBadRevision && err != store.ErrNoSuchRevision {
+                t.Fatalf("parseRevision(%q): unexpected error %v", s, err)
+            }
+            return
+        }
+        if n < 1 {
+            t.Fatalf("parseRevision(%q) = %d, want at least 1", s, n)
+        }
+        if m, err := parseRevision("r" + strconv.Itoa(n)); err != nil || m != n {
+            t.Fatalf("r%d does not round trip: %d, %v", n, m, err)
+        }
+    })
+}
+
+func FuzzValidateLength(f *testing.F) {
+    for _, s := range []string{"0", "5", "-1", "", "1e3", "99999999999999999999", "+5", " 5"} {
+        f.Add(s)
+    }
+    f.Fuzz(func(t *testing.T, s string) {
+        n, err := parseLength(s)
+        if err != nil {
+            return
+        }
+        if n < 0 {
+            t.Fatalf("parseLength(%q) = %d", s, n)
+        }
+    })
+}
+
+func FuzzValidateText(f *testing.F) {
+    for _, s := range []string{"hello\n", "tab\there\r\n", "\x00", "\x7f", "é", ""} {
+        f.Add([]byte(s))
+    }
+    f.Fuzz(func(t *testing.T, data []byte) {
+        if validateText(data) != nil {
+            return
+        }
+        for _, b := range data {
+            if b > 126 || b < 32 && b != '\n' && b != '\r' && b != '\t' {
+                t.Fatalf("accepted byte 0x%02x", b)
+            }
+        }
+    })
+}
+
+func TestValidateNames(t *testing.T) {
+    files := map[string]bool{
+        "/a": true, "/a/b.txt": true, "/.hidden": true, "/a..b": true, "/-_.": true,
+        "/": false, "/a/": false, "//a": false, "a": false, "": false, "/.": false,
+        "/..": false, "/a/../b": false, "/a b": false, "/ä": false,
+    }
+    for name, ok := range files {
+        if got := validateFileName(name) == nil; got != ok {
+            t.Errorf("validateFileName(%q) ok = %v, want %v", name, got, ok)
+        }
+    }
+    dirs := map[string]bool{"/": true, "/a/": true, "/a": true, "//": false, "/a/./": false, "a/": false}
+    for name, ok := range dirs {
+        if got := validateDirName(name) == nil; got != ok {
+            t.Errorf("validateDirName(%q) ok = %v, want %v", name, got, ok)
+        }
+    }
+}
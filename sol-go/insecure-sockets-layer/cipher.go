@@ -0,0 +1,157 @@
+package main
+
+import (
+    "errors"
+    "io"
+
+    "../../lib-go/quota"
+)
+
+// Cipher spec operations
+const (
+    opEnd         = 0x00
+    opReverseBits = 0x01
+    opXor         = 0x02 // followed by N
+    opXorPos      = 0x03
+    opAdd         = 0x04 // followed by N
+    opAddPos      = 0x05
+)
+
+var errBadSpec = errors.New("invalid cipher spec")
+
+type op struct {
+    code byte
+    arg  byte
+}
+
+// cipherSpec is a client's cipher. Positions count bytes from the start of
+// the stream in each direction separately.
+type cipherSpec []op
+
+// reverseTable maps every byte to the byte with its bits reversed.
+var reverseTable [256]byte
+
+func init() {
+    for i := range reverseTable {
+        var r byte
+        for bit := 0; bit < 8; bit++ {
+            r = r<<1 | byte(i)>>bit&1
+        }
+        reverseTable[i] = r
+    }
+}
+
+// readCipherSpec reads a spec up to and including its terminating 0x00,
+// which must come within limit bytes (0 for no limit).
+func readCipherSpec(r io.ByteReader, limit int) (cipherSpec, error) {
+    var spec cipherSpec
+    for n := 0; n < quota.Max(limit); n++ {
+        code, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        switch code {
+        case opEnd:
+            return spec, nil
+        case opReverseBits, opXorPos, opAddPos:
+            spec = append(spec, op{code: code})
+        case opXor, opAdd:
+            arg, err := r.ReadByte()
+            if err != nil {
+                return nil, err
+            }
+            n++
+            spec = append(spec, op{code: code, arg: arg})
+        default:
+            return nil, errBadSpec
+        }
+    }
+    return nil, errBadSpec
+}
+
+// encode applies the spec to a byte at a stream position.
+func (s cipherSpec) encode(b byte, pos int) byte {
+    for _, o := range s {
+        switch o.code {
+        case opReverseBits:
+            b = reverseTable[b]
+        case opXor:
+            b ^= o.arg
+        case opXorPos:
+            b ^= byte(pos)
+        case opAdd:
+            b += o.arg
+        case opAddPos:
+            b += byte(pos)
+        }
+    }
+    return b
+}
+
+// decode undoes encode by applying the inverse operations in reverse.
+func (s cipherSpec) decode(b byte, pos int) byte {
+    for i := len(s) - 1; i >= 0; i-- {
+        switch o := s[i]; o.code {
+        case opReverseBits:
+            b = reverseTable[b]
+        case opXor:
+            b ^= o.arg
+        case opXorPos:
+            b ^= byte(pos)
+        case opAdd:
+            b -= o.arg
+        case opAddPos:
+            b -= byte(pos)
+        }
+    }
+    return b
+}
+
+// isNoop reports whether the spec leaves every byte unchanged at every
+// position. Positions only matter mod 256, so this check is exhaustive.
+func (s cipherSpec) isNoop() bool {
+    for pos := 0; pos < 256; pos++ {
+        for b := 0; b < 256; b++ {
+            if s.encode(byte(b), pos) != byte(b) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// decryptReader decodes everything read through it.
+type decryptReader struct {
+    r    io.Reader
+    spec cipherSpec
+    pos  int
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+    n, err := d.r.Read(p)
+    for i := range p[:n] {
+        p[i] = d.spec.decode(p[i], d.pos)
+        d.pos++
+    }
+    return n, err
+}
+
+// encryptWriter encodes everything written through it.
+type encryptWriter struct {
+    w    io.Writer
+    spec cipherSpec
+    pos  int
+    buf  []byte
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+    e.buf = e.buf[:0]
+    for _, b := range p {
+        e.buf = append(e.buf, e.spec.encode(b, e.pos))
+        e.pos++
+    }
+    if _, err := e.w.Write(e.buf); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "math/rand"
+    "net"
+    "testing"
+
+    "../../lib-go/golden"
+    "../../lib-go/quota"
+    "../../lib-go/testnet"
+)
+
+// isl is the protocol's default quotas, which the tests run with.
+var isl = quota.For("insecure-sockets-layer")
+
+// The reference cipher works bit by bit and in plain integers, and decodes
+// by searching for the byte that encodes to the input, so that it shares
+// no shortcuts (the reverse table, wrapping byte arithmetic, the inverse
+// operations) with the implementation it checks.
+
+func refReverse(b byte) byte {
+    var bits [8]int
+    for i := range bits {
+        bits[i] = int(b>>i) & 1
+    }
+    out := 0
+    for i := range bits {
+        out = out*2 + bits[i]
+    }
+    return byte(out)
+}
+
+func refEncode(s cipherSpec, b byte, pos int) byte {
+    v := int(b)
+    for _, o := range s {
+        switch o.code {
+        case opReverseBits:
+            v = int(refReverse(byte(v)))
+        case opXor:
+            v ^= int(o.arg)
+        case opXorPos:
+            v ^= pos % 256
+        case opAdd:
+            v = (v + int(o.arg)) % 256
+        case opAddPos:
+            v = (v + pos) % 256
+        }
+    }
+    return byte(v)
+}
+
+func refDecode(s cipherSpec, c byte, pos int) (byte, bool) {
+    for b := 0; b < 256; b++ {
+        if refEncode(s, byte(b), pos) == c {
+            return byte(b), true
+        }
+    }
+    return 0, false
+}
+
+func refIsNoop(s cipherSpec) bool {
+    for pos := 0; pos < 256; pos++ {
+        for b := 0; b < 256; b++ {
+            if refEncode(s, byte(b), pos) != byte(b) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// specBytes serializes s as it is sent on the wire, with its 0x00.
+func specBytes(s cipherSpec) []byte {
+    var out []byte
+    for _, o := range s {
+        out = append(out, o.code)
+        if o.code == opXor || o.code == opAdd {
+            out = append(out, o.arg)
+        }
+    }
+    return append(out, opEnd)
+}
+
+func randomSpec(rng *rand.Rand) cipherSpec {
+    var s cipherSpec
+    for n := rng.Intn(6); n > 0; n-- {
+        code := byte(opReverseBits + rng.Intn(5))
+        o := op{code: code}
+        if code == opXor || code == opAdd {
+            o.arg = byte(rng.Intn(256))
+        }
+        s = append(s, o)
+    }
+    return s
+}
+
+// seedSpecs are the spec's examples plus known no-ops.
+var seedSpecs = [][]byte{
+    {0x02, 0x01, 0x01, 0x00},             // xor(1),reversebits
+    {0x05, 0x05, 0x00},                   // addpos,addpos
+    {0x02, 0x7b, 0x05, 0x01, 0x00},       // xor(123),addpos,reversebits
+    {0x00},                               // empty: a no-op
+    {0x02, 0x00, 0x00},                   // xor(0): a no-op
+    {0x02, 0xab, 0x02, 0xab, 0x00},       // xor(X),xor(X): a no-op
+    {0x01, 0x01, 0x00},                   // reversebits twice: a no-op
+    {0x02, 0xa0, 0x02, 0x0b, 0x02, 0xab, 0x00}, // xors cancelling out
+    {0x03, 0x03, 0x00},                   // xorpos twice: a no-op
+    {0x04, 0x80, 0x04, 0x80, 0x00},       // add(128) twice: a no-op
+}
+
+// goldenStreams returns what each golden transcript sends: a cipher spec
+// (a malformed one, in some) and then ciphertext.
+func goldenStreams(f *testing.F) [][]byte {
+    streams, err := golden.Sent("../../tools-go/protohackers/golden/insecure-sockets-layer")
+    if err != nil {
+        f.Fatal(err)
+    }
+    return streams
+}
+
+func FuzzCipherRoundTrip(f *testing.F) {
+    for _, spec := range seedSpecs {
+        f.Add(spec, []byte("4x dog,5x car\n"), uint16(0))
+        f.Add(spec, []byte{0x00, 0xff, 0x80, 0x01}, uint16(255))
+    }
+    for _, s := range goldenStreams(f) {
+        r := bytes.NewReader(s)
+        if _, err := readCipherSpec(r, isl.Handshake); err == nil {
+            n := len(s) - r.Len()
+            f.Add(s[:n], s[n:], uint16(0))
+        }
+    }
+    f.Fuzz(func(t *testing.T, rawSpec, payload []byte, start uint16) {
+        spec, err := readCipherSpec(bytes.NewReader(rawSpec), isl.Handshake)
+        if err != nil {
+            return
+        }
+        for i, b := range payload {
+            pos := int(start) + i
+            enc := spec.encode(b, pos)
+            if want := refEncode(spec, b, pos); enc != want {
+                t.Fatalf("encode(0x%02x) at %d = 0x%02x, reference 0x%02x", b, pos, enc, want)
+            }
+            if dec := spec.decode(enc, pos); dec != b {
+                t.Fatalf("decode(encode(0x%02x)) at %d = 0x%02x", b, pos, dec)
+            }
+            want, ok := refDecode(spec, b, pos)
+            if !ok {
+                t.Fatalf("reference finds no byte encoding to 0x%02x at %d: spec is not a bijection", b, pos)
+            }
+            if dec := spec.decode(b, pos); dec != want {
+                t.Fatalf("decode(0x%02x) at %d = 0x%02x, reference 0x%02x", b, pos, dec, want)
+            }
+        }
+    })
+}
+
+func FuzzIsNoop(f *testing.F) {
+    for _, spec := range seedSpecs {
+        f.Add(spec)
+    }
+    for _, s := range goldenStreams(f) {
+        f.Add(s)
+    }
+    f.Fuzz(func(t *testing.T, rawSpec []byte) {
+        spec, err := readCipherSpec(bytes.NewReader(rawSpec), isl.Handshake)
+        if err != nil || len(spec) > 8 {
+            return // long specs make the reference too slow to fuzz with
+        }
+        if got, want := spec.isNoop(), refIsNoop(spec); got != want {
+            t.Fatalf("isNoop(% x) = %v, reference %v", rawSpec, got, want)
+        }
+    })
+}
+
+func FuzzReadCipherSpec(f *testing.F) {
+    for _, spec := range seedSpecs {
+        f.Add(spec)
+    }
+    for _, s := range goldenStreams(f) {
+        f.Add(s)
+    }
+    f.Add(bytes.Repeat([]byte{0x01}, 100))
+    f.Add([]byte{0x02})
+    f.Add([]byte{0x06, 0x00})
+    f.Fuzz(func(t *testing.T, raw []byte) {
+        spec, err := readCipherSpec(bytes.NewReader(raw), isl.Handshake)
+        if err != nil {
+            return
+        }
+        wire := specBytes(spec)
+        if len(wire) > isl.Handshake {
+            t.Fatalf("accepted a %d-byte spec, over %d", len(wire), isl.Handshake)
+        }
+        if !bytes.HasPrefix(raw, wire) {
+            t.Fatalf("spec % x read back as % x", raw, wire)
+        }
+    })
+}
+
+// TestStreamPositions checks the reader and writer against the reference
+// across many writes and short reads, well past position 256 where the
+// position-dependent ops wrap.
+func TestStreamPositions(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 200; i++ {
+        spec := randomSpec(rng)
+        plain := make([]byte, 1000+rng.Intn(1000))
+        rng.Read(plain)
+
+        var wire bytes.Buffer
+        w := &encryptWriter{w: &wire, spec: spec}
+        for rest := plain; len(rest) > 0; {
+            n := min(len(rest), 1+rng.Intn(64))
+            if _, err := w.Write(rest[:n]); err != nil {
+                t.Fatal(err)
+            }
+            rest = rest[n:]
+        }
+        for pos, c := range wire.Bytes() {
+            if want := refEncode(spec, plain[pos], pos); c != want {
+                t.Fatalf("spec % x: byte %d encoded as 0x%02x, reference 0x%02x", specBytes(spec), pos, c, want)
+            }
+        }
+
+        // Read it back a few bytes at a time.
+        r := &decryptReader{r: bufio.NewReaderSize(&wire, 16), spec: spec}
+        var got []byte
+        buf := make([]byte, 7)
+        for {
+            n, err := r.Read(buf[:1+rng.Intn(len(buf))])
+            got = append(got, buf[:n]...)
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+        }
+        if !bytes.Equal(got, plain) {
+            t.Fatalf("spec % x: stream did not round trip", specBytes(spec))
+        }
+    }
+}
+
+func TestIsNoopMatchesReference(t *testing.T) {
+    for _, raw := range seedSpecs {
+        spec, err := readCipherSpec(bytes.NewReader(raw), isl.Handshake)
+        if err != nil {
+            t.Fatalf("seed % x: %v", raw, err)
+        }
+        if got, want := spec.isNoop(), refIsNoop(spec); got != want {
+            t.Errorf("isNoop(% x) = %v, reference %v", raw, got, want)
+        }
+    }
+    rng := rand.New(rand.NewSource(2))
+    for i := 0; i < 50; i++ {
+        spec := randomSpec(rng)
+        if got, want := spec.isNoop(), refIsNoop(spec); got != want {
+            t.Errorf("isNoop(% x) = %v, reference %v", specBytes(spec), got, want)
+        }
+    }
+}
+
+// encodeStream encodes data as sent from stream position 0.
+func encodeStream(s cipherSpec, data string) []byte {
+    out := make([]byte, len(data))
+    for i := range out {
+        out[i] = s.encode(data[i], i)
+    }
+    return out
+}
+
+// TestSessionFragmented sends the cipher spec and a request a few bytes
+// at a time, so both are split across reads.
+func TestSessionFragmented(t *testing.T) {
+    raw := []byte{0x02, 0x7b, 0x05, 0x01, 0x00} // xor(123),addpos,reversebits
+    spec, err := readCipherSpec(bytes.NewReader(raw), isl.Handshake)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := testnet.Pipe(t, func(conn net.Conn) { handleClient(conn, false, isl) })
+    c.Fragment(3, 1)
+    c.Send(raw)
+    c.Send(encodeStream(spec, "4x dog,5x car\n"))
+    c.Expect(encodeStream(spec, "5x car\n"))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "os"
+
+    "../../lib-go/quota"
+    "../../lib-go/signals"
+)
+
+// cipherConn is the application's view of a client: reads are decoded and
+// writes encoded with the client's cipher spec.
+type cipherConn struct {
+    *decryptReader
+    *encryptWriter
+}
+
+func handleClient(conn net.Conn, plain bool, q quota.Quota) {
+    defer conn.Close()
+
+    addr := conn.RemoteAddr()
+    fmt.Printf("[NEW CONNECTION] %s connected.\n", addr)
+
+    var err error
+    if plain {
+        err = serveToys(conn, q)
+    } else {
+        err = serveCiphered(conn, q)
+    }
+    if err != nil && !errors.Is(err, io.EOF) {
+        fmt.Printf("[ERROR] %s: %v\n", addr, err)
+    }
+    fmt.Printf("[DISCONNECTED] %s disconnected.\n", addr)
+}
+
+// serveCiphered reads the client's cipher spec and then runs the
+// application over the cipher.
+func serveCiphered(conn net.Conn, q quota.Quota) error {
+    // The spec is read from the same buffered reader the cipher then reads
+    // from, so no bytes after it are lost.
+    reader := bufio.NewReader(conn)
+    spec, err := readCipherSpec(reader, q.Handshake)
+    if err != nil {
+        return err
+    }
+    // "If a client tries to use a cipher that leaves every byte of input
+    // unchanged, the server must immediately disconnect without sending
+    // any data back."
+    if spec.isNoop() {
+        return errors.New("no-op cipher spec")
+    }
+
+    return serveToys(cipherConn{
+        &decryptReader{r: reader, spec: spec},
+        &encryptWriter{w: conn, spec: spec},
+    }, q)
+}
+
+func startServer(host string, port string, plain bool, q quota.Quota) {
+    address := host + ":" + port
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer listener.Close()
+
+    if plain {
+        fmt.Printf("[LISTENING] Toy Server listening on %s without a cipher\n", address)
+    } else {
+        fmt.Printf("[LISTENING] Insecure Sockets Layer Server listening on %s\n", address)
+    }
+
+    // Handle graceful shutdown
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        listener.Close()
+    })
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            fmt.Printf("[ERROR] Accept error: %v\n", err)
+            continue
+        }
+
+        go handleClient(conn, plain, q)
+    }
+}
+
+func main() {
+    port := flag.String("port", "65432", "TCP port to listen on")
+    plain := flag.Bool("plain", false, "serve the toy protocol in the clear, without a cipher spec (for debugging)")
+    q := quota.Flags(flag.CommandLine, "insecure-sockets-layer")
+    flag.Parse()
+    if err := q.Validate(); err != nil {
+        fmt.Printf("[ERROR] %v\n", err)
+        os.Exit(2)
+    }
+
+    startServer("0.0.0.0", *port, *plain, *q)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "io"
+    "strconv"
+    "strings"
+
+    "../../lib-go/quota"
+)
+
+// mostToys picks the entry with the largest count from a request such as
+// "10x toy car,15x dog on a string,4x inflatable motorcycle".
+func mostToys(line string) string {
+    best, bestCount := "", -1
+    for _, part := range strings.Split(line, ",") {
+        count, _, ok := strings.Cut(part, "x")
+        if !ok {
+            continue
+        }
+        n, err := strconv.Atoi(count)
+        if err != nil {
+            continue
+        }
+        if n > bestCount {
+            best, bestCount = part, n
+        }
+    }
+    return best
+}
+
+// serveToys runs the toy-priority application protocol over rw: one reply
+// line per request line. It knows nothing about the cipher, so rw can be
+// the cipher wrappers or a plain connection. A request line longer than
+// q.Message ends the session.
+func serveToys(rw io.ReadWriter, q quota.Quota) error {
+    scanner := q.NewScanner(rw, make([]byte, 4096))
+
+    for scanner.Scan() {
+        if _, err := io.WriteString(rw, mostToys(scanner.Text())+"\n"); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "cmp"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "slices"
+    "strconv"
+)
+
+// The admin listener serves the connection table:
+//
+//    GET  /debug/conns                  every connection, as JSON
+//    POST /debug/conns/close?id=12      force-close connection 12
+//    POST /debug/conns/close?ip=1.2.3.4 force-close every connection from an IP
+//
+// for example with curl -X POST. A closed client's blocked get is cancelled
+// and its jobs are aborted, as if it had disconnected.
+
+// connStatus describes one connection.
+type connStatus struct {
+    ID     int64  `json:"id"`
+    Addr   string `json:"addr"`
+    Exempt bool   `json:"exempt"`
+    Busy   bool   `json:"busy"`
+    IdleMs int64  `json:"idle_ms"`
+    Jobs   int    `json:"jobs"` // jobs it is working on
+}
+
+func (t *connTable) list() []connStatus {
+    t.mu.Lock()
+    clients := make([]*client, 0, len(t.clients))
+    for _, c := range t.clients {
+        clients = append(clients, c)
+    }
+    t.mu.Unlock()
+
+    list := make([]connStatus, 0, len(clients))
+    for _, c := range clients {
+        c.jc.mu.Lock()
+        jobs := len(c.working)
+        c.jc.mu.Unlock()
+        list = append(list, connStatus{
+            ID:     c.id,
+            Addr:   c.addr,
+            Exempt: c.exempt,
+            Busy:   c.busy.Load(),
+            IdleMs: c.idle().Milliseconds(),
+            Jobs:   jobs,
+        })
+    }
+    slices.SortFunc(list, func(a, b connStatus) int { return cmp.Compare(a.ID, b.ID) })
+    return list
+}
+
+// matching returns the connection with id, or every connection from ip.
+func (t *connTable) matching(id int64, ip net.IP) []*client {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if ip == nil {
+        if c, ok := t.clients[id]; ok {
+            return []*client{c}
+        }
+        return nil
+    }
+    var matched []*client
+    for _, c := range t.clients {
+        if tcp, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok && tcp.IP.Equal(ip) {
+            matched = append(matched, c)
+        }
+    }
+    return matched
+}
+
+// forceClose cancels the client's context, which stops any work running
+// for it (a blocked get gives up at once), and then closes the connection
+// under its handler, which cleans up as for any disconnect.
+func (c *client) forceClose(reason string) {
+    fmt.Printf("[KILLED] %s (conn %d): %s\n", c.addr, c.id, reason)
+    c.cancel()
+    c.conn.Close()
+}
+
+func (t *connTable) serveList(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(t.list())
+}
+
+func (t *connTable) serveClose(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "use POST", http.StatusMethodNotAllowed)
+        return
+    }
+    var id int64
+    var ip net.IP
+    switch {
+    case r.FormValue("id") != "":
+        var err error
+        if id, err = strconv.ParseInt(r.FormValue("id"), 10, 64); err != nil {
+            http.Error(w, "invalid id", http.StatusBadRequest)
+            return
+        }
+    case r.FormValue("ip") != "":
+        if ip = net.ParseIP(r.FormValue("ip")); ip == nil {
+            http.Error(w, "invalid ip", http.StatusBadRequest)
+            return
+        }
+    default:
+        http.Error(w, "want id or ip", http.StatusBadRequest)
+        return
+    }
+
+    closed := []int64{}
+    for _, c := range t.matching(id, ip) {
+        c.forceClose("closed by an admin from " + r.RemoteAddr)
+        closed = append(closed, c.id)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string][]int64{"closed": closed})
+}
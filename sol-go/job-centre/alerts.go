@@ -0,0 +1,113 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "runtime"
+    "sync/atomic"
+    "time"
+
+    "../../lib-go/clock"
+)
+
+// Event counters behind the rate hooks.
+var (
+    acceptCount atomic.Int64 // connections accepted
+    errorCount  atomic.Int64 // error responses sent and connections broken
+)
+
+// rateHook is called when a per-second rate crosses its threshold: with
+// above set as it rises over, and clear once it falls back under.
+type rateHook func(rate, threshold float64, above bool)
+
+// hooks let a deployment react to traffic as it changes (page someone,
+// block a source, ...) instead of polling /debug/vars. They run on the
+// rate watcher's goroutine, so a slow hook delays the next check.
+type hooks struct {
+    OnAcceptRate rateHook
+    OnErrorRate  rateHook
+}
+
+// rateWatch turns a counter into a rate and fires hook on each crossing.
+type rateWatch struct {
+    counter   *atomic.Int64
+    threshold float64
+    hook      rateHook
+
+    last  int64
+    above bool
+}
+
+func (w *rateWatch) check(elapsed time.Duration) {
+    n := w.counter.Load()
+    rate := float64(n-w.last) / elapsed.Seconds()
+    w.last = n
+    if above := rate > w.threshold; above != w.above {
+        w.above = above
+        w.hook(rate, w.threshold, above)
+    }
+}
+
+// watchRates checks the accept and error rates every interval. A hook
+// with no threshold is not watched.
+func watchRates(h hooks, acceptThreshold, errorThreshold float64, interval time.Duration, clk clock.Clock) {
+    var watches []*rateWatch
+    if h.OnAcceptRate != nil && acceptThreshold > 0 {
+        watches = append(watches, &rateWatch{counter: &acceptCount, threshold: acceptThreshold, hook: h.OnAcceptRate})
+    }
+    if h.OnErrorRate != nil && errorThreshold > 0 {
+        watches = append(watches, &rateWatch{counter: &errorCount, threshold: errorThreshold, hook: h.OnErrorRate})
+    }
+    if len(watches) == 0 {
+        return
+    }
+    for _, w := range watches {
+        w.last = w.counter.Load()
+    }
+    last := clk.Now()
+    for now := range clk.NewTicker(interval).C() {
+        for _, w := range watches {
+            w.check(now.Sub(last))
+        }
+        last = now
+    }
+}
+
+// shellCommand runs cmd through the system's shell.
+func shellCommand(cmd string) *exec.Cmd {
+    if runtime.GOOS == "windows" {
+        return exec.Command("cmd.exe", "/C", cmd)
+    }
+    return exec.Command("/bin/sh", "-c", cmd)
+}
+
+// alertHook is the hook installed from the command line: it logs the
+// crossing and, if cmd is set, runs it through the shell with the details
+// in ALERT_METRIC, ALERT_STATE (above or below), ALERT_RATE and
+// ALERT_THRESHOLD.
+func alertHook(metric, cmd string) rateHook {
+    return func(rate, threshold float64, above bool) {
+        state := "below"
+        if above {
+            state = "above"
+        }
+        fmt.Printf("[ALERT] %s rate %.1f/s is %s the %.1f/s threshold\n", metric, rate, state, threshold)
+        if cmd == "" {
+            return
+        }
+        run := shellCommand(cmd)
+        run.Env = append(os.Environ(),
+            "ALERT_METRIC="+metric,
+            "ALERT_STATE="+state,
+            fmt.Sprintf("ALERT_RATE=%.1f", rate),
+            fmt.Sprintf("ALERT_THRESHOLD=%.1f", threshold),
+        )
+        run.Stdout, run.Stderr = os.Stdout, os.Stderr
+        if err := run.Start(); err != nil {
+            fmt.Printf("[ERROR] Alert command: %v\n", err)
+            return
+        }
+        go run.Wait()
+    }
+}
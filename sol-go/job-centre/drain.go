@@ -0,0 +1,147 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "expvar"
+    "fmt"
+    "net"
+    "net/http"
+    "sync"
+)
+
+// listenerDrain lets an admin take the server out of service gently:
+// draining closes the listener, so new connections are refused while the
+// ones already open carry on until their clients leave, and undraining
+// listens again.
+//
+//    POST /debug/drain      stop accepting
+//    POST /debug/undrain    accept again
+type listenerDrain struct {
+    address string
+
+    mu        sync.Mutex
+    listener  net.Listener  // nil while drained
+    undrained chan struct{} // closed when the drain ends
+    stopped   bool
+}
+
+func newListenerDrain(address string) *listenerDrain {
+    d := &listenerDrain{address: address}
+    loadStats.Set("draining", expvar.Func(func() any { return d.draining() }))
+    return d
+}
+
+// listen opens the listener, ending a drain. It is a no-op if it is open.
+func (d *listenerDrain) listen() error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.stopped {
+        return net.ErrClosed
+    }
+    if d.listener != nil {
+        return nil
+    }
+    l, err := net.Listen("tcp", d.address)
+    if err != nil {
+        return err
+    }
+    d.listener = l
+    if d.undrained != nil {
+        close(d.undrained)
+        d.undrained = nil
+    }
+    return nil
+}
+
+// drain closes the listener. It reports false if it was already drained.
+func (d *listenerDrain) drain() bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.listener == nil {
+        return false
+    }
+    d.listener.Close()
+    d.listener = nil
+    d.undrained = make(chan struct{})
+    return true
+}
+
+// close shuts the listener for good.
+func (d *listenerDrain) close() {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.stopped = true
+    if d.listener != nil {
+        d.listener.Close()
+        d.listener = nil
+    }
+}
+
+func (d *listenerDrain) draining() bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.listener == nil && !d.stopped
+}
+
+// accept waits for the next connection, through any drains. It returns
+// net.ErrClosed once the listener is closed for good or stop is closed.
+func (d *listenerDrain) accept(stop <-chan struct{}) (net.Conn, error) {
+    for {
+        d.mu.Lock()
+        l, undrained, stopped := d.listener, d.undrained, d.stopped
+        d.mu.Unlock()
+        if stopped {
+            return nil, net.ErrClosed
+        }
+        if l == nil {
+            select {
+            case <-undrained:
+                continue
+            case <-stop:
+                return nil, net.ErrClosed
+            }
+        }
+
+        conn, err := l.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            continue // drained or stopped; the next pass tells which
+        }
+        return conn, err
+    }
+}
+
+func (d *listenerDrain) serveDrain(conns *connTable) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            http.Error(w, "use POST", http.StatusMethodNotAllowed)
+            return
+        }
+        conns.mu.Lock()
+        open := len(conns.clients)
+        conns.mu.Unlock()
+        if d.drain() {
+            fmt.Printf("[DRAINING] Refusing new connections, %d still open (by an admin from %s)\n", open, r.RemoteAddr)
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]any{"draining": true, "connections": open})
+    }
+}
+
+func (d *listenerDrain) serveUndrain(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "use POST", http.StatusMethodNotAllowed)
+        return
+    }
+    wasDraining := d.draining()
+    if err := d.listen(); err != nil {
+        fmt.Printf("[ERROR] Undrain: %v\n", err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if wasDraining {
+        fmt.Printf("[UNDRAINED] Accepting again on %s (by an admin from %s)\n", d.address, r.RemoteAddr)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"draining": false})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "encoding/json"
+    "expvar"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// snapshot is everything worth attaching to a report of a failed checker
+// run: every published variable (queue depths, load, allocation audit,
+// memstats, ...) and the connection table, at one moment.
+type snapshot struct {
+    Time        time.Time                  `json:"time"`
+    Vars        map[string]json.RawMessage `json:"vars"`
+    Connections []connStatus               `json:"connections"`
+}
+
+// writeSnapshot writes a snapshot to a new timestamped file in dir and
+// returns its path.
+func writeSnapshot(dir string, conns *connTable) (string, error) {
+    snap := snapshot{Time: time.Now(), Vars: make(map[string]json.RawMessage)}
+    expvar.Do(func(kv expvar.KeyValue) {
+        snap.Vars[kv.Key] = json.RawMessage(kv.Value.String())
+    })
+    snap.Connections = conns.list()
+
+    data, err := json.MarshalIndent(snap, "", "  ")
+    if err != nil {
+        return "", err
+    }
+    path := filepath.Join(dir, "job-centre-"+snap.Time.Format("20060102-150405.000")+".json")
+    if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+        return "", err
+    }
+    fmt.Printf("[DUMP] Wrote stats snapshot to %s\n", path)
+    return path, nil
+}
+
+// serveDump writes a snapshot on POST /debug/dump and replies with its
+// path.
+func serveDump(dir string, conns *connTable) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            http.Error(w, "use POST", http.StatusMethodNotAllowed)
+            return
+        }
+        path, err := writeSnapshot(dir, conns)
+        if err != nil {
+            fmt.Printf("[ERROR] Stats snapshot: %v\n", err)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]string{"path": path})
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "bufio"
+    "expvar"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync/atomic"
+)
+
+// statFiltered counts connections closed by the address filter.
+var statFiltered = new(expvar.Int)
+
+func init() {
+    loadStats.Set("filtered", statFiltered)
+}
+
+// ipNets is a list of source networks, such as the ones exempt from
+// connection limits, shedding and paused accepts (so operators can still
+// get in when the server is overloaded; the admin listener is separate and
+// never limited).
+type ipNets []*net.IPNet
+
+// parseIPNets parses a comma-separated list of IPs and CIDRs.
+func parseIPNets(s string) (ipNets, error) {
+    var nets ipNets
+    for _, field := range strings.Split(s, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" {
+            continue
+        }
+        if !strings.Contains(field, "/") {
+            ip := net.ParseIP(field)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid IP %q", field)
+            }
+            bits := 8 * len(ip.To16())
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(field)
+        if err != nil {
+            return nil, err
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+func (nets ipNets) contains(addr net.Addr) bool {
+    tcp, ok := addr.(*net.TCPAddr)
+    if !ok {
+        return false
+    }
+    for _, n := range nets {
+        if n.Contains(tcp.IP) {
+            return true
+        }
+    }
+    return false
+}
+
+// filterRules are the allow and deny lists from a filter file, one rule
+// per line:
+//
+//    # scanners
+//    deny 203.0.113.0/24
+//    deny 198.51.100.7
+//    allow 203.0.113.64/26
+//
+// An address is refused if it is denied and not allowed, so the checker's
+// ranges can be kept open inside a denied block. "deny 0.0.0.0/0" and
+// "deny ::/0" turn it into an allow list.
+type filterRules struct {
+    allow ipNets
+    deny  ipNets
+}
+
+func loadFilterRules(path string) (*filterRules, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    rules := &filterRules{}
+    scanner := bufio.NewScanner(f)
+    for n := 1; scanner.Scan(); n++ {
+        line, _, _ := strings.Cut(scanner.Text(), "#")
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+        if len(fields) != 2 {
+            return nil, fmt.Errorf("%s:%d: want allow|deny <ip or cidr>", path, n)
+        }
+        nets, err := parseIPNets(fields[1])
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+        }
+        switch fields[0] {
+        case "allow":
+            rules.allow = append(rules.allow, nets...)
+        case "deny":
+            rules.deny = append(rules.deny, nets...)
+        default:
+            return nil, fmt.Errorf("%s:%d: unknown action %q", path, n, fields[0])
+        }
+    }
+    return rules, scanner.Err()
+}
+
+// addrFilter refuses connections from denied addresses as they are
+// accepted, before a client is set up for them. The rules are read from
+// path at start-up and again on reload (SIGHUP).
+type addrFilter struct {
+    path  string
+    rules atomic.Pointer[filterRules]
+}
+
+func newAddrFilter(path string) (*addrFilter, error) {
+    f := &addrFilter{path: path}
+    rules, err := loadFilterRules(path)
+    if err != nil {
+        return nil, err
+    }
+    f.rules.Store(rules)
+    return f, nil
+}
+
+// reload rereads the rules; if the file is broken the old ones stay.
+func (f *addrFilter) reload() {
+    rules, err := loadFilterRules(f.path)
+    if err != nil {
+        fmt.Printf("[ERROR] Reloading filter, keeping the old rules: %v\n", err)
+        return
+    }
+    f.rules.Store(rules)
+    fmt.Printf("[FILTER] Reloaded %s: %d allowed, %d denied networks\n", f.path, len(rules.allow), len(rules.deny))
+}
+
+// allows reports whether addr may connect. A nil filter allows everyone.
+func (f *addrFilter) allows(addr net.Addr) bool {
+    if f == nil {
+        return true
+    }
+    rules := f.rules.Load()
+    return !rules.deny.contains(addr) || rules.allow.contains(addr)
+}
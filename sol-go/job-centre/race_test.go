@@ -0,0 +1,247 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "../../lib-go/clock"
+)
+
+// These tests hammer the job centre from many goroutines at once. They
+// check the centre's invariants afterwards, and are meant to be run with
+// -race as well.
+
+// checkConsistent fails the test unless every job is in exactly one place
+// (its queue's heap, or the working set of one client) and every waiter
+// still queued is live and correctly indexed.
+func checkConsistent(t *testing.T, jc *jobCentre) {
+    t.Helper()
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+
+    queued := 0
+    for name, q := range jc.queues {
+        if q.Len() == 0 {
+            t.Errorf("queue %q is empty but still listed", name)
+        }
+        for i, j := range *q {
+            if jc.jobs[j.id] != j {
+                t.Errorf("job %d is queued on %q but not live", j.id, name)
+            }
+            if j.queue != name || j.index != i || j.worker != nil {
+                t.Errorf("job %d on %q: queue %q, index %d (at %d), worker %v", j.id, name, j.queue, j.index, i, j.worker != nil)
+            }
+            queued++
+        }
+    }
+
+    working := 0
+    for id, j := range jc.jobs {
+        if j.worker == nil {
+            continue
+        }
+        if j.worker.working[id] != j || j.index != -1 {
+            t.Errorf("job %d has a worker that does not hold it (index %d)", id, j.index)
+        }
+        working++
+    }
+    if queued+working != len(jc.jobs) {
+        t.Errorf("%d jobs queued and %d in progress, but %d live", queued, working, len(jc.jobs))
+    }
+
+    for name, ws := range jc.waiters {
+        if ws.Len() == 0 {
+            t.Errorf("waiter queue %q is empty but still listed", name)
+        }
+        for i, w := range ws.ws {
+            if w.done || w.index[ws] != i {
+                t.Errorf("waiter on %q: done %v, index %d (at %d)", name, w.done, w.index[ws], i)
+            }
+        }
+    }
+}
+
+func TestConcurrentGetDeleteAbort(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    queues := []string{"q1", "q2", "q3"}
+
+    var nextID atomic.Int64 // highest ID put so far
+    var deletes sync.Map    // id -> *atomic.Int32, successful deletes
+    deleted := func(id int64) {
+        n, _ := deletes.LoadOrStore(id, new(atomic.Int32))
+        if n.(*atomic.Int32).Add(1) > 1 {
+            t.Errorf("job %d deleted twice", id)
+        }
+    }
+
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        c, _ := newTestClient(t, jc)
+        rng := rand.New(rand.NewSource(int64(g)))
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 2000; i++ {
+                switch rng.Intn(5) {
+                case 0, 1:
+                    id := jc.put(queues[rng.Intn(len(queues))], rng.Int63n(10), json.RawMessage(`{}`))
+                    for {
+                        old := nextID.Load()
+                        if id <= old || nextID.CompareAndSwap(old, id) {
+                            break
+                        }
+                    }
+                case 2:
+                    j, _ := jc.get(c, queues[:1+rng.Intn(len(queues))], false, 0)
+                    if j == nil {
+                        continue
+                    }
+                    if rng.Intn(2) == 0 {
+                        // Someone else may delete it first.
+                        jc.abort(c, j.id)
+                    } else if jc.delete(j.id) {
+                        deleted(j.id)
+                    }
+                case 3:
+                    // Delete a job that may be queued, in progress with
+                    // any client, or gone already.
+                    if max := nextID.Load(); max > 0 {
+                        if id := 1 + rng.Int63n(max); jc.delete(id) {
+                            deleted(id)
+                        }
+                    }
+                case 4:
+                    // Abort a job this client most likely isn't working on.
+                    if max := nextID.Load(); max > 0 {
+                        jc.abort(c, 1+rng.Int63n(max))
+                    }
+                }
+            }
+            jc.disconnect(c)
+        }()
+    }
+    wg.Wait()
+
+    checkConsistent(t, jc)
+    for id, j := range jc.jobs {
+        if j.worker != nil {
+            t.Errorf("job %d still has a worker after every client disconnected", id)
+        }
+    }
+}
+
+// raceClient is one connection to a job centre served by handleClient.
+type raceClient struct {
+    conn    net.Conn
+    r       *bufio.Reader
+    handled chan struct{}
+}
+
+func startRaceClient(t *testing.T, jc *jobCentre, conns *connTable) *raceClient {
+    server, peer := net.Pipe()
+    c := newClient(jc, server)
+    if !conns.tryAdd(c) {
+        t.Error("connection table refused a client")
+    }
+    rc := &raceClient{conn: peer, r: bufio.NewReader(peer), handled: make(chan struct{})}
+    go func() {
+        handleClient(c, conns)
+        close(rc.handled)
+    }()
+    return rc
+}
+
+func (rc *raceClient) request(req string) (response, error) {
+    rc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+    if _, err := fmt.Fprintln(rc.conn, req); err != nil {
+        return response{}, err
+    }
+    line, err := rc.r.ReadBytes('\n')
+    if err != nil {
+        return response{}, err
+    }
+    var resp response
+    return resp, json.Unmarshal(line, &resp)
+}
+
+// TestWaitersJoinAndLeaveDuringPuts has clients connect, block in a get
+// with wait, and hang up (sometimes before the reply, sometimes after
+// taking a job) while producers keep putting jobs. Once everyone has gone,
+// every job put and not deleted must be back on its queue: none may be
+// lost to a waiter that left just as it was handed one.
+func TestWaitersJoinAndLeaveDuringPuts(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    conns := newTestConnTable()
+
+    const producers, consumers, rounds = 4, 16, 50
+    var put, deleted atomic.Int64
+    var wg sync.WaitGroup
+    for p := 0; p < producers; p++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < rounds*consumers/producers; i++ {
+                jc.put("q", 1, json.RawMessage(`{}`))
+                put.Add(1)
+                if i%8 == 0 {
+                    time.Sleep(time.Millisecond)
+                }
+            }
+        }()
+    }
+    for n := 0; n < consumers; n++ {
+        rng := rand.New(rand.NewSource(int64(n)))
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < rounds; i++ {
+                rc := startRaceClient(t, jc, conns)
+                switch rng.Intn(3) {
+                case 0:
+                    // Ask, and leave without waiting for the answer.
+                    rc.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+                    fmt.Fprintln(rc.conn, `{"request":"get","queues":["q"],"wait":true}`)
+                case 1:
+                    // Take a job and leave holding it.
+                    rc.request(`{"request":"get","queues":["q"],"wait":true}`)
+                case 2:
+                    // Take a job and finish it.
+                    resp, err := rc.request(`{"request":"get","queues":["q"],"wait":true}`)
+                    if err == nil && resp.Status == "ok" {
+                        del, err := rc.request(fmt.Sprintf(`{"request":"delete","id":%d}`, resp.ID))
+                        if err == nil && del.Status == "ok" {
+                            deleted.Add(1)
+                        }
+                    }
+                }
+                rc.conn.Close()
+                select {
+                case <-rc.handled:
+                case <-time.After(5 * time.Second):
+                    t.Error("handler still running after its client hung up")
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+
+    checkConsistent(t, jc)
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+    if want := put.Load() - deleted.Load(); int64(len(jc.jobs)) != want {
+        t.Errorf("%d live jobs, want %d put less %d deleted", len(jc.jobs), put.Load(), deleted.Load())
+    } else if q := jc.queues["q"]; want > 0 && (q == nil || int64(q.Len()) != want) {
+        t.Errorf("not every live job is back on its queue")
+    }
+    if len(jc.waiters) != 0 {
+        t.Errorf("%d queues still have waiters with every client gone", len(jc.waiters))
+    }
+}
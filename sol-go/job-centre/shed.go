@@ -0,0 +1,297 @@
+package main
+
+import (
+    "cmp"
+    "expvar"
+    "fmt"
+    "math"
+    "runtime"
+    "runtime/metrics"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "../../lib-go/clock"
+)
+
+// Load counters, published on the admin listener at /debug/vars.
+var (
+    loadStats       = expvar.NewMap("load")
+    statPauses      = new(expvar.Int) // times the accept loop paused
+    statPausedMs    = new(expvar.Int) // total time spent paused
+    statShed        = new(expvar.Int) // connections dropped by the memory guard
+    statReaped      = new(expvar.Int) // connections closed by the idle reaper
+    statRefused     = new(expvar.Int) // connections closed unserved during a pause
+    statConnections = new(expvar.Int)
+)
+
+func init() {
+    loadStats.Set("pauses", statPauses)
+    loadStats.Set("paused_ms", statPausedMs)
+    loadStats.Set("shed", statShed)
+    loadStats.Set("reaped", statReaped)
+    loadStats.Set("refused", statRefused)
+    loadStats.Set("connections", statConnections)
+}
+
+// acceptGate pauses the accept loop while any of its causes (the
+// connection limit, the memory budget) holds it, and resumes it once the
+// last one releases it. Connections arriving meanwhile wait in the listen
+// backlog.
+type acceptGate struct {
+    mu       sync.Mutex
+    causes   map[string]string // cause -> why it is holding the gate
+    resume   chan struct{}     // closed when the gate opens again
+    pausedAt time.Time
+    clock    clock.Clock
+}
+
+func newAcceptGate(clk clock.Clock) *acceptGate {
+    g := &acceptGate{causes: make(map[string]string), clock: clk}
+    loadStats.Set("paused", expvar.Func(func() any { return g.reason() }))
+    return g
+}
+
+// hold pauses accepting for cause; why is logged and reported.
+func (g *acceptGate) hold(cause, why string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if _, held := g.causes[cause]; held {
+        g.causes[cause] = why
+        return
+    }
+    g.causes[cause] = why
+    if len(g.causes) == 1 {
+        g.resume = make(chan struct{})
+        g.pausedAt = g.clock.Now()
+        statPauses.Add(1)
+    }
+    fmt.Printf("[PAUSED] Not accepting: %s\n", why)
+}
+
+// release drops cause's hold, resuming accepts if no other cause holds.
+func (g *acceptGate) release(cause string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if _, held := g.causes[cause]; !held {
+        return
+    }
+    delete(g.causes, cause)
+    if len(g.causes) > 0 {
+        return
+    }
+    paused := g.clock.Since(g.pausedAt)
+    statPausedMs.Add(paused.Milliseconds())
+    close(g.resume)
+    g.resume = nil
+    fmt.Printf("[RESUMED] Accepting again after %v, %s back under the limit\n", paused.Round(time.Millisecond), cause)
+}
+
+// reason describes what is holding the gate, or "" if it is open.
+func (g *acceptGate) reason() string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    whys := make([]string, 0, len(g.causes))
+    for _, why := range g.causes {
+        whys = append(whys, why)
+    }
+    slices.Sort(whys)
+    return strings.Join(whys, "; ")
+}
+
+// held reports whether the gate is held.
+func (g *acceptGate) held() bool {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.resume != nil
+}
+
+// wait blocks while the gate is held. It reports false if stop was closed
+// first.
+func (g *acceptGate) wait(stop <-chan struct{}) bool {
+    g.mu.Lock()
+    resume := g.resume
+    g.mu.Unlock()
+    if resume == nil {
+        return true
+    }
+    select {
+    case <-resume:
+        return true
+    case <-stop:
+        return false
+    }
+}
+
+// connTable tracks every connected client by ID, so the shedder and the
+// admin endpoints can pick which ones to drop. With max set, it holds the
+// gate once max connections count towards the limit, and releases it when
+// they drop to resumeAt. Exempt connections don't count.
+type connTable struct {
+    mu      sync.Mutex
+    clients map[int64]*client
+    limited int
+
+    gate     *acceptGate
+    max      int
+    resumeAt int
+}
+
+// tryAdd adds c unless that would take it past the connection limit.
+// Exempt clients are always added.
+func (t *connTable) tryAdd(c *client) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if !c.exempt {
+        if t.max > 0 && t.limited >= t.max {
+            return false
+        }
+        t.limited++
+    }
+    t.clients[c.id] = c
+    statConnections.Set(int64(len(t.clients)))
+    if t.max > 0 && t.limited >= t.max {
+        t.gate.hold("connections", fmt.Sprintf("%d connections, at the %d limit", t.limited, t.max))
+    }
+    return true
+}
+
+// admit waits for the gate and adds c. It reports false if stop was
+// closed first.
+func (t *connTable) admit(c *client, stop <-chan struct{}) bool {
+    for {
+        if !c.exempt && !t.gate.wait(stop) {
+            return false
+        }
+        if t.tryAdd(c) {
+            return true
+        }
+    }
+}
+
+// admitNow adds c if it can without waiting: c is exempt, or the gate is
+// open and the limit allows it.
+func (t *connTable) admitNow(c *client) bool {
+    if !c.exempt && t.gate.held() {
+        return false
+    }
+    return t.tryAdd(c)
+}
+
+func (t *connTable) remove(c *client) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.clients, c.id)
+    if !c.exempt {
+        t.limited--
+    }
+    statConnections.Set(int64(len(t.clients)))
+    if t.max > 0 && t.limited <= t.resumeAt {
+        t.gate.release("connections")
+    }
+}
+
+// idlest returns up to n clients with no request in progress, the ones
+// that have been quiet longest first. Exempt clients are never chosen.
+func (t *connTable) idlest(n int) []*client {
+    t.mu.Lock()
+    idle := make([]*client, 0, len(t.clients))
+    for _, c := range t.clients {
+        if !c.busy.Load() && !c.exempt {
+            idle = append(idle, c)
+        }
+    }
+    t.mu.Unlock()
+
+    slices.SortFunc(idle, func(a, b *client) int {
+        return cmp.Compare(a.lastActive.Load(), b.lastActive.Load())
+    })
+    return idle[:min(n, len(idle))]
+}
+
+// heapBytes reads the bytes of heap objects, live or not yet swept.
+func heapBytes() uint64 {
+    sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+    metrics.Read(sample)
+    return sample[0].Value.Uint64()
+}
+
+// memoryGuard keeps the heap under a budget: while it is over, the accept
+// gate is held and the idlest clients are shed, rather than the process
+// growing until the OOM killer ends every session at once. Accepting
+// resumes once the heap is down to resumeAt.
+type memoryGuard struct {
+    budget   uint64
+    resumeAt uint64
+    conns    *connTable
+    gate     *acceptGate
+    clock    clock.Clock
+}
+
+// check sheds a tenth of the idle clients if the heap is over budget.
+// Garbage counts towards the heap until it is swept, so it collects first
+// and only sheds if live data alone is over.
+func (g *memoryGuard) check() {
+    heap := heapBytes()
+    if heap > g.budget {
+        runtime.GC()
+        heap = heapBytes()
+    }
+    if heap <= g.resumeAt {
+        g.gate.release("memory")
+    }
+    if heap <= g.budget {
+        return
+    }
+
+    g.gate.hold("memory", fmt.Sprintf("heap %d MiB is over the %d MiB budget", heap>>20, g.budget>>20))
+    g.conns.mu.Lock()
+    n := max(1, g.conns.limited/10)
+    g.conns.mu.Unlock()
+    for _, c := range g.conns.idlest(n) {
+        idle := c.idle().Round(time.Millisecond)
+        statShed.Add(1)
+        c.shed(fmt.Sprintf("idle for %v while heap %d MiB is over the %d MiB budget", idle, heap>>20, g.budget>>20))
+    }
+}
+
+func (g *memoryGuard) run(interval time.Duration) {
+    for range g.clock.NewTicker(interval).C() {
+        g.check()
+    }
+}
+
+// idleReaper closes connections that have sent nothing for timeout. A
+// client with a request in progress (a get waiting for a job) or with jobs
+// it is working on is quiet for a reason and is left alone, as are exempt
+// clients.
+type idleReaper struct {
+    conns   *connTable
+    timeout time.Duration
+    clock   clock.Clock
+}
+
+func (r *idleReaper) check() {
+    for _, c := range r.conns.idlest(math.MaxInt) {
+        idle := c.idle()
+        if idle < r.timeout {
+            return // the rest have been quiet for less
+        }
+        c.jc.mu.Lock()
+        jobs := len(c.working)
+        c.jc.mu.Unlock()
+        if jobs > 0 {
+            continue
+        }
+        statReaped.Add(1)
+        fmt.Printf("[REAPED] %s (conn %d): idle for %v\n", c.addr, c.id, idle.Round(time.Millisecond))
+        c.conn.Close()
+    }
+}
+
+func (r *idleReaper) run() {
+    for range r.clock.NewTicker(max(r.timeout/4, 100*time.Millisecond)).C() {
+        r.check()
+    }
+}
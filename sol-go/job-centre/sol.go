@@ -0,0 +1,1139 @@
+package main
+
+import (
+    "cmp"
+    "container/heap"
+    "context"
+    "encoding/json"
+    "errors"
+    "expvar"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "runtime"
+    "runtime/debug"
+    "slices"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/quota"
+    "../../lib-go/signals"
+)
+
+// job is a single job. While it is queued, index is its position in its
+// queue's heap; while a client works on it, worker is set and index is -1.
+type job struct {
+    id      int64
+    pri     int64
+    queue   string
+    payload json.RawMessage
+
+    worker *client
+    index  int
+}
+
+// jobQueue is a max-heap of jobs by priority (ties go to the older job).
+// Each job tracks its own index, so any job can be removed in O(log n).
+type jobQueue []*job
+
+func (q jobQueue) Len() int { return len(q) }
+
+func (q jobQueue) Less(i, j int) bool { return before(q[i], q[j]) }
+
+// before reports whether a should be handed out before b.
+func before(a, b *job) bool {
+    if a.pri != b.pri {
+        return a.pri > b.pri
+    }
+    return a.id < b.id
+}
+
+func (q jobQueue) Swap(i, j int) {
+    q[i], q[j] = q[j], q[i]
+    q[i].index = i
+    q[j].index = j
+}
+
+func (q *jobQueue) Push(x any) {
+    j := x.(*job)
+    j.index = len(*q)
+    *q = append(*q, j)
+}
+
+func (q *jobQueue) Pop() any {
+    old := *q
+    j := old[len(old)-1]
+    old[len(old)-1] = nil
+    j.index = -1
+    *q = old[:len(old)-1]
+    return j
+}
+
+// waiter is a client blocked in a get with wait=true. The job handed to it
+// is sent on ch. It is in the waiterQueue of every queue it waits on until
+// it is served or cancelled; then it is removed from all of them and done
+// is set.
+type waiter struct {
+    c      *client
+    queues []string // without duplicates
+    ch     chan *job
+    done   bool
+    index  map[*waiterQueue]int // its position in each waiterQueue
+
+    seq int64 // arrival order
+    pri int64 // the get request's optional "pri", for wakePriority
+}
+
+// wakeupPolicy decides which waiting client gets a newly available job.
+type wakeupPolicy int
+
+const (
+    // wakeFIFO wakes the client that has been waiting longest.
+    wakeFIFO wakeupPolicy = iota
+    // wakePriority wakes the client whose get carried the highest "pri",
+    // falling back to arrival order between equal priorities.
+    wakePriority
+)
+
+func parseWakeupPolicy(s string) (wakeupPolicy, error) {
+    switch s {
+    case "fifo":
+        return wakeFIFO, nil
+    case "priority":
+        return wakePriority, nil
+    }
+    return 0, fmt.Errorf("unknown wakeup policy %q (want fifo or priority)", s)
+}
+
+// waiterQueue is a heap of the clients waiting on one queue, ordered by
+// the wakeup policy. Ties always go to the earliest arrival, so a waiter
+// can only be overtaken by one that asked with a higher priority.
+type waiterQueue struct {
+    policy wakeupPolicy
+    ws     []*waiter
+}
+
+func (q *waiterQueue) Len() int { return len(q.ws) }
+
+func (q *waiterQueue) Less(i, j int) bool {
+    a, b := q.ws[i], q.ws[j]
+    if q.policy == wakePriority && a.pri != b.pri {
+        return a.pri > b.pri
+    }
+    return a.seq < b.seq
+}
+
+func (q *waiterQueue) Swap(i, j int) {
+    q.ws[i], q.ws[j] = q.ws[j], q.ws[i]
+    q.ws[i].index[q] = i
+    q.ws[j].index[q] = j
+}
+
+func (q *waiterQueue) Push(x any) {
+    w := x.(*waiter)
+    w.index[q] = len(q.ws)
+    q.ws = append(q.ws, w)
+}
+
+func (q *waiterQueue) Pop() any {
+    w := q.ws[len(q.ws)-1]
+    q.ws[len(q.ws)-1] = nil
+    q.ws = q.ws[:len(q.ws)-1]
+    delete(w.index, q)
+    return w
+}
+
+// --- Journal ---
+
+// journalRecord is one line of the journal.
+type journalRecord struct {
+    Op    string          `json:"op"` // "next", "put", "delete" or "abort"
+    ID    int64           `json:"id"`
+    Queue string          `json:"queue,omitempty"`
+    Pri   int64           `json:"pri,omitempty"`
+    Job   json.RawMessage `json:"job,omitempty"`
+}
+
+// journal is an append-only JSON-lines log of every put, delete and abort,
+// replayed on start-up so queued jobs survive a crash or deploy.
+// A nil *journal disables persistence.
+type journal struct {
+    f    *os.File
+    enc  *json.Encoder
+    sync bool // fsync after every record
+}
+
+// openJournal replays the journal at path into jc, compacts it down to the
+// jobs still live, and opens it for appending.
+//
+// The compacted journal starts with a "next" record holding the ID the
+// next put will get. Without it the highest ID would only be remembered
+// while its put was still in the journal, and an ID deleted before one
+// compaction would be handed out again after the next.
+//
+// Jobs that were in progress when the server stopped are simply queued
+// again: their workers' connections are gone, which aborts them anyway.
+func openJournal(path string, sync bool, jc *jobCentre) (*journal, error) {
+    if f, err := os.Open(path); err == nil {
+        dec := json.NewDecoder(f)
+        for {
+            var rec journalRecord
+            if err := dec.Decode(&rec); err != nil {
+                // A torn final line from a crash ends the replay.
+                if !errors.Is(err, io.EOF) {
+                    fmt.Printf("[JOURNAL] Stopped replaying %s: %v\n", path, err)
+                }
+                break
+            }
+            switch rec.Op {
+            case "next":
+                jc.nextID = max(jc.nextID, rec.ID-1)
+            case "put":
+                j := &job{id: rec.ID, pri: rec.Pri, queue: rec.Queue, payload: rec.Job, index: -1}
+                jc.jobs[j.id] = j
+                jc.enqueue(j)
+                jc.nextID = max(jc.nextID, rec.ID)
+            case "delete":
+                jc.deleteLocked(rec.ID)
+            }
+        }
+        f.Close()
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return nil, err
+    }
+
+    // Compact: rewrite the journal with one put per live job, in ID order
+    // so replaying it again assigns the same order within a priority.
+    tmp := path + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return nil, err
+    }
+    jl := &journal{f: f, enc: json.NewEncoder(f), sync: sync}
+    if err := jl.enc.Encode(journalRecord{Op: "next", ID: jc.nextID + 1}); err != nil {
+        f.Close()
+        return nil, err
+    }
+    ids := make([]int64, 0, len(jc.jobs))
+    for id := range jc.jobs {
+        ids = append(ids, id)
+    }
+    slices.Sort(ids)
+    for _, id := range ids {
+        j := jc.jobs[id]
+        if err := jl.enc.Encode(journalRecord{Op: "put", ID: j.id, Queue: j.queue, Pri: j.pri, Job: j.payload}); err != nil {
+            f.Close()
+            return nil, err
+        }
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return nil, err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        f.Close()
+        return nil, err
+    }
+    return jl, nil
+}
+
+// write appends a record. The caller must hold jc.mu, which keeps the
+// journal in the same order as the state changes.
+func (jl *journal) write(rec journalRecord) {
+    if jl == nil {
+        return
+    }
+    err := jl.enc.Encode(rec)
+    if err == nil && jl.sync {
+        err = jl.f.Sync()
+    }
+    if err != nil {
+        fmt.Printf("[ERROR] Writing journal: %v\n", err)
+    }
+}
+
+// jobCentre is the state shared by all clients, guarded by mu.
+type jobCentre struct {
+    mu      sync.Mutex
+    nextID  int64
+    journal *journal
+
+    // jobs indexes every live job (queued or in progress) by ID.
+    jobs map[int64]*job
+
+    // queues maps a queue name to its heap of ready jobs.
+    queues map[string]*jobQueue
+
+    // waiters maps a queue name to the clients waiting on it, in wakeup
+    // order. A waiter on several queues appears in each until it is done.
+    // Queues without waiters have no entry.
+    waiters   map[string]*waiterQueue
+    policy    wakeupPolicy
+    waiterSeq int64
+    waiting   int // waiters not yet done
+
+    // quota bounds the jobs held (Items), the gets waiting (Pending), line
+    // length and session length. The zero Quota is no limits.
+    quota quota.Quota
+
+    // clock times how long clients have been idle.
+    clock clock.Clock
+}
+
+func newJobCentre(policy wakeupPolicy, clk clock.Clock) *jobCentre {
+    return &jobCentre{
+        jobs:    make(map[int64]*job),
+        queues:  make(map[string]*jobQueue),
+        waiters: make(map[string]*waiterQueue),
+        policy:  policy,
+        clock:   clk,
+    }
+}
+
+// enqueue makes j available: directly to a waiting client if there is one,
+// otherwise by pushing it onto its queue. The caller must hold jc.mu.
+func (jc *jobCentre) enqueue(j *job) {
+    if ws := jc.waiters[j.queue]; ws != nil {
+        // Withdrawing the waiter from every queue before handing over the
+        // job means no other queue can give it a second one.
+        w := ws.ws[0]
+        jc.unwait(w)
+        jc.assign(j, w.c)
+        w.ch <- j
+        return
+    }
+
+    q := jc.queues[j.queue]
+    if q == nil {
+        q = &jobQueue{}
+        jc.queues[j.queue] = q
+    }
+    heap.Push(q, j)
+}
+
+// assign marks c as working on j. The caller must hold jc.mu.
+func (jc *jobCentre) assign(j *job, c *client) {
+    j.worker = c
+    c.working[j.id] = j
+}
+
+// put adds a new job and returns its ID, or 0 if the job centre already
+// holds quota.Items jobs.
+func (jc *jobCentre) put(queue string, pri int64, payload json.RawMessage) int64 {
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+
+    if jc.quota.Items > 0 && len(jc.jobs) >= jc.quota.Items {
+        return 0
+    }
+    jc.nextID++
+    j := &job{id: jc.nextID, pri: pri, queue: queue, payload: payload, index: -1}
+    jc.jobs[j.id] = j
+    jc.journal.write(journalRecord{Op: "put", ID: j.id, Queue: queue, Pri: pri, Job: payload})
+    jc.enqueue(j)
+    return j.id
+}
+
+// get assigns c the highest-priority job across queues. If there is none
+// and wait is set, it returns a waiter that will receive the next job put
+// on any of the queues instead; pri orders it under wakePriority. With
+// quota.Pending gets already waiting, it returns neither.
+func (jc *jobCentre) get(c *client, queues []string, wait bool, pri int64) (*job, *waiter) {
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+
+    var best *jobQueue
+    for _, name := range queues {
+        q := jc.queues[name]
+        if q == nil || q.Len() == 0 {
+            continue
+        }
+        if best == nil || before((*q)[0], (*best)[0]) {
+            best = q
+        }
+    }
+
+    if best != nil {
+        j := heap.Pop(best).(*job)
+        if best.Len() == 0 {
+            delete(jc.queues, j.queue)
+        }
+        jc.assign(j, c)
+        return j, nil
+    }
+    if !wait || (jc.quota.Pending > 0 && jc.waiting >= jc.quota.Pending) {
+        return nil, nil
+    }
+
+    jc.waiterSeq++
+    jc.waiting++
+    w := &waiter{
+        c:      c,
+        queues: slices.Compact(slices.Sorted(slices.Values(queues))),
+        ch:     make(chan *job, 1),
+        index:  make(map[*waiterQueue]int, len(queues)),
+        seq:    jc.waiterSeq,
+        pri:    pri,
+    }
+    for _, name := range w.queues {
+        ws := jc.waiters[name]
+        if ws == nil {
+            ws = &waiterQueue{policy: jc.policy}
+            jc.waiters[name] = ws
+        }
+        heap.Push(ws, w)
+    }
+    return nil, w
+}
+
+// cancel withdraws a waiter that is no longer interested (the client went
+// away). It may have been served already.
+func (jc *jobCentre) cancel(w *waiter) {
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+    if !w.done {
+        jc.unwait(w)
+    }
+}
+
+// unwait removes w from every queue it waits on and marks it done. The
+// caller must hold jc.mu.
+func (jc *jobCentre) unwait(w *waiter) {
+    for _, name := range w.queues {
+        ws := jc.waiters[name]
+        heap.Remove(ws, w.index[ws])
+        if ws.Len() == 0 {
+            delete(jc.waiters, name)
+        }
+    }
+    w.done = true
+    jc.waiting--
+}
+
+// delete removes a job wherever it is. It reports whether the job existed.
+func (jc *jobCentre) delete(id int64) bool {
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+
+    if !jc.deleteLocked(id) {
+        return false
+    }
+    jc.journal.write(journalRecord{Op: "delete", ID: id})
+    return true
+}
+
+func (jc *jobCentre) deleteLocked(id int64) bool {
+    j, ok := jc.jobs[id]
+    if !ok {
+        return false
+    }
+    delete(jc.jobs, id)
+
+    if j.worker != nil {
+        delete(j.worker.working, id)
+        j.worker = nil
+    } else if q := jc.queues[j.queue]; q != nil && j.index >= 0 {
+        heap.Remove(q, j.index)
+        if q.Len() == 0 {
+            delete(jc.queues, j.queue)
+        }
+    }
+    return true
+}
+
+// abort returns a job c is working on to its queue. It reports false if c
+// is not working on the job.
+func (jc *jobCentre) abort(c *client, id int64) bool {
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+    return jc.abortLocked(c, id)
+}
+
+func (jc *jobCentre) abortLocked(c *client, id int64) bool {
+    j, ok := c.working[id]
+    if !ok {
+        return false
+    }
+    delete(c.working, id)
+    j.worker = nil
+    jc.journal.write(journalRecord{Op: "abort", ID: id})
+    jc.enqueue(j)
+    return true
+}
+
+// disconnect aborts every job c was working on.
+// "all jobs that a client is working on are automatically aborted when
+// that client disconnects"
+func (jc *jobCentre) disconnect(c *client) {
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+    for id := range c.working {
+        jc.abortLocked(c, id)
+    }
+}
+
+// --- Inspection ---
+
+// queueStatus describes one queue for the admin endpoint and SIGUSR1 dump.
+type queueStatus struct {
+    Name    string `json:"name"`
+    Depth   int    `json:"depth"`
+    TopPri  int64  `json:"top_pri"`
+    Waiters int    `json:"waiters"`
+}
+
+// workStatus describes one job a client is working on.
+type workStatus struct {
+    ID     int64  `json:"id"`
+    Queue  string `json:"queue"`
+    Pri    int64  `json:"pri"`
+    Worker string `json:"worker"`
+}
+
+type centreStatus struct {
+    Queues     []queueStatus `json:"queues"`
+    InProgress []workStatus  `json:"in_progress"`
+}
+
+// status takes a consistent snapshot of every queue and assignment.
+func (jc *jobCentre) status() centreStatus {
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+
+    byName := make(map[string]*queueStatus)
+    named := func(name string) *queueStatus {
+        qs := byName[name]
+        if qs == nil {
+            qs = &queueStatus{Name: name}
+            byName[name] = qs
+        }
+        return qs
+    }
+    for name, q := range jc.queues {
+        qs := named(name)
+        qs.Depth = q.Len()
+        qs.TopPri = (*q)[0].pri
+    }
+    for name, ws := range jc.waiters {
+        named(name).Waiters = ws.Len()
+    }
+
+    st := centreStatus{Queues: []queueStatus{}, InProgress: []workStatus{}}
+    for _, qs := range byName {
+        st.Queues = append(st.Queues, *qs)
+    }
+    slices.SortFunc(st.Queues, func(a, b queueStatus) int { return strings.Compare(a.Name, b.Name) })
+
+    for _, j := range jc.jobs {
+        if j.worker != nil {
+            st.InProgress = append(st.InProgress, workStatus{ID: j.id, Queue: j.queue, Pri: j.pri, Worker: j.worker.addr})
+        }
+    }
+    slices.SortFunc(st.InProgress, func(a, b workStatus) int { return cmp.Compare(a.ID, b.ID) })
+    return st
+}
+
+// dump prints the status, for SIGUSR1.
+func (st centreStatus) dump() {
+    fmt.Printf("[DUMP] %d queues, %d jobs in progress\n", len(st.Queues), len(st.InProgress))
+    for _, q := range st.Queues {
+        fmt.Printf("[DUMP] queue %q depth=%d top_pri=%d waiters=%d\n", q.Name, q.Depth, q.TopPri, q.Waiters)
+    }
+    for _, w := range st.InProgress {
+        fmt.Printf("[DUMP] job %d (queue %q, pri %d) held by %s\n", w.ID, w.Queue, w.Pri, w.Worker)
+    }
+}
+
+// --- Protocol ---
+
+// response is every message the server sends; unused fields are omitted.
+type response struct {
+    Status string          `json:"status"`
+    ID     int64           `json:"id,omitempty"`
+    Job    json.RawMessage `json:"job,omitempty"`
+    Pri    *int64          `json:"pri,omitempty"`
+    Queue  string          `json:"queue,omitempty"`
+    Error  string          `json:"error,omitempty"`
+}
+
+func errorResponse(msg string) response {
+    return response{Status: "error", Error: msg}
+}
+
+// request holds the raw fields of a request, validated per request type.
+type request map[string]json.RawMessage
+
+func (r request) string(key string) (string, bool) {
+    var s string
+    raw, ok := r[key]
+    if !ok || json.Unmarshal(raw, &s) != nil {
+        return "", false
+    }
+    return s, true
+}
+
+// int returns a non-negative integer field. Floats such as 1.5 are rejected.
+func (r request) int(key string) (int64, bool) {
+    var n int64
+    raw, ok := r[key]
+    if !ok || json.Unmarshal(raw, &n) != nil || n < 0 {
+        return 0, false
+    }
+    return n, true
+}
+
+func (r request) strings(key string) ([]string, bool) {
+    var s []string
+    raw, ok := r[key]
+    if !ok || json.Unmarshal(raw, &s) != nil || s == nil {
+        return nil, false
+    }
+    return s, true
+}
+
+// object returns a field that must be a JSON object.
+func (r request) object(key string) (json.RawMessage, bool) {
+    var m map[string]json.RawMessage
+    raw, ok := r[key]
+    if !ok || json.Unmarshal(raw, &m) != nil || m == nil {
+        return nil, false
+    }
+    return raw, true
+}
+
+// client is a single connection.
+type client struct {
+    id   int64
+    conn net.Conn
+    addr string
+    jc   *jobCentre
+
+    // working holds the jobs this client is working on, guarded by jc.mu.
+    working map[int64]*job
+
+    // closed is closed when the connection's read side ends, so a blocked
+    // get can give up.
+    closed chan struct{}
+
+    // ctx is cancelled when the connection is force-closed or its handler
+    // returns. Work done for the client, such as a blocked get, stops on
+    // it without waiting for a read to fail.
+    ctx    context.Context
+    cancel context.CancelFunc
+
+    // exempt clients come from an -exempt address and are never limited
+    // or shed.
+    exempt bool
+
+    // busy is set while a request is being handled, and lastActive (unix
+    // nanoseconds) is when the last one arrived or was answered; the
+    // memory guard sheds the idlest clients first.
+    busy       atomic.Bool
+    lastActive atomic.Int64
+
+    // shedding is closed to make the client hang up, with shedReason.
+    shedOnce   sync.Once
+    shedding   chan struct{}
+    shedReason string
+}
+
+// touch records activity on the connection now.
+func (c *client) touch() {
+    c.lastActive.Store(c.jc.clock.Now().UnixNano())
+}
+
+// idle returns how long the connection has been quiet.
+func (c *client) idle() time.Duration {
+    return c.jc.clock.Since(time.Unix(0, c.lastActive.Load()))
+}
+
+// shed asks the client's handler to drop the connection.
+func (c *client) shed(reason string) {
+    c.shedOnce.Do(func() {
+        c.shedReason = reason
+        close(c.shedding)
+    })
+}
+
+// handleRequest processes one request line and returns the response.
+func (c *client) handleRequest(line []byte) response {
+    var req request
+    if err := json.Unmarshal(line, &req); err != nil || req == nil {
+        return errorResponse("Invalid JSON")
+    }
+
+    kind, _ := req.string("request")
+    switch kind {
+    case "put":
+        queue, ok1 := req.string("queue")
+        pri, ok2 := req.int("pri")
+        payload, ok3 := req.object("job")
+        if !ok1 || !ok2 || !ok3 {
+            return errorResponse("Invalid arguments for 'put'")
+        }
+        id := c.jc.put(queue, pri, payload)
+        if id == 0 {
+            return errorResponse("Too many jobs")
+        }
+        return response{Status: "ok", ID: id}
+
+    case "get":
+        queues, ok := req.strings("queues")
+        if !ok {
+            return errorResponse("Invalid arguments for 'get'")
+        }
+        var wait bool
+        if raw, ok := req["wait"]; ok && json.Unmarshal(raw, &wait) != nil {
+            return errorResponse("Invalid arguments for 'get'")
+        }
+        // "pri" on a get is an extension used by the priority wakeup policy.
+        var pri int64
+        if _, ok := req["pri"]; ok {
+            if pri, ok = req.int("pri"); !ok {
+                return errorResponse("Invalid arguments for 'get'")
+            }
+        }
+
+        j, w := c.jc.get(c, queues, wait, pri)
+        if w != nil {
+            select {
+            case j = <-w.ch:
+            case <-c.closed:
+            case <-c.ctx.Done():
+            }
+            if j == nil {
+                c.jc.cancel(w)
+                // A job may have been handed over just before the cancel;
+                // disconnect will abort it.
+                return response{Status: "no-job"}
+            }
+        }
+        if j == nil {
+            return response{Status: "no-job"}
+        }
+        jobPri := j.pri
+        return response{Status: "ok", ID: j.id, Job: j.payload, Pri: &jobPri, Queue: j.queue}
+
+    case "delete", "abort":
+        id, ok := req.int("id")
+        if !ok {
+            return errorResponse(fmt.Sprintf("Invalid arguments for '%s'", kind))
+        }
+        var found bool
+        if kind == "delete" {
+            found = c.jc.delete(id)
+        } else {
+            found = c.jc.abort(c, id)
+        }
+        if !found {
+            return response{Status: "no-job"}
+        }
+        return response{Status: "ok"}
+
+    default:
+        return errorResponse("Unknown request type")
+    }
+}
+
+// lastClientID numbers connections for the log and the admin endpoints.
+var lastClientID atomic.Int64
+
+func newClient(jc *jobCentre, conn net.Conn) *client {
+    ctx, cancel := context.WithCancel(context.Background())
+    c := &client{
+        id:       lastClientID.Add(1),
+        conn:     conn,
+        addr:     conn.RemoteAddr().String(),
+        jc:       jc,
+        working:  make(map[int64]*job),
+        closed:   make(chan struct{}),
+        ctx:      ctx,
+        cancel:   cancel,
+        shedding: make(chan struct{}),
+    }
+    c.touch()
+    return c
+}
+
+// overloadResponse is what a shed client is told before it is hung up on.
+var overloadResponse = errorResponse("Server overloaded, please reconnect later")
+
+// rejectOverloaded sends overloadResponse and closes the connection
+// gently: the write side is shut first and anything the client still
+// sends is read and dropped for a moment, so closing with unread data
+// does not reset the connection and lose the response.
+func (c *client) rejectOverloaded(enc *json.Encoder, lines <-chan []byte) {
+    c.conn.SetDeadline(time.Now().Add(time.Second))
+    if enc.Encode(overloadResponse) == nil {
+        if tcp, ok := c.conn.(*net.TCPConn); ok {
+            tcp.CloseWrite()
+        }
+    }
+    for {
+        select {
+        case <-lines:
+        case <-c.closed:
+            return
+        }
+    }
+}
+
+// scanBuffers recycles the 64 KiB line buffers, which are most of what a
+// short-lived connection allocates.
+var scanBuffers = sync.Pool{New: func() any {
+    b := make([]byte, 64*1024)
+    return &b
+}}
+
+// handleClient handles a single client connection, already added to conns.
+func handleClient(c *client, conns *connTable) {
+    jc, conn := c.jc, c.conn
+    fmt.Printf("[NEW CONNECTION] %s connected (conn %d).\n", c.addr, c.id)
+
+    defer func() {
+        c.cancel()
+        conns.remove(c)
+        jc.disconnect(c)
+        conn.Close()
+        fmt.Printf("[DISCONNECTED] %s disconnected.\n", c.addr)
+    }()
+
+    // A client still connected after quota.Session is closed as by
+    // /debug/conns/close, so any jobs it holds go back to their queues.
+    if d := jc.quota.Session; d > 0 {
+        t := jc.clock.AfterFunc(d, func() { c.forceClose(fmt.Sprintf("connected for the %v session limit", d)) })
+        defer t.Stop()
+    }
+
+    // Lines are read on their own goroutine so that a get blocked waiting
+    // for a job still notices the client disconnecting. done tells it the
+    // handler has returned and will take no more lines.
+    lines := make(chan []byte)
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        defer close(c.closed)
+        buf := scanBuffers.Get().(*[]byte)
+        defer scanBuffers.Put(buf)
+        scanner := jc.quota.NewScanner(conn, *buf)
+        for scanner.Scan() {
+            line := append([]byte(nil), scanner.Bytes()...)
+            select {
+            case lines <- line:
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    enc := json.NewEncoder(conn)
+    for {
+        var line []byte
+        select {
+        case line = <-lines:
+        case <-c.closed:
+            return
+        case <-c.ctx.Done():
+            return
+        case <-c.shedding:
+            fmt.Printf("[SHED] %s: %s\n", c.addr, c.shedReason)
+            c.rejectOverloaded(enc, lines)
+            return
+        }
+
+        c.busy.Store(true)
+        c.touch()
+        resp := audit.handle(line, c.handleRequest)
+        if resp.Status == "error" {
+            errorCount.Add(1)
+        }
+        err := enc.Encode(resp)
+        c.touch()
+        c.busy.Store(false)
+        if err != nil {
+            errorCount.Add(1)
+            fmt.Printf("[ERROR] Write error with %s: %v\n", c.addr, err)
+            return
+        }
+    }
+}
+
+// config holds the server's start-up options.
+type config struct {
+    host   string
+    port   string
+    policy wakeupPolicy
+
+    // If journalPath is set, jobs are journaled there and restored on
+    // start-up.
+    journalPath string
+    journalSync bool
+
+    // If adminAddr is set, queue status is served there at /debug/vars and
+    // the connection table at /debug/conns (see admin.go).
+    adminAddr string
+
+    // If maxConns is set, accepting pauses at that many connections.
+    maxConns int
+
+    // If memBudget (bytes) is set, the heap is checked against it every
+    // memInterval; see memoryGuard.
+    memBudget   uint64
+    memInterval time.Duration
+
+    // resumeAt is the fraction of maxConns and memBudget that load must
+    // drop to before paused accepts resume.
+    resumeAt float64
+
+    // If idleTimeout is set, clients quiet for that long are closed; see
+    // idleReaper.
+    idleTimeout time.Duration
+
+    // Clients from exempt addresses skip all of the above.
+    exempt ipNets
+
+    // If filterPath is set, connections from addresses it denies are
+    // closed as soon as they are accepted; see addrFilter.
+    filterPath string
+
+    // hooks are called when the accept or error rate per second crosses
+    // acceptAlert or errorAlert (0 disables each).
+    hooks       hooks
+    acceptAlert float64
+    errorAlert  float64
+
+    // Stats snapshots (SIGUSR2 or POST /debug/dump) are written to dumpDir.
+    dumpDir string
+
+    // memLimit (bytes) and gcPercent, if set, override GOMEMLIMIT and GOGC.
+    memLimit  int64
+    gcPercent int
+
+    // quota is the limits from the -max-* flags; see jobCentre.quota.
+    quota quota.Quota
+
+    // clock times idle clients, pauses and the periodic checks.
+    clock clock.Clock
+}
+
+// tuneRuntime applies the GC settings. On a small VPS the default of
+// letting the heap double between collections can overshoot the machine,
+// while collecting too eagerly shows up as latency spikes.
+func tuneRuntime(cfg config) {
+    if cfg.memLimit > 0 {
+        debug.SetMemoryLimit(cfg.memLimit)
+        fmt.Printf("[RUNTIME] Memory limit %d MiB\n", cfg.memLimit>>20)
+    }
+    if cfg.gcPercent != 0 {
+        debug.SetGCPercent(cfg.gcPercent)
+        fmt.Printf("[RUNTIME] GC percent %d\n", cfg.gcPercent)
+    }
+}
+
+// refuse closes a connection that arrived while accepting is paused.
+func refuse(conn net.Conn, why string) {
+    statRefused.Add(1)
+    fmt.Printf("[REFUSED] %s: not accepting, %s\n", conn.RemoteAddr(), why)
+    conn.Close()
+}
+
+// startServer runs the server.
+func startServer(cfg config) {
+    tuneRuntime(cfg)
+    jc := newJobCentre(cfg.policy, cfg.clock)
+    jc.quota = cfg.quota
+    if cfg.journalPath != "" {
+        jl, err := openJournal(cfg.journalPath, cfg.journalSync, jc)
+        if err != nil {
+            fmt.Printf("[ERROR] Could not open journal: %v\n", err)
+            return
+        }
+        jc.journal = jl
+        fmt.Printf("[JOURNAL] Restored %d jobs from %s\n", len(jc.jobs), cfg.journalPath)
+    }
+
+    expvar.Publish("jobcentre", expvar.Func(func() any { return jc.status() }))
+    expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+
+    // SIGUSR1 prints the same status to the log. Windows has no user
+    // signals; /debug/vars and /debug/dump do their jobs there.
+    signals.On(signals.User1, func() { jc.status().dump() })
+
+    var filter *addrFilter
+    if cfg.filterPath != "" {
+        var err error
+        if filter, err = newAddrFilter(cfg.filterPath); err != nil {
+            fmt.Printf("[ERROR] Could not load filter: %v\n", err)
+            return
+        }
+        rules := filter.rules.Load()
+        fmt.Printf("[FILTER] Loaded %s: %d allowed, %d denied networks\n", cfg.filterPath, len(rules.allow), len(rules.deny))
+        // SIGHUP rereads the rules.
+        signals.On(signals.Hangup, filter.reload)
+    }
+
+    go watchRates(cfg.hooks, cfg.acceptAlert, cfg.errorAlert, time.Second, cfg.clock)
+
+    gate := newAcceptGate(cfg.clock)
+    conns := &connTable{
+        clients:  make(map[int64]*client),
+        gate:     gate,
+        max:      cfg.maxConns,
+        resumeAt: int(float64(cfg.maxConns) * cfg.resumeAt),
+    }
+    if cfg.memBudget > 0 {
+        guard := &memoryGuard{
+            budget:   cfg.memBudget,
+            resumeAt: uint64(float64(cfg.memBudget) * cfg.resumeAt),
+            conns:    conns,
+            gate:     gate,
+            clock:    cfg.clock,
+        }
+        go guard.run(cfg.memInterval)
+    }
+    if cfg.idleTimeout > 0 {
+        reaper := &idleReaper{conns: conns, timeout: cfg.idleTimeout, clock: cfg.clock}
+        go reaper.run()
+    }
+
+    // SIGUSR2 writes a full stats snapshot to a file.
+    signals.On(signals.User2, func() {
+        if _, err := writeSnapshot(cfg.dumpDir, conns); err != nil {
+            fmt.Printf("[ERROR] Stats snapshot: %v\n", err)
+        }
+    })
+
+    address := cfg.host + ":" + cfg.port
+    listener := newListenerDrain(address)
+
+    if cfg.adminAddr != "" {
+        // expvar registers /debug/vars on the default mux.
+        http.HandleFunc("/debug/conns", conns.serveList)
+        http.HandleFunc("/debug/conns/close", conns.serveClose)
+        http.HandleFunc("/debug/drain", listener.serveDrain(conns))
+        http.HandleFunc("/debug/undrain", listener.serveUndrain)
+        http.HandleFunc("/debug/dump", serveDump(cfg.dumpDir, conns))
+        go func() {
+            fmt.Printf("[ADMIN] Queue status on http://%s/debug/vars, connections on /debug/conns, drain on /debug/drain\n", cfg.adminAddr)
+            if err := http.ListenAndServe(cfg.adminAddr, nil); err != nil {
+                fmt.Printf("[ERROR] Admin listener: %v\n", err)
+            }
+        }()
+    }
+
+    if err := listener.listen(); err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer listener.close()
+
+    fmt.Printf("[LISTENING] Job Queue Server listening on %s\n", address)
+
+    // Handle graceful shutdown
+    stopping := make(chan struct{})
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        close(stopping)
+        listener.close()
+    })
+
+    for {
+        conn, err := listener.accept(stopping)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            fmt.Printf("[ERROR] Accept error: %v\n", err)
+            continue
+        }
+        acceptCount.Add(1)
+        if !filter.allows(conn.RemoteAddr()) {
+            statFiltered.Add(1)
+            fmt.Printf("[FILTERED] %s refused.\n", conn.RemoteAddr())
+            conn.Close()
+            continue
+        }
+        exempt := cfg.exempt.contains(conn.RemoteAddr())
+        if len(cfg.exempt) > 0 {
+            // The loop can't stop for a pause when the next connection in
+            // the backlog might be exempt, so the others are refused
+            // instead of waiting: a pause costs an accept and a close per
+            // connection, not a goroutine and a socket held open.
+            if !exempt && gate.held() {
+                refuse(conn, gate.reason())
+                continue
+            }
+            c := newClient(jc, conn)
+            c.exempt = exempt
+            if !conns.admitNow(c) {
+                refuse(conn, gate.reason())
+                continue
+            }
+            go handleClient(c, conns)
+            continue
+        }
+        c := newClient(jc, conn)
+
+        // While accepting is paused, the new connection waits unserved
+        // like the ones still in the listen backlog.
+        if !conns.admit(c, stopping) {
+            conn.Close()
+            return
+        }
+        go handleClient(c, conns)
+    }
+}
+
+func main() {
+    cfg := config{host: "0.0.0.0", clock: clock.Real}
+    flag.StringVar(&cfg.port, "port", "65432", "TCP port to listen on")
+    wakeup := flag.String("wakeup", "fifo", "which waiting client gets a new job: fifo or priority (of the get request)")
+    flag.StringVar(&cfg.journalPath, "journal", "", "file to journal jobs to for crash recovery (memory only if empty)")
+    flag.BoolVar(&cfg.journalSync, "journal-sync", false, "fsync the journal after every record")
+    flag.StringVar(&cfg.adminAddr, "admin", "", "address to serve queue status on, e.g. 127.0.0.1:8080 (disabled if empty)")
+    flag.IntVar(&cfg.maxConns, "max-conns", 0, "connections at which accepting pauses (0 = unlimited)")
+    memBudget := flag.Uint64("mem-budget", 0, "heap size in MiB above which new connections wait and idle ones are shed (0 = unlimited)")
+    flag.DurationVar(&cfg.memInterval, "mem-interval", time.Second, "how often the heap is checked against -mem-budget")
+    flag.Float64Var(&cfg.resumeAt, "resume-at", 0.9, "fraction of -max-conns and -mem-budget that load must drop to before accepting resumes")
+    flag.DurationVar(&cfg.idleTimeout, "idle-timeout", 0, "close clients that send nothing for this long, unless waiting on a get or holding jobs (0 = never)")
+    exempt := flag.String("exempt", "", "comma-separated IPs and CIDRs exempt from -max-conns, -mem-budget shedding and paused accepts; while set, other connections are refused during a pause rather than left in the backlog")
+    flag.StringVar(&cfg.dumpDir, "dump-dir", os.TempDir(), "directory stats snapshots are written to on SIGUSR2 or POST /debug/dump")
+    flag.StringVar(&cfg.filterPath, "filter", "", "file of allow/deny CIDR rules for client addresses, reread on SIGHUP (none if empty)")
+    flag.Float64Var(&cfg.acceptAlert, "alert-accept-rate", 0, "connections accepted per second above which to alert (0 = never)")
+    flag.Float64Var(&cfg.errorAlert, "alert-error-rate", 0, "error responses and broken connections per second above which to alert (0 = never)")
+    alertCmd := flag.String("alert-cmd", "", "shell command run when an alert rate is crossed, with ALERT_* variables set")
+    memLimit := flag.Int64("mem-limit", 0, "soft memory limit for the Go runtime in MiB, as GOMEMLIMIT; keep it above -mem-budget (0 = GOMEMLIMIT or none)")
+    flag.IntVar(&cfg.gcPercent, "gc-percent", 0, "GC target percentage, as GOGC; -1 turns the GC off below -mem-limit (0 = GOGC or 100)")
+    q := quota.Flags(flag.CommandLine, "job-centre")
+    flag.Parse()
+
+    policy, err := parseWakeupPolicy(*wakeup)
+    if err != nil {
+        fmt.Printf("[ERROR] %v\n", err)
+        os.Exit(2)
+    }
+    cfg.policy = policy
+    if err := q.Validate(); err != nil {
+        fmt.Printf("[ERROR] %v\n", err)
+        os.Exit(2)
+    }
+    cfg.quota = *q
+    cfg.hooks = hooks{
+        OnAcceptRate: alertHook("accept", *alertCmd),
+        OnErrorRate:  alertHook("error", *alertCmd),
+    }
+    if cfg.exempt, err = parseIPNets(*exempt); err != nil {
+        fmt.Printf("[ERROR] -exempt: %v\n", err)
+        os.Exit(2)
+    }
+    cfg.memBudget = *memBudget << 20
+    cfg.memLimit = *memLimit << 20
+
+    startServer(cfg)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/quota"
+    "../../lib-go/testnet"
+)
+
+// newTestClient returns a client of jc on one end of a net.Pipe, and the
+// other end.
+func newTestClient(t testing.TB, jc *jobCentre) (*client, net.Conn) {
+    t.Helper()
+    server, peer := net.Pipe()
+    t.Cleanup(func() {
+        server.Close()
+        peer.Close()
+    })
+    return newClient(jc, server), peer
+}
+
+func newTestConnTable() *connTable {
+    return &connTable{clients: make(map[int64]*client), gate: newAcceptGate(clock.Real)}
+}
+
+// TestSessionFragmented sends requests a few bytes at a time and expects
+// an answer to each.
+func TestSessionFragmented(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    c := testnet.Pipe(t, func(conn net.Conn) { handleClient(newClient(jc, conn), newTestConnTable()) })
+    c.Fragment(5, 1)
+    c.SendLine(`{"request":"put","queue":"q","job":{"title":"x"},"pri":3}`)
+    c.ExpectLine(`{"status":"ok","id":1}`)
+    c.SendLine(`{"request":"get","queues":["q"]}`)
+    c.ExpectLine(`{"status":"ok","id":1,"job":{"title":"x"},"pri":3,"queue":"q"}`)
+    c.SendLine(`{"request":"delete","id":1}`)
+    c.ExpectLine(`{"status":"ok"}`)
+}
+
+// TestCancelReleasesBlockedGet cancels a client's context while its get
+// waits, without closing the connection: the get gives up and leaves the
+// waiter queue, and the handler hangs up.
+func TestCancelReleasesBlockedGet(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    clients := make(chan *client, 1)
+    c := testnet.Pipe(t, func(conn net.Conn) {
+        cl := newClient(jc, conn)
+        clients <- cl
+        handleClient(cl, newTestConnTable())
+    })
+    cl := <-clients
+    c.SendLine(`{"request":"get","queues":["q"],"wait":true}`)
+    deadline := time.Now().Add(5 * time.Second)
+    for waiting := 0; waiting == 0; {
+        jc.mu.Lock()
+        waiting = len(jc.waiters)
+        jc.mu.Unlock()
+        if time.Now().After(deadline) {
+            t.Fatal("get never started waiting")
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    cl.cancel()
+    c.ExpectLine(`{"status":"no-job"}`)
+    c.ExpectClosed()
+    jc.mu.Lock()
+    defer jc.mu.Unlock()
+    if len(jc.waiters) != 0 {
+        t.Fatal("cancelled get still waiting")
+    }
+}
+
+func TestWaiterLeavesEveryQueueWhenServed(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    c, _ := newTestClient(t, jc)
+
+    _, w := jc.get(c, []string{"a", "b", "a"}, true, 0)
+    if w == nil {
+        t.Fatal("get on empty queues with wait returned no waiter")
+    }
+    jc.put("b", 1, []byte(`{}`))
+
+    select {
+    case j := <-w.ch:
+        if j.queue != "b" {
+            t.Fatalf("waiter got a job from %q, want b", j.queue)
+        }
+    default:
+        t.Fatal("waiter was not handed the job")
+    }
+    if len(jc.waiters) != 0 {
+        t.Fatalf("served waiter still waits on %d queues", len(jc.waiters))
+    }
+
+    // The next job on "a" must be queued, not handed to the old waiter.
+    jc.put("a", 1, []byte(`{}`))
+    if q := jc.queues["a"]; q == nil || q.Len() != 1 {
+        t.Fatal("job put after the waiter was served did not stay queued")
+    }
+}
+
+func TestWaiterLeavesEveryQueueWhenCancelled(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    c1, _ := newTestClient(t, jc)
+    c2, _ := newTestClient(t, jc)
+
+    _, w1 := jc.get(c1, []string{"a", "b"}, true, 0)
+    _, w2 := jc.get(c2, []string{"b", "c"}, true, 0)
+    jc.cancel(w1)
+    jc.cancel(w1) // a second cancel is harmless
+
+    if _, ok := jc.waiters["a"]; ok {
+        t.Fatal("cancelled waiter's only queue still has waiters")
+    }
+    if ws := jc.waiters["b"]; ws == nil || ws.Len() != 1 || ws.ws[0] != w2 {
+        t.Fatal("queue b should hold just the remaining waiter")
+    }
+
+    jc.put("b", 1, []byte(`{}`))
+    if j := <-w2.ch; j.queue != "b" {
+        t.Fatalf("remaining waiter got a job from %q, want b", j.queue)
+    }
+    jc.cancel(w2) // already served: nothing to remove
+    if len(jc.waiters) != 0 {
+        t.Fatalf("%d queues still have waiters", len(jc.waiters))
+    }
+}
+
+// failWrites is a connection whose writes fail while reads carry on.
+type failWrites struct {
+    net.Conn
+}
+
+func (failWrites) Write([]byte) (int, error) {
+    return 0, errors.New("write failed")
+}
+
+func TestReaderStopsWhenHandlerReturns(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    server, peer := net.Pipe()
+    defer peer.Close()
+    c := newClient(jc, failWrites{server})
+
+    handled := make(chan struct{})
+    go func() {
+        handleClient(c, newTestConnTable())
+        close(handled)
+    }()
+
+    // Both lines arrive in one read, so the reader holds the second while
+    // the handler fails to write the reply to the first.
+    peer.SetWriteDeadline(time.Now().Add(time.Second))
+    peer.Write([]byte("{}\n{}\n"))
+
+    for name, ch := range map[string]chan struct{}{"handler": handled, "reader": c.closed} {
+        select {
+        case <-ch:
+        case <-time.After(2 * time.Second):
+            t.Fatalf("%s still running after a write error", name)
+        }
+    }
+}
+
+// waitAll starts a get with wait on queues for each client, in order, with
+// the given request priorities.
+func waitAll(t *testing.T, jc *jobCentre, queues []string, pris ...int64) []*waiter {
+    t.Helper()
+    ws := make([]*waiter, len(pris))
+    for i, pri := range pris {
+        c, _ := newTestClient(t, jc)
+        j, w := jc.get(c, queues, true, pri)
+        if j != nil || w == nil {
+            t.Fatalf("waiter %d: got a job from empty queues", i)
+        }
+        ws[i] = w
+    }
+    return ws
+}
+
+// served returns the index of the one waiter in ws that has been handed a
+// job, failing the test unless exactly one has.
+func served(t *testing.T, ws []*waiter) int {
+    t.Helper()
+    got := -1
+    for i, w := range ws {
+        select {
+        case <-w.ch:
+            if got >= 0 {
+                t.Fatalf("waiters %d and %d both got the job", got, i)
+            }
+            got = i
+        default:
+        }
+    }
+    if got < 0 {
+        t.Fatal("no waiter got the job")
+    }
+    return got
+}
+
+func TestWakeFIFO(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    // Request priorities are ignored under FIFO.
+    ws := waitAll(t, jc, []string{"q"}, 0, 9, 3, 9, 1)
+    for want := range ws {
+        jc.put("q", 1, []byte(`{}`))
+        if got := served(t, ws); got != want {
+            t.Fatalf("job %d went to waiter %d, want %d", want, got, want)
+        }
+    }
+}
+
+func TestWakePriority(t *testing.T) {
+    jc := newJobCentre(wakePriority, clock.Real)
+    ws := waitAll(t, jc, []string{"q"}, 1, 5, 3, 5, 1)
+    // Highest priority first, ties by arrival.
+    for _, want := range []int{1, 3, 2, 0, 4} {
+        jc.put("q", 1, []byte(`{}`))
+        if got := served(t, ws); got != want {
+            t.Fatalf("job went to waiter %d, want %d", got, want)
+        }
+    }
+}
+
+// No waiter is starved under FIFO: however many arrive after it, with
+// whatever priority, each new job goes to whoever has waited longest.
+func TestWakeFIFONoStarvation(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    waiting := waitAll(t, jc, []string{"a", "b"}, 0)
+    for round := 0; round < 100; round++ {
+        waiting = append(waiting, waitAll(t, jc, []string{"b"}, int64(round))...)
+        jc.put("b", 1, []byte(`{}`))
+        if got := served(t, waiting); got != 0 {
+            t.Fatalf("round %d: waiter %d was served before the oldest", round, got)
+        }
+        waiting = waiting[1:]
+    }
+}
+
+// Under wakePriority a waiter is overtaken only by higher priorities: once
+// they are served, it is next, before anyone who arrived after it at its
+// own priority.
+func TestWakePriorityNoStarvationAtEqualPriority(t *testing.T) {
+    jc := newJobCentre(wakePriority, clock.Real)
+    low := waitAll(t, jc, []string{"q"}, 1)[0]
+    high := waitAll(t, jc, []string{"q"}, 2, 2)
+    laterLow := waitAll(t, jc, []string{"q"}, 1)[0]
+
+    all := []*waiter{low, high[0], high[1], laterLow}
+    for _, want := range []int{1, 2, 0, 3} {
+        jc.put("q", 1, []byte(`{}`))
+        if got := served(t, all); got != want {
+            t.Fatalf("job went to waiter %d, want %d", got, want)
+        }
+    }
+}
+
+// closed reports whether the other end of a net.Pipe has been closed.
+func closed(peer net.Conn) bool {
+    peer.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+    _, err := peer.Read(make([]byte, 1))
+    return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestIdleReaperOnFakeClock(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    jc := newJobCentre(wakeFIFO, clk)
+    conns := newTestConnTable()
+    reaper := &idleReaper{conns: conns, timeout: time.Minute, clock: clk}
+
+    idle, idlePeer := newTestClient(t, jc)
+    holding, holdingPeer := newTestClient(t, jc)
+    for _, c := range []*client{idle, holding} {
+        conns.tryAdd(c)
+    }
+    jc.put("q", 1, []byte(`{}`))
+    if j, _ := jc.get(holding, []string{"q"}, false, 0); j == nil {
+        t.Fatal("no job to hold")
+    }
+
+    clk.Advance(59 * time.Second)
+    reaper.check()
+    if closed(idlePeer) {
+        t.Fatal("reaped a client before its idle timeout")
+    }
+
+    clk.Advance(time.Second)
+    reaper.check()
+    if !closed(idlePeer) {
+        t.Fatal("idle client not reaped after the timeout")
+    }
+    if closed(holdingPeer) {
+        t.Fatal("reaped a client holding a job")
+    }
+}
+
+// BenchmarkRequests handles a put, a get and a delete per op, each from
+// its JSON line to the response it marshals to. Run with -benchmem for the
+// allocations behind them.
+func BenchmarkRequests(b *testing.B) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    c, _ := newTestClient(b, jc)
+    put := []byte(`{"request":"put","queue":"queue1","job":{"title":"example-job","args":[1,2,3]},"pri":123}`)
+    get := []byte(`{"request":"get","queues":["queue1","queue2"]}`)
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        resp := c.handleRequest(put)
+        if _, err := json.Marshal(resp); err != nil {
+            b.Fatal(err)
+        }
+        if resp = c.handleRequest(get); resp.Status != "ok" {
+            b.Fatalf("get: %+v", resp)
+        }
+        json.Marshal(resp)
+        resp = c.handleRequest([]byte(fmt.Sprintf(`{"request":"delete","id":%d}`, resp.ID)))
+        if resp.Status != "ok" {
+            b.Fatalf("delete: %+v", resp)
+        }
+        json.Marshal(resp)
+    }
+}
+
+// restart opens the journal at path into a fresh jobCentre, as the server
+// does on start-up, and closes it when the test ends.
+func restart(t *testing.T, path string) *jobCentre {
+    t.Helper()
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    jl, err := openJournal(path, false, jc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    jc.journal = jl
+    t.Cleanup(func() { jl.f.Close() })
+    return jc
+}
+
+// TestJournalNeverReusesIDs deletes the newest job and restarts twice:
+// the first restart compacts its put away, and the second must still not
+// hand its ID out again.
+func TestJournalNeverReusesIDs(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "journal")
+    jc := restart(t, path)
+    jc.put("q", 1, json.RawMessage(`{}`))
+    jc.put("q", 1, json.RawMessage(`{}`))
+    jc.delete(2)
+
+    restart(t, path)
+    jc = restart(t, path)
+    if _, ok := jc.jobs[1]; !ok || len(jc.jobs) != 1 {
+        t.Fatalf("restored jobs %v, want only job 1", jc.jobs)
+    }
+    if id := jc.put("q", 1, json.RawMessage(`{}`)); id != 3 {
+        t.Fatalf("put after two restarts got id %d, want 3", id)
+    }
+}
+
+func TestItemsQuota(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    jc.quota = quota.Quota{Items: 2}
+    c, _ := newTestClient(t, jc)
+    put := []byte(`{"request":"put","queue":"q","job":{},"pri":1}`)
+    for i := 0; i < 2; i++ {
+        if resp := c.handleRequest(put); resp.Status != "ok" {
+            t.Fatalf("put %d under the quota: %+v", i+1, resp)
+        }
+    }
+    if resp := c.handleRequest(put); resp.Status != "error" {
+        t.Fatalf("put over the quota: %+v", resp)
+    }
+
+    // A job being worked on still counts; a deleted one doesn't.
+    j, _ := jc.get(c, []string{"q"}, false, 0)
+    if id := jc.put("q", 1, []byte(`{}`)); id != 0 {
+        t.Fatalf("put with one job queued and one held: id %d, want 0", id)
+    }
+    jc.delete(j.id)
+    if id := jc.put("q", 1, []byte(`{}`)); id == 0 {
+        t.Fatal("put after a delete was refused")
+    }
+}
+
+func TestPendingQuota(t *testing.T) {
+    jc := newJobCentre(wakeFIFO, clock.Real)
+    jc.quota = quota.Quota{Pending: 1}
+    a, _ := newTestClient(t, jc)
+    b, _ := newTestClient(t, jc)
+
+    _, w := jc.get(a, []string{"q", "r"}, true, 0)
+    if w == nil {
+        t.Fatal("first get did not wait")
+    }
+    if j, w := jc.get(b, []string{"q"}, true, 0); j != nil || w != nil {
+        t.Fatalf("get over the quota: job %v, waiter %v", j, w)
+    }
+
+    // Serving the waiter frees its place.
+    jc.put("r", 1, []byte(`{}`))
+    if j := <-w.ch; j == nil {
+        t.Fatal("waiter got no job")
+    }
+    if _, w := jc.get(b, []string{"q"}, true, 0); w == nil {
+        t.Fatal("get after the waiter was served did not wait")
+    }
+}
+
+// TestSessionQuota checks a client is hung up on once its session is
+// over, and that the job it held goes back to its queue.
+func TestSessionQuota(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    jc := newJobCentre(wakeFIFO, clk)
+    jc.quota = quota.Quota{Session: time.Hour}
+    c := testnet.Pipe(t, func(conn net.Conn) { handleClient(newClient(jc, conn), newTestConnTable()) })
+    c.SendLine(`{"request":"put","queue":"q","job":{},"pri":1}`)
+    c.ExpectLine(`{"status":"ok","id":1}`)
+    c.SendLine(`{"request":"get","queues":["q"]}`)
+    c.ExpectLine(`{"status":"ok","id":1,"job":{},"pri":1,"queue":"q"}`)
+
+    clk.BlockUntil(1)
+    clk.Advance(time.Hour - time.Second)
+    c.SendLine(`{"request":"get","queues":["q"]}`)
+    c.ExpectLine(`{"status":"no-job"}`)
+    clk.Advance(time.Second)
+    c.ExpectClosed()
+    <-c.Done()
+    other, _ := newTestClient(t, jc)
+    if j, _ := jc.get(other, []string{"q"}, false, 0); j == nil || j.id != 1 {
+        t.Fatalf("job after the session ended: %v, want job 1 back on its queue", j)
+    }
+}
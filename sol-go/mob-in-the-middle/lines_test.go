@@ -0,0 +1,42 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "testing"
+
+    "../../lib-go/lines"
+)
+
+// chatTraffic is budget-chat as the proxy sees it: short chatter, the odd
+// long message, and Boguscoin addresses to rewrite.
+func chatTraffic(rng *rand.Rand, size int) []byte {
+    words := []string{"hi", "anyone", "send", "me", "the", "coins", "to", "please", "thanks", "ok", "lol", "bye"}
+    var b bytes.Buffer
+    for b.Len() < size {
+        fmt.Fprintf(&b, "[user%d]", rng.Intn(50))
+        n := 1 + rng.Intn(12)
+        if rng.Intn(50) == 0 {
+            n = 100 + rng.Intn(100)
+        }
+        for i := 0; i < n; i++ {
+            b.WriteByte(' ')
+            if rng.Intn(20) == 0 {
+                b.WriteString("7F1u3wSD5RbOHQmupo9nx4TnhQ")
+            } else {
+                b.WriteString(words[rng.Intn(len(words))])
+            }
+        }
+        b.WriteByte('\n')
+    }
+    return b.Bytes()
+}
+
+// BenchmarkLineReading reads a megabyte of chat into lines with each of
+// the strategies lines.Benchmark compares.
+//
+//    go test -run NONE -bench LineReading -benchmem
+func BenchmarkLineReading(b *testing.B) {
+    lines.Benchmark(b, chatTraffic(rand.New(rand.NewSource(1)), 1<<20))
+}
@@ -0,0 +1,906 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "expvar"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "../../lib-go/breaker"
+    "../../lib-go/clock"
+    "../../lib-go/lines"
+    "../../lib-go/retry"
+    "../../lib-go/signals"
+)
+
+// tonyAddress is Tony's Boguscoin address, substituted for every address
+// seen in the chat.
+const tonyAddress = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+// rule rewrites every token matching Pattern to Replacement.
+// Patterns are matched against the whole token.
+type rule struct {
+    Pattern     string `json:"pattern"`
+    Replacement string `json:"replacement"`
+
+    re *regexp.Regexp
+}
+
+// config is the proxy configuration, optionally loaded from a JSON file.
+type config struct {
+    Listen   string `json:"listen"`
+    Upstream string `json:"upstream"`
+
+    // Delimiters lists the characters that separate tokens in a line.
+    Delimiters string `json:"delimiters"`
+    Rules      []rule `json:"rules"`
+
+    // Linger is how long the other direction of a pair may keep draining
+    // after one side has cleanly disconnected.
+    Linger duration `json:"linger"`
+
+    // UpstreamTLS makes the proxy speak TLS to the upstream server.
+    // Victims still connect in plaintext.
+    UpstreamTLS tlsOptions `json:"upstream_tls"`
+
+    // SOCKS5 routes the upstream connection through a SOCKS5 proxy.
+    SOCKS5 socksOptions `json:"socks5"`
+
+    // DNSTTL is how long a resolution of the upstream host is cached before
+    // it is refreshed in the background; 0 resolves on every connection.
+    DNSTTL duration `json:"dns_ttl"`
+
+    // ResolveAttempts bounds how many times a hostname in Listen or
+    // Upstream is looked up at startup before giving up, so the proxy can
+    // be started before DNS or the upstream is ready. The retries back off
+    // as retry.Backoff does: the first waits up to ResolveRetry, and each
+    // one after up to twice as long as the last, capped at a minute.
+    ResolveAttempts int      `json:"resolve_attempts"`
+    ResolveRetry    duration `json:"resolve_retry"`
+
+    // Relay is "pair" to relay each direction of a pair on its own
+    // goroutine, or "single" to relay both from the victim's handler
+    // goroutine alone (see pair.runSingle), waiting up to Poll on each
+    // side in turn.
+    Relay string   `json:"relay"`
+    Poll  duration `json:"poll"`
+
+    // BreakerFailures upstream dials failing in a row make the proxy hang
+    // up on victims at once for BreakerCooldown, rather than have each wait
+    // out a dial; 0 turns the breaker off.
+    BreakerFailures int      `json:"breaker_failures"`
+    BreakerCooldown duration `json:"breaker_cooldown"`
+
+    // Admin is an address to serve the breaker's state and counters on,
+    // at /debug/vars; empty for none.
+    Admin string `json:"admin"`
+
+    tlsConfig *tls.Config       // built by compile when UpstreamTLS is enabled
+    resolver  *upstreamResolver // built by compile when DNSTTL is set
+    breaker   *breaker.Breaker  // built by compile when BreakerFailures is set
+    dial      retry.Policy      // built by compile, for upstream dials
+
+    // clock times startup lookup retries, cache refreshes and the breaker.
+    // Read deadlines on the relayed connections come from time.Now.
+    clock clock.Clock
+}
+
+// tlsOptions configures the TLS connection to the upstream server.
+type tlsOptions struct {
+    Enabled bool `json:"enabled"`
+
+    // CAFile is a PEM bundle of CAs to trust instead of the system roots.
+    CAFile string `json:"ca_file"`
+
+    // ServerName is the SNI/verification name; it defaults to the upstream
+    // host.
+    ServerName string `json:"server_name"`
+
+    InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// socksOptions configures an optional SOCKS5 proxy for upstream dials.
+type socksOptions struct {
+    // Address is the proxy's host:port; an empty address dials directly.
+    Address string `json:"address"`
+
+    // Username and Password enable RFC 1929 authentication.
+    Username string `json:"username"`
+    Password string `json:"password"`
+}
+
+// duration is a time.Duration that reads from JSON strings such as "5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return err
+    }
+    v, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = duration(v)
+    return nil
+}
+
+// defaultConfig is the behaviour required by the challenge: Boguscoin
+// addresses (starting with 7, 26-35 alphanumerics) delimited by spaces.
+func defaultConfig() config {
+    return config{
+        Listen:          "0.0.0.0:65432",
+        Upstream:        "chat.protohackers.com:16963",
+        Delimiters:      " ",
+        Linger:          duration(5 * time.Second),
+        DNSTTL:          duration(time.Minute),
+        ResolveAttempts: 5,
+        ResolveRetry:    duration(time.Second),
+        Relay:           "pair",
+        Poll:            duration(10 * time.Millisecond),
+        BreakerFailures: 5,
+        BreakerCooldown: duration(10 * time.Second),
+        clock:           clock.Real,
+        Rules: []rule{
+            {Pattern: "7[a-zA-Z0-9]{25,34}", Replacement: tonyAddress},
+        },
+    }
+}
+
+// loadConfig reads a JSON config file over the defaults.
+// Fields missing from the file keep their default values.
+func loadConfig(path string) (config, error) {
+    cfg := defaultConfig()
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return cfg, err
+    }
+    if err := json.Unmarshal(data, &cfg); err != nil {
+        return cfg, fmt.Errorf("parsing %s: %w", path, err)
+    }
+    return cfg, nil
+}
+
+// compile prepares the rules for matching.
+func (cfg *config) compile() error {
+    if cfg.Delimiters == "" {
+        return errors.New("no token delimiters configured")
+    }
+    if cfg.Relay != "pair" && cfg.Relay != "single" {
+        return fmt.Errorf("unknown relay mode %q (want pair or single)", cfg.Relay)
+    }
+    if cfg.Relay == "single" && cfg.Poll <= 0 {
+        return errors.New("single relay mode needs a positive poll interval")
+    }
+    if cfg.ResolveAttempts < 1 {
+        return errors.New("resolve_attempts must be at least 1")
+    }
+    if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+        return fmt.Errorf("listen: %w", err)
+    }
+    for i := range cfg.Rules {
+        // Anchor the pattern so it only ever matches a complete token.
+        re, err := regexp.Compile("^(?:" + cfg.Rules[i].Pattern + ")$")
+        if err != nil {
+            return fmt.Errorf("rule %d: %w", i, err)
+        }
+        cfg.Rules[i].re = re
+    }
+
+    if cfg.UpstreamTLS.Enabled {
+        tlsConfig, err := cfg.UpstreamTLS.build(cfg.Upstream)
+        if err != nil {
+            return fmt.Errorf("upstream TLS: %w", err)
+        }
+        cfg.tlsConfig = tlsConfig
+    }
+
+    // Through SOCKS5 the proxy resolves the hostname, and IP literals need
+    // no resolving at all.
+    host, port, err := net.SplitHostPort(cfg.Upstream)
+    if err != nil {
+        return fmt.Errorf("upstream: %w", err)
+    }
+    if cfg.DNSTTL > 0 && cfg.SOCKS5.Address == "" && net.ParseIP(host) == nil {
+        cfg.resolver = &upstreamResolver{host: host, port: port, ttl: time.Duration(cfg.DNSTTL), clock: cfg.clock}
+    }
+    cfg.dial = retry.DialPolicy(cfg.clock)
+    if cfg.BreakerFailures > 0 {
+        cfg.breaker = breaker.New("upstream", cfg.BreakerFailures, time.Duration(cfg.BreakerCooldown), cfg.clock)
+    }
+    return nil
+}
+
+// build turns the options into a tls.Config for dialing upstream.
+func (o tlsOptions) build(upstream string) (*tls.Config, error) {
+    serverName := o.ServerName
+    if serverName == "" {
+        host, _, err := net.SplitHostPort(upstream)
+        if err != nil {
+            return nil, err
+        }
+        serverName = host
+    }
+
+    tlsConfig := &tls.Config{
+        ServerName:         serverName,
+        InsecureSkipVerify: o.InsecureSkipVerify,
+    }
+
+    if o.CAFile != "" {
+        pem, err := os.ReadFile(o.CAFile)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    return tlsConfig, nil
+}
+
+// dialUpstream opens a connection to the upstream chat server, wrapped in
+// TLS if configured.
+func (cfg *config) dialUpstream() (net.Conn, error) {
+    var conn net.Conn
+    err := cfg.dial.Do(func() error {
+        var err error
+        if cfg.SOCKS5.Address != "" {
+            conn, err = cfg.SOCKS5.dial(cfg.Upstream, retry.DialTimeout)
+        } else if cfg.resolver != nil {
+            conn, err = cfg.resolver.dial(retry.DialTimeout)
+        } else {
+            conn, err = net.DialTimeout("tcp", cfg.Upstream, retry.DialTimeout)
+        }
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    if cfg.tlsConfig == nil {
+        return conn, nil
+    }
+
+    // TLS runs end-to-end with the upstream, through the SOCKS tunnel if any.
+    tlsConn := tls.Client(conn, cfg.tlsConfig)
+    tlsConn.SetDeadline(time.Now().Add(retry.DialTimeout))
+    if err := tlsConn.Handshake(); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("TLS handshake: %w", err)
+    }
+    tlsConn.SetDeadline(time.Time{})
+    return tlsConn, nil
+}
+
+// rewriteToken applies the first matching rule to a single token.
+func (cfg *config) rewriteToken(token string) string {
+    for _, r := range cfg.Rules {
+        if r.re.MatchString(token) {
+            return r.Replacement
+        }
+    }
+    return token
+}
+
+// rewriteLine rewrites every token in line, preserving the delimiters
+// between them. line must not include the trailing newline.
+func (cfg *config) rewriteLine(line string) string {
+    var out strings.Builder
+    for {
+        i := strings.IndexAny(line, cfg.Delimiters)
+        if i < 0 {
+            out.WriteString(cfg.rewriteToken(line))
+            return out.String()
+        }
+        _, size := utf8.DecodeRuneInString(line[i:])
+        out.WriteString(cfg.rewriteToken(line[:i]))
+        out.WriteString(line[i : i+size])
+        line = line[i+size:]
+    }
+}
+
+// forward copies complete lines from src to dst, rewriting each one.
+// A trailing partial line (no newline before EOF) is never forwarded.
+// Lines are cut with a lines.Splitter rather than bufio, which copies
+// each line before it is rewritten (see BenchmarkLineReading).
+func forward(cfg *config, src io.Reader, dst io.Writer) error {
+    buf := make([]byte, 4096)
+    var splitter lines.Splitter
+    write := func(line []byte) error {
+        _, err := io.WriteString(dst, cfg.rewriteLine(string(line))+"\n")
+        return err
+    }
+    for {
+        n, err := src.Read(buf)
+        if werr := splitter.Split(buf[:n], write); werr != nil {
+            return werr
+        }
+        if err != nil {
+            if errors.Is(err, io.EOF) {
+                return nil
+            }
+            return err
+        }
+    }
+}
+
+// pair is a victim connection and the upstream connection made for it.
+type pair struct {
+    cfg      *config
+    client   net.Conn
+    upstream net.Conn
+
+    closeOnce sync.Once
+}
+
+// closeBoth tears down both connections. It is safe to call repeatedly.
+func (p *pair) closeBoth() {
+    p.closeOnce.Do(func() {
+        p.client.Close()
+        p.upstream.Close()
+    })
+}
+
+// closeWrite half-closes conn so its peer sees EOF while we keep reading.
+// Connections that cannot half-close are closed outright.
+func closeWrite(conn net.Conn) {
+    if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+        hc.CloseWrite()
+        return
+    }
+    conn.Close()
+}
+
+// pipe relays src to dst. When src reaches a clean EOF every complete line
+// has already been written, so dst is half-closed to pass the EOF along.
+func (p *pair) pipe(src, dst net.Conn) error {
+    err := forward(p.cfg, src, dst)
+    if err == nil {
+        closeWrite(dst)
+    }
+    return err
+}
+
+// run relays both directions and returns once both have finished and both
+// connections are closed, so no goroutine outlives the pair.
+//
+// An error on either side tears the pair down immediately. A clean EOF
+// only half-closes the other side, and the remaining direction then gets
+// cfg.Linger to drain before it is cut off as well.
+func (p *pair) run() {
+    errc := make(chan error, 2)
+    go func() { errc <- p.pipe(p.client, p.upstream) }()
+    go func() { errc <- p.pipe(p.upstream, p.client) }()
+
+    if err := <-errc; err != nil {
+        p.closeBoth()
+    } else {
+        deadline := time.Now().Add(time.Duration(p.cfg.Linger))
+        p.client.SetReadDeadline(deadline)
+        p.upstream.SetReadDeadline(deadline)
+    }
+    <-errc
+    p.closeBoth()
+}
+
+// relaySide is one direction of a pair relayed by runSingle, with the
+// partial line read from src so far.
+type relaySide struct {
+    src, dst net.Conn
+    lines    lines.Splitter
+    done     bool // src reached a clean EOF
+}
+
+// relay reads what src has within the deadline and writes each complete
+// line on, rewritten. A timeout just means src had nothing to say.
+func (s *relaySide) relay(cfg *config, buf []byte, deadline time.Time) error {
+    s.src.SetReadDeadline(deadline)
+    n, err := s.src.Read(buf)
+    werr := s.lines.Split(buf[:n], func(line []byte) error {
+        _, err := io.WriteString(s.dst, cfg.rewriteLine(string(line))+"\n")
+        return err
+    })
+    if werr != nil {
+        return werr
+    }
+
+    var netErr net.Error
+    switch {
+    case err == nil || errors.As(err, &netErr) && netErr.Timeout():
+        return nil
+    case errors.Is(err, io.EOF):
+        // As in forward, a trailing partial line is dropped.
+        s.done = true
+        closeWrite(s.dst)
+        return nil
+    }
+    return err
+}
+
+// runSingle relays both directions on the calling goroutine, where run
+// starts a goroutine for each. It reads each side in turn with a read
+// deadline cfg.Poll away, keeping each direction's partial line between
+// reads. That cuts the goroutines per pair from three to one when the
+// checker opens a storm of connections. The costs are up to cfg.Poll of
+// extra latency per line, an idle pair waking every cfg.Poll, and one
+// direction waiting while a write in the other blocks.
+//
+// Teardown is as in run: an error closes the pair at once, and after a
+// clean EOF the other direction has cfg.Linger to drain.
+func (p *pair) runSingle() {
+    defer p.closeBoth()
+
+    sides := []*relaySide{{src: p.client, dst: p.upstream}, {src: p.upstream, dst: p.client}}
+    buf := make([]byte, 4096)
+    var cutoff time.Time // set once one side has finished
+    for {
+        open := 0
+        for _, s := range sides {
+            if s.done {
+                continue
+            }
+            deadline := time.Now().Add(time.Duration(p.cfg.Poll))
+            if !cutoff.IsZero() {
+                if time.Now().After(cutoff) {
+                    return
+                }
+                if cutoff.Before(deadline) {
+                    deadline = cutoff
+                }
+            }
+            if err := s.relay(p.cfg, buf, deadline); err != nil {
+                return
+            }
+            if s.done && cutoff.IsZero() {
+                cutoff = time.Now().Add(time.Duration(p.cfg.Linger))
+            }
+            if !s.done {
+                open++
+            }
+        }
+        if open == 0 {
+            return
+        }
+    }
+}
+
+// resolveAtStartup looks host up, backing off between failures until
+// cfg.ResolveAttempts lookups have failed. IP literals and the empty (any)
+// host are returned as they are.
+func (cfg *config) resolveAtStartup(host string) ([]string, error) {
+    if host == "" || net.ParseIP(host) != nil {
+        return []string{host}, nil
+    }
+    policy := retry.Policy{
+        Attempts: cfg.ResolveAttempts,
+        Backoff:  retry.Backoff{Base: time.Duration(cfg.ResolveRetry), Max: max(time.Minute, time.Duration(cfg.ResolveRetry))},
+        Clock:    cfg.clock,
+    }
+    var addrs []string
+    attempt := 0
+    err := policy.Do(func() error {
+        attempt++
+        ctx, cancel := context.WithTimeout(context.Background(), retry.DialTimeout)
+        defer cancel()
+        var err error
+        if addrs, err = net.DefaultResolver.LookupHost(ctx, host); err != nil && attempt < cfg.ResolveAttempts {
+            fmt.Printf("[DNS] resolving %s failed (attempt %d of %d), retrying: %v\n", host, attempt, cfg.ResolveAttempts, err)
+        }
+        return err
+    })
+    if err != nil {
+        return nil, fmt.Errorf("resolving %s failed %d times: %w", host, attempt, err)
+    }
+    return addrs, nil
+}
+
+// upstreamResolver caches the upstream host's addresses so that a flood of
+// victims doesn't turn into a flood of DNS queries. The cache is refreshed
+// in the background every ttl; if a refresh fails the previous addresses
+// keep being used.
+type upstreamResolver struct {
+    host string
+    port string
+    ttl  time.Duration
+
+    clock clock.Clock
+
+    mu    sync.RWMutex
+    addrs []string
+    next  int // round-robin position in addrs
+}
+
+// refresh resolves the host once and replaces the cached addresses.
+func (r *upstreamResolver) refresh() error {
+    ctx, cancel := context.WithTimeout(context.Background(), retry.DialTimeout)
+    defer cancel()
+
+    addrs, err := net.DefaultResolver.LookupHost(ctx, r.host)
+    if err != nil {
+        return err
+    }
+
+    r.mu.Lock()
+    r.addrs = addrs
+    r.mu.Unlock()
+    return nil
+}
+
+// refreshLoop keeps the cache warm until stop is closed. Failed lookups
+// are retried sooner than the ttl, backing off up to it.
+func (r *upstreamResolver) refreshLoop(stop <-chan struct{}) {
+    backoff := retry.Backoff{Base: time.Second, Max: r.ttl}
+    wait, failures := r.ttl, 0
+    for {
+        select {
+        case <-r.clock.After(wait):
+        case <-stop:
+            return
+        }
+
+        if err := r.refresh(); err != nil {
+            fmt.Printf("[DNS] refreshing %s failed, keeping cached addresses: %v\n", r.host, err)
+            wait = backoff.Delay(failures)
+            failures++
+            continue
+        }
+        wait, failures = r.ttl, 0
+    }
+}
+
+// dial connects to one of the cached addresses, trying each in turn
+// starting from the next round-robin position. With an empty cache it falls
+// back to a normal (resolving) dial.
+func (r *upstreamResolver) dial(timeout time.Duration) (net.Conn, error) {
+    r.mu.Lock()
+    addrs := r.addrs
+    start := r.next
+    r.next++
+    r.mu.Unlock()
+
+    if len(addrs) == 0 {
+        return net.DialTimeout("tcp", net.JoinHostPort(r.host, r.port), timeout)
+    }
+
+    var err error
+    for i := range addrs {
+        var conn net.Conn
+        addr := addrs[(start+i)%len(addrs)]
+        if conn, err = net.DialTimeout("tcp", net.JoinHostPort(addr, r.port), timeout); err == nil {
+            return conn, nil
+        }
+    }
+    return nil, err
+}
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929).
+const (
+    socksVersion      = 0x05
+    socksNoAuth       = 0x00
+    socksUserPass     = 0x02
+    socksNoAcceptable = 0xff
+    socksConnect      = 0x01
+    socksIPv4         = 0x01
+    socksDomain       = 0x03
+    socksIPv6         = 0x04
+    socksSucceeded    = 0x00
+)
+
+// dial connects to target through the SOCKS5 proxy. Hostnames are passed
+// to the proxy unresolved, so they are looked up on the far side.
+func (o socksOptions) dial(target string, timeout time.Duration) (net.Conn, error) {
+    host, portStr, err := net.SplitHostPort(target)
+    if err != nil {
+        return nil, err
+    }
+    port, err := strconv.ParseUint(portStr, 10, 16)
+    if err != nil {
+        return nil, fmt.Errorf("invalid port %q", portStr)
+    }
+
+    conn, err := net.DialTimeout("tcp", o.Address, timeout)
+    if err != nil {
+        return nil, fmt.Errorf("connecting to SOCKS5 proxy: %w", err)
+    }
+    conn.SetDeadline(time.Now().Add(timeout))
+
+    if err := o.handshake(conn, host, uint16(port)); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("SOCKS5 proxy %s: %w", o.Address, err)
+    }
+    conn.SetDeadline(time.Time{})
+    return conn, nil
+}
+
+// handshake negotiates authentication and issues the CONNECT request.
+func (o socksOptions) handshake(conn net.Conn, host string, port uint16) error {
+    // 1. Method selection
+    methods := []byte{socksNoAuth}
+    if o.Username != "" {
+        methods = []byte{socksUserPass}
+    }
+    if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+        return err
+    }
+
+    reply := make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return err
+    }
+    if reply[0] != socksVersion {
+        return fmt.Errorf("unexpected version %d", reply[0])
+    }
+
+    // 2. Authentication
+    switch reply[1] {
+    case socksNoAuth:
+    case socksUserPass:
+        if len(o.Username) > 255 || len(o.Password) > 255 {
+            return errors.New("username or password too long")
+        }
+        req := []byte{0x01, byte(len(o.Username))}
+        req = append(req, o.Username...)
+        req = append(req, byte(len(o.Password)))
+        req = append(req, o.Password...)
+        if _, err := conn.Write(req); err != nil {
+            return err
+        }
+        if _, err := io.ReadFull(conn, reply); err != nil {
+            return err
+        }
+        if reply[1] != 0x00 {
+            return errors.New("authentication failed")
+        }
+    case socksNoAcceptable:
+        return errors.New("no acceptable authentication method")
+    default:
+        return fmt.Errorf("unsupported authentication method %d", reply[1])
+    }
+
+    // 3. CONNECT
+    req := []byte{socksVersion, socksConnect, 0x00}
+    if ip := net.ParseIP(host); ip == nil {
+        if len(host) > 255 {
+            return errors.New("hostname too long")
+        }
+        req = append(req, socksDomain, byte(len(host)))
+        req = append(req, host...)
+    } else if ip4 := ip.To4(); ip4 != nil {
+        req = append(req, socksIPv4)
+        req = append(req, ip4...)
+    } else {
+        req = append(req, socksIPv6)
+        req = append(req, ip...)
+    }
+    req = binary.BigEndian.AppendUint16(req, port)
+    if _, err := conn.Write(req); err != nil {
+        return err
+    }
+
+    // 4. Reply: VER REP RSV ATYP BND.ADDR BND.PORT
+    head := make([]byte, 4)
+    if _, err := io.ReadFull(conn, head); err != nil {
+        return err
+    }
+    if head[1] != socksSucceeded {
+        return fmt.Errorf("CONNECT failed with code %d", head[1])
+    }
+
+    var addrLen int
+    switch head[3] {
+    case socksIPv4:
+        addrLen = net.IPv4len
+    case socksIPv6:
+        addrLen = net.IPv6len
+    case socksDomain:
+        l := make([]byte, 1)
+        if _, err := io.ReadFull(conn, l); err != nil {
+            return err
+        }
+        addrLen = int(l[0])
+    default:
+        return fmt.Errorf("unknown address type %d", head[3])
+    }
+    // The bound address is of no use to us; just consume it and the port.
+    _, err := io.ReadFull(conn, make([]byte, addrLen+2))
+    return err
+}
+
+// handleClient connects a victim to the upstream chat server and relays
+// their conversation in both directions.
+func handleClient(cfg *config, client net.Conn) {
+    addr := client.RemoteAddr().String()
+    fmt.Printf("[NEW VICTIM] %s connected.\n", addr)
+
+    if !cfg.breaker.Allow() {
+        fmt.Printf("[ERROR] connecting to upstream: %v\n", breaker.ErrOpen)
+        client.Close()
+        return
+    }
+    upstream, err := cfg.dialUpstream()
+    cfg.breaker.Done(err)
+    if err != nil {
+        fmt.Printf("[ERROR] connecting to upstream: %v\n", err)
+        client.Close()
+        return
+    }
+
+    p := &pair{cfg: cfg, client: client, upstream: upstream}
+    if cfg.Relay == "single" {
+        p.runSingle()
+    } else {
+        p.run()
+    }
+    fmt.Printf("[DISCONNECTED] %s disconnected.\n", addr)
+}
+
+func startServer(cfg *config) {
+    // Victims are only accepted once the upstream resolves. Through SOCKS5
+    // the proxy resolves it instead.
+    if cfg.SOCKS5.Address == "" {
+        host, _, _ := net.SplitHostPort(cfg.Upstream)
+        addrs, err := cfg.resolveAtStartup(host)
+        if err != nil {
+            fmt.Printf("[ERROR] Could not start server: upstream: %v\n", err)
+            return
+        }
+        if cfg.resolver != nil {
+            cfg.resolver.addrs = addrs
+        }
+    }
+
+    host, port, _ := net.SplitHostPort(cfg.Listen)
+    addrs, err := cfg.resolveAtStartup(host)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: listen: %v\n", err)
+        return
+    }
+    listener, err := net.Listen("tcp", net.JoinHostPort(addrs[0], port))
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer listener.Close()
+
+    fmt.Printf("[LISTENING] MITM Proxy on %s -> %s\n", listener.Addr(), cfg.Upstream)
+
+    if cfg.Admin != "" {
+        // expvar registers /debug/vars on the default mux.
+        expvar.Publish("breaker", expvar.Func(func() any { return cfg.breaker.Stats() }))
+        go func() {
+            fmt.Printf("[ADMIN] Breaker state on http://%s/debug/vars\n", cfg.Admin)
+            if err := http.ListenAndServe(cfg.Admin, nil); err != nil {
+                fmt.Printf("[ERROR] Admin listener: %v\n", err)
+            }
+        }()
+    }
+
+    if cfg.resolver != nil {
+        stop := make(chan struct{})
+        defer close(stop)
+        go cfg.resolver.refreshLoop(stop)
+    }
+
+    // Handle graceful shutdown
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        listener.Close()
+    })
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            fmt.Printf("[ERROR] Accept error: %v\n", err)
+            continue
+        }
+
+        go handleClient(cfg, conn)
+    }
+}
+
+func main() {
+    configPath := flag.String("config", "", "JSON file with listen/upstream addresses and rewrite rules")
+    listen := flag.String("listen", "", "address to accept victims on (overrides config)")
+    port := flag.String("port", "", "port to accept victims on, keeping the listen host (overrides config and -listen)")
+    upstream := flag.String("upstream", "", "upstream chat server host:port (overrides config)")
+    upstreamTLS := flag.Bool("upstream-tls", false, "connect to the upstream over TLS (overrides config)")
+    upstreamCA := flag.String("upstream-ca", "", "PEM file of CAs trusted for the upstream (overrides config)")
+    upstreamSNI := flag.String("upstream-sni", "", "server name sent and verified for the upstream (overrides config)")
+    socks5 := flag.String("socks5", "", "SOCKS5 proxy host:port to reach the upstream through (overrides config)")
+    dnsTTL := flag.Duration("dns-ttl", -1, "how long to cache the upstream's DNS resolution, 0 to disable (overrides config)")
+    linger := flag.Duration("linger", 0, "how long to drain the other side after a clean disconnect (overrides config)")
+    relay := flag.String("relay", "", "pair (a goroutine per direction) or single (one goroutine polling both) (overrides config)")
+    poll := flag.Duration("poll", 0, "how long single relay mode waits on each side in turn (overrides config)")
+    breakerFailures := flag.Int("breaker-failures", -1, "failed upstream dials in a row that open the circuit breaker, 0 to disable (overrides config)")
+    breakerCooldown := flag.Duration("breaker-cooldown", 0, "how long the open breaker fails fast before probing the upstream (overrides config)")
+    admin := flag.String("admin", "", "address to serve the breaker's state on at /debug/vars (overrides config)")
+    resolveAttempts := flag.Int("resolve-attempts", 0, "how many times to look up the listen and upstream hosts at startup (overrides config)")
+    resolveRetry := flag.Duration("resolve-retry", 0, "longest wait before the first startup lookup retry, doubling after each (overrides config)")
+    flag.Parse()
+
+    cfg := defaultConfig()
+    if *configPath != "" {
+        var err error
+        if cfg, err = loadConfig(*configPath); err != nil {
+            fmt.Printf("[ERROR] Could not load config: %v\n", err)
+            os.Exit(1)
+        }
+    }
+    if *listen != "" {
+        cfg.Listen = *listen
+    }
+    if *port != "" {
+        // A bad Listen is reported by compile.
+        if host, _, err := net.SplitHostPort(cfg.Listen); err == nil {
+            cfg.Listen = net.JoinHostPort(host, *port)
+        }
+    }
+    if *upstream != "" {
+        cfg.Upstream = *upstream
+    }
+    if *linger > 0 {
+        cfg.Linger = duration(*linger)
+    }
+    if *relay != "" {
+        cfg.Relay = *relay
+    }
+    if *poll > 0 {
+        cfg.Poll = duration(*poll)
+    }
+    if *breakerFailures >= 0 {
+        cfg.BreakerFailures = *breakerFailures
+    }
+    if *breakerCooldown > 0 {
+        cfg.BreakerCooldown = duration(*breakerCooldown)
+    }
+    if *admin != "" {
+        cfg.Admin = *admin
+    }
+    if *resolveAttempts > 0 {
+        cfg.ResolveAttempts = *resolveAttempts
+    }
+    if *resolveRetry > 0 {
+        cfg.ResolveRetry = duration(*resolveRetry)
+    }
+    if *dnsTTL >= 0 {
+        cfg.DNSTTL = duration(*dnsTTL)
+    }
+    if *socks5 != "" {
+        cfg.SOCKS5.Address = *socks5
+    }
+    if *upstreamTLS {
+        cfg.UpstreamTLS.Enabled = true
+    }
+    if *upstreamCA != "" {
+        cfg.UpstreamTLS.CAFile = *upstreamCA
+    }
+    if *upstreamSNI != "" {
+        cfg.UpstreamTLS.ServerName = *upstreamSNI
+    }
+    if err := cfg.compile(); err != nil {
+        fmt.Printf("[ERROR] Invalid config: %v\n", err)
+        os.Exit(1)
+    }
+
+    startServer(&cfg)
+}
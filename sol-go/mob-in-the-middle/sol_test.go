@@ -0,0 +1,300 @@
+package main
+
+import (
+    "io"
+    "math/rand"
+    "net"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+
+    "../../lib-go/fragment"
+    "../../lib-go/testnet"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    dialed, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    accepted, err := l.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        dialed.Close()
+        accepted.Close()
+    })
+    return dialed, accepted
+}
+
+// proxied is a pair being relayed, with the victim's and the upstream
+// server's ends of it.
+type proxied struct {
+    victim, server net.Conn
+    done           chan struct{} // closed when the relay returns
+}
+
+// startPair relays between a victim and a server with the given relay
+// mode and linger.
+func startPair(t *testing.T, relay string, linger time.Duration) *proxied {
+    t.Helper()
+    cfg := defaultConfig()
+    cfg.Relay, cfg.Linger = relay, duration(linger)
+    if err := cfg.compile(); err != nil {
+        t.Fatal(err)
+    }
+    victim, client := tcpPair(t)
+    upstream, server := tcpPair(t)
+    p := &pair{cfg: &cfg, client: client, upstream: upstream}
+    pp := &proxied{victim: victim, server: server, done: make(chan struct{})}
+    go func() {
+        defer close(pp.done)
+        if relay == "single" {
+            p.runSingle()
+        } else {
+            p.run()
+        }
+    }()
+    return pp
+}
+
+// readAll reads conn to EOF, failing the test if that takes longer than d.
+func readAll(t *testing.T, conn net.Conn, d time.Duration) string {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(d))
+    data, err := io.ReadAll(conn)
+    if err != nil {
+        t.Fatalf("reading to EOF: %v (got %q)", err, data)
+    }
+    return string(data)
+}
+
+// readLine reads one line from conn, failing the test if none comes
+// within five seconds.
+func readLine(t *testing.T, conn net.Conn) string {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    var line []byte
+    b := make([]byte, 1)
+    for {
+        if _, err := conn.Read(b); err != nil {
+            t.Fatalf("reading a line: %v (got %q)", err, line)
+        }
+        if b[0] == '\n' {
+            return string(line)
+        }
+        line = append(line, b[0])
+    }
+}
+
+// finished fails the test unless the relay has returned within d.
+func (pp *proxied) finished(t *testing.T, d time.Duration) {
+    t.Helper()
+    select {
+    case <-pp.done:
+    case <-time.After(d):
+        t.Fatal("relay still running")
+    }
+}
+
+const (
+    bogus = "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"
+    tony  = tonyAddress
+)
+
+func forEachRelay(t *testing.T, test func(t *testing.T, relay string)) {
+    for _, relay := range []string{"pair", "single"} {
+        t.Run(relay, func(t *testing.T) { test(t, relay) })
+    }
+}
+
+// TestRelayGoroutines checks how many goroutines a pair costs: one for
+// the single relay mode, where run's pair mode needs three.
+func TestRelayGoroutines(t *testing.T) {
+    for relay, want := range map[string]int{"single": 1, "pair": 3} {
+        before := runtime.NumGoroutine()
+        pp := startPair(t, relay, time.Minute)
+        pp.victim.Write([]byte("hi\n"))
+        readLine(t, pp.server)
+        if got := runtime.NumGoroutine() - before; got != want {
+            t.Errorf("%s: %d goroutines per pair, want %d", relay, got, want)
+        }
+        pp.victim.Close()
+        pp.server.Close()
+        pp.finished(t, 5*time.Second)
+    }
+}
+
+// The victim hangs up first: what it sent is flushed upstream, the server
+// sees EOF, and once it hangs up too the pair is gone without waiting out
+// the linger.
+func TestVictimClosesFirst(t *testing.T) {
+    forEachRelay(t, func(t *testing.T, relay string) {
+        pp := startPair(t, relay, time.Minute)
+        pp.victim.Write([]byte("send to " + bogus + "\npartial"))
+        pp.victim.Close()
+
+        if got, want := readAll(t, pp.server, 5*time.Second), "send to "+tony+"\n"; got != want {
+            t.Fatalf("server got %q, want %q", got, want)
+        }
+        pp.server.Close()
+        pp.finished(t, 5*time.Second)
+    })
+}
+
+// Both sides send in pieces of a few bytes, so an address arrives split
+// across reads: it is still rewritten whole, in both directions.
+func TestFragmentedAddressRewritten(t *testing.T) {
+    forEachRelay(t, func(t *testing.T, relay string) {
+        pp := startPair(t, relay, time.Minute)
+        victim := fragment.NewConn(pp.victim, 3, time.Millisecond, rand.New(rand.NewSource(1)))
+        server := fragment.NewConn(pp.server, 3, time.Millisecond, rand.New(rand.NewSource(2)))
+        victim.Write([]byte("send to " + bogus + " please\n"))
+        server.Write([]byte("[bob] " + bogus + "\n"))
+        pp.victim.(*net.TCPConn).CloseWrite()
+        pp.server.(*net.TCPConn).CloseWrite()
+
+        if got, want := readAll(t, pp.server, 5*time.Second), "send to "+tony+" please\n"; got != want {
+            t.Fatalf("server got %q, want %q", got, want)
+        }
+        if got, want := readAll(t, pp.victim, 5*time.Second), "[bob] "+tony+"\n"; got != want {
+            t.Fatalf("victim got %q, want %q", got, want)
+        }
+        pp.finished(t, 5*time.Second)
+    })
+}
+
+// The victim half-closes and the server keeps talking: the server's lines
+// still reach the victim until the server is done.
+func TestVictimHalfClosesServerFinishes(t *testing.T) {
+    forEachRelay(t, func(t *testing.T, relay string) {
+        pp := startPair(t, relay, time.Minute)
+        pp.victim.(*net.TCPConn).CloseWrite()
+        if got := readAll(t, pp.server, 5*time.Second); got != "" {
+            t.Fatalf("server got %q, want EOF", got)
+        }
+        pp.server.Write([]byte("last words from " + bogus + "\n"))
+        pp.server.Close()
+
+        if got, want := readAll(t, pp.victim, 5*time.Second), "last words from "+tony+"\n"; got != want {
+            t.Fatalf("victim got %q, want %q", got, want)
+        }
+        pp.finished(t, 5*time.Second)
+    })
+}
+
+// The server hangs up first: its complete lines reach the victim, then EOF.
+func TestServerClosesFirst(t *testing.T) {
+    forEachRelay(t, func(t *testing.T, relay string) {
+        pp := startPair(t, relay, time.Minute)
+        pp.server.Write([]byte("welcome\n" + bogus + " says hi\ntrailing"))
+        pp.server.Close()
+
+        if got, want := readAll(t, pp.victim, 5*time.Second), "welcome\n"+tony+" says hi\n"; got != want {
+            t.Fatalf("victim got %q, want %q", got, want)
+        }
+        pp.victim.Close()
+        pp.finished(t, 5*time.Second)
+    })
+}
+
+// One side hangs up and the other goes quiet without hanging up: the pair
+// is cut off once the linger runs out.
+func TestLingerCutsOffSilentSide(t *testing.T) {
+    forEachRelay(t, func(t *testing.T, relay string) {
+        pp := startPair(t, relay, 200*time.Millisecond)
+        pp.server.Close()
+        // The victim never closes, but still sees EOF when the pair goes.
+        if got := readAll(t, pp.victim, 5*time.Second); got != "" {
+            t.Fatalf("victim got %q, want EOF", got)
+        }
+        pp.finished(t, 5*time.Second)
+    })
+}
+
+// Both hang up at once.
+func TestBothCloseAtOnce(t *testing.T) {
+    forEachRelay(t, func(t *testing.T, relay string) {
+        pp := startPair(t, relay, time.Minute)
+        pp.victim.Write([]byte("hi\n"))
+        pp.server.Write([]byte("hello\n"))
+        start := make(chan struct{})
+        closed := make(chan struct{}, 2)
+        for _, conn := range []net.Conn{pp.victim, pp.server} {
+            go func() {
+                <-start
+                conn.Close()
+                closed <- struct{}{}
+            }()
+        }
+        close(start)
+        <-closed
+        <-closed
+        pp.finished(t, 5*time.Second)
+    })
+}
+
+// An abortive close (RST) on either side tears the pair down at once,
+// without the linger.
+func TestResetTearsDownAtOnce(t *testing.T) {
+    forEachRelay(t, func(t *testing.T, relay string) {
+        pp := startPair(t, relay, time.Minute)
+        pp.server.(*net.TCPConn).SetLinger(0)
+        // Unread data makes the close send RST rather than FIN.
+        pp.victim.Write([]byte("unread\n"))
+        time.Sleep(50 * time.Millisecond)
+        pp.server.Close()
+        pp.finished(t, 5*time.Second)
+    })
+}
+
+// TestForwardPartialLines feeds forward lines split across reads, one
+// longer than its buffer, and a last line with no newline: the split ones
+// are rewritten whole and the unterminated one is dropped.
+func TestForwardPartialLines(t *testing.T) {
+    cfg := defaultConfig()
+    if err := cfg.compile(); err != nil {
+        t.Fatal(err)
+    }
+    long := strings.Repeat("word ", 2000)
+    src := testnet.NewConn(
+        testnet.Data("send to "+bogus[:10]),
+        testnet.Data(bogus[10:]+" now\nsec"),
+        testnet.Data("ond\n"+long+bogus+"\n"),
+        testnet.Data("no newline "+bogus),
+    )
+    var dst strings.Builder
+    if err := forward(&cfg, src, &dst); err != nil {
+        t.Fatal(err)
+    }
+    want := "send to " + tony + " now\nsecond\n" + long + tony + "\n"
+    if got := dst.String(); got != want {
+        t.Fatalf("forwarded %q, want %q", got, want)
+    }
+}
+
+// TestForwardReadError passes on what arrived whole before a read fails,
+// and reports the failure.
+func TestForwardReadError(t *testing.T) {
+    cfg := defaultConfig()
+    if err := cfg.compile(); err != nil {
+        t.Fatal(err)
+    }
+    src := testnet.NewConn(testnet.Data("whole\npart"), testnet.Read{Err: testnet.ErrTransient})
+    var dst strings.Builder
+    if err := forward(&cfg, src, &dst); err != testnet.ErrTransient {
+        t.Fatalf("got %v, want the read error", err)
+    }
+    if got := dst.String(); got != "whole\n" {
+        t.Fatalf("forwarded %q", got)
+    }
+}
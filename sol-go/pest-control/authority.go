@@ -0,0 +1,134 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "time"
+
+    "../../lib-go/retry"
+)
+
+// target is a species' acceptable population range at a site.
+type target struct {
+    min uint32
+    max uint32
+}
+
+// policy is a policy we created at a site.
+type policy struct {
+    id     uint32
+    action byte
+}
+
+// siteLink is the connection to one site's Authority and what we know
+// about the site through it. It is used only by the site's worker, so
+// requests on the connection never interleave.
+type siteLink struct {
+    addr string
+    site uint32
+    dial retry.Policy
+
+    conn     net.Conn // nil until dialed, and again after a failure
+    reader   *bufio.Reader
+    targets  map[string]target
+    policies map[string]policy // by species
+}
+
+// connect dials the Authority, exchanges Hellos and fetches the site's
+// target populations.
+func (l *siteLink) connect() error {
+    conn, err := l.dial.Dial("tcp", l.addr, retry.DialTimeout)
+    if err != nil {
+        return err
+    }
+    l.conn = conn
+    l.reader = bufio.NewReader(conn)
+
+    if _, err := l.call(msgHello, helloPayload(), msgHello); err != nil {
+        l.close()
+        return fmt.Errorf("hello: %w", err)
+    }
+
+    d, err := l.call(msgDialAuthority, appendU32(nil, l.site), msgTargetPopulations)
+    if err != nil {
+        l.close()
+        return fmt.Errorf("dial authority: %w", err)
+    }
+    site := d.u32()
+    targets := make(map[string]target)
+    for n := d.u32(); n > 0 && d.err == nil; n-- {
+        species := d.str()
+        targets[species] = target{min: d.u32(), max: d.u32()}
+    }
+    if err := d.finish("TargetPopulations"); err != nil {
+        l.close()
+        return err
+    }
+    if site != l.site {
+        l.close()
+        return fmt.Errorf("asked for site %d, got targets for %d", l.site, site)
+    }
+
+    // Policies belong to the connection that created them, so a fresh
+    // connection starts with none.
+    l.targets = targets
+    l.policies = make(map[string]policy)
+    fmt.Printf("[AUTHORITY] Connected for site %d (%d targets)\n", l.site, len(targets))
+    return nil
+}
+
+// close drops the connection; the next visit dials a new one.
+func (l *siteLink) close() {
+    if l.conn != nil {
+        l.conn.Close()
+        l.conn = nil
+    }
+}
+
+// call sends one request and reads its response, which must be of type
+// want.
+func (l *siteLink) call(typ byte, payload []byte, want byte) (*decoder, error) {
+    l.conn.SetDeadline(time.Now().Add(retry.RequestTimeout))
+    defer l.conn.SetDeadline(time.Time{})
+
+    if err := writeMessage(l.conn, typ, payload); err != nil {
+        return nil, err
+    }
+    resp, err := readMessage(l.reader)
+    if err != nil {
+        return nil, err
+    }
+
+    d := &decoder{buf: resp.payload}
+    switch resp.typ {
+    case want:
+        return d, nil
+    case msgError:
+        return nil, fmt.Errorf("authority error: %s", d.str())
+    default:
+        return nil, fmt.Errorf("expected message 0x%02x, got 0x%02x", want, resp.typ)
+    }
+}
+
+func (l *siteLink) createPolicy(species string, action byte) error {
+    d, err := l.call(msgCreatePolicy, append(appendStr(nil, species), action), msgPolicyResult)
+    if err != nil {
+        return err
+    }
+    id := d.u32()
+    if err := d.finish("PolicyResult"); err != nil {
+        return err
+    }
+    l.policies[species] = policy{id: id, action: action}
+    return nil
+}
+
+func (l *siteLink) deletePolicy(species string) error {
+    p := l.policies[species]
+    if _, err := l.call(msgDeletePolicy, appendU32(nil, p.id), msgOK); err != nil {
+        return err
+    }
+    delete(l.policies, species)
+    return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+)
+
+// Message types
+const (
+    msgHello             = 0x50
+    msgError             = 0x51
+    msgOK                = 0x52
+    msgDialAuthority     = 0x53
+    msgTargetPopulations = 0x54
+    msgCreatePolicy      = 0x55
+    msgDeletePolicy      = 0x56
+    msgPolicyResult      = 0x57
+    msgSiteVisit         = 0x58
+)
+
+// Policy actions
+const (
+    actionCull     = 0x90
+    actionConserve = 0xa0
+)
+
+const (
+    protocolName    = "pestcontrol"
+    protocolVersion = 1
+
+    // maxMessageLen rejects absurd lengths before allocating for them.
+    maxMessageLen = 10_000_000
+)
+
+// errProtocol marks a malformed message; the peer is sent an Error and
+// the connection is closed.
+type errProtocol string
+
+func (e errProtocol) Error() string { return string(e) }
+
+// message is one framed message with the length and checksum stripped.
+type message struct {
+    typ     byte
+    payload []byte
+}
+
+// readMessage reads and verifies one message. A clean EOF before the first
+// byte is returned as io.EOF.
+func readMessage(r *bufio.Reader) (message, error) {
+    var header [5]byte
+    if _, err := io.ReadFull(r, header[:1]); err != nil {
+        return message{}, err
+    }
+    if _, err := io.ReadFull(r, header[1:]); err != nil {
+        return message{}, errProtocol("truncated length")
+    }
+
+    // The length counts the type, length and checksum bytes too.
+    length := binary.BigEndian.Uint32(header[1:])
+    if length < 6 {
+        return message{}, errProtocol(fmt.Sprintf("invalid length %d", length))
+    }
+    if length > maxMessageLen {
+        return message{}, errProtocol("message too large")
+    }
+
+    body := make([]byte, length-5)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return message{}, errProtocol("truncated body")
+    }
+
+    var sum byte
+    for _, b := range header {
+        sum += b
+    }
+    for _, b := range body {
+        sum += b
+    }
+    if sum != 0 {
+        return message{}, errProtocol("invalid checksum")
+    }
+
+    return message{typ: header[0], payload: body[:len(body)-1]}, nil
+}
+
+// writeMessage frames payload and writes it in a single call.
+func writeMessage(w io.Writer, typ byte, payload []byte) error {
+    buf := make([]byte, 0, len(payload)+6)
+    buf = append(buf, typ)
+    buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)+6))
+    buf = append(buf, payload...)
+
+    var sum byte
+    for _, b := range buf {
+        sum += b
+    }
+    buf = append(buf, -sum)
+
+    _, err := w.Write(buf)
+    return err
+}
+
+func appendU32(b []byte, v uint32) []byte {
+    return binary.BigEndian.AppendUint32(b, v)
+}
+
+func appendStr(b []byte, s string) []byte {
+    b = appendU32(b, uint32(len(s)))
+    return append(b, s...)
+}
+
+// helloPayload is the Hello both sides send first.
+func helloPayload() []byte {
+    return appendU32(appendStr(nil, protocolName), protocolVersion)
+}
+
+// decoder reads fields from a payload. The first out-of-bounds read sets
+// err and every later read returns zero values, so callers check once.
+type decoder struct {
+    buf []byte
+    err error
+}
+
+func (d *decoder) u8() byte {
+    if d.err != nil || len(d.buf) < 1 {
+        d.fail("u8 out of bounds")
+        return 0
+    }
+    v := d.buf[0]
+    d.buf = d.buf[1:]
+    return v
+}
+
+func (d *decoder) u32() uint32 {
+    if d.err != nil || len(d.buf) < 4 {
+        d.fail("u32 out of bounds")
+        return 0
+    }
+    v := binary.BigEndian.Uint32(d.buf)
+    d.buf = d.buf[4:]
+    return v
+}
+
+func (d *decoder) str() string {
+    n := d.u32()
+    if d.err != nil || uint64(len(d.buf)) < uint64(n) {
+        d.fail("str out of bounds")
+        return ""
+    }
+    s := string(d.buf[:n])
+    d.buf = d.buf[n:]
+    return s
+}
+
+func (d *decoder) fail(msg string) {
+    if d.err == nil {
+        d.err = errProtocol(msg)
+    }
+}
+
+// finish reports the first decoding error, or an error if any bytes were
+// left unread.
+func (d *decoder) finish(what string) error {
+    if d.err == nil && len(d.buf) > 0 {
+        d.err = errProtocol("trailing bytes in " + what)
+    }
+    return d.err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "io"
+    "math/rand"
+    "net"
+    "reflect"
+    "testing"
+    "testing/iotest"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/golden"
+    "../../lib-go/testnet"
+)
+
+func randomString(rng *rand.Rand) string {
+    b := make([]byte, rng.Intn(40))
+    rng.Read(b)
+    return string(b)
+}
+
+// TestMessageRoundTrip frames a stream of messages and reads them back a
+// byte at a time.
+func TestMessageRoundTrip(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    var sent []message
+    var stream bytes.Buffer
+    for i := 0; i < 1000; i++ {
+        m := message{typ: byte(rng.Intn(256)), payload: make([]byte, rng.Intn(300))}
+        rng.Read(m.payload)
+        if err := writeMessage(&stream, m.typ, m.payload); err != nil {
+            t.Fatal(err)
+        }
+        sent = append(sent, m)
+    }
+
+    r := bufio.NewReader(iotest.OneByteReader(&stream))
+    for i, want := range sent {
+        got, err := readMessage(r)
+        if err != nil {
+            t.Fatalf("message %d: %v", i, err)
+        }
+        if got.typ != want.typ || !bytes.Equal(got.payload, want.payload) {
+            t.Fatalf("message %d: read 0x%02x % x, wrote 0x%02x % x", i, got.typ, got.payload, want.typ, want.payload)
+        }
+    }
+    if _, err := readMessage(r); err != io.EOF {
+        t.Fatalf("after the last message: got %v, want io.EOF", err)
+    }
+}
+
+// siteVisitPayload encodes a SiteVisit as a client would.
+func siteVisitPayload(site uint32, species []string, counts []uint32) []byte {
+    b := appendU32(appendU32(nil, site), uint32(len(species)))
+    for i, s := range species {
+        b = appendU32(appendStr(b, s), counts[i])
+    }
+    return b
+}
+
+func TestSiteVisitRoundTrip(t *testing.T) {
+    rng := rand.New(rand.NewSource(2))
+    for i := 0; i < 1000; i++ {
+        site := rng.Uint32()
+        want := make(map[string]uint32)
+        var species []string
+        var counts []uint32
+        for n := rng.Intn(10); n > 0; n-- {
+            s, c := randomString(rng), rng.Uint32()
+            if prev, ok := want[s]; ok {
+                c = prev // repeating a species is fine with the same count
+            }
+            want[s] = c
+            species = append(species, s)
+            counts = append(counts, c)
+        }
+
+        gotSite, got, err := parseSiteVisit(siteVisitPayload(site, species, counts))
+        if err != nil {
+            t.Fatalf("visit %d: %v", i, err)
+        }
+        if gotSite != site || !reflect.DeepEqual(got, want) {
+            t.Fatalf("visit %d: decoded site %d %v, encoded site %d %v", i, gotSite, got, site, want)
+        }
+    }
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+    if err := checkHello(message{typ: msgHello, payload: helloPayload()}); err != nil {
+        t.Fatalf("our own Hello: %v", err)
+    }
+}
+
+// TestSessionFragmented sends a client's messages a few bytes at a time.
+// The SiteVisit's conflicting counts are only seen once it has been put
+// back together, and are answered with an Error.
+func TestSessionFragmented(t *testing.T) {
+    pool := newSitePool(refusingAddr(t), 1, time.Minute, clock.Real)
+    c := testnet.Pipe(t, func(conn net.Conn) { handleClient(pool, conn) })
+    c.Fragment(3, 1)
+    c.Expect(frame(msgHello, helloPayload()))
+    c.Send(frame(msgHello, helloPayload()))
+    c.Send(frame(msgSiteVisit, siteVisitPayload(7, []string{"dog", "cat", "dog"}, []uint32{1, 2, 3})))
+    c.Expect(frame(msgError, appendStr(nil, "conflicting counts for dog")))
+    c.ExpectClosed()
+}
+
+// TestDecodeArbitraryBytes feeds every decoder random bytes: each must
+// stop with a protocol error (or io.EOF between frames), never panic.
+func TestDecodeArbitraryBytes(t *testing.T) {
+    rng := rand.New(rand.NewSource(3))
+    for i := 0; i < 10000; i++ {
+        data := make([]byte, rng.Intn(64))
+        rng.Read(data)
+
+        var perr errProtocol
+        r := bufio.NewReader(bytes.NewReader(data))
+        for {
+            m, err := readMessage(r)
+            if err != nil {
+                if err != io.EOF && !errors.As(err, &perr) {
+                    t.Fatalf("readMessage(% x): unexpected error %v", data, err)
+                }
+                break
+            }
+            checkHello(m)
+        }
+
+        if _, _, err := parseSiteVisit(data); err != nil && !errors.As(err, &perr) {
+            t.Fatalf("parseSiteVisit(% x): unexpected error %v", data, err)
+        }
+        d := &decoder{buf: data}
+        d.str()
+        d.u32()
+        d.u8()
+        if err := d.finish("test"); err != nil && !errors.As(err, &perr) {
+            t.Fatalf("decoder(% x): unexpected error %v", data, err)
+        }
+    }
+}
+
+// FuzzReadMessage reads arbitrary client bytes, seeded with what the
+// golden transcripts send, and decodes each message read as the server
+// would. Every message must frame back to exactly the bytes it was read
+// from.
+func FuzzReadMessage(f *testing.F) {
+    streams, err := golden.Sent("../../tools-go/protohackers/golden/pest-control")
+    if err != nil {
+        f.Fatal(err)
+    }
+    for _, s := range streams {
+        f.Add(s)
+    }
+    f.Fuzz(func(t *testing.T, data []byte) {
+        src := bytes.NewReader(data)
+        r := bufio.NewReader(src)
+        consumed := 0
+        for {
+            m, err := readMessage(r)
+            if err != nil {
+                return
+            }
+            end := len(data) - src.Len() - r.Buffered()
+            var framed bytes.Buffer
+            writeMessage(&framed, m.typ, m.payload)
+            if !bytes.Equal(framed.Bytes(), data[consumed:end]) {
+                t.Fatalf("read % x, which frames as % x", data[consumed:end], framed.Bytes())
+            }
+            consumed = end
+
+            switch m.typ {
+            case msgHello:
+                checkHello(m)
+            case msgSiteVisit:
+                parseSiteVisit(m.payload)
+            }
+        }
+    })
+}
+
+// repeatReader reads data over and over, without end.
+type repeatReader struct {
+    data []byte
+    off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+    n := 0
+    for n < len(p) {
+        c := copy(p[n:], r.data[r.off:])
+        n += c
+        r.off = (r.off + c) % len(r.data)
+    }
+    return n, nil
+}
+
+// frame returns a message as it goes over the wire.
+func frame(typ byte, payload []byte) []byte {
+    var b bytes.Buffer
+    writeMessage(&b, typ, payload)
+    return b.Bytes()
+}
+
+// typicalVisit is a SiteVisit of the size the checker sends.
+var typicalVisit = siteVisitPayload(12345,
+    []string{"long-tailed rat", "dog", "black cat", "house sparrow", "brown rat"},
+    []uint32{20, 3, 1, 72, 9})
+
+// BenchmarkReadSiteVisit reads and parses one SiteVisit per op from an
+// endless stream of them. Run with -benchmem for the allocations behind
+// each.
+func BenchmarkReadSiteVisit(b *testing.B) {
+    r := bufio.NewReader(&repeatReader{data: frame(msgSiteVisit, typicalVisit)})
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        m, err := readMessage(r)
+        if err != nil {
+            b.Fatal(err)
+        }
+        if _, _, err := parseSiteVisit(m.payload); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        writeMessage(io.Discard, msgSiteVisit, typicalVisit)
+    }
+}
+
+// TestDecodeAllocations pins the allocations behind reading a message and
+// parsing a SiteVisit, so a change that adds one shows up here and not
+// just in the benchmarks. Lower a ceiling when a change saves one.
+// readMessage allocates the body, and the header that escapes through
+// io.ReadFull; parseSiteVisit the map and its buckets, and a string per
+// species.
+func TestDecodeAllocations(t *testing.T) {
+    if testnet.RaceEnabled {
+        t.Skip("the race detector allocates")
+    }
+    r := bufio.NewReader(&repeatReader{data: frame(msgSiteVisit, typicalVisit)})
+    var m message
+    if got := testing.AllocsPerRun(1000, func() { m, _ = readMessage(r) }); got > 2 {
+        t.Errorf("readMessage: %v allocations, want at most 2", got)
+    }
+    if got := testing.AllocsPerRun(1000, func() { parseSiteVisit(m.payload) }); got > 7 {
+        t.Errorf("parseSiteVisit: %v allocations, want at most 7", got)
+    }
+}
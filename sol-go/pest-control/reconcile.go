@@ -0,0 +1,211 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "sync"
+    "time"
+
+    "../../lib-go/breaker"
+    "../../lib-go/clock"
+    "../../lib-go/retry"
+)
+
+// Each site has a worker that owns its Authority link and applies visits
+// one at a time, so two sessions reporting on the same site can never
+// race to create or delete the same policy. Different sites have separate
+// workers and proceed in parallel.
+//
+// Reconciliation is desired-state: the policies a site should have depend
+// only on the latest observed counts. Visits that arrive while the worker
+// is busy therefore replace each other, and only the newest is applied.
+//
+// Each site also has its own circuit breaker around its Authority link, so
+// a site whose link keeps failing fails fast without holding up the
+// others. Counts that could not be applied are kept and tried again once
+// the breaker lets a probe through, unless a newer visit replaces them.
+
+// sitePool holds the worker for every site seen so far.
+type sitePool struct {
+    addr string
+
+    // breakerFailures Authority attempts failing in a row open a site's
+    // breaker for breakerCooldown; 0 means no breakers.
+    breakerFailures int
+    breakerCooldown time.Duration
+
+    // clock times the breakers' cooldowns and the retries they allow.
+    clock clock.Clock
+
+    // dial is how every site's link connects to the Authority.
+    dial retry.Policy
+
+    mu    sync.Mutex
+    sites map[uint32]*siteWorker
+}
+
+func newSitePool(addr string, breakerFailures int, breakerCooldown time.Duration, clk clock.Clock) *sitePool {
+    return &sitePool{
+        addr:            addr,
+        breakerFailures: breakerFailures,
+        breakerCooldown: breakerCooldown,
+        clock:           clk,
+        dial:            retry.DialPolicy(clk),
+        sites:           make(map[uint32]*siteWorker),
+    }
+}
+
+// site returns the worker for a site, starting it on first use. The
+// Authority is dialed lazily by the first visit.
+func (p *sitePool) site(id uint32) *siteWorker {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    w := p.sites[id]
+    if w == nil {
+        w = &siteWorker{
+            link:  &siteLink{addr: p.addr, site: id, dial: p.dial},
+            wake:  make(chan struct{}, 1),
+            clock: p.clock,
+        }
+        if p.breakerFailures > 0 {
+            w.breaker = breaker.New(fmt.Sprintf("authority for site %d", id), p.breakerFailures, p.breakerCooldown, p.clock)
+        }
+        p.sites[id] = w
+        go w.run()
+    }
+    return w
+}
+
+// breakerStats returns every site's breaker state and counters, by site.
+func (p *sitePool) breakerStats() map[string]breaker.Stats {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    stats := make(map[string]breaker.Stats, len(p.sites))
+    for id, w := range p.sites {
+        stats[strconv.FormatUint(uint64(id), 10)] = w.breaker.Stats()
+    }
+    return stats
+}
+
+// siteWorker serializes all reconciliation for one site.
+type siteWorker struct {
+    link    *siteLink
+    breaker *breaker.Breaker // nil if there are no breakers
+    clock   clock.Clock
+
+    mu     sync.Mutex
+    latest map[string]uint32 // newest counts not yet applied, or nil
+    wake   chan struct{}
+}
+
+// submit queues a visit's counts, replacing any not yet applied.
+func (w *siteWorker) submit(counts map[string]uint32) {
+    w.mu.Lock()
+    w.latest = counts
+    w.mu.Unlock()
+    w.poke()
+}
+
+// retry puts back counts that could not be applied, unless a newer visit
+// has replaced them meanwhile, and wakes the worker to try again once the
+// breaker allows. Without a breaker nothing would bound the retries, so
+// the counts are dropped and the site waits for its next visit.
+func (w *siteWorker) retry(counts map[string]uint32) {
+    if w.breaker == nil {
+        return
+    }
+    w.mu.Lock()
+    if w.latest == nil {
+        w.latest = counts
+    }
+    w.mu.Unlock()
+    w.clock.AfterFunc(w.breaker.RetryAfter(), w.poke)
+}
+
+func (w *siteWorker) poke() {
+    select {
+    case w.wake <- struct{}{}:
+    default: // already woken
+    }
+}
+
+func (w *siteWorker) run() {
+    for range w.wake {
+        w.mu.Lock()
+        counts := w.latest
+        w.latest = nil
+        w.mu.Unlock()
+
+        if counts == nil {
+            continue
+        }
+        if err := w.apply(counts); err != nil {
+            fmt.Printf("[ERROR] Site %d: %v\n", w.link.site, err)
+            w.retry(counts)
+        }
+    }
+}
+
+// apply reconciles the site against counts. If the connection fails part
+// way, it reconnects once and starts over. Each attempt goes through the
+// breaker.
+func (w *siteWorker) apply(counts map[string]uint32) error {
+    l := w.link
+
+    var err error
+    for attempt := 0; attempt < 2; attempt++ {
+        if !w.breaker.Allow() {
+            return breaker.ErrOpen
+        }
+        if l.conn == nil {
+            if err = l.connect(); err != nil {
+                w.breaker.Done(err)
+                continue
+            }
+        }
+        err = l.reconcile(counts)
+        w.breaker.Done(err)
+        if err == nil {
+            return nil
+        }
+        l.close()
+    }
+    return err
+}
+
+// desiredAction returns the policy a species should have for its count:
+// conserve below the target, cull above it, or none (0) within it.
+func desiredAction(t target, count uint32) byte {
+    switch {
+    case count < t.min:
+        return actionConserve
+    case count > t.max:
+        return actionCull
+    }
+    return 0
+}
+
+// reconcile creates, replaces or deletes policies so each target species
+// has the one its count calls for. Species without a target are left alone.
+func (l *siteLink) reconcile(counts map[string]uint32) error {
+    for species, t := range l.targets {
+        want := desiredAction(t, counts[species])
+
+        current, ok := l.policies[species]
+        if ok && current.action == want {
+            continue
+        }
+        if ok {
+            if err := l.deletePolicy(species); err != nil {
+                return err
+            }
+        }
+        if want != 0 {
+            if err := l.createPolicy(species, want); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
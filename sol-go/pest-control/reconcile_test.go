@@ -0,0 +1,60 @@
+package main
+
+import (
+    "net"
+    "testing"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/retry"
+)
+
+// refusingAddr returns an address that refuses connections.
+func refusingAddr(t *testing.T) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := l.Addr().String()
+    l.Close()
+    return addr
+}
+
+// waitForOpens waits for w's breaker to have opened n times.
+func waitForOpens(t *testing.T, w *siteWorker, n int64) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for w.breaker.Stats().Opens < n {
+        if time.Now().After(deadline) {
+            t.Fatalf("breaker opened %d times, want %d", w.breaker.Stats().Opens, n)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// TestRetryAfterCooldown checks that counts the Authority could not take
+// are tried again when the breaker's cooldown ends, and not before.
+func TestRetryAfterCooldown(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    pool := newSitePool(refusingAddr(t), 1, time.Minute, clk)
+    pool.dial = retry.Policy{Attempts: 1} // only the breaker retries
+    w := pool.site(1)
+    w.submit(map[string]uint32{"dog": 1})
+
+    waitForOpens(t, w, 1)
+    clk.BlockUntil(1) // the retry
+    clk.Advance(59 * time.Second)
+    time.Sleep(20 * time.Millisecond)
+    if w.breaker.Stats().Opens != 1 {
+        t.Fatal("retried before the cooldown ended")
+    }
+
+    clk.Advance(time.Second)
+    waitForOpens(t, w, 2)
+    clk.BlockUntil(1) // the next retry, set once the counts are back
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.latest == nil {
+        t.Fatal("counts dropped after the retry failed")
+    }
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "expvar"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/signals"
+)
+
+const authorityAddress = "pestcontrol.protohackers.com:20547"
+
+// parseSiteVisit decodes a SiteVisit into its site and species counts.
+// Listing a species twice with different counts is an error.
+func parseSiteVisit(payload []byte) (uint32, map[string]uint32, error) {
+    d := &decoder{buf: payload}
+    site := d.u32()
+    counts := make(map[string]uint32)
+    for n := d.u32(); n > 0 && d.err == nil; n-- {
+        species, count := d.str(), d.u32()
+        if prev, ok := counts[species]; ok && prev != count {
+            return 0, nil, errProtocol("conflicting counts for " + species)
+        }
+        counts[species] = count
+    }
+    if err := d.finish("SiteVisit"); err != nil {
+        return 0, nil, err
+    }
+    return site, counts, nil
+}
+
+// checkHello validates the client's Hello.
+func checkHello(m message) error {
+    if m.typ != msgHello {
+        return errProtocol("expected Hello")
+    }
+    d := &decoder{buf: m.payload}
+    name, version := d.str(), d.u32()
+    if err := d.finish("Hello"); err != nil {
+        return err
+    }
+    if name != protocolName || version != protocolVersion {
+        return errProtocol("unsupported protocol/version")
+    }
+    return nil
+}
+
+// session reads Hello and then SiteVisits from one client until it
+// disconnects or breaks the protocol.
+func session(pool *sitePool, conn net.Conn, reader *bufio.Reader) error {
+    if err := writeMessage(conn, msgHello, helloPayload()); err != nil {
+        return err
+    }
+
+    m, err := readMessage(reader)
+    if err != nil {
+        return err
+    }
+    if err := checkHello(m); err != nil {
+        return err
+    }
+
+    for {
+        m, err := readMessage(reader)
+        if err != nil {
+            return err
+        }
+
+        switch m.typ {
+        case msgSiteVisit:
+            site, counts, err := parseSiteVisit(m.payload)
+            if err != nil {
+                return err
+            }
+            // The site's worker applies it; Authority trouble is ours, not
+            // the client's, so the client isn't kept waiting for it.
+            pool.site(site).submit(counts)
+        case msgError:
+            return nil
+        default:
+            return errProtocol(fmt.Sprintf("unexpected message type 0x%02x", m.typ))
+        }
+    }
+}
+
+func handleClient(pool *sitePool, conn net.Conn) {
+    defer conn.Close()
+
+    addr := conn.RemoteAddr()
+    fmt.Printf("[NEW CONNECTION] %s connected.\n", addr)
+
+    err := session(pool, conn, bufio.NewReader(conn))
+
+    var perr errProtocol
+    switch {
+    case errors.As(err, &perr):
+        writeMessage(conn, msgError, appendStr(nil, perr.Error()))
+        fmt.Printf("[ERROR] %s: %v\n", addr, perr)
+    case err != nil && !errors.Is(err, io.EOF):
+        fmt.Printf("[ERROR] Connection error with %s: %v\n", addr, err)
+    }
+    fmt.Printf("[DISCONNECTED] %s disconnected.\n", addr)
+}
+
+func startServer(host string, port string, pool *sitePool, admin string) {
+    if admin != "" {
+        // expvar registers /debug/vars on the default mux.
+        expvar.Publish("breakers", expvar.Func(func() any { return pool.breakerStats() }))
+        go func() {
+            fmt.Printf("[ADMIN] Breaker state by site on http://%s/debug/vars\n", admin)
+            if err := http.ListenAndServe(admin, nil); err != nil {
+                fmt.Printf("[ERROR] Admin listener: %v\n", err)
+            }
+        }()
+    }
+
+    address := host + ":" + port
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer listener.Close()
+
+    fmt.Printf("[LISTENING] Pest Control Server listening on %s\n", address)
+
+    // Handle graceful shutdown
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        listener.Close()
+    })
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            fmt.Printf("[ERROR] Accept error: %v\n", err)
+            continue
+        }
+
+        go handleClient(pool, conn)
+    }
+}
+
+func main() {
+    port := flag.String("port", "65432", "TCP port to listen on")
+    authority := flag.String("authority", authorityAddress, "Authority server address")
+    breakerFailures := flag.Int("breaker-failures", 5, "failed Authority attempts in a row that open a site's circuit breaker (0 = no breakers)")
+    breakerCooldown := flag.Duration("breaker-cooldown", 10*time.Second, "how long an open breaker holds a site's visits before probing the Authority")
+    admin := flag.String("admin", "", "address to serve the breakers' state on at /debug/vars (none if empty)")
+    flag.Parse()
+
+    pool := newSitePool(*authority, *breakerFailures, *breakerCooldown, clock.Real)
+    startServer("0.0.0.0", *port, pool, *admin)
+}
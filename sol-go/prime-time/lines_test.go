@@ -0,0 +1,41 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "strings"
+    "testing"
+
+    "../../lib-go/lines"
+)
+
+// primeTraffic is prime-time requests: mostly small integers, some
+// floats and negatives, and now and then a number hundreds of digits long.
+func primeTraffic(rng *rand.Rand, size int) []byte {
+    var b bytes.Buffer
+    for b.Len() < size {
+        var n string
+        switch r := rng.Intn(100); {
+        case r < 70:
+            n = fmt.Sprint(rng.Intn(1 << 20))
+        case r < 85:
+            n = fmt.Sprint(rng.Float64() * 1e6)
+        case r < 97:
+            n = fmt.Sprint(-rng.Int63())
+        default:
+            n = strings.Repeat("9", 100+rng.Intn(900))
+        }
+        fmt.Fprintf(&b, `{"method":"isPrime","number":%s}`+"\n", n)
+    }
+    return b.Bytes()
+}
+
+// BenchmarkLineReading reads a megabyte of requests into lines with each
+// of the strategies lines.Benchmark compares. handleClient uses
+// bufio.Scanner, which owns the connection.
+//
+//    go test -run NONE -bench LineReading -benchmem
+func BenchmarkLineReading(b *testing.B) {
+    lines.Benchmark(b, primeTraffic(rand.New(rand.NewSource(1)), 1<<20))
+}
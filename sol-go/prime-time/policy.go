@@ -0,0 +1,80 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// policy decides the protocol's edge cases: what counts as a well-formed
+// request and what happens to one that isn't. specPolicy is what the
+// checker expects; the others are for experiments and local testing, so
+// they don't need their own copy of handleClient.
+type policy interface {
+    // parse returns the number asked about, or ok false if the request
+    // is malformed.
+    parse(line []byte) (n float64, ok bool)
+    // malformed returns the reply to a malformed request, and whether to
+    // disconnect after sending it.
+    malformed(line []byte) (reply []byte, disconnect bool)
+}
+
+func parsePolicy(s string) (policy, error) {
+    switch s {
+    case "spec":
+        return specPolicy{}, nil
+    case "lenient":
+        return lenientPolicy{}, nil
+    }
+    return nil, fmt.Errorf("unknown policy %q (want spec or lenient)", s)
+}
+
+// specPolicy wants {"method":"isPrime","number":<number>} exactly, and
+// answers anything else with "malformed" and a disconnect.
+type specPolicy struct{}
+
+func (specPolicy) parse(line []byte) (float64, bool) {
+    var req Request
+    if err := json.Unmarshal(line, &req); err != nil {
+        return 0, false
+    }
+    // Check for missing fields (nil) or incorrect method
+    if req.Method == nil || *req.Method != "isPrime" || req.Number == nil {
+        return 0, false
+    }
+    return *req.Number, true
+}
+
+func (specPolicy) malformed(line []byte) ([]byte, bool) {
+    return []byte("malformed\n"), true
+}
+
+// lenientPolicy is for poking at the server by hand: the method name is
+// matched case-insensitively, the number may be a string, and a malformed
+// request gets an explanation instead of a disconnect.
+type lenientPolicy struct{}
+
+func (lenientPolicy) parse(line []byte) (float64, bool) {
+    var req struct {
+        Method string          `json:"method"`
+        Number json.RawMessage `json:"number"`
+    }
+    if err := json.Unmarshal(line, &req); err != nil || !strings.EqualFold(req.Method, "isPrime") {
+        return 0, false
+    }
+    var n float64
+    if json.Unmarshal(req.Number, &n) == nil {
+        return n, true
+    }
+    var s string
+    if json.Unmarshal(req.Number, &s) != nil {
+        return 0, false
+    }
+    n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+    return n, err == nil
+}
+
+func (lenientPolicy) malformed(line []byte) ([]byte, bool) {
+    return []byte(`{"error":"malformed: want {\"method\":\"isPrime\",\"number\":<number>}"}` + "\n"), false
+}
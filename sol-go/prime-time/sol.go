@@ -2,10 +2,18 @@ package main
 
 import (
     "bufio"
+    "context"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
     "math"
     "net"
+    "os"
+    "sync"
+    "time"
+
+    "../../lib-go/clock"
 )
 
 // Request defines the expected structure of client data.
@@ -20,34 +28,62 @@ type Response struct {
     Prime  bool   `json:"prime"`
 }
 
-// isPrime checks if the number is a valid prime integer.
-func isPrime(n float64) bool {
+// isPrime checks if the number is a valid prime integer. Trial division
+// of a large prime takes seconds, so it gives up with ok false if deadline
+// (unless zero) passes first.
+func isPrime(n float64, deadline time.Time) (prime, ok bool) {
     // Check if it is an integer (e.g., 5.0 is okay, 5.5 is not)
     if n != math.Trunc(n) {
-        return false
+        return false, true
     }
 
     // Convert to integer for primality test
     i := int64(n)
 
     if i <= 1 {
-        return false
+        return false, true
     }
     if i <= 3 {
-        return true
+        return true, true
     }
     if i%2 == 0 || i%3 == 0 {
-        return false
+        return false, true
     }
 
-    for k := int64(5); k*k <= i; k += 6 {
+    for k, step := int64(5), 0; k*k <= i; k, step = k+6, step+1 {
         if i%k == 0 || i%(k+2) == 0 {
-            return false
+            return false, true
+        }
+        if step%65536 == 0 && !deadline.IsZero() && budgetClock.Now().After(deadline) {
+            return false, false
         }
     }
-    return true
+    return true, true
 }
 
+// Silence is fatal here: a client sends a request and waits for the
+// answer, so one that says nothing for idleTimeout is stuck or gone and is
+// dropped. The read deadline does that job, so TCP keepalives are off.
+var idleTimeout = flag.Duration("idle-timeout", 60*time.Second, "drop a client silent for this long (0 to never)")
+
+// computeBudget is the total time a connection may spend in primality
+// checks, so one client sending huge primes can't keep the CPUs to itself.
+// A check that would take it over is cut short and the client dropped.
+var computeBudget = flag.Duration("compute-budget", 0, "primality-checking time each connection may use in all (0 = unlimited)")
+
+// budgetClock times the primality checks against computeBudget.
+var budgetClock clock.Clock = clock.Real
+
+// edgePolicy handles the protocol's edge cases; see policy.
+var edgePolicy policy = specPolicy{}
+
+// lineBuffers holds scanner buffers for reuse, so each new connection
+// doesn't allocate (and later collect) its own.
+var lineBuffers = sync.Pool{New: func() any {
+    b := make([]byte, 4096)
+    return &b
+}}
+
 func handleClient(conn net.Conn) {
     // Ensure connection closes when this function returns
     defer conn.Close()
@@ -56,25 +92,44 @@ func handleClient(conn net.Conn) {
 
     // bufio.Scanner handles the buffering and splitting by '\n' automatically
     scanner := bufio.NewScanner(conn)
+    buf := lineBuffers.Get().(*[]byte)
+    defer lineBuffers.Put(buf)
+    scanner.Buffer(*buf, bufio.MaxScanTokenSize)
+    budget := *computeBudget
+
+    for {
+        if *idleTimeout > 0 {
+            conn.SetReadDeadline(time.Now().Add(*idleTimeout))
+        }
+        if !scanner.Scan() {
+            break
+        }
 
-    for scanner.Scan() {
         // scanner.Bytes() gets the raw line excluding the newline char
         line := scanner.Bytes()
 
         // 1. Parse JSON
-        var req Request
-        if err := json.Unmarshal(line, &req); err != nil {
-            conn.Write([]byte("malformed\n"))
-            return // Disconnect immediately
+        number, ok := edgePolicy.parse(line)
+        if !ok {
+            reply, disconnect := edgePolicy.malformed(line)
+            conn.Write(reply)
+            if disconnect {
+                return
+            }
+            continue
         }
 
-        // Check for missing fields (nil) or incorrect method
-        if req.Method == nil || *req.Method != "isPrime" || req.Number == nil {
-            conn.Write([]byte("malformed\n"))
-            return // Disconnect immediately
+        var deadline time.Time
+        start := budgetClock.Now()
+        if *computeBudget > 0 {
+            deadline = start.Add(budget)
+        }
+        isP, ok := isPrime(number, deadline)
+        budget -= budgetClock.Since(start)
+        if !ok || *computeBudget > 0 && budget <= 0 {
+            fmt.Printf("[BUDGET] %s used up its %v compute budget, disconnecting.\n", conn.RemoteAddr(), *computeBudget)
+            return
         }
-
-        isP := isPrime(*req.Number)
 
         // 4. Send Response
         resp := Response{
@@ -92,7 +147,9 @@ func handleClient(conn net.Conn) {
         conn.Write(append(respBytes, '\n'))
     }
 
-    if err := scanner.Err(); err != nil {
+    if err := scanner.Err(); errors.Is(err, os.ErrDeadlineExceeded) {
+        fmt.Printf("[TIMEOUT] %s silent for %v, disconnecting.\n", conn.RemoteAddr(), *idleTimeout)
+    } else if err != nil {
         fmt.Printf("[ERROR] connection error with %s: %v\n", conn.RemoteAddr(), err)
     } else {
         fmt.Printf("[DISCONNECTED] %s disconnected.\n", conn.RemoteAddr())
@@ -100,15 +157,26 @@ func handleClient(conn net.Conn) {
 }
 
 func main() {
-    port := ":65432"
-    listener, err := net.Listen("tcp", port)
+    port := flag.String("port", "65432", "TCP port to listen on")
+    policyName := flag.String("policy", "spec", "edge-case policy: spec, or lenient for poking at the server by hand")
+    flag.Parse()
+
+    var err error
+    if edgePolicy, err = parsePolicy(*policyName); err != nil {
+        fmt.Println("[ERROR]", err)
+        os.Exit(2)
+    }
+
+    address := ":" + *port
+    lc := net.ListenConfig{KeepAlive: -1}
+    listener, err := lc.Listen(context.Background(), "tcp", address)
     if err != nil {
         fmt.Println("[ERROR] Could not start server:", err)
         return
     }
     defer listener.Close()
 
-    fmt.Println("[LISTENING] Server is listening on", port)
+    fmt.Println("[LISTENING] Server is listening on", address)
 
     for {
         // Accept blocks until a new client connects
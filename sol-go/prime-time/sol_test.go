@@ -0,0 +1,156 @@
+package main
+
+import (
+    "io"
+    "math"
+    "net"
+    "testing"
+    "time"
+
+    "../../lib-go/testnet"
+)
+
+func TestHandleClientAnswers(t *testing.T) {
+    c := testnet.Pipe(t, handleClient)
+    for req, want := range map[string]string{
+        `{"method":"isPrime","number":7}`:                  `{"method":"isPrime","prime":true}`,
+        `{"number":91,"method":"isPrime"}`:                 `{"method":"isPrime","prime":false}`,
+        `{"method":"isPrime","number":7.5}`:                `{"method":"isPrime","prime":false}`,
+        `{"method":"isPrime","number":-3,"extra":[1,2,3]}`: `{"method":"isPrime","prime":false}`,
+        `{"method":"isPrime","number":2147483647}`:         `{"method":"isPrime","prime":true}`,
+    } {
+        c.SendLine(req)
+        c.ExpectLine(want)
+    }
+}
+
+// TestHandleClientFragmented sends requests a few bytes at a time and
+// expects an answer to each.
+func TestHandleClientFragmented(t *testing.T) {
+    c := testnet.Pipe(t, handleClient)
+    c.Fragment(4, 1)
+    for _, rr := range []struct{ req, want string }{
+        {`{"method":"isPrime","number":13}`, `{"method":"isPrime","prime":true}`},
+        {`{"method":"isPrime","number":15}`, `{"method":"isPrime","prime":false}`},
+        {`{"method":"isPrime","number":2147483647}`, `{"method":"isPrime","prime":true}`},
+    } {
+        c.SendLine(rr.req)
+        c.ExpectLine(rr.want)
+    }
+}
+
+func TestHandleClientMalformed(t *testing.T) {
+    for _, req := range []string{
+        `{"method":"isPrime"}`,
+        `{"method":"isprime","number":7}`,
+        `{"method":"isPrime","number":"7"}`,
+        `not json`,
+    } {
+        c := testnet.Pipe(t, handleClient)
+        c.SendLine(req)
+        c.ExpectLine("malformed")
+        c.ExpectClosed()
+    }
+}
+
+func TestHandleClientComputeBudget(t *testing.T) {
+    defer func(old time.Duration) { *computeBudget = old }(*computeBudget)
+    *computeBudget = time.Nanosecond
+
+    c := testnet.Pipe(t, handleClient)
+    c.SendLine(`{"method":"isPrime","number":2147483647}`)
+    c.ExpectClosed()
+}
+
+// TestHandleClientReadErrors checks every way a read can fail ends the
+// connection, after answering what had arrived whole.
+func TestHandleClientReadErrors(t *testing.T) {
+    req := `{"method":"isPrime","number":7}` + "\n"
+    for name, last := range map[string]testnet.Read{
+        "timeout": {Err: testnet.ErrTimeout},
+        "reset":   {Err: testnet.ErrTransient},
+        "eof":     {Err: io.EOF},
+    } {
+        conn := testnet.NewConn(append(testnet.Bytewise(req), last)...)
+        handleClient(conn)
+        if got := string(conn.Written()); got != `{"method":"isPrime","prime":true}`+"\n" {
+            t.Errorf("%s: wrote %q", name, got)
+        }
+        if !conn.Closed() {
+            t.Errorf("%s: connection left open", name)
+        }
+        if conn.ReadDeadline().IsZero() {
+            t.Errorf("%s: no idle deadline set", name)
+        }
+    }
+}
+
+// requestConn is a connection that sends the same request n times, then
+// EOF, and throws away the replies.
+type requestConn struct {
+    net.Conn // only Read, Write, Close, RemoteAddr and SetReadDeadline are called
+    req      []byte
+    off, n   int
+    replies  int
+}
+
+func (c *requestConn) Read(p []byte) (int, error) {
+    read := 0
+    for read < len(p) && c.n > 0 {
+        m := copy(p[read:], c.req[c.off:])
+        read += m
+        if c.off += m; c.off == len(c.req) {
+            c.off = 0
+            c.n--
+        }
+    }
+    if read == 0 {
+        return 0, io.EOF
+    }
+    return read, nil
+}
+
+func (c *requestConn) Write(p []byte) (int, error) {
+    c.replies++
+    return len(p), nil
+}
+
+func (c *requestConn) Close() error                    { return nil }
+func (c *requestConn) RemoteAddr() net.Addr            { return &net.TCPAddr{} }
+func (c *requestConn) SetReadDeadline(time.Time) error { return nil }
+
+// BenchmarkRequest handles one request per op, from parsing its JSON to
+// writing the reply. Run with -benchmem for the allocations behind each.
+func BenchmarkRequest(b *testing.B) {
+    for _, bc := range []struct{ name, req string }{
+        {"small", `{"method":"isPrime","number":7919}`},
+        {"float", `{"method":"isPrime","number":7919.5}`},
+        {"large", `{"method":"isPrime","number":2147483647}`},
+    } {
+        b.Run(bc.name, func(b *testing.B) {
+            b.ReportAllocs()
+            conn := &requestConn{req: []byte(bc.req + "\n"), n: b.N}
+            handleClient(conn)
+            if conn.replies != b.N {
+                b.Fatalf("%d replies to %d requests", conn.replies, b.N)
+            }
+        })
+    }
+}
+
+// TestRequestAllocations pins the allocations behind handling a request,
+// so a change that adds one shows up here and not just in the benchmark.
+// Lower the ceiling when a change saves one.
+func TestRequestAllocations(t *testing.T) {
+    if testnet.RaceEnabled {
+        t.Skip("the race detector allocates")
+    }
+    const requests = 1000
+    req := []byte(`{"method":"isPrime","number":7919}` + "\n")
+    perConn := testing.AllocsPerRun(10, func() { handleClient(&requestConn{req: req, n: requests}) })
+    // The connection's own allocations, spread over the requests, round
+    // away.
+    if got, want := math.Round(perConn/requests), 6.0; got > want {
+        t.Fatalf("%v allocations per request, want at most %v", got, want)
+    }
+}
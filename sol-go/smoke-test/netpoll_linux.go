@@ -0,0 +1,234 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "syscall"
+
+    "../../lib-go/signals"
+)
+
+// pollConn is what the event loop keeps per connection: its address and
+// any echoed bytes the socket would not take yet.
+type pollConn struct {
+    addr    string
+    pending []byte
+    eof     bool // the client shut down its sending side
+}
+
+// netpoller echoes on every connection from one goroutine driven by epoll,
+// so an idle connection costs a file descriptor and a pollConn rather than
+// a goroutine stack and a read buffer.
+type netpoller struct {
+    epfd     int
+    listenFd int
+    wakeR    int // readable once the server should stop
+    conns    map[int]*pollConn
+
+    // buffer is read into for every connection in turn. It is one fixed
+    // size, not adapted per connection as handleClient's are: it is shared,
+    // so an idle connection holds no buffer to shrink.
+    buffer []byte
+}
+
+func listenSocket(host, port string) (int, error) {
+    addr, err := net.ResolveTCPAddr("tcp4", host+":"+port)
+    if err != nil {
+        return -1, err
+    }
+    fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+    if err != nil {
+        return -1, err
+    }
+    sa := &syscall.SockaddrInet4{Port: addr.Port}
+    copy(sa.Addr[:], addr.IP.To4())
+    if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+        syscall.Close(fd)
+        return -1, err
+    }
+    if err := syscall.Bind(fd, sa); err != nil {
+        syscall.Close(fd)
+        return -1, err
+    }
+    if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+        syscall.Close(fd)
+        return -1, err
+    }
+    return fd, nil
+}
+
+func (p *netpoller) watch(fd int, events uint32) error {
+    return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)})
+}
+
+func (p *netpoller) rewatch(fd int, events uint32) {
+    syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)})
+}
+
+func (p *netpoller) accept() {
+    for {
+        fd, sa, err := syscall.Accept4(p.listenFd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+        if err == syscall.EAGAIN {
+            return
+        }
+        if err != nil {
+            fmt.Printf("[ERROR] Accept error: %v\n", err)
+            return
+        }
+        addr := "unknown"
+        if in, ok := sa.(*syscall.SockaddrInet4); ok {
+            addr = fmt.Sprintf("%s:%d", net.IP(in.Addr[:]), in.Port)
+        }
+        if err := p.watch(fd, syscall.EPOLLIN|syscall.EPOLLRDHUP); err != nil {
+            fmt.Printf("[ERROR] Watching %s: %v\n", addr, err)
+            syscall.Close(fd)
+            continue
+        }
+        p.conns[fd] = &pollConn{addr: addr}
+        fmt.Printf("[NEW CONNECTION] %s connected.\n", addr)
+        fmt.Printf("[ACTIVE CONNECTIONS] %d\n", len(p.conns))
+    }
+}
+
+func (p *netpoller) close(fd int) {
+    c := p.conns[fd]
+    delete(p.conns, fd)
+    syscall.Close(fd) // also removes it from the epoll set
+    fmt.Printf("[DISCONNECTED] %s disconnected.\n", c.addr)
+}
+
+// flush writes what is pending. It returns false once the connection is
+// finished with, either broken or drained after the client's EOF.
+func (p *netpoller) flush(fd int, c *pollConn) bool {
+    for len(c.pending) > 0 {
+        n, err := syscall.Write(fd, c.pending)
+        if err == syscall.EAGAIN {
+            // Stop reading until the client takes what it has been sent.
+            p.rewatch(fd, syscall.EPOLLOUT)
+            return true
+        }
+        if err != nil {
+            fmt.Printf("[ERROR] Write error with %s: %v\n", c.addr, err)
+            return false
+        }
+        c.pending = c.pending[n:]
+    }
+    c.pending = nil
+    if c.eof {
+        return false
+    }
+    p.rewatch(fd, syscall.EPOLLIN|syscall.EPOLLRDHUP)
+    return true
+}
+
+func (p *netpoller) read(fd int, c *pollConn) bool {
+    for {
+        n, err := syscall.Read(fd, p.buffer)
+        if err == syscall.EAGAIN {
+            return true
+        }
+        if err != nil {
+            fmt.Printf("[ERROR] Connection error with %s: %v\n", c.addr, err)
+            return false
+        }
+        if n == 0 {
+            c.eof = true
+            return p.flush(fd, c)
+        }
+        c.pending = append(c.pending, p.buffer[:n]...)
+        if !p.flush(fd, c) {
+            return false
+        }
+        if len(c.pending) > 0 {
+            return true // blocked; the rest is read once it drains
+        }
+    }
+}
+
+func (p *netpoller) run() {
+    events := make([]syscall.EpollEvent, 256)
+    for {
+        n, err := syscall.EpollWait(p.epfd, events, -1)
+        if err == syscall.EINTR {
+            continue
+        }
+        if err != nil {
+            fmt.Printf("[ERROR] epoll_wait: %v\n", err)
+            return
+        }
+        for _, ev := range events[:n] {
+            fd := int(ev.Fd)
+            switch fd {
+            case p.wakeR:
+                return
+            case p.listenFd:
+                p.accept()
+                continue
+            }
+            c := p.conns[fd]
+            if c == nil {
+                continue
+            }
+            ok := true
+            if ev.Events&syscall.EPOLLOUT != 0 {
+                ok = p.flush(fd, c)
+            } else if ev.Events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+                ok = p.read(fd, c)
+            }
+            if !ok {
+                p.close(fd)
+            }
+        }
+    }
+}
+
+func init() {
+    startNetpollServer = serveNetpoll
+}
+
+// serveNetpoll serves the echo protocol from a single epoll loop instead
+// of a goroutine per connection.
+func serveNetpoll(host string, port string) {
+    listenFd, err := listenSocket(host, port)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer syscall.Close(listenFd)
+
+    epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer syscall.Close(epfd)
+
+    var wake [2]int
+    if err := syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer syscall.Close(wake[0])
+    defer syscall.Close(wake[1])
+
+    p := &netpoller{epfd: epfd, listenFd: listenFd, wakeR: wake[0], conns: make(map[int]*pollConn), buffer: make([]byte, 4096)}
+    for _, fd := range []int{listenFd, wake[0]} {
+        if err := p.watch(fd, syscall.EPOLLIN); err != nil {
+            fmt.Printf("[ERROR] Could not start server: %v\n", err)
+            return
+        }
+    }
+
+    fmt.Printf("[LISTENING] Server is listening on %s:%s (netpoll)\n", host, port)
+
+    // Handle graceful shutdown
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        syscall.Write(wake[1], []byte{0})
+    })
+
+    p.run()
+    for fd := range p.conns {
+        p.close(fd)
+    }
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+    "flag"
     "fmt"
     "io"
     "net"
     "os"
-    "os/signal"
     "runtime"
-    "syscall"
 	"errors"
+
+    "../../lib-go/signals"
+)
+
+// Read buffers adapt to each client: most send a few bytes at a time, so
+// they start small, but a read that fills the buffer doubles it (for bulk
+// transfers), and a run of reads using under a quarter of it halves it.
+const (
+    minBufferSize = 512
+    maxBufferSize = 64 * 1024
+    shrinkAfter   = 16
 )
 
 // handleClient handles a single client connection.
@@ -23,7 +33,8 @@ func handleClient(conn net.Conn) {
         fmt.Printf("[DISCONNECTED] %s disconnected.\n", addr)
     }()
 
-    buffer := make([]byte, 4096)
+    buffer := make([]byte, minBufferSize)
+    small := 0 // consecutive reads using under a quarter of buffer
 
     for {
         // Read data from the connection
@@ -44,6 +55,19 @@ func handleClient(conn net.Conn) {
             fmt.Printf("[ERROR] Write error with %s: %v\n", addr, err)
             break
         }
+
+        switch {
+        case n == len(buffer) && len(buffer) < maxBufferSize:
+            buffer = make([]byte, 2*len(buffer))
+            small = 0
+        case n < len(buffer)/4 && len(buffer) > minBufferSize:
+            if small++; small >= shrinkAfter {
+                buffer = make([]byte, len(buffer)/2)
+                small = 0
+            }
+        default:
+            small = 0
+        }
     }
 }
 
@@ -60,13 +84,10 @@ func startServer(host string, port string) {
     fmt.Printf("[LISTENING] Server is listening on %s\n", address)
 
     // Handle graceful shutdown
-    c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-    go func() {
-        <-c // Block until signal is received
+    signals.OnShutdown(func() {
         fmt.Println("\n[SHUTTING DOWN] Server stopping...")
         listener.Close() 
-    }()
+    })
 
     for {
         conn, err := listener.Accept()
@@ -88,6 +109,22 @@ func startServer(host string, port string) {
     }
 }
 
+// startNetpollServer is the epoll server, registered by netpoll_linux.go;
+// it is nil on other systems.
+var startNetpollServer func(host string, port string)
+
 func main() {
-    startServer("0.0.0.0", "65432")
+    port := flag.String("port", "65432", "TCP port to listen on")
+    netpoll := flag.Bool("netpoll", false, "serve every connection from one epoll loop instead of a goroutine each, reading into one fixed 4 KiB buffer they share rather than an adaptive buffer per connection (Linux only)")
+    flag.Parse()
+
+    if *netpoll {
+        if startNetpollServer == nil {
+            fmt.Println("[ERROR] -netpoll needs Linux")
+            os.Exit(2)
+        }
+        startNetpollServer("0.0.0.0", *port)
+        return
+    }
+    startServer("0.0.0.0", *port)
 }
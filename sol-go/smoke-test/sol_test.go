@@ -0,0 +1,190 @@
+package main
+
+import (
+    "io"
+    "net"
+    "testing"
+
+    "../../lib-go/testnet"
+)
+
+// echoConn is a connection that sends segments segments of size bytes,
+// then EOF, and throws away what is written back. A read never spans two
+// segments, as if each arrived after the last was read.
+type echoConn struct {
+    net.Conn // only Read, Write, Close and RemoteAddr are called
+    segment  []byte
+    left     []byte // rest of the current segment
+    segments int
+    echoed   int
+}
+
+func newEchoConn(size, segments int) *echoConn {
+    return &echoConn{segment: make([]byte, size), segments: segments}
+}
+
+func (c *echoConn) Read(p []byte) (int, error) {
+    if len(c.left) == 0 {
+        if c.segments == 0 {
+            return 0, io.EOF
+        }
+        c.segments--
+        c.left = c.segment
+    }
+    n := copy(p, c.left)
+    c.left = c.left[n:]
+    return n, nil
+}
+
+func (c *echoConn) Write(p []byte) (int, error) {
+    c.echoed += len(p)
+    return len(p), nil
+}
+
+func (c *echoConn) Close() error         { return nil }
+func (c *echoConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+func TestEchoesShortReads(t *testing.T) {
+    msg := "hello, this arrives a byte at a time"
+    conn := testnet.NewConn(testnet.Bytewise(msg)...)
+    handleClient(conn)
+    if got := string(conn.Written()); got != msg {
+        t.Fatalf("echoed %q", got)
+    }
+    if !conn.Closed() {
+        t.Fatal("connection left open")
+    }
+}
+
+// sizedConn records the size of the buffer each Read is given.
+type sizedConn struct {
+    *testnet.Conn
+    sizes []int
+}
+
+func (c *sizedConn) Read(p []byte) (int, error) {
+    c.sizes = append(c.sizes, len(p))
+    return c.Conn.Read(p)
+}
+
+// bufferSizes echoes reads and returns the buffer size of each read,
+// without the last one that finds EOF.
+func bufferSizes(t *testing.T, reads ...testnet.Read) []int {
+    t.Helper()
+    conn := &sizedConn{Conn: testnet.NewConn(reads...)}
+    handleClient(conn)
+    return conn.sizes[:len(conn.sizes)-1]
+}
+
+// fill is a read step of n bytes.
+func fill(n int) testnet.Read {
+    return testnet.Read{Data: make([]byte, n)}
+}
+
+// repeat is n copies of step.
+func repeat(n int, step testnet.Read) []testnet.Read {
+    steps := make([]testnet.Read, n)
+    for i := range steps {
+        steps[i] = step
+    }
+    return steps
+}
+
+// growTo is reads that fill the buffer until it is size.
+func growTo(size int) []testnet.Read {
+    var steps []testnet.Read
+    for n := minBufferSize; n < size; n *= 2 {
+        steps = append(steps, fill(n))
+    }
+    return steps
+}
+
+func TestBufferDoublesOnFullReads(t *testing.T) {
+    // One long stream fills every read, whatever the buffer's size.
+    sizes := bufferSizes(t, fill(4*maxBufferSize))
+    want := minBufferSize
+    for i, size := range sizes {
+        if size != want {
+            t.Fatalf("read %d: buffer of %d bytes, want %d (sizes %v)", i, size, want, sizes)
+        }
+        want = min(2*want, maxBufferSize)
+    }
+    if sizes[len(sizes)-1] != maxBufferSize {
+        t.Fatalf("buffer stopped growing at %d", sizes[len(sizes)-1])
+    }
+}
+
+func TestBufferHalvesAfterSmallReads(t *testing.T) {
+    const start = 4096
+    steps := growTo(start)
+    grown := len(steps)
+    steps = append(steps, repeat(5*shrinkAfter, fill(1))...)
+    sizes := bufferSizes(t, steps...)[grown:]
+
+    // Each run of shrinkAfter small reads halves the buffer, down to
+    // minBufferSize and no further.
+    want := start
+    for i, size := range sizes {
+        if i > 0 && i%shrinkAfter == 0 {
+            want = max(want/2, minBufferSize)
+        }
+        if size != want {
+            t.Fatalf("small read %d: buffer of %d bytes, want %d", i, size, want)
+        }
+    }
+}
+
+func TestBufferMidSizeReadResetsShrinking(t *testing.T) {
+    const start = 4096
+    steps := growTo(start)
+    grown := len(steps)
+    steps = append(steps, repeat(shrinkAfter-1, fill(1))...)
+    steps = append(steps, fill(start/2)) // neither full nor small
+    steps = append(steps, repeat(shrinkAfter, fill(1))...)
+    steps = append(steps, fill(1))
+    sizes := bufferSizes(t, steps...)[grown:]
+
+    // The small reads before the mid-size one no longer count: it takes
+    // another shrinkAfter in a row to halve the buffer.
+    for i, size := range sizes[:len(sizes)-1] {
+        if size != start {
+            t.Fatalf("read %d: buffer of %d bytes, want it kept at %d", i, size, start)
+        }
+    }
+    if last := sizes[len(sizes)-1]; last != start/2 {
+        t.Fatalf("after %d small reads in a row: buffer of %d bytes, want %d", shrinkAfter, last, start/2)
+    }
+}
+
+// TestEchoLoopAllocations checks the echo loop allocates per connection
+// and not per read: a thousand reads cost no more than ten.
+func TestEchoLoopAllocations(t *testing.T) {
+    if testnet.RaceEnabled {
+        t.Skip("the race detector allocates")
+    }
+    few := testing.AllocsPerRun(100, func() { handleClient(newEchoConn(100, 10)) })
+    many := testing.AllocsPerRun(100, func() { handleClient(newEchoConn(100, 1000)) })
+    if many > few {
+        t.Fatalf("%v allocations for 1000 reads, %v for 10", many, few)
+    }
+}
+
+// BenchmarkEchoLoop echoes one segment per op. Run with -benchmem: the
+// allocations are the connection's, spread over b.N segments, so they
+// should round to zero.
+func BenchmarkEchoLoop(b *testing.B) {
+    for _, bc := range []struct {
+        name string
+        size int
+    }{{"small", 64}, {"mss", 1460}, {"bulk", 64 << 10}} {
+        b.Run(bc.name, func(b *testing.B) {
+            b.SetBytes(int64(bc.size))
+            b.ReportAllocs()
+            conn := newEchoConn(bc.size, b.N)
+            handleClient(conn)
+            if conn.echoed != bc.size*b.N {
+                b.Fatalf("echoed %d bytes of %d", conn.echoed, bc.size*b.N)
+            }
+        })
+    }
+}
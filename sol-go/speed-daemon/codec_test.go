@@ -0,0 +1,283 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "math/rand"
+    "reflect"
+    "strings"
+    "testing"
+    "testing/iotest"
+
+    "../../lib-go/golden"
+    "../../lib-go/testnet"
+)
+
+// encodeRequest encodes req as a client would send it.
+func encodeRequest(req request) []byte {
+    switch req.typ {
+    case msgPlate:
+        return plateMsg(req.plate, req.timestamp)
+    case msgWantHeartbeat:
+        return binary.BigEndian.AppendUint32([]byte{msgWantHeartbeat}, req.interval)
+    case msgIAmCamera:
+        return iAmCamera(req.road, req.mile, req.limit)
+    case msgIAmDispatcher:
+        return iAmDispatcher(req.roads...)
+    }
+    panic("encodeRequest: unknown type")
+}
+
+// decodeTicket decodes a Ticket as a dispatcher would.
+func decodeTicket(msg []byte) (ticket, error) {
+    r := bufio.NewReader(bytes.NewReader(msg))
+    if typ, err := r.ReadByte(); err != nil || typ != msgTicket {
+        return ticket{}, errors.New("not a ticket")
+    }
+    var t ticket
+    var err error
+    if t.plate, err = readStr(r); err != nil {
+        return t, err
+    }
+    for _, field := range []any{&t.road, &t.mile1, &t.timestamp1, &t.mile2, &t.timestamp2, &t.speed} {
+        if err := binary.Read(r, binary.BigEndian, field); err != nil {
+            return t, err
+        }
+    }
+    if r.Buffered() > 0 {
+        return t, errors.New("trailing bytes")
+    }
+    return t, nil
+}
+
+func randomPlate(rng *rand.Rand) string {
+    const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+    var b strings.Builder
+    for n := rng.Intn(256); n > 0; n-- {
+        b.WriteByte(alphabet[rng.Intn(len(alphabet))])
+    }
+    return b.String()
+}
+
+func randomRequest(rng *rand.Rand) request {
+    u16 := func() uint16 { return uint16(rng.Intn(1 << 16)) }
+    switch rng.Intn(4) {
+    case 0:
+        return request{typ: msgPlate, plate: randomPlate(rng), timestamp: rng.Uint32()}
+    case 1:
+        return request{typ: msgWantHeartbeat, interval: rng.Uint32()}
+    case 2:
+        return request{typ: msgIAmCamera, road: u16(), mile: u16(), limit: u16()}
+    }
+    req := request{typ: msgIAmDispatcher, roads: make([]uint16, rng.Intn(256))}
+    for i := range req.roads {
+        req.roads[i] = u16()
+    }
+    return req
+}
+
+// TestRequestRoundTrip decodes a stream of every kind of client message,
+// delivered a byte at a time, and checks each comes back as it was sent.
+func TestRequestRoundTrip(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    var sent []request
+    var stream []byte
+    for i := 0; i < 1000; i++ {
+        req := randomRequest(rng)
+        sent = append(sent, req)
+        stream = append(stream, encodeRequest(req)...)
+    }
+
+    r := bufio.NewReader(iotest.OneByteReader(bytes.NewReader(stream)))
+    for i, want := range sent {
+        typ, err := r.ReadByte()
+        if err != nil {
+            t.Fatalf("message %d: %v", i, err)
+        }
+        got, err := readRequest(r, typ)
+        if err != nil {
+            t.Fatalf("message %d (0x%02x): %v", i, typ, err)
+        }
+        if !reflect.DeepEqual(got, want) {
+            t.Fatalf("message %d: decoded %+v, sent %+v", i, got, want)
+        }
+    }
+    if _, err := r.ReadByte(); err != io.EOF {
+        t.Fatalf("bytes left over after the last message (%v)", err)
+    }
+}
+
+func TestTicketRoundTrip(t *testing.T) {
+    rng := rand.New(rand.NewSource(2))
+    for i := 0; i < 1000; i++ {
+        want := ticket{
+            plate:      randomPlate(rng),
+            road:       uint16(rng.Intn(1 << 16)),
+            mile1:      uint16(rng.Intn(1 << 16)),
+            timestamp1: rng.Uint32(),
+            mile2:      uint16(rng.Intn(1 << 16)),
+            timestamp2: rng.Uint32(),
+            speed:      uint16(rng.Intn(1 << 16)),
+        }
+        got, err := decodeTicket(want.encode())
+        if err != nil {
+            t.Fatalf("ticket %+v: %v", want, err)
+        }
+        if got != want {
+            t.Fatalf("decoded %+v, encoded %+v", got, want)
+        }
+    }
+}
+
+// readAll decodes messages from data until an error, which it returns.
+func readAll(data []byte) error {
+    r := bufio.NewReader(bytes.NewReader(data))
+    for {
+        typ, err := r.ReadByte()
+        if err != nil {
+            return err
+        }
+        if _, err := readRequest(r, typ); err != nil {
+            return err
+        }
+    }
+}
+
+// TestReadRequestArbitraryBytes feeds the decoder random bytes (some
+// starting with a valid type, so the body decoders see them): it must
+// stop with a protocol error or a short read, never panic or hang.
+func TestReadRequestArbitraryBytes(t *testing.T) {
+    rng := rand.New(rand.NewSource(3))
+    types := []byte{msgPlate, msgWantHeartbeat, msgIAmCamera, msgIAmDispatcher}
+    for i := 0; i < 10000; i++ {
+        data := make([]byte, rng.Intn(64))
+        rng.Read(data)
+        if len(data) > 0 && i%2 == 0 {
+            data[0] = types[rng.Intn(len(types))]
+        }
+        var perr errProtocol
+        if err := readAll(data); err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &perr) {
+            t.Fatalf("% x: unexpected error %v", data, err)
+        }
+    }
+}
+
+// FuzzReadRequest decodes arbitrary client bytes, seeded with what the
+// golden transcripts send. Every message decoded must encode back to
+// exactly the bytes it was read from.
+func FuzzReadRequest(f *testing.F) {
+    streams, err := golden.Sent("../../tools-go/protohackers/golden/speed-daemon")
+    if err != nil {
+        f.Fatal(err)
+    }
+    for _, s := range streams {
+        f.Add(s)
+    }
+    f.Fuzz(func(t *testing.T, data []byte) {
+        src := bytes.NewReader(data)
+        r := bufio.NewReader(src)
+        consumed := 0
+        for {
+            typ, err := r.ReadByte()
+            if err != nil {
+                return
+            }
+            req, err := readRequest(r, typ)
+            if err != nil {
+                return
+            }
+            end := len(data) - src.Len() - r.Buffered()
+            if enc := encodeRequest(req); !bytes.Equal(enc, data[consumed:end]) {
+                t.Fatalf("read % x as %+v, which encodes as % x", data[consumed:end], req, enc)
+            }
+            consumed = end
+        }
+    })
+}
+
+// repeatReader reads data over and over, without end.
+type repeatReader struct {
+    data []byte
+    off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+    n := 0
+    for n < len(p) {
+        c := copy(p[n:], r.data[r.off:])
+        n += c
+        r.off = (r.off + c) % len(r.data)
+    }
+    return n, nil
+}
+
+// decodeOne reads a single message from r, failing b on an error.
+func decodeOne(b *testing.B, r *bufio.Reader) request {
+    typ, err := r.ReadByte()
+    if err != nil {
+        b.Fatal(err)
+    }
+    req, err := readRequest(r, typ)
+    if err != nil {
+        b.Fatal(err)
+    }
+    return req
+}
+
+// The decoding benchmarks read one message per op from an endless stream
+// of them. Run with -benchmem for the allocations behind each.
+func BenchmarkReadPlate(b *testing.B) {
+    r := bufio.NewReader(&repeatReader{data: plateMsg("UN1X", 1000)})
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        decodeOne(b, r)
+    }
+}
+
+func BenchmarkReadIAmDispatcher(b *testing.B) {
+    r := bufio.NewReader(&repeatReader{data: iAmDispatcher(66, 123, 368, 7000)})
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        decodeOne(b, r)
+    }
+}
+
+func BenchmarkTicketEncode(b *testing.B) {
+    t := ticket{plate: "UN1X", road: 123, mile1: 8, timestamp1: 0, mile2: 9, timestamp2: 45, speed: 8000}
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        t.encode()
+    }
+}
+
+// TestDecodeAllocations pins the allocations behind decoding each kind of
+// message, so a change that adds one shows up here and not just in the
+// benchmarks. Lower a ceiling when a change saves one. A Plate's string
+// and a dispatcher's roads are needed; the rest are the readU16 and readU32
+// buffers, which escape through io.ReadFull.
+func TestDecodeAllocations(t *testing.T) {
+    if testnet.RaceEnabled {
+        t.Skip("the race detector allocates")
+    }
+    for _, tc := range []struct {
+        msg  []byte
+        want float64
+    }{
+        {plateMsg("UN1X", 1000), 3},
+        {iAmDispatcher(66, 123, 368), 4},
+        {iAmCamera(123, 8, 60), 3},
+        {binary.BigEndian.AppendUint32([]byte{msgWantHeartbeat}, 25), 1},
+    } {
+        r := bufio.NewReader(&repeatReader{data: tc.msg})
+        got := testing.AllocsPerRun(1000, func() {
+            typ, _ := r.ReadByte()
+            readRequest(r, typ)
+        })
+        if got > tc.want {
+            t.Errorf("message 0x%02x: %v allocations, want at most %v", tc.msg[0], got, tc.want)
+        }
+    }
+}
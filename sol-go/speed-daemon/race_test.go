@@ -0,0 +1,225 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "../../lib-go/clock"
+)
+
+// These tests run cameras and dispatchers through handleClient from many
+// goroutines at once, and are meant to be run with -race as well.
+
+// connect starts handleClient on one end of a net.Pipe and returns the
+// other end, which has already sent hello. The handler's connection is
+// closed when the test ends, if it hasn't returned by then.
+func connect(t *testing.T, st *state, wheel *heartbeatWheel, hello []byte) net.Conn {
+    server, peer := net.Pipe()
+    t.Cleanup(func() { server.Close() })
+    go handleClient(st, wheel, server)
+    peer.SetWriteDeadline(time.Now().Add(5 * time.Second))
+    if _, err := peer.Write(hello); err != nil {
+        t.Errorf("sending hello: %v", err)
+    }
+    return peer
+}
+
+func iAmCamera(road, mile, limit uint16) []byte {
+    msg := binary.BigEndian.AppendUint16([]byte{msgIAmCamera}, road)
+    msg = binary.BigEndian.AppendUint16(msg, mile)
+    return binary.BigEndian.AppendUint16(msg, limit)
+}
+
+func iAmDispatcher(roads ...uint16) []byte {
+    msg := []byte{msgIAmDispatcher, byte(len(roads))}
+    for _, road := range roads {
+        msg = binary.BigEndian.AppendUint16(msg, road)
+    }
+    return msg
+}
+
+func plateMsg(plate string, timestamp uint32) []byte {
+    msg := append([]byte{msgPlate, byte(len(plate))}, plate...)
+    return binary.BigEndian.AppendUint32(msg, timestamp)
+}
+
+// readTicket reads exactly one Ticket from conn and returns its plate. It
+// reads no further, so a ticket the server is still writing when conn is
+// closed fails to send and is routed again rather than lost.
+func readTicket(conn net.Conn) (string, error) {
+    var head [2]byte
+    if _, err := io.ReadFull(conn, head[:]); err != nil {
+        return "", err
+    }
+    if head[0] != msgTicket {
+        return "", fmt.Errorf("got message 0x%02x, want a ticket", head[0])
+    }
+    rest := make([]byte, int(head[1])+16)
+    if _, err := io.ReadFull(conn, rest); err != nil {
+        return "", err
+    }
+    return string(rest[:head[1]]), nil
+}
+
+// TestDispatchersComeAndGoMidTicket has cameras report a speeding car for
+// every plate while dispatchers connect, take a ticket or two (or part of
+// one) and hang up. A last dispatcher for every road then stays: between
+// them all, every car must be ticketed exactly once.
+func TestDispatchersComeAndGoMidTicket(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    wheel := newHeartbeatWheel(clk, 8, 100*time.Millisecond, 1)
+    st := newState(nil, nil)
+
+    const roads, platesPerRoad = 8, 25
+    allRoads := make([]uint16, roads)
+    for i := range allRoads {
+        allRoads[i] = uint16(i)
+    }
+
+    var mu sync.Mutex
+    got := make(map[string]int)
+    record := func(plate string) {
+        mu.Lock()
+        got[plate]++
+        mu.Unlock()
+    }
+
+    // Two cameras per road, 10 miles apart, see each car a minute apart:
+    // 600 mph on a 60 mph road.
+    var cameras sync.WaitGroup
+    for road := uint16(0); road < roads; road++ {
+        for _, mile := range []uint16{0, 10} {
+            cameras.Add(1)
+            go func() {
+                defer cameras.Done()
+                conn := connect(t, st, wheel, iAmCamera(road, mile, 60))
+                defer conn.Close()
+                for p := 0; p < platesPerRoad; p++ {
+                    plate := fmt.Sprintf("R%dP%d", road, p)
+                    if _, err := conn.Write(plateMsg(plate, uint32(p*1000)+uint32(mile)*6)); err != nil {
+                        t.Errorf("camera on road %d: %v", road, err)
+                        return
+                    }
+                    if p%5 == 0 {
+                        time.Sleep(time.Millisecond)
+                    }
+                }
+            }()
+        }
+    }
+
+    camerasDone := make(chan struct{})
+    go func() {
+        cameras.Wait()
+        close(camerasDone)
+    }()
+
+    var dispatchers sync.WaitGroup
+    for d := 0; d < 4; d++ {
+        rng := rand.New(rand.NewSource(int64(d)))
+        dispatchers.Add(1)
+        go func() {
+            defer dispatchers.Done()
+            for {
+                select {
+                case <-camerasDone:
+                    return
+                default:
+                }
+                var mine []uint16
+                for _, road := range allRoads {
+                    if rng.Intn(2) == 0 {
+                        mine = append(mine, road)
+                    }
+                }
+                conn := connect(t, st, wheel, iAmDispatcher(mine...))
+                for n := rng.Intn(3); n > 0; n-- {
+                    conn.SetReadDeadline(time.Now().Add(time.Duration(rng.Intn(5)) * time.Millisecond))
+                    plate, err := readTicket(conn)
+                    if err != nil {
+                        break
+                    }
+                    record(plate)
+                }
+                conn.Close()
+            }
+        }()
+    }
+    dispatchers.Wait()
+
+    last := connect(t, st, wheel, iAmDispatcher(allRoads...))
+    defer last.Close()
+    for {
+        mu.Lock()
+        n := len(got)
+        mu.Unlock()
+        if n == roads*platesPerRoad {
+            break
+        }
+        last.SetReadDeadline(time.Now().Add(5 * time.Second))
+        plate, err := readTicket(last)
+        if err != nil {
+            t.Fatalf("%d of %d cars ticketed: %v", n, roads*platesPerRoad, err)
+        }
+        record(plate)
+    }
+    last.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+    if plate, err := readTicket(last); err == nil {
+        record(plate)
+    }
+
+    for plate, n := range got {
+        if n != 1 {
+            t.Errorf("%s ticketed %d times", plate, n)
+        }
+    }
+    for _, road := range allRoads {
+        if pending := pendingTickets(st, road); len(pending) != 0 {
+            t.Errorf("road %d: %d tickets still pending with a dispatcher connected", road, len(pending))
+        }
+    }
+}
+
+// TestCamerasJoinMidTicket has cameras connect and hang up one observation
+// at a time, all at once, while a dispatcher is being sent tickets: every
+// speeding pair must still produce one ticket.
+func TestCamerasJoinMidTicket(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    wheel := newHeartbeatWheel(clk, 8, 100*time.Millisecond, 1)
+    st := newState(nil, nil)
+
+    disp := connect(t, st, wheel, iAmDispatcher(7))
+    defer disp.Close()
+
+    const cars = 100
+    var wg sync.WaitGroup
+    for p := 0; p < cars; p++ {
+        for _, mile := range []uint16{0, 10} {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                conn := connect(t, st, wheel, append(iAmCamera(7, mile, 60), plateMsg(fmt.Sprint("P", p), uint32(p*1000)+uint32(mile)*6)...))
+                conn.Close()
+            }()
+        }
+    }
+
+    got := make(map[string]int)
+    for len(got) < cars {
+        disp.SetReadDeadline(time.Now().Add(5 * time.Second))
+        plate, err := readTicket(disp)
+        if err != nil {
+            t.Fatalf("%d of %d cars ticketed: %v", len(got), cars, err)
+        }
+        if got[plate]++; got[plate] > 1 {
+            t.Errorf("%s ticketed twice", plate)
+        }
+    }
+    wg.Wait()
+}
@@ -0,0 +1,954 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/signals"
+)
+
+// Message types
+const (
+    msgError         = 0x10
+    msgPlate         = 0x20
+    msgTicket        = 0x21
+    msgWantHeartbeat = 0x40
+    msgHeartbeat     = 0x41
+    msgIAmCamera     = 0x80
+    msgIAmDispatcher = 0x81
+)
+
+// writeTimeout bounds every write to a client, so one stalled reader can't
+// block ticket dispatch or the heartbeat workers forever.
+const writeTimeout = 10 * time.Second
+
+// Silence is expected here: a camera says nothing between observations and
+// a dispatcher may never speak after identifying itself, so reads have no
+// deadline. TCP keepalives find the peers that vanished instead: after
+// keepaliveIdle without traffic, probes go out every keepaliveInterval and
+// keepaliveCount unanswered ones close the connection.
+const (
+    keepaliveInterval = 10 * time.Second
+    keepaliveCount    = 3
+)
+
+// secondsPerDay defines the protocol's days: day = floor(timestamp / 86400).
+const secondsPerDay = 86400
+
+// dayOf returns the day a camera timestamp falls on.
+func dayOf(timestamp uint32) uint32 {
+    return timestamp / secondsPerDay
+}
+
+// ticket is a speeding ticket as sent to a dispatcher.
+type ticket struct {
+    plate      string
+    road       uint16
+    mile1      uint16
+    timestamp1 uint32
+    mile2      uint16
+    timestamp2 uint32
+    speed      uint16 // 100x miles per hour
+}
+
+// encode serialises the ticket as a Ticket (0x21) message.
+func (t ticket) encode() []byte {
+    msg := []byte{msgTicket, byte(len(t.plate))}
+    msg = append(msg, t.plate...)
+    msg = binary.BigEndian.AppendUint16(msg, t.road)
+    msg = binary.BigEndian.AppendUint16(msg, t.mile1)
+    msg = binary.BigEndian.AppendUint32(msg, t.timestamp1)
+    msg = binary.BigEndian.AppendUint16(msg, t.mile2)
+    msg = binary.BigEndian.AppendUint32(msg, t.timestamp2)
+    msg = binary.BigEndian.AppendUint16(msg, t.speed)
+    return msg
+}
+
+// queuedTicket is a ticket that has been issued but not yet delivered to a
+// dispatcher, identified for the pending log.
+type queuedTicket struct {
+    id uint64
+    ticket
+}
+
+// --- Pending Log ---
+
+// pendingRecord is one line of the pending log: either a ticket being
+// queued ("add") or a queued ticket being delivered ("done").
+type pendingRecord struct {
+    Op         string `json:"op"`
+    ID         uint64 `json:"id"`
+    Plate      string `json:"plate,omitempty"`
+    Road       uint16 `json:"road,omitempty"`
+    Mile1      uint16 `json:"mile1,omitempty"`
+    Timestamp1 uint32 `json:"timestamp1,omitempty"`
+    Mile2      uint16 `json:"mile2,omitempty"`
+    Timestamp2 uint32 `json:"timestamp2,omitempty"`
+    Speed      uint16 `json:"speed,omitempty"`
+}
+
+// pendingLog is an append-only JSON-lines journal of undelivered tickets,
+// so that a restart never loses a ticket still waiting for a dispatcher.
+// A nil *pendingLog keeps tickets in memory only.
+type pendingLog struct {
+    mu  sync.Mutex
+    f   *os.File
+    enc *json.Encoder
+}
+
+// openPendingLog replays the log at path and returns the tickets that were
+// never delivered. The log is then compacted to just those tickets and
+// kept open for appending.
+func openPendingLog(path string) (*pendingLog, []queuedTicket, error) {
+    outstanding := make(map[uint64]queuedTicket)
+    var order []uint64
+
+    if f, err := os.Open(path); err == nil {
+        dec := json.NewDecoder(f)
+        for {
+            var rec pendingRecord
+            if err := dec.Decode(&rec); err != nil {
+                // A torn final line from a crash ends the replay.
+                if !errors.Is(err, io.EOF) {
+                    fmt.Printf("[PENDING] Stopped replaying %s: %v\n", path, err)
+                }
+                break
+            }
+            switch rec.Op {
+            case "add":
+                outstanding[rec.ID] = queuedTicket{id: rec.ID, ticket: ticket{
+                    plate:      rec.Plate,
+                    road:       rec.Road,
+                    mile1:      rec.Mile1,
+                    timestamp1: rec.Timestamp1,
+                    mile2:      rec.Mile2,
+                    timestamp2: rec.Timestamp2,
+                    speed:      rec.Speed,
+                }}
+                order = append(order, rec.ID)
+            case "done":
+                delete(outstanding, rec.ID)
+            }
+        }
+        f.Close()
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return nil, nil, err
+    }
+
+    var tickets []queuedTicket
+    for _, id := range order {
+        if q, ok := outstanding[id]; ok {
+            tickets = append(tickets, q)
+            delete(outstanding, id)
+        }
+    }
+
+    // Compact: rewrite the log with only the outstanding tickets.
+    tmp := path + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return nil, nil, err
+    }
+    l := &pendingLog{f: f, enc: json.NewEncoder(f)}
+    for _, q := range tickets {
+        if err := l.enc.Encode(addRecord(q)); err != nil {
+            f.Close()
+            return nil, nil, err
+        }
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return nil, nil, err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        f.Close()
+        return nil, nil, err
+    }
+    return l, tickets, nil
+}
+
+func addRecord(q queuedTicket) pendingRecord {
+    return pendingRecord{
+        Op:         "add",
+        ID:         q.id,
+        Plate:      q.plate,
+        Road:       q.road,
+        Mile1:      q.mile1,
+        Timestamp1: q.timestamp1,
+        Mile2:      q.mile2,
+        Timestamp2: q.timestamp2,
+        Speed:      q.speed,
+    }
+}
+
+// write appends a record and syncs it to disk.
+func (l *pendingLog) write(rec pendingRecord) {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    err := l.enc.Encode(rec)
+    if err == nil {
+        err = l.f.Sync()
+    }
+    if err != nil {
+        fmt.Printf("[ERROR] Writing pending log: %v\n", err)
+    }
+}
+
+// add records that q is waiting for delivery.
+func (l *pendingLog) add(q queuedTicket) { l.write(addRecord(q)) }
+
+// done records that the ticket with id has been delivered.
+func (l *pendingLog) done(id uint64) { l.write(pendingRecord{Op: "done", ID: id}) }
+
+// observation is a plate seen by a camera at a given time.
+type observation struct {
+    timestamp uint32
+    mile      uint16
+}
+
+// --- Shared State ---
+
+// numShards is the number of road shards. Roads are spread across shards by
+// road number, so cameras on different roads rarely contend for a lock.
+const numShards = 64
+
+// roadShard holds the per-road state for the roads that hash to it.
+type roadShard struct {
+    mu sync.Mutex
+
+    // dispatchers maps a road to the dispatchers responsible for it.
+    dispatchers map[uint16][]*client
+
+    // pending holds tickets for roads that have no dispatcher yet.
+    pending map[uint16][]queuedTicket
+
+    // observations maps road -> plate -> observations sorted by timestamp.
+    observations map[uint16]map[string][]observation
+}
+
+// plateDay identifies one car on one day (see dayOf).
+type plateDay struct {
+    plate string
+    day   uint32
+}
+
+// ticketLedger records which (plate, day) pairs have been ticketed, so a car
+// never gets more than one ticket per day across all roads.
+type ticketLedger struct {
+    mu   sync.Mutex
+    days map[plateDay]struct{}
+}
+
+func newTicketLedger() *ticketLedger {
+    return &ticketLedger{days: make(map[plateDay]struct{})}
+}
+
+// claim atomically checks and records a ticket spanning day1..day2
+// (inclusive). It returns false, recording nothing, if plate was already
+// ticketed on any of those days; otherwise every day in the span is marked
+// and the caller must issue the ticket.
+func (l *ticketLedger) claim(plate string, day1, day2 uint32) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    for day := day1; day <= day2; day++ {
+        if _, ok := l.days[plateDay{plate, day}]; ok {
+            return false
+        }
+    }
+    for day := day1; day <= day2; day++ {
+        l.days[plateDay{plate, day}] = struct{}{}
+    }
+    return true
+}
+
+// state holds everything shared between clients.
+//
+// Observations, dispatchers and pending tickets are sharded by road, each
+// shard with its own lock. Only the ticket ledger spans roads; its lock is
+// taken briefly, always after a shard lock.
+//
+// Every issued ticket stays in the pending log until a write to a
+// dispatcher succeeds, so it survives both dispatcher failures and, when
+// the log is on disk, server restarts.
+type state struct {
+    shards [numShards]roadShard
+    ledger *ticketLedger
+    log    *pendingLog
+    nextID atomic.Uint64
+}
+
+func newState(log *pendingLog, pending []queuedTicket) *state {
+    s := &state{ledger: newTicketLedger(), log: log}
+    for i := range s.shards {
+        s.shards[i] = roadShard{
+            dispatchers:  make(map[uint16][]*client),
+            pending:      make(map[uint16][]queuedTicket),
+            observations: make(map[uint16]map[string][]observation),
+        }
+    }
+
+    // Tickets recovered from the log wait for their road's dispatcher, and
+    // still count against their plate's days.
+    for _, q := range pending {
+        s.ledger.claim(q.plate, dayOf(q.timestamp1), dayOf(q.timestamp2))
+        sh := s.shard(q.road)
+        sh.pending[q.road] = append(sh.pending[q.road], q)
+        if q.id > s.nextID.Load() {
+            s.nextID.Store(q.id)
+        }
+    }
+    return s
+}
+
+// shard returns the shard holding road's state.
+func (s *state) shard(road uint16) *roadShard {
+    return &s.shards[road%numShards]
+}
+
+// observe records a plate observation from a camera and issues tickets for
+// any speeding it reveals.
+func (s *state) observe(road, mile, limit uint16, plate string, timestamp uint32) {
+    sh := s.shard(road)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    plates := sh.observations[road]
+    if plates == nil {
+        plates = make(map[string][]observation)
+        sh.observations[road] = plates
+    }
+
+    // Insert in timestamp order. Average speed over any span can only
+    // exceed the limit if some pair of adjacent observations does, so only
+    // the new observation's neighbours need checking.
+    history := plates[plate]
+    i := sort.Search(len(history), func(i int) bool { return history[i].timestamp >= timestamp })
+    obs := observation{timestamp: timestamp, mile: mile}
+    history = append(history, observation{})
+    copy(history[i+1:], history[i:])
+    history[i] = obs
+    plates[plate] = history
+
+    if i > 0 {
+        s.check(sh, plate, road, limit, history[i-1], obs)
+    }
+    if i+1 < len(history) {
+        s.check(sh, plate, road, limit, obs, history[i+1])
+    }
+}
+
+// check issues a ticket if the car averaged limit + 0.5 mph or more between
+// two observations. The caller must hold sh.mu.
+func (s *state) check(sh *roadShard, plate string, road, limit uint16, o1, o2 observation) {
+    if o1.timestamp == o2.timestamp {
+        return // Ignore infinite speed / duplicate timestamps
+    }
+
+    distance := uint64(o2.mile) - uint64(o1.mile)
+    if o1.mile > o2.mile {
+        distance = uint64(o1.mile) - uint64(o2.mile)
+    }
+    elapsed := uint64(o2.timestamp - o1.timestamp)
+
+    // Speed = (Distance / Time) * 3600, in 100x mph
+    speed := distance * 3600 * 100 / elapsed
+    if speed < uint64(limit)*100+50 {
+        return
+    }
+
+    // --- VIOLATION FOUND ---
+    // The ticket covers every day from the first to the last observation.
+    if !s.ledger.claim(plate, dayOf(o1.timestamp), dayOf(o2.timestamp)) {
+        return
+    }
+
+    s.issue(sh, ticket{
+        plate:      plate,
+        road:       road,
+        mile1:      o1.mile,
+        timestamp1: o1.timestamp,
+        mile2:      o2.mile,
+        timestamp2: o2.timestamp,
+        speed:      uint16(min(speed, 0xffff)),
+    })
+}
+
+// issue logs a new ticket as pending and routes it. The caller must hold
+// sh.mu.
+func (s *state) issue(sh *roadShard, t ticket) {
+    q := queuedTicket{id: s.nextID.Add(1), ticket: t}
+    s.log.add(q)
+    s.route(sh, q)
+}
+
+// route sends a ticket to a live dispatcher for its road or buffers it.
+// The caller must hold sh.mu.
+func (s *state) route(sh *roadShard, q queuedTicket) {
+    for _, d := range sh.dispatchers[q.road] {
+        // Send to the first available dispatcher
+        if !d.dead.Load() {
+            go s.deliver(d, q)
+            return
+        }
+    }
+    // No dispatcher connected for this road, buffer it.
+    sh.pending[q.road] = append(sh.pending[q.road], q)
+}
+
+// deliver writes a ticket to dispatcher c. Once the write succeeds the
+// ticket is retired from the log; if it fails, the ticket is routed again.
+func (s *state) deliver(c *client, q queuedTicket) {
+    if err := c.send(q.encode()); err == nil {
+        s.log.done(q.id)
+        return
+    }
+    sh := s.shard(q.road)
+    sh.mu.Lock()
+    s.route(sh, q)
+    sh.mu.Unlock()
+}
+
+// addDispatcher registers c for roads and flushes their pending tickets.
+func (s *state) addDispatcher(c *client, roads []uint16) {
+    for _, road := range roads {
+        sh := s.shard(road)
+        sh.mu.Lock()
+        sh.dispatchers[road] = append(sh.dispatchers[road], c)
+        queued := sh.pending[road]
+        delete(sh.pending, road)
+        if len(queued) > 0 {
+            // Drain in order on one goroutine.
+            go func() {
+                for i, q := range queued {
+                    if err := c.send(q.encode()); err != nil {
+                        sh.mu.Lock()
+                        for _, q := range queued[i:] {
+                            s.route(sh, q)
+                        }
+                        sh.mu.Unlock()
+                        return
+                    }
+                    s.log.done(q.id)
+                }
+            }()
+        }
+        sh.mu.Unlock()
+    }
+}
+
+// removeDispatcher unregisters c from roads.
+func (s *state) removeDispatcher(c *client, roads []uint16) {
+    for _, road := range roads {
+        sh := s.shard(road)
+        sh.mu.Lock()
+        ds := sh.dispatchers[road]
+        for i, d := range ds {
+            if d == c {
+                sh.dispatchers[road] = append(ds[:i], ds[i+1:]...)
+                break
+            }
+        }
+        if len(sh.dispatchers[road]) == 0 {
+            delete(sh.dispatchers, road)
+        }
+        sh.mu.Unlock()
+    }
+}
+
+// --- Heartbeats ---
+
+// heartbeat is one client's entry in the heartbeat wheel.
+type heartbeat struct {
+    c         *client
+    interval  int // in wheel ticks (deciseconds)
+    rounds    int // full wheel revolutions left before it fires
+    cancelled atomic.Bool
+}
+
+// heartbeatWheel sends heartbeats for every client from a single hashed
+// timer wheel instead of a ticker goroutine per client. Each tick only
+// visits the entries in one slot; fired heartbeats are written by a small
+// pool of workers so a slow client never stalls the wheel.
+type heartbeatWheel struct {
+    mu     sync.Mutex
+    slots  [][]*heartbeat
+    cursor int
+    tick   time.Duration
+    clock  clock.Clock
+    due    chan *heartbeat
+}
+
+func newHeartbeatWheel(clk clock.Clock, size int, tick time.Duration, workers int) *heartbeatWheel {
+    w := &heartbeatWheel{
+        slots: make([][]*heartbeat, size),
+        tick:  tick,
+        clock: clk,
+        due:   make(chan *heartbeat, 1024),
+    }
+    for i := 0; i < workers; i++ {
+        go w.worker()
+    }
+    return w
+}
+
+// schedule adds a heartbeat firing every interval deciseconds.
+// Stop it by setting cancelled.
+func (w *heartbeatWheel) schedule(c *client, interval uint32) *heartbeat {
+    hb := &heartbeat{c: c, interval: int(interval)}
+    w.mu.Lock()
+    w.insert(hb)
+    w.mu.Unlock()
+    return hb
+}
+
+// insert places hb interval ticks after the cursor. The caller must hold
+// w.mu.
+func (w *heartbeatWheel) insert(hb *heartbeat) {
+    slot := (w.cursor + hb.interval) % len(w.slots)
+    hb.rounds = (hb.interval - 1) / len(w.slots)
+    w.slots[slot] = append(w.slots[slot], hb)
+}
+
+// run advances the wheel every tick until stop is closed.
+func (w *heartbeatWheel) run(stop <-chan struct{}) {
+    ticker := w.clock.NewTicker(w.tick)
+    defer ticker.Stop()
+
+    var fired []*heartbeat
+    for {
+        select {
+        case <-ticker.C():
+        case <-stop:
+            return
+        }
+
+        w.mu.Lock()
+        w.cursor = (w.cursor + 1) % len(w.slots)
+        slot := w.slots[w.cursor]
+        w.slots[w.cursor] = nil
+
+        fired = fired[:0]
+        for _, hb := range slot {
+            switch {
+            case hb.cancelled.Load():
+                // Dropped lazily, so cancelling is O(1).
+            case hb.rounds > 0:
+                hb.rounds--
+                w.slots[w.cursor] = append(w.slots[w.cursor], hb)
+            default:
+                fired = append(fired, hb)
+                w.insert(hb)
+            }
+        }
+        w.mu.Unlock()
+
+        for _, hb := range fired {
+            w.due <- hb
+        }
+    }
+}
+
+// worker writes heartbeats that have fallen due.
+func (w *heartbeatWheel) worker() {
+    for hb := range w.due {
+        if !hb.cancelled.Load() {
+            hb.c.send([]byte{msgHeartbeat})
+        }
+    }
+}
+
+// --- Clients ---
+
+// client is a single connection: a camera, a dispatcher, or not yet
+// identified.
+type client struct {
+    conn  net.Conn
+    addr  string
+    st    *state
+    wheel *heartbeatWheel
+
+    writeMu sync.Mutex
+    dead    atomic.Bool // set once a write has failed
+
+    // Identity, set once by IAmCamera or IAmDispatcher.
+    camera     bool
+    dispatcher bool
+    road       uint16
+    mile       uint16
+    limit      uint16
+    roads      []uint16
+
+    // wantedHeartbeat is set by the first WantHeartbeat, even one with
+    // interval 0 that schedules nothing, since a second is an error
+    // either way.
+    wantedHeartbeat bool
+    heartbeat       *heartbeat // nil unless heartbeats are being sent
+}
+
+// send writes one message to the client. A failed write closes the
+// connection, which in turn ends the read loop.
+func (c *client) send(msg []byte) error {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+
+    c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+    _, err := c.conn.Write(msg)
+    if err != nil {
+        c.dead.Store(true)
+        c.conn.Close()
+    }
+    return err
+}
+
+// sendError sends an Error message; the caller then disconnects.
+func (c *client) sendError(text string) {
+    fmt.Printf("[ERROR] Sending error to %s: %s\n", c.addr, text)
+    msg := []byte{msgError, byte(len(text))}
+    c.send(append(msg, text...))
+}
+
+// readStr reads a length-prefixed string.
+func readStr(r *bufio.Reader) (string, error) {
+    n, err := r.ReadByte()
+    if err != nil {
+        return "", err
+    }
+    buf := make([]byte, n)
+    if _, err := io.ReadFull(r, buf); err != nil {
+        return "", err
+    }
+    return string(buf), nil
+}
+
+func readU16(r *bufio.Reader) (uint16, error) {
+    var buf [2]byte
+    if _, err := io.ReadFull(r, buf[:]); err != nil {
+        return 0, err
+    }
+    return binary.BigEndian.Uint16(buf[:]), nil
+}
+
+func readU32(r *bufio.Reader) (uint32, error) {
+    var buf [4]byte
+    if _, err := io.ReadFull(r, buf[:]); err != nil {
+        return 0, err
+    }
+    return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// errProtocol marks a message the client should be told off for.
+type errProtocol string
+
+func (e errProtocol) Error() string { return string(e) }
+
+// request is one message from a client, decoded. Only the fields of its
+// type are set.
+type request struct {
+    typ byte
+
+    plate     string // Plate
+    timestamp uint32 // Plate
+
+    interval uint32 // WantHeartbeat
+
+    road, mile, limit uint16 // IAmCamera
+
+    roads []uint16 // IAmDispatcher
+}
+
+// readRequest reads the body of a message of the given type.
+func readRequest(r *bufio.Reader, msgType byte) (request, error) {
+    req := request{typ: msgType}
+    var err error
+    switch msgType {
+    case msgPlate:
+        if req.plate, err = readStr(r); err != nil {
+            return req, err
+        }
+        req.timestamp, err = readU32(r)
+
+    case msgWantHeartbeat:
+        req.interval, err = readU32(r)
+
+    case msgIAmCamera:
+        for _, field := range []*uint16{&req.road, &req.mile, &req.limit} {
+            if *field, err = readU16(r); err != nil {
+                return req, err
+            }
+        }
+
+    case msgIAmDispatcher:
+        n, err := r.ReadByte()
+        if err != nil {
+            return req, err
+        }
+        req.roads = make([]uint16, n)
+        for i := range req.roads {
+            if req.roads[i], err = readU16(r); err != nil {
+                return req, err
+            }
+        }
+
+    default:
+        return req, errProtocol(fmt.Sprintf("illegal msg type 0x%02x", msgType))
+    }
+    return req, err
+}
+
+// handleMessage reads and processes one message of the given type.
+func (c *client) handleMessage(r *bufio.Reader, msgType byte) error {
+    req, err := readRequest(r, msgType)
+    if err != nil {
+        return err
+    }
+
+    switch req.typ {
+    case msgPlate:
+        if !c.camera {
+            return errProtocol("not a camera")
+        }
+        c.st.observe(c.road, c.mile, c.limit, req.plate, req.timestamp)
+
+    case msgWantHeartbeat:
+        if c.wantedHeartbeat {
+            return errProtocol("heartbeat already requested")
+        }
+        c.wantedHeartbeat = true
+        if req.interval > 0 {
+            c.heartbeat = c.wheel.schedule(c, req.interval)
+        }
+
+    case msgIAmCamera:
+        if c.camera || c.dispatcher {
+            return errProtocol("already identified")
+        }
+        c.camera = true
+        c.road, c.mile, c.limit = req.road, req.mile, req.limit
+
+    case msgIAmDispatcher:
+        if c.camera || c.dispatcher {
+            return errProtocol("already identified")
+        }
+        c.dispatcher = true
+        c.roads = req.roads
+        c.st.addDispatcher(c, req.roads)
+    }
+    return nil
+}
+
+// readers recycles connection readers; cameras reconnect often and each
+// one would otherwise allocate a fresh 4 KiB buffer.
+var readers = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+
+// handleClient handles a single client connection.
+func handleClient(st *state, wheel *heartbeatWheel, conn net.Conn) {
+    c := &client{conn: conn, addr: conn.RemoteAddr().String(), st: st, wheel: wheel}
+    fmt.Printf("[NEW CONNECTION] %s connected.\n", c.addr)
+
+    defer func() {
+        if c.heartbeat != nil {
+            c.heartbeat.cancelled.Store(true)
+        }
+        if c.dispatcher {
+            st.removeDispatcher(c, c.roads)
+        }
+        conn.Close()
+        fmt.Printf("[DISCONNECTED] %s disconnected.\n", c.addr)
+    }()
+
+    r := readers.Get().(*bufio.Reader)
+    r.Reset(conn)
+    defer func() {
+        r.Reset(nil)
+        readers.Put(r)
+    }()
+    for {
+        msgType, err := r.ReadByte()
+        if err == nil {
+            err = c.handleMessage(r, msgType)
+        }
+        if err == nil {
+            continue
+        }
+
+        var perr errProtocol
+        if errors.As(err, &perr) {
+            c.sendError(string(perr))
+        } else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+            fmt.Printf("[ERROR] Connection error with %s: %v\n", c.addr, err)
+        }
+        return
+    }
+}
+
+// --- Offline Scenarios ---
+
+// scenario describes roads, cameras and plate observations to replay
+// without any network clients.
+type scenario struct {
+    Roads []struct {
+        Road  uint16 `json:"road"`
+        Limit uint16 `json:"limit"`
+    } `json:"roads"`
+    Cameras []struct {
+        Name string `json:"name"`
+        Road uint16 `json:"road"`
+        Mile uint16 `json:"mile"`
+    } `json:"cameras"`
+    // Observations are replayed in file order, as if they had arrived in
+    // that order from the named cameras.
+    Observations []struct {
+        Camera    string `json:"camera"`
+        Plate     string `json:"plate"`
+        Timestamp uint32 `json:"timestamp"`
+    } `json:"observations"`
+}
+
+// runScenario replays a scenario file through the ticketing logic and
+// prints every ticket that would be issued, in the order it was issued.
+func runScenario(path string) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var sc scenario
+    if err := json.Unmarshal(data, &sc); err != nil {
+        return fmt.Errorf("parsing %s: %w", path, err)
+    }
+
+    limits := make(map[uint16]uint16)
+    for _, r := range sc.Roads {
+        limits[r.Road] = r.Limit
+    }
+    type camera struct{ road, mile, limit uint16 }
+    cameras := make(map[string]camera)
+    for _, c := range sc.Cameras {
+        limit, ok := limits[c.Road]
+        if !ok {
+            return fmt.Errorf("camera %q is on unknown road %d", c.Name, c.Road)
+        }
+        cameras[c.Name] = camera{road: c.Road, mile: c.Mile, limit: limit}
+    }
+
+    // With no dispatchers connected, every ticket ends up pending.
+    st := newState(nil, nil)
+    for i, o := range sc.Observations {
+        c, ok := cameras[o.Camera]
+        if !ok {
+            return fmt.Errorf("observation %d is from unknown camera %q", i, o.Camera)
+        }
+        st.observe(c.road, c.mile, c.limit, o.Plate, o.Timestamp)
+    }
+
+    var tickets []queuedTicket
+    for i := range st.shards {
+        for _, queued := range st.shards[i].pending {
+            tickets = append(tickets, queued...)
+        }
+    }
+    sort.Slice(tickets, func(i, j int) bool { return tickets[i].id < tickets[j].id })
+
+    for _, t := range tickets {
+        fmt.Printf("[TICKET] %s road %d: mile %d at %d (day %d) -> mile %d at %d (day %d), %d.%02d mph\n",
+            t.plate, t.road,
+            t.mile1, t.timestamp1, dayOf(t.timestamp1),
+            t.mile2, t.timestamp2, dayOf(t.timestamp2),
+            t.speed/100, t.speed%100)
+    }
+    fmt.Printf("[SCENARIO] %d observations, %d tickets\n", len(sc.Observations), len(tickets))
+    return nil
+}
+
+// startServer runs the server, taking all time from clk. If pendingPath is
+// set, undelivered tickets are journaled there and redelivered after a
+// restart. Idle connections are probed after keepaliveIdle (never if 0).
+func startServer(host string, port string, pendingPath string, keepaliveIdle time.Duration, clk clock.Clock) {
+    var log *pendingLog
+    var recovered []queuedTicket
+    if pendingPath != "" {
+        var err error
+        if log, recovered, err = openPendingLog(pendingPath); err != nil {
+            fmt.Printf("[ERROR] Could not open pending log: %v\n", err)
+            return
+        }
+        fmt.Printf("[PENDING] Recovered %d undelivered tickets from %s\n", len(recovered), pendingPath)
+    }
+
+    address := host + ":" + port
+    lc := net.ListenConfig{KeepAlive: -1}
+    if keepaliveIdle > 0 {
+        lc.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: keepaliveIdle, Interval: keepaliveInterval, Count: keepaliveCount}
+    }
+    listener, err := lc.Listen(context.Background(), "tcp", address)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer listener.Close()
+
+    fmt.Printf("[LISTENING] Speed Camera Server listening on %s\n", address)
+
+    st := newState(log, recovered)
+
+    // One decisecond per tick matches the WantHeartbeat resolution; 1024
+    // slots cover ~100s before entries need extra rounds.
+    stop := make(chan struct{})
+    defer close(stop)
+    wheel := newHeartbeatWheel(clk, 1024, 100*time.Millisecond, 8)
+    go wheel.run(stop)
+
+    // Handle graceful shutdown
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        listener.Close()
+    })
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            fmt.Printf("[ERROR] Accept error: %v\n", err)
+            continue
+        }
+
+        go handleClient(st, wheel, conn)
+    }
+}
+
+func main() {
+    port := flag.String("port", "65432", "TCP port to listen on")
+    scenarioPath := flag.String("scenario", "", "replay a JSON scenario offline and print the tickets instead of serving")
+    pendingPath := flag.String("pending-log", "", "file to journal undelivered tickets to (memory only if empty)")
+    keepaliveIdle := flag.Duration("keepalive", 60*time.Second, "probe a connection idle for this long to check the peer is still there (0 to never)")
+    flag.Parse()
+
+    if *scenarioPath != "" {
+        if err := runScenario(*scenarioPath); err != nil {
+            fmt.Printf("[ERROR] Scenario failed: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    startServer("0.0.0.0", *port, *pendingPath, *keepaliveIdle, clock.Real)
+}
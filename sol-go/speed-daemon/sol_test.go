@@ -0,0 +1,256 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "net"
+    "testing"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/testnet"
+)
+
+// pipeClient returns a client on one end of a net.Pipe and the other end.
+func pipeClient(t *testing.T, st *state, wheel *heartbeatWheel) (*client, net.Conn) {
+    t.Helper()
+    server, peer := net.Pipe()
+    t.Cleanup(func() {
+        server.Close()
+        peer.Close()
+    })
+    return &client{conn: server, addr: "pipe", st: st, wheel: wheel}, peer
+}
+
+// readByteWithin reads one byte from conn, failing the test if none comes
+// within d of real time.
+func readByteWithin(t *testing.T, conn net.Conn, d time.Duration) byte {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(d))
+    var b [1]byte
+    if _, err := conn.Read(b[:]); err != nil {
+        t.Fatalf("reading: %v", err)
+    }
+    return b[0]
+}
+
+// expectNothing fails the test if conn has anything to read within d.
+func expectNothing(t *testing.T, conn net.Conn, d time.Duration) {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(d))
+    var b [1]byte
+    if n, err := conn.Read(b[:]); err == nil {
+        t.Fatalf("read %d unexpected bytes: % x", n, b[:n])
+    }
+}
+
+func TestHeartbeatOnFakeClock(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    wheel := newHeartbeatWheel(clk, 8, 100*time.Millisecond, 1)
+    stop := make(chan struct{})
+    defer close(stop)
+    go wheel.run(stop)
+    clk.BlockUntil(1)
+
+    // Every 2.5 seconds: longer than the wheel goes round, so it spends
+    // rounds in its slot.
+    c, peer := pipeClient(t, newState(nil, nil), wheel)
+    hb := wheel.schedule(c, 25)
+
+    clk.Advance(2400 * time.Millisecond)
+    expectNothing(t, peer, 50*time.Millisecond)
+    for i := 0; i < 3; i++ {
+        clk.Advance(100 * time.Millisecond)
+        if b := readByteWithin(t, peer, time.Second); b != msgHeartbeat {
+            t.Fatalf("heartbeat %d: got 0x%02x, want 0x%02x", i, b, msgHeartbeat)
+        }
+        clk.Advance(2400 * time.Millisecond)
+    }
+
+    hb.cancelled.Store(true)
+    clk.Advance(10 * time.Second)
+    expectNothing(t, peer, 50*time.Millisecond)
+}
+
+// The write deadline must come from the wall clock: a fake clock frozen in
+// 1970 would otherwise put every deadline in the past and fail every
+// write.
+func TestSendDeadlineIgnoresFakeClock(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    wheel := newHeartbeatWheel(clk, 8, 100*time.Millisecond, 1)
+    c, peer := pipeClient(t, newState(nil, nil), wheel)
+
+    go peer.Read(make([]byte, 1))
+    if err := c.send([]byte{msgHeartbeat}); err != nil {
+        t.Fatalf("send with a fake clock: %v", err)
+    }
+}
+
+// wantHeartbeat encodes a WantHeartbeat's body (the type byte is read by
+// the caller of handleMessage).
+func wantHeartbeat(interval uint32) *bufio.Reader {
+    return bufio.NewReader(bytes.NewReader(binary.BigEndian.AppendUint32(nil, interval)))
+}
+
+func TestSecondWantHeartbeatIsAnError(t *testing.T) {
+    for _, first := range []uint32{0, 10} {
+        clk := clock.NewFake(time.Unix(0, 0))
+        c, _ := pipeClient(t, newState(nil, nil), newHeartbeatWheel(clk, 8, 100*time.Millisecond, 1))
+        if err := c.handleMessage(wantHeartbeat(first), msgWantHeartbeat); err != nil {
+            t.Fatalf("first WantHeartbeat(%d): %v", first, err)
+        }
+        var perr errProtocol
+        err := c.handleMessage(wantHeartbeat(0), msgWantHeartbeat)
+        if !errors.As(err, &perr) {
+            t.Errorf("second WantHeartbeat after WantHeartbeat(%d): got %v, want a protocol error", first, err)
+        }
+    }
+}
+
+// TestTicketFragmented runs the spec's example with every client's
+// messages split into pieces of a few bytes: the cameras' observations
+// must still add up to a ticket for the dispatcher.
+func TestTicketFragmented(t *testing.T) {
+    st := newState(nil, nil)
+    wheel := newHeartbeatWheel(clock.Real, 8, 100*time.Millisecond, 1)
+    session := func(seed int64) *testnet.Client {
+        c := testnet.Pipe(t, func(conn net.Conn) { handleClient(st, wheel, conn) })
+        c.Fragment(3, seed)
+        return c
+    }
+
+    dispatcher := session(1)
+    dispatcher.Send(iAmDispatcher(123))
+    for i, obs := range []struct {
+        mile      uint16
+        timestamp uint32
+    }{{8, 0}, {9, 45}} {
+        camera := session(int64(2 + i))
+        camera.Send(iAmCamera(123, obs.mile, 60))
+        camera.Send(plateMsg("UN1X", obs.timestamp))
+    }
+
+    want := ticket{plate: "UN1X", road: 123, mile1: 8, timestamp1: 0, mile2: 9, timestamp2: 45, speed: 8000}
+    dispatcher.Expect(want.encode())
+}
+
+// pendingTickets returns the tickets waiting for a dispatcher on road.
+func pendingTickets(st *state, road uint16) []ticket {
+    sh := st.shard(road)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    var tickets []ticket
+    for _, q := range sh.pending[road] {
+        tickets = append(tickets, q.ticket)
+    }
+    return tickets
+}
+
+func TestLedgerClaimSpansEveryDay(t *testing.T) {
+    l := newTicketLedger()
+    if !l.claim("CAR", 1, 3) {
+        t.Fatal("first claim refused")
+    }
+    for day := uint32(1); day <= 3; day++ {
+        if l.claim("CAR", day, day) {
+            t.Errorf("day %d claimed twice", day)
+        }
+    }
+    if !l.claim("CAR", 4, 4) || !l.claim("CAR", 0, 0) {
+        t.Error("days either side of the span refused")
+    }
+    if !l.claim("OTHER", 2, 2) {
+        t.Error("another plate refused a day")
+    }
+
+    // A refused claim records nothing: days 5 and 6 stay free.
+    if l.claim("CAR", 4, 6) {
+        t.Fatal("claim overlapping day 4 accepted")
+    }
+    if !l.claim("CAR", 5, 6) {
+        t.Error("refused claim left days 5-6 marked")
+    }
+}
+
+func TestTicketSpanningMidnight(t *testing.T) {
+    st := newState(nil, nil)
+    // 1 mile in 20 seconds (180 mph) across the end of day 0.
+    st.observe(1, 10, 60, "MID", secondsPerDay-10)
+    st.observe(1, 11, 60, "MID", secondsPerDay+10)
+
+    got := pendingTickets(st, 1)
+    if len(got) != 1 {
+        t.Fatalf("got %d tickets, want 1", len(got))
+    }
+    if want := (ticket{plate: "MID", road: 1, mile1: 10, timestamp1: secondsPerDay - 10, mile2: 11, timestamp2: secondsPerDay + 10, speed: 18000}); got[0] != want {
+        t.Fatalf("got %+v, want %+v", got[0], want)
+    }
+
+    // The ticket took both days, so speeding on either is not ticketed
+    // again, on any road.
+    st.observe(2, 0, 60, "MID", 100)
+    st.observe(2, 1, 60, "MID", 110)
+    st.observe(3, 0, 60, "MID", secondsPerDay+1000)
+    st.observe(3, 1, 60, "MID", secondsPerDay+1010)
+    if n := len(pendingTickets(st, 2)) + len(pendingTickets(st, 3)); n != 0 {
+        t.Fatalf("%d more tickets on days already ticketed", n)
+    }
+
+    // Day 2 is still free.
+    st.observe(4, 0, 60, "MID", 2*secondsPerDay+100)
+    st.observe(4, 1, 60, "MID", 2*secondsPerDay+110)
+    if n := len(pendingTickets(st, 4)); n != 1 {
+        t.Fatalf("got %d tickets on day 2, want 1", n)
+    }
+}
+
+func TestMultiDayAverage(t *testing.T) {
+    st := newState(nil, nil)
+    // 3000 miles from the middle of day 0 to the middle of day 2 (48
+    // hours) is 62.5 mph: over a limit of 62 by exactly the 0.5 margin.
+    st.observe(1, 0, 62, "LONG", secondsPerDay/2)
+    st.observe(1, 3000, 62, "LONG", 2*secondsPerDay+secondsPerDay/2)
+    got := pendingTickets(st, 1)
+    if len(got) != 1 || got[0].speed != 6250 {
+        t.Fatalf("got %+v, want one ticket at 62.50 mph", got)
+    }
+
+    // Every day from the first observation to the last is taken, day 1
+    // included though the car was never seen on it.
+    st.observe(2, 0, 60, "LONG", secondsPerDay+100)
+    st.observe(2, 1, 60, "LONG", secondsPerDay+110)
+    if n := len(pendingTickets(st, 2)); n != 0 {
+        t.Fatalf("got %d tickets on day 1, want none", n)
+    }
+}
+
+func TestAverageJustUnderMargin(t *testing.T) {
+    st := newState(nil, nil)
+    // 2999 miles in 48 hours is 62.479 mph: under 62.5, so no ticket
+    // however many days it spans.
+    st.observe(1, 0, 62, "SLOW", 0)
+    st.observe(1, 2999, 62, "SLOW", 2*secondsPerDay)
+    if n := len(pendingTickets(st, 1)); n != 0 {
+        t.Fatalf("got %d tickets, want none", n)
+    }
+}
+
+func TestOutOfOrderObservationsAcrossDays(t *testing.T) {
+    st := newState(nil, nil)
+    // Seen at mile 0 on day 0 and mile 100 on day 3 (a slow 1.4 mph
+    // average), then an observation arrives late for day 1 that makes the
+    // first leg fast. Only the neighbouring pair that speeds is ticketed.
+    st.observe(1, 0, 60, "LATE", 1000)
+    st.observe(1, 100, 60, "LATE", 3*secondsPerDay)
+    st.observe(1, 99, 60, "LATE", 1000+3600)
+
+    got := pendingTickets(st, 1)
+    if len(got) != 1 {
+        t.Fatalf("got %d tickets, want 1", len(got))
+    }
+    if got[0].timestamp1 != 1000 || got[0].timestamp2 != 4600 || got[0].speed != 9900 {
+        t.Fatalf("got %+v, want the 99 mph leg on day 0", got[0])
+    }
+}
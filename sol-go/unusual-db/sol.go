@@ -0,0 +1,510 @@
+package main
+
+import (
+    "bytes"
+    "container/list"
+    "encoding/gob"
+    "errors"
+    "expvar"
+    "flag"
+    "fmt"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "runtime"
+    "runtime/debug"
+    "strings"
+    "sync"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/quota"
+    "../../lib-go/signals"
+)
+
+// entry is a single key-value pair in the store's recency list.
+type entry struct {
+    key     string
+    value   []byte
+    expires time.Time // zero for keys that never expire
+}
+
+// store is the key-value map shared by every request.
+// Keys and values are arbitrary bytes, so they are kept as strings/[]byte
+// rather than being decoded.
+//
+// The 'version' key is server metadata rather than a stored pair: it lives
+// outside the map, is answered before the map is consulted, and is never
+// counted or evicted, so no insert can ever shadow it.
+//
+// When maxKeys or maxBytes is set, the store is bounded: inserting past a
+// limit evicts the least recently used keys.
+//
+// Entries inserted with an expiry are also tracked in expiring, so the
+// reaper only has to look at those rather than the whole store.
+type store struct {
+    mu       sync.Mutex
+    version  []byte
+    entries  map[string]*list.Element
+    expiring map[string]*list.Element
+    lru      *list.List // front = most recently used
+    size     int        // total bytes of keys and values in entries
+    maxKeys  int
+    maxBytes int
+    clock    clock.Clock // for expiry
+}
+
+// versionKey is the key the server answers with its own version.
+const versionKey = "version"
+
+// version is reported for the 'version' key. It can be set at build time
+// with -ldflags "-X main.version=..." or at start-up with -version.
+var version = "Ken's Key-Value Store 1.0"
+
+func newStore(version string, maxKeys, maxBytes int, clk clock.Clock) *store {
+    return &store{
+        version:  []byte(version),
+        entries:  make(map[string]*list.Element),
+        expiring: make(map[string]*list.Element),
+        lru:      list.New(),
+        maxKeys:  maxKeys,
+        maxBytes: maxBytes,
+        clock:    clk,
+    }
+}
+
+// insert stores value under key, expiring it at expires unless that is zero.
+// Attempts to modify 'version' are ignored.
+func (s *store) insert(key string, value []byte, expires time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if key == versionKey {
+        return
+    }
+
+    // A pair that could never fit is dropped rather than flushing the store.
+    if s.maxBytes > 0 && len(key)+len(value) > s.maxBytes {
+        return
+    }
+
+    el, ok := s.entries[key]
+    if ok {
+        e := el.Value.(*entry)
+        s.size += len(value) - len(e.value)
+        e.value = value
+        e.expires = expires
+        s.lru.MoveToFront(el)
+    } else {
+        el = s.lru.PushFront(&entry{key: key, value: value, expires: expires})
+        s.entries[key] = el
+        s.size += len(key) + len(value)
+    }
+
+    if expires.IsZero() {
+        delete(s.expiring, key)
+    } else {
+        s.expiring[key] = el
+    }
+    s.evict()
+}
+
+// remove deletes the entry held in el. The caller must hold s.mu.
+func (s *store) remove(el *list.Element) {
+    e := s.lru.Remove(el).(*entry)
+    delete(s.entries, e.key)
+    delete(s.expiring, e.key)
+    s.size -= len(e.key) + len(e.value)
+}
+
+// evict drops least recently used entries until the store is within its
+// limits. The caller must hold s.mu.
+func (s *store) evict() {
+    for s.lru.Len() > 0 &&
+        ((s.maxKeys > 0 && s.lru.Len() > s.maxKeys) || (s.maxBytes > 0 && s.size > s.maxBytes)) {
+        s.remove(s.lru.Back())
+    }
+}
+
+// reap deletes every entry that has expired by now and returns how many
+// were removed.
+func (s *store) reap(now time.Time) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    n := 0
+    for _, el := range s.expiring {
+        if !el.Value.(*entry).expires.After(now) {
+            s.remove(el)
+            n++
+        }
+    }
+    return n
+}
+
+// retrieve returns the value stored under key, if any.
+func (s *store) retrieve(key string) ([]byte, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if key == versionKey {
+        return s.version, true
+    }
+    el, ok := s.entries[key]
+    if !ok {
+        return nil, false
+    }
+
+    // The reaper runs periodically, so an expired key may still be here.
+    e := el.Value.(*entry)
+    if !e.expires.IsZero() && !e.expires.After(s.clock.Now()) {
+        s.remove(el)
+        return nil, false
+    }
+    s.lru.MoveToFront(el)
+    return e.value, true
+}
+
+// len returns the number of stored keys, not counting 'version'.
+func (s *store) len() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.entries)
+}
+
+// save writes a snapshot of the map to path.
+// Keys with an expiry are scratch data and are left out of the snapshot.
+// The snapshot is written to a temporary file first and renamed into place,
+// so a crash mid-write never leaves a truncated snapshot behind.
+func (s *store) save(path string) error {
+    var buf bytes.Buffer
+    s.mu.Lock()
+    data := make(map[string][]byte, len(s.entries))
+    for key, el := range s.entries {
+        if _, ok := s.expiring[key]; !ok {
+            data[key] = el.Value.(*entry).value
+        }
+    }
+    s.mu.Unlock()
+    if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(buf.Bytes()); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// load inserts every pair from the snapshot at path into the store.
+// A missing snapshot is not an error: the store simply starts empty.
+func (s *store) load(path string) error {
+    f, err := os.Open(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    var data map[string][]byte
+    if err := gob.NewDecoder(f).Decode(&data); err != nil {
+        return err
+    }
+
+    // insert never lets a snapshot override the server's own version, and
+    // keeps the store within its limits if they shrank since the save.
+    for key, value := range data {
+        s.insert(key, value, time.Time{})
+    }
+    return nil
+}
+
+// snapshotLoop saves the store every interval until stop is closed.
+func snapshotLoop(db *store, path string, interval time.Duration, stop <-chan struct{}) {
+    ticker := db.clock.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C():
+            if err := db.save(path); err != nil {
+                fmt.Printf("[ERROR] Snapshot failed: %v\n", err)
+            }
+        case <-stop:
+            return
+        }
+    }
+}
+
+// reapLoop removes expired keys every interval until stop is closed.
+func reapLoop(db *store, interval time.Duration, stop <-chan struct{}) {
+    ticker := db.clock.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case now := <-ticker.C():
+            if n := db.reap(now); n > 0 {
+                fmt.Printf("[TTL] Reaped %d expired keys\n", n)
+            }
+        case <-stop:
+            return
+        }
+    }
+}
+
+// splitTTL splits a "key@ttl" insert key (e.g. "session@30s") into the key
+// and its time-to-live. Keys without a valid positive duration after the
+// last '@' are returned unchanged with ok set to false.
+func splitTTL(key string) (string, time.Duration, bool) {
+    i := strings.LastIndexByte(key, '@')
+    if i < 0 {
+        return key, 0, false
+    }
+    ttl, err := time.ParseDuration(key[i+1:])
+    if err != nil || ttl <= 0 {
+        return key, 0, false
+    }
+    return key[:i], ttl, true
+}
+
+// Packet counters, published on the admin listener at /debug/vars.
+var (
+    stats          = expvar.NewMap("unusualdb")
+    statPackets    = new(expvar.Int) // datagrams received
+    statInserts    = new(expvar.Int)
+    statRetrieves  = new(expvar.Int)
+    statMisses     = new(expvar.Int) // retrieves of unknown keys
+    statOversized  = new(expvar.Int) // requests dropped for exceeding -max-message
+    statInvalid    = new(expvar.Int) // requests ignored, e.g. writes to 'version'
+    statDropped    = new(expvar.Int) // responses not sent (too large or write error)
+    statReadErrors = new(expvar.Int)
+)
+
+func init() {
+    expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+    stats.Set("packets", statPackets)
+    stats.Set("inserts", statInserts)
+    stats.Set("retrieves", statRetrieves)
+    stats.Set("misses", statMisses)
+    stats.Set("oversized", statOversized)
+    stats.Set("invalid", statInvalid)
+    stats.Set("dropped", statDropped)
+    stats.Set("read_errors", statReadErrors)
+}
+
+// config holds the server's start-up options.
+type config struct {
+    host    string
+    port    string
+    version string
+
+    // quota.Message bounds requests and responses, and quota.Items and
+    // maxBytes bound the store (0 means unlimited).
+    quota    quota.Quota
+    maxBytes int
+
+    // If snapshotPath is set, the map is loaded from it on start and saved
+    // to it every snapshotInterval and on shutdown; otherwise the store is
+    // purely in-memory.
+    snapshotPath     string
+    snapshotInterval time.Duration
+
+    // ttlKeys enables the "key@ttl=value" insert extension; expired keys
+    // are removed every reapInterval.
+    ttlKeys      bool
+    reapInterval time.Duration
+
+    // clock times expiry, reaping and snapshots.
+    clock clock.Clock
+
+    // adminAddr, if set, serves the packet counters over HTTP.
+    adminAddr string
+
+    // memLimit (bytes) and gcPercent, if set, override GOMEMLIMIT and GOGC.
+    memLimit  int64
+    gcPercent int
+}
+
+// tuneRuntime applies the GC settings, so a store sized with -max-bytes
+// for a small VPS can be paired with a memory limit that fits it.
+func tuneRuntime(cfg config) {
+    if cfg.memLimit > 0 {
+        debug.SetMemoryLimit(cfg.memLimit)
+        fmt.Printf("[RUNTIME] Memory limit %d MiB\n", cfg.memLimit>>20)
+    }
+    if cfg.gcPercent != 0 {
+        debug.SetGCPercent(cfg.gcPercent)
+        fmt.Printf("[RUNTIME] GC percent %d\n", cfg.gcPercent)
+    }
+}
+
+// server answers requests on a single UDP socket.
+type server struct {
+    conn net.PacketConn
+    db   *store
+    cfg  config
+}
+
+// handlePacket processes a single request datagram.
+func (s *server) handlePacket(data []byte, addr net.Addr) {
+    statPackets.Add(1)
+    if !quota.Within(len(data), s.cfg.quota.Message) {
+        statOversized.Add(1)
+        return
+    }
+
+    // The prompt defines 'Insert' by the presence of an equals sign.
+    if i := bytes.IndexByte(data, '='); i >= 0 {
+        // --- INSERT ---
+        // Split only on the *first* equals sign.
+        // key=value=foo -> key="key", value="value=foo"
+        // Insert requests get NO response.
+        statInserts.Add(1)
+        key := string(data[:i])
+        if key == versionKey {
+            statInvalid.Add(1)
+            return
+        }
+        var expires time.Time
+        if s.cfg.ttlKeys {
+            var ttl time.Duration
+            var ok bool
+            if key, ttl, ok = splitTTL(key); ok {
+                expires = s.db.clock.Now().Add(ttl)
+            }
+        }
+        s.db.insert(key, bytes.Clone(data[i+1:]), expires)
+        return
+    }
+
+    // --- RETRIEVE ---
+    // If the key doesn't exist, we do nothing (per spec option: "return no response at all")
+    statRetrieves.Add(1)
+    key := string(data)
+    value, ok := s.db.retrieve(key)
+    if !ok {
+        statMisses.Add(1)
+        return
+    }
+
+    // Format: key=value
+    response := append([]byte(key+"="), value...)
+    if !quota.Within(len(response), s.cfg.quota.Message) {
+        statDropped.Add(1)
+        return
+    }
+    if _, err := s.conn.WriteTo(response, addr); err != nil {
+        statDropped.Add(1)
+        fmt.Printf("[ERROR] Write error with %s: %v\n", addr, err)
+    }
+}
+
+// startServer serves the database over UDP.
+func startServer(cfg config) {
+    tuneRuntime(cfg)
+    db := newStore(cfg.version, cfg.quota.Items, cfg.maxBytes, cfg.clock)
+    if cfg.snapshotPath != "" {
+        if err := db.load(cfg.snapshotPath); err != nil {
+            fmt.Printf("[ERROR] Could not load snapshot %s: %v\n", cfg.snapshotPath, err)
+            return
+        }
+        fmt.Printf("[SNAPSHOT] Store has %d keys after loading %s\n", db.len(), cfg.snapshotPath)
+    }
+
+    address := cfg.host + ":" + cfg.port
+    conn, err := net.ListenPacket("udp", address)
+    if err != nil {
+        fmt.Printf("[ERROR] Could not start server: %v\n", err)
+        return
+    }
+    defer conn.Close()
+
+    fmt.Printf("[LISTENING] UDP Server listening on %s\n", address)
+
+    stop := make(chan struct{})
+    if cfg.snapshotPath != "" && cfg.snapshotInterval > 0 {
+        go snapshotLoop(db, cfg.snapshotPath, cfg.snapshotInterval, stop)
+    }
+    if cfg.ttlKeys {
+        go reapLoop(db, cfg.reapInterval, stop)
+    }
+    if cfg.adminAddr != "" {
+        // expvar registers /debug/vars on the default mux.
+        go func() {
+            fmt.Printf("[ADMIN] Metrics on http://%s/debug/vars\n", cfg.adminAddr)
+            if err := http.ListenAndServe(cfg.adminAddr, nil); err != nil {
+                fmt.Printf("[ERROR] Admin listener: %v\n", err)
+            }
+        }()
+    }
+
+    // Handle graceful shutdown
+    signals.OnShutdown(func() {
+        fmt.Println("\n[SHUTTING DOWN] Server stopping...")
+        conn.Close()
+    })
+
+    s := &server{conn: conn, db: db, cfg: cfg}
+    // Read into a buffer larger than -max-message so oversized requests are
+    // seen (and counted) rather than silently truncated.
+    buffer := make([]byte, 65536)
+    for {
+        n, addr, err := conn.ReadFrom(buffer)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                break
+            }
+            statReadErrors.Add(1)
+            fmt.Printf("[ERROR] Read error: %v\n", err)
+            continue
+        }
+        s.handlePacket(buffer[:n], addr)
+    }
+
+    close(stop)
+    if cfg.snapshotPath != "" {
+        if err := db.save(cfg.snapshotPath); err != nil {
+            fmt.Printf("[ERROR] Final snapshot failed: %v\n", err)
+            return
+        }
+        fmt.Printf("[SNAPSHOT] Saved to %s\n", cfg.snapshotPath)
+    }
+}
+
+func main() {
+    cfg := config{host: "0.0.0.0", clock: clock.Real}
+    flag.StringVar(&cfg.port, "port", "65432", "UDP port to listen on")
+    flag.StringVar(&cfg.version, "version", version, "value reported for the 'version' key")
+    flag.IntVar(&cfg.maxBytes, "max-bytes", 0, "maximum total bytes of keys and values before LRU eviction (0 = unlimited)")
+    flag.StringVar(&cfg.snapshotPath, "snapshot", "", "file to persist the store to (disabled if empty)")
+    flag.DurationVar(&cfg.snapshotInterval, "snapshot-interval", 30*time.Second, "how often to write the snapshot")
+    flag.BoolVar(&cfg.ttlKeys, "ttl-keys", false, "treat inserts to key@ttl (e.g. foo@30s=bar) as expiring keys")
+    flag.DurationVar(&cfg.reapInterval, "reap-interval", time.Second, "how often expired keys are removed in -ttl-keys mode")
+    flag.StringVar(&cfg.adminAddr, "admin", "", "address to serve metrics on, e.g. 127.0.0.1:8080 (disabled if empty)")
+    memLimit := flag.Int64("mem-limit", 0, "soft memory limit for the Go runtime in MiB, as GOMEMLIMIT (0 = GOMEMLIMIT or none)")
+    flag.IntVar(&cfg.gcPercent, "gc-percent", 0, "GC target percentage, as GOGC; -1 turns the GC off below -mem-limit (0 = GOGC or 100)")
+    q := quota.Flags(flag.CommandLine, "unusual-db")
+    flag.Parse()
+    if err := q.Validate(); err != nil {
+        fmt.Printf("[ERROR] %v\n", err)
+        os.Exit(2)
+    }
+    cfg.quota = *q
+    cfg.memLimit = *memLimit << 20
+
+    startServer(cfg)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "net"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "../../lib-go/clock"
+    "../../lib-go/quota"
+)
+
+const testVersion = "test-version 1.0"
+
+func TestStoreIgnoresVersionInserts(t *testing.T) {
+    s := newStore(testVersion, 0, 0, clock.Real)
+    s.insert(versionKey, []byte("evil"), time.Time{})
+    s.insert(versionKey, []byte("evil"), time.Now().Add(time.Hour))
+    s.insert(versionKey, nil, time.Time{})
+
+    if v, ok := s.retrieve(versionKey); !ok || string(v) != testVersion {
+        t.Fatalf("version is %q, %v; want %q", v, ok, testVersion)
+    }
+    if n := s.len(); n != 0 {
+        t.Fatalf("%d keys stored, want 0", n)
+    }
+}
+
+func TestVersionSurvivesEvictionAndReaping(t *testing.T) {
+    s := newStore(testVersion, 1, 64, clock.Real)
+    for _, key := range []string{"a", "b", "c"} {
+        s.insert(key, []byte("0123456789"), time.Now().Add(-time.Second))
+    }
+    s.reap(time.Now())
+    if v, _ := s.retrieve(versionKey); string(v) != testVersion {
+        t.Fatalf("version is %q after eviction and reaping", v)
+    }
+}
+
+func TestSnapshotCannotOverwriteVersion(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "db.gob")
+
+    // A snapshot from a build that stored 'version' as a normal pair.
+    old := newStore("old", 0, 0, clock.Real)
+    old.entries[versionKey] = old.lru.PushFront(&entry{key: versionKey, value: []byte("old")})
+    old.insert("k", []byte("v"), time.Time{})
+    if err := old.save(path); err != nil {
+        t.Fatal(err)
+    }
+
+    s := newStore(testVersion, 0, 0, clock.Real)
+    if err := s.load(path); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.retrieve(versionKey); string(v) != testVersion {
+        t.Fatalf("version is %q after loading the snapshot", v)
+    }
+    if v, ok := s.retrieve("k"); !ok || string(v) != "v" {
+        t.Fatalf("k is %q, %v after loading the snapshot", v, ok)
+    }
+}
+
+// TestServerVersionOverwrite sends the inserts a client might try over
+// real UDP and checks what retrieving 'version' returns.
+func TestServerVersionOverwrite(t *testing.T) {
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    client, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    s := &server{conn: conn, db: newStore(testVersion, 0, 0, clock.Real), cfg: config{ttlKeys: true}}
+    for _, req := range []string{
+        "version=evil",
+        "version=",
+        "version==evil",
+        "version@1h=evil", // with -ttl-keys, the TTL suffix is stripped first
+    } {
+        s.handlePacket([]byte(req), client.LocalAddr())
+    }
+    s.handlePacket([]byte(versionKey), client.LocalAddr())
+
+    client.SetReadDeadline(time.Now().Add(time.Second))
+    buf := make([]byte, 1000)
+    n, _, err := client.ReadFrom(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, want := string(buf[:n]), versionKey+"="+testVersion; got != want {
+        t.Fatalf("got %q, want %q", got, want)
+    }
+    if n := s.db.len(); n != 0 {
+        t.Fatalf("%d keys stored, want 0", n)
+    }
+
+    // Keys that merely look like it are ordinary keys.
+    s.handlePacket([]byte("Version=x"), client.LocalAddr())
+    s.handlePacket([]byte("version =x"), client.LocalAddr())
+    if n := s.db.len(); n != 2 {
+        t.Fatalf("%d keys stored, want 2", n)
+    }
+}
+
+// TestTTLOnFakeClock checks that a key@ttl insert expires on time, both
+// when retrieved and when the reaper gets to it first.
+func TestTTLOnFakeClock(t *testing.T) {
+    clk := clock.NewFake(time.Unix(0, 0))
+    db := newStore(testVersion, 0, 0, clk)
+    s := &server{db: db, cfg: config{ttlKeys: true}}
+    s.handlePacket([]byte("a@30s=1"), nil)
+    s.handlePacket([]byte("b@30s=2"), nil)
+
+    clk.Advance(29 * time.Second)
+    if _, ok := db.retrieve("a"); !ok {
+        t.Fatal("key expired early")
+    }
+    clk.Advance(time.Second)
+    if _, ok := db.retrieve("a"); ok {
+        t.Fatal("key retrieved after it expired")
+    }
+
+    stop := make(chan struct{})
+    defer close(stop)
+    go reapLoop(db, time.Second, stop)
+    clk.BlockUntil(1)
+    if n := db.len(); n != 1 {
+        t.Fatalf("%d keys before reaping, want 1", n)
+    }
+    // The second tick is only taken once the reap after the first is done.
+    clk.Advance(2 * time.Second)
+    if n := db.len(); n != 0 {
+        t.Fatalf("%d keys after reaping, want 0", n)
+    }
+}
+
+// TestMessageQuota checks the default -max-message keeps requests shorter
+// than 1000 bytes, as the spec has it.
+func TestMessageQuota(t *testing.T) {
+    db := newStore(testVersion, 0, 0, clock.Real)
+    s := &server{db: db, cfg: config{quota: quota.For("unusual-db")}}
+    fits := "a=" + strings.Repeat("x", 997)
+    s.handlePacket([]byte(fits), nil)
+    s.handlePacket([]byte("b="+strings.Repeat("x", 998)), nil)
+    if _, ok := db.retrieve("a"); !ok {
+        t.Fatalf("a %d-byte insert was dropped", len(fits))
+    }
+    if _, ok := db.retrieve("b"); ok {
+        t.Fatalf("a %d-byte insert was stored", len(fits)+1)
+    }
+}
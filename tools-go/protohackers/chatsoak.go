@@ -0,0 +1,325 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "fmt"
+    "math/rand"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// chatBot is one simulated budget chat user taking part in a soak run.
+//
+// Every bot sends "seq 1" ... "seq N" followed by "fin N", and checks that it
+// receives exactly that sequence from every other bot.
+type chatBot struct {
+    name   string
+    prefix string
+    want   int // number of other bots in the swarm
+    conn   net.Conn
+    reader *bufio.Reader
+
+    // The fields below are owned by readLoop until exited is closed.
+    peers map[string]bool
+    last  map[string]int
+    fins  map[string]int
+
+    received int
+    gaps     int // messages that never arrived
+    stale    int // duplicated or out-of-order messages
+    left     []string
+
+    ready    chan struct{} // closed once every other bot is in the room
+    finished chan struct{} // closed once every other bot has sent "fin"
+    exited   chan struct{} // closed when readLoop returns
+}
+
+// joinBot connects a bot to the server and completes the name handshake.
+func joinBot(addr, name, prefix string, want int, timeout time.Duration, frag *fragmentOptions, rng *rand.Rand) (*chatBot, error) {
+    conn, err := dialPolicy.Dial("tcp", addr, timeout)
+    if err != nil {
+        return nil, err
+    }
+    conn = frag.wrap(conn, rng)
+
+    b := &chatBot{
+        name:     name,
+        prefix:   prefix,
+        want:     want,
+        conn:     conn,
+        reader:   bufio.NewReader(conn),
+        peers:    make(map[string]bool),
+        last:     make(map[string]int),
+        fins:     make(map[string]int),
+        ready:    make(chan struct{}),
+        finished: make(chan struct{}),
+        exited:   make(chan struct{}),
+    }
+
+    conn.SetDeadline(time.Now().Add(timeout))
+    defer conn.SetDeadline(time.Time{})
+
+    // 1. Welcome prompt
+    if _, err := b.reader.ReadString('\n'); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("reading welcome: %w", err)
+    }
+
+    // 2. Name
+    if _, err := fmt.Fprintf(conn, "%s\n", name); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("sending name: %w", err)
+    }
+
+    // 3. Room list, e.g. "* The room contains: alice, bob"
+    line, err := b.reader.ReadString('\n')
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("reading room list: %w", err)
+    }
+    if !strings.HasPrefix(line, "*") {
+        conn.Close()
+        return nil, fmt.Errorf("unexpected room list %q", strings.TrimSpace(line))
+    }
+    if _, list, ok := strings.Cut(line, ":"); ok {
+        for _, peer := range strings.Split(list, ",") {
+            b.addPeer(strings.TrimSpace(peer))
+        }
+    }
+
+    return b, nil
+}
+
+// isBot reports whether name belongs to this swarm (and is not the bot itself).
+func (b *chatBot) isBot(name string) bool {
+    return name != b.name && strings.HasPrefix(name, b.prefix)
+}
+
+func (b *chatBot) addPeer(name string) {
+    if !b.isBot(name) || b.peers[name] {
+        return
+    }
+    b.peers[name] = true
+    if len(b.peers) == b.want {
+        close(b.ready)
+    }
+}
+
+// readLoop consumes everything the server sends to this bot until the
+// connection is closed.
+func (b *chatBot) readLoop() {
+    defer close(b.exited)
+
+    for {
+        line, err := b.reader.ReadString('\n')
+        if err != nil {
+            return
+        }
+        line = strings.TrimRight(line, "\r\n")
+
+        switch {
+        case strings.HasPrefix(line, "* "):
+            b.handlePresence(line[2:])
+        case strings.HasPrefix(line, "["):
+            b.handleChat(line)
+        }
+    }
+}
+
+// handlePresence tracks "X has entered the room" / "X has left the room".
+func (b *chatBot) handlePresence(text string) {
+    if name, ok := strings.CutSuffix(text, " has entered the room"); ok {
+        b.addPeer(name)
+    } else if name, ok := strings.CutSuffix(text, " has left the room"); ok && b.isBot(name) {
+        b.left = append(b.left, name)
+    }
+}
+
+// handleChat checks a "[name] seq N" or "[name] fin N" message.
+func (b *chatBot) handleChat(line string) {
+    end := strings.IndexByte(line, ']')
+    if end < 0 {
+        return
+    }
+    sender := line[1:end]
+    if !b.isBot(sender) {
+        return
+    }
+
+    kind, num, _ := strings.Cut(strings.TrimSpace(line[end+1:]), " ")
+    n, err := strconv.Atoi(num)
+    if err != nil {
+        b.stale++
+        return
+    }
+
+    last := b.last[sender]
+    switch kind {
+    case "seq":
+        b.received++
+        if n <= last {
+            b.stale++
+            return
+        }
+        b.gaps += n - last - 1
+        b.last[sender] = n
+    case "fin":
+        if _, dup := b.fins[sender]; dup {
+            b.stale++
+            return
+        }
+        if n > last {
+            b.gaps += n - last
+        }
+        b.fins[sender] = n
+        if len(b.fins) == b.want {
+            close(b.finished)
+        }
+    }
+}
+
+// chat sends count sequenced messages, one every interval, then "fin".
+func (b *chatBot) chat(count int, interval time.Duration) error {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for seq := 1; seq <= count; seq++ {
+        <-ticker.C
+        if _, err := fmt.Fprintf(b.conn, "seq %d\n", seq); err != nil {
+            return err
+        }
+    }
+    _, err := fmt.Fprintf(b.conn, "fin %d\n", count)
+    return err
+}
+
+// waitAll waits until the channel picked from every bot is closed.
+func waitAll(swarm []*chatBot, pick func(*chatBot) chan struct{}, timeout time.Duration) error {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    for _, b := range swarm {
+        select {
+        case <-pick(b):
+        case <-timer.C:
+            return fmt.Errorf("timed out waiting for %s", b.name)
+        }
+    }
+    return nil
+}
+
+// runChatSoak joins a swarm of bots to a budget chat server, has them chat
+// at a fixed rate, and verifies that each bot received every message from
+// every other bot exactly once and in order.
+func runChatSoak(args []string) error {
+    fs := flag.NewFlagSet("chat-soak", flag.ExitOnError)
+    addr := fs.String("addr", "127.0.0.1:65432", "budget chat server address")
+    bots := fs.Int("bots", 10, "number of simulated users")
+    rate := fs.Float64("rate", 5, "messages per second sent by each bot")
+    duration := fs.Duration("duration", 30*time.Second, "how long each bot keeps chatting")
+    settle := fs.Duration("settle", 10*time.Second, "how long to wait for joins and for the last messages")
+    prefix := fs.String("prefix", "soak", "alphanumeric prefix for bot names")
+    frag := fragmentFlags(fs, 0)
+    seed := seedFlag(fs)
+    fs.Parse(args)
+
+    if *bots < 2 {
+        return errors.New("need at least 2 bots")
+    }
+    if *rate <= 0 {
+        return errors.New("rate must be positive")
+    }
+
+    fmt.Printf("[SOAK] seed %d\n", *seed)
+    rng := rand.New(rand.NewSource(*seed))
+
+    // 1. Join the bots one at a time so the room state is predictable.
+    swarm := make([]*chatBot, 0, *bots)
+    defer func() {
+        for _, b := range swarm {
+            b.conn.Close()
+        }
+    }()
+
+    for i := 0; i < *bots; i++ {
+        b, err := joinBot(*addr, fmt.Sprintf("%s%04d", *prefix, i), *prefix, *bots-1, *settle,
+            frag, rand.New(rand.NewSource(rng.Int63())))
+        if err != nil {
+            return seedError(fmt.Errorf("joining bot %d: %w", i, err), *seed)
+        }
+        swarm = append(swarm, b)
+        go b.readLoop()
+    }
+    fmt.Printf("[SOAK] %d bots joined %s\n", len(swarm), *addr)
+
+    // Messages only reach users already in the room, so nobody speaks until
+    // every bot has seen every other bot arrive.
+    if err := waitAll(swarm, func(b *chatBot) chan struct{} { return b.ready }, *settle); err != nil {
+        return seedError(fmt.Errorf("waiting for joins: %w", err), *seed)
+    }
+
+    // 2. Chat
+    count := int(*rate * duration.Seconds())
+    if count < 1 {
+        count = 1
+    }
+    interval := time.Duration(float64(time.Second) / *rate)
+    fmt.Printf("[SOAK] each bot sends %d messages every %v\n", count, interval)
+
+    start := time.Now()
+    var wg sync.WaitGroup
+    sendErrs := make([]error, len(swarm))
+    for i, b := range swarm {
+        wg.Add(1)
+        go func(i int, b *chatBot) {
+            defer wg.Done()
+            sendErrs[i] = b.chat(count, interval)
+        }(i, b)
+    }
+    wg.Wait()
+    elapsed := time.Since(start)
+
+    // 3. Wait for the tail of the traffic, then stop the readers.
+    waitErr := waitAll(swarm, func(b *chatBot) chan struct{} { return b.finished }, *settle)
+    for _, b := range swarm {
+        b.conn.Close()
+        <-b.exited
+    }
+
+    // 4. Report
+    failed := waitErr != nil
+    if waitErr != nil {
+        fmt.Printf("[ERROR] %v\n", waitErr)
+    }
+
+    var received, gaps, stale int
+    for i, b := range swarm {
+        received += b.received
+        gaps += b.gaps
+        stale += b.stale
+
+        // Bots that never saw a "fin" are missing that sender's whole stream.
+        gaps += (b.want - len(b.fins)) * count
+
+        if sendErrs[i] != nil || b.gaps > 0 || b.stale > 0 || len(b.left) > 0 || len(b.fins) < b.want {
+            failed = true
+            fmt.Printf("[BOT] %s: received=%d gaps=%d stale=%d fins=%d/%d left=%v send_err=%v\n",
+                b.name, b.received, b.gaps, b.stale, len(b.fins), b.want, b.left, sendErrs[i])
+        }
+    }
+
+    expected := len(swarm) * (len(swarm) - 1) * count
+    fmt.Printf("[RESULT] delivered %d/%d messages in %v (missing=%d stale=%d)\n",
+        received, expected, elapsed.Round(time.Millisecond), gaps, stale)
+
+    if failed {
+        return seedError(errors.New("soak test failed"), *seed)
+    }
+    fmt.Println("[RESULT] PASS")
+    return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "time"
+
+    "../../lib-go/golden"
+    "../../lib-go/retry"
+    "../../lib-go/signals"
+    "../../lib-go/testserver"
+)
+
+// A problem's conformance suite is its directory of golden transcripts,
+// golden/<problem>/*.txt. conform replays every suite either against one
+// address or against each Go solution, built from sol-go/<problem> and
+// started for the duration of its suite. A solution started here is also
+// checked for file descriptors it still holds once every transcript's
+// connection is closed.
+
+// suiteResult is the outcome of one problem's suite.
+type suiteResult struct {
+    problem  string
+    passed   int
+    total    int
+    failures []string // "transcript: error" for each failure
+    leaks    []string // resources the server kept after the suite
+    setupErr error    // the suite could not be run at all
+}
+
+// localServer builds and starts the Go solution for problem with args,
+// waiting until it accepts connections on addr. There is nothing to connect
+// to for a UDP server, so it is just given a moment to bind.
+func localServer(solDir, problem, network, addr string, timeout time.Duration, args ...string) (*exec.Cmd, error) {
+    src := filepath.Join(solDir, problem)
+    if matches, _ := filepath.Glob(filepath.Join(src, "*.go")); len(matches) == 0 {
+        return nil, fmt.Errorf("no Go solution in %s", src)
+    }
+    bin, err := filepath.Abs(filepath.Join(os.TempDir(), "protohackers-conform-"+problem))
+    if err != nil {
+        return nil, err
+    }
+    if err := testserver.Build(src, bin); err != nil {
+        return nil, err
+    }
+
+    server := exec.Command(bin, args...)
+    if err := server.Start(); err != nil {
+        return nil, err
+    }
+    if network == "udp" {
+        time.Sleep(500 * time.Millisecond)
+        return server, nil
+    }
+    wait := retry.Backoff{Base: 50 * time.Millisecond, Max: time.Second}
+    for retry, deadline := 0, time.Now().Add(timeout); time.Now().Before(deadline); retry++ {
+        if conn, err := net.Dial("tcp", addr); err == nil {
+            conn.Close()
+            return server, nil
+        }
+        time.Sleep(wait.Delay(retry))
+    }
+    stopServer(server)
+    return nil, fmt.Errorf("%s did not start listening on %s", problem, addr)
+}
+
+// stopServer shuts a solution down the way an operator would. Where
+// processes can't be sent a signal (Windows), it is killed.
+func stopServer(server *exec.Cmd) {
+    if err := server.Process.Signal(signals.Terminate); err != nil {
+        server.Process.Kill()
+    }
+    done := make(chan struct{})
+    go func() {
+        server.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(retry.StopTimeout):
+        server.Process.Kill()
+        <-done
+    }
+}
+
+func runSuite(problem, dir, addr string, timeout time.Duration) suiteResult {
+    res := suiteResult{problem: problem}
+    paths, err := golden.Paths([]string{dir})
+    if err != nil {
+        res.setupErr = err
+        return res
+    }
+    res.total = len(paths)
+    for _, path := range paths {
+        if err := replayFile(addr, path, timeout); err != nil {
+            res.failures = append(res.failures, fmt.Sprintf("%s: %v", filepath.Base(path), err))
+        } else {
+            res.passed++
+        }
+    }
+    return res
+}
+
+// runConform replays every problem's conformance suite and prints a
+// pass/fail matrix.
+func runConform(args []string) error {
+    fs := flag.NewFlagSet("conform", flag.ExitOnError)
+    addr := fs.String("addr", "", "run every suite against this server instead of starting the Go solutions")
+    goldenDir := fs.String("golden", "golden", "directory of per-problem transcript suites")
+    solDir := fs.String("sol", "../../sol-go", "directory of Go solutions to build and start")
+    listen := fs.String("listen", "127.0.0.1:65432", "address the Go solutions listen on")
+    timeout := fs.Duration("timeout", retry.ReplyTimeout, "how long to wait for each reply, and for a server to start")
+    settle := fs.Duration("settle", 500*time.Millisecond, "how long a started solution gets to close connections before its fds are counted")
+    slack := fs.Int("slack", 0, "fds a started solution may keep after its suite before it counts as a leak")
+    fs.Parse(args)
+
+    // Problems to check: those named, or every suite there is.
+    problems := fs.Args()
+    if len(problems) == 0 {
+        entries, err := os.ReadDir(*goldenDir)
+        if err != nil {
+            return err
+        }
+        for _, e := range entries {
+            if e.IsDir() {
+                problems = append(problems, e.Name())
+            }
+        }
+        sort.Strings(problems)
+    }
+    if len(problems) == 0 {
+        return fmt.Errorf("no suites in %s", *goldenDir)
+    }
+
+    var results []suiteResult
+    for _, problem := range problems {
+        dir := filepath.Join(*goldenDir, problem)
+        if *addr != "" {
+            results = append(results, runSuite(problem, dir, *addr, *timeout))
+            continue
+        }
+
+        server, err := localServer(*solDir, problem, "tcp", *listen, *timeout)
+        if err != nil {
+            results = append(results, suiteResult{problem: problem, setupErr: err})
+            continue
+        }
+        time.Sleep(*settle)
+        before := sampleProcess(server.Process.Pid, "")
+        res := runSuite(problem, dir, *listen, *timeout)
+        time.Sleep(*settle)
+        res.leaks = leaks(before, sampleProcess(server.Process.Pid, ""), *slack)
+        results = append(results, res)
+        stopServer(server)
+    }
+
+    failed := 0
+    fmt.Printf("\n%-26s %-6s %s\n", "PROBLEM", "RESULT", "TRANSCRIPTS")
+    for _, r := range results {
+        status := "PASS"
+        switch {
+        case r.setupErr != nil:
+            status = "ERROR"
+        case r.total == 0:
+            status = "EMPTY"
+        case r.passed < r.total:
+            status = "FAIL"
+        case len(r.leaks) > 0:
+            status = "LEAK"
+        }
+        if status != "PASS" {
+            failed++
+        }
+        fmt.Printf("%-26s %-6s %d/%d\n", r.problem, status, r.passed, r.total)
+    }
+
+    for _, r := range results {
+        if r.setupErr != nil {
+            fmt.Printf("\n[ERROR] %s: %v\n", r.problem, r.setupErr)
+        }
+        for _, f := range r.failures {
+            fmt.Printf("\n[FAIL] %s/%s\n", r.problem, f)
+        }
+        for _, l := range r.leaks {
+            fmt.Printf("\n[LEAK] %s: %s\n", r.problem, l)
+        }
+    }
+
+    if failed > 0 {
+        return fmt.Errorf("%d of %d problems did not pass", failed, len(results))
+    }
+    fmt.Println("\n[RESULT] PASS")
+    return nil
+}
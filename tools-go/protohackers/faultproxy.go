@@ -0,0 +1,192 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "sync"
+    "time"
+
+    "../../lib-go/retry"
+    "../../lib-go/signals"
+)
+
+// faultConfig describes the adverse network the proxy simulates. Every
+// setting applies to each direction separately.
+type faultConfig struct {
+    latency   time.Duration // added before each fragment is forwarded
+    jitter    time.Duration // random extra latency, up to this much
+    bandwidth int           // bytes per second, 0 for unlimited
+    fragment  int           // split writes into random pieces of at most this many bytes, 0 to keep them whole
+    reset     float64       // probability per fragment of resetting both connections
+}
+
+// faultProxy forwards TCP connections to an upstream server through a
+// faultConfig. Randomness comes from one seeded source so a run can be
+// repeated.
+type faultProxy struct {
+    upstream string
+    cfg      faultConfig
+
+    mu  sync.Mutex
+    rng *rand.Rand
+}
+
+func (p *faultProxy) intn(n int) int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.rng.Intn(n)
+}
+
+func (p *faultProxy) chance(prob float64) bool {
+    if prob <= 0 {
+        return false
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.rng.Float64() < prob
+}
+
+// split cuts data into the fragments that will be forwarded one by one.
+func (p *faultProxy) split(data []byte) [][]byte {
+    if p.cfg.fragment <= 0 {
+        return [][]byte{data}
+    }
+    var frags [][]byte
+    for len(data) > 0 {
+        n := min(len(data), 1+p.intn(p.cfg.fragment))
+        frags = append(frags, data[:n])
+        data = data[n:]
+    }
+    return frags
+}
+
+// delay is how long to hold a fragment of n bytes before forwarding it.
+func (p *faultProxy) delay(n int) time.Duration {
+    d := p.cfg.latency
+    if p.cfg.jitter > 0 {
+        d += time.Duration(p.intn(int(p.cfg.jitter)))
+    }
+    if p.cfg.bandwidth > 0 {
+        d += time.Duration(n) * time.Second / time.Duration(p.cfg.bandwidth)
+    }
+    return d
+}
+
+// resetConn closes a connection with an RST instead of a FIN.
+func resetConn(c net.Conn) {
+    if tcp, ok := c.(*net.TCPConn); ok {
+        tcp.SetLinger(0)
+    }
+    c.Close()
+}
+
+// pipe forwards src to dst until src ends, either side fails or a reset
+// is injected. It reports whether it injected a reset, and the error that
+// stopped it. A clean end of stream is passed on as a half-close and is
+// not an error.
+func (p *faultProxy) pipe(dst, src net.Conn) (bool, error) {
+    buf := make([]byte, 32*1024)
+    for {
+        n, err := src.Read(buf)
+        for _, frag := range p.split(buf[:n]) {
+            time.Sleep(p.delay(len(frag)))
+            if p.chance(p.cfg.reset) {
+                return true, nil
+            }
+            if _, err := dst.Write(frag); err != nil {
+                return false, err
+            }
+        }
+        if errors.Is(err, io.EOF) {
+            if tcp, ok := dst.(*net.TCPConn); ok {
+                tcp.CloseWrite()
+            }
+            return false, nil
+        }
+        if err != nil {
+            return false, err
+        }
+    }
+}
+
+func (p *faultProxy) handle(client net.Conn) {
+    server, err := dialPolicy.Dial("tcp", p.upstream, retry.ReplyTimeout)
+    if err != nil {
+        fmt.Printf("[ERROR] Dialing %s: %v\n", p.upstream, err)
+        client.Close()
+        return
+    }
+    fmt.Printf("[PROXY] %s <-> %s\n", client.RemoteAddr(), p.upstream)
+
+    var once sync.Once
+    closeBoth := func(reset bool) {
+        once.Do(func() {
+            if reset {
+                fmt.Printf("[RESET] %s\n", client.RemoteAddr())
+                resetConn(client)
+                resetConn(server)
+            } else {
+                client.Close()
+                server.Close()
+            }
+        })
+    }
+
+    var wg sync.WaitGroup
+    wg.Add(2)
+    for _, dir := range [][2]net.Conn{{server, client}, {client, server}} {
+        go func(dst, src net.Conn) {
+            defer wg.Done()
+            // Anything but a clean end of stream tears down both
+            // directions, rather than leave the other one waiting.
+            if reset, err := p.pipe(dst, src); reset || err != nil {
+                closeBoth(reset)
+            }
+        }(dir[0], dir[1])
+    }
+    wg.Wait()
+    closeBoth(false)
+}
+
+// runFaultProxy sits between test clients and a server and makes the
+// network between them slow, fragmented and unreliable.
+func runFaultProxy(args []string) error {
+    fs := flag.NewFlagSet("fault-proxy", flag.ExitOnError)
+    listen := fs.String("listen", "127.0.0.1:65433", "address for clients to connect to")
+    upstream := fs.String("upstream", "127.0.0.1:65432", "server to forward to")
+    var cfg faultConfig
+    fs.DurationVar(&cfg.latency, "latency", 0, "delay added to every fragment")
+    fs.DurationVar(&cfg.jitter, "jitter", 0, "random extra delay per fragment, up to this much")
+    fs.IntVar(&cfg.bandwidth, "bandwidth", 0, "bytes per second in each direction (0 for unlimited)")
+    fs.IntVar(&cfg.fragment, "fragment", 0, "split data into random pieces of at most this many bytes (0 to keep writes whole)")
+    fs.Float64Var(&cfg.reset, "reset", 0, "probability per fragment of resetting the connection")
+    seed := seedFlag(fs)
+    fs.Parse(args)
+
+    p := &faultProxy{upstream: *upstream, cfg: cfg, rng: rand.New(rand.NewSource(*seed))}
+
+    listener, err := net.Listen("tcp", *listen)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("[LISTENING] Fault proxy on %s -> %s (seed %d)\n", *listen, *upstream, *seed)
+
+    signals.OnShutdown(func() {
+        listener.Close()
+    })
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return nil
+            }
+            return err
+        }
+        go p.handle(conn)
+    }
+}
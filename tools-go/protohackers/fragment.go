@@ -0,0 +1,32 @@
+package main
+
+import (
+    "flag"
+    "math/rand"
+    "net"
+    "time"
+
+    "../../lib-go/fragment"
+)
+
+// fragmentOptions are the -fragment flags shared by the client tools.
+type fragmentOptions struct {
+    max   int
+    delay time.Duration
+}
+
+func fragmentFlags(fs *flag.FlagSet, defaultMax int) *fragmentOptions {
+    o := &fragmentOptions{}
+    fs.IntVar(&o.max, "fragment", defaultMax, "split each write into random pieces of at most this many bytes (0 to keep writes whole)")
+    fs.DurationVar(&o.delay, "fragment-delay", time.Millisecond, "pause between the pieces of a fragmented write")
+    return o
+}
+
+// wrap returns conn fragmenting its writes as configured, using rng for
+// the piece sizes. rng must not be shared with another goroutine.
+func (o *fragmentOptions) wrap(conn net.Conn, rng *rand.Rand) net.Conn {
+    if o.max <= 0 {
+        return conn
+    }
+    return fragment.NewConn(conn, o.max, o.delay, rng)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+
+    "../../lib-go/golden"
+    "../../lib-go/retry"
+)
+
+// describeDiff explains where got first departs from want.
+func describeDiff(want, got []byte) string {
+    i := 0
+    for i < len(want) && i < len(got) && want[i] == got[i] {
+        i++
+    }
+    lo := max(0, i-16)
+    return fmt.Sprintf("differs at byte %d:\n    want %q\n    got  %q", i, want[lo:min(len(want), i+32)], got[lo:min(len(got), i+32)])
+}
+
+// replayTranscript runs one transcript against addr and diffs every reply.
+func replayTranscript(addr string, steps []golden.Step, timeout time.Duration) error {
+    conn, err := dialPolicy.Dial("tcp", addr, timeout)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    for i, s := range steps {
+        conn.SetDeadline(time.Now().Add(timeout))
+        switch {
+        case s.Send && s.EOF:
+            if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+                return fmt.Errorf("step %d: %w", i+1, err)
+            }
+        case s.Send:
+            if _, err := conn.Write(s.Data); err != nil {
+                return fmt.Errorf("step %d: %w", i+1, err)
+            }
+        case s.EOF:
+            n, err := conn.Read(make([]byte, 1))
+            if n > 0 || !errors.Is(err, io.EOF) {
+                return fmt.Errorf("step %d: expected the server to close the connection (read %d, %v)", i+1, n, err)
+            }
+        default:
+            got := make([]byte, len(s.Data))
+            n, err := io.ReadFull(conn, got)
+            if !bytes.Equal(got[:n], s.Data) {
+                return fmt.Errorf("step %d: reply %s", i+1, describeDiff(s.Data, got[:n]))
+            }
+            if err != nil {
+                return fmt.Errorf("step %d: %w", i+1, err)
+            }
+        }
+    }
+    return nil
+}
+
+// replayFile parses and replays one transcript.
+func replayFile(addr, path string, timeout time.Duration) error {
+    steps, err := golden.Parse(path)
+    if err != nil {
+        return err
+    }
+    return replayTranscript(addr, steps, timeout)
+}
+
+// transcriptWriter records one proxied connection, merging consecutive
+// chunks in the same direction into one line.
+type transcriptWriter struct {
+    mu      sync.Mutex
+    f       *os.File
+    lastDir string
+    pending []byte
+}
+
+func (t *transcriptWriter) add(dir string, data []byte) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.f == nil {
+        return
+    }
+    if dir != t.lastDir {
+        t.flushLocked()
+        t.lastDir = dir
+    }
+    t.pending = append(t.pending, data...)
+}
+
+func (t *transcriptWriter) flushLocked() {
+    if len(t.pending) > 0 {
+        fmt.Fprintf(t.f, "%s %s\n", t.lastDir, strconv.QuoteToASCII(string(t.pending)))
+        t.pending = nil
+    }
+}
+
+// eof records one side closing the connection.
+func (t *transcriptWriter) eof(dir string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.f == nil {
+        return
+    }
+    t.flushLocked()
+    t.lastDir = ""
+    fmt.Fprintf(t.f, "%s EOF\n", dir)
+}
+
+// close ends the transcript; anything after it is not recorded.
+func (t *transcriptWriter) close() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.flushLocked()
+    t.f.Close()
+    t.f = nil
+}
+
+// recordSession proxies one client to upstream, writing what passes to
+// path.
+func recordSession(client net.Conn, upstream, path string) {
+    defer client.Close()
+
+    server, err := dialPolicy.Dial("tcp", upstream, retry.ReplyTimeout)
+    if err != nil {
+        fmt.Printf("[ERROR] Dialing %s: %v\n", upstream, err)
+        return
+    }
+    defer server.Close()
+
+    f, err := os.Create(path)
+    if err != nil {
+        fmt.Printf("[ERROR] %v\n", err)
+        return
+    }
+    fmt.Fprintf(f, "# recorded from %s on %s\n", upstream, time.Now().Format(time.RFC3339))
+    t := &transcriptWriter{f: f}
+    fmt.Printf("[RECORDING] %s -> %s\n", client.RemoteAddr(), path)
+
+    copyDir := func(dst, src net.Conn, dir string) error {
+        buf := make([]byte, 32*1024)
+        for {
+            n, err := src.Read(buf)
+            if n > 0 {
+                t.add(dir, buf[:n])
+                if _, werr := dst.Write(buf[:n]); werr != nil {
+                    return werr
+                }
+            }
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    serverDone := make(chan error, 1)
+    go func() { serverDone <- copyDir(client, server, "<") }()
+    go func() {
+        // However the client's side ended, replaying it is a close.
+        copyDir(server, client, ">")
+        t.eof(">")
+        server.(*net.TCPConn).CloseWrite()
+    }()
+
+    // The transcript ends when the server finishes replying.
+    if err := <-serverDone; errors.Is(err, io.EOF) {
+        t.eof("<")
+    }
+    t.close()
+}
+
+func runGoldenRecord(args []string) error {
+    fs := flag.NewFlagSet("golden record", flag.ExitOnError)
+    listen := fs.String("listen", "127.0.0.1:65433", "address for the client to connect to")
+    upstream := fs.String("upstream", "127.0.0.1:65432", "server to record")
+    out := fs.String("out", "transcript", "path prefix; connection N is written to <out>-N.txt")
+    fs.Parse(args)
+
+    listener, err := net.Listen("tcp", *listen)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("[LISTENING] Recording %s -> %s\n", *listen, *upstream)
+
+    for n := 1; ; n++ {
+        conn, err := listener.Accept()
+        if err != nil {
+            return err
+        }
+        go recordSession(conn, *upstream, fmt.Sprintf("%s-%d.txt", *out, n))
+    }
+}
+
+func runGoldenReplay(args []string) error {
+    fs := flag.NewFlagSet("golden replay", flag.ExitOnError)
+    addr := fs.String("addr", "127.0.0.1:65432", "server to check")
+    timeout := fs.Duration("timeout", retry.ReplyTimeout, "how long to wait for each reply")
+    fs.Parse(args)
+
+    paths, err := golden.Paths(fs.Args())
+    if err != nil {
+        return err
+    }
+    if len(paths) == 0 {
+        return errors.New("no transcripts given")
+    }
+
+    failed := 0
+    for _, path := range paths {
+        if err := replayFile(*addr, path, *timeout); err != nil {
+            failed++
+            fmt.Printf("[FAIL] %s: %v\n", path, err)
+        } else {
+            fmt.Printf("[OK] %s\n", path)
+        }
+    }
+
+    fmt.Printf("[RESULT] %d/%d transcripts match\n", len(paths)-failed, len(paths))
+    if failed > 0 {
+        return fmt.Errorf("%d transcripts differ", failed)
+    }
+    return nil
+}
+
+// runGolden records transcripts through a proxy, or replays them against a
+// server and diffs its output against the recorded bytes, e.g.
+//
+//    protohackers golden replay -addr 127.0.0.1:65432 golden/prime-time
+//
+// lib-go/golden describes the transcript format.
+func runGolden(args []string) error {
+    if len(args) > 0 {
+        switch args[0] {
+        case "record":
+            return runGoldenRecord(args[1:])
+        case "replay":
+            return runGoldenReplay(args[1:])
+        }
+    }
+    return errors.New("usage: protohackers golden record|replay [flags] [transcripts...]")
+}
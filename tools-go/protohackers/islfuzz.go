@@ -0,0 +1,251 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "math/rand"
+    "strings"
+    "time"
+
+    "../../lib-go/retry"
+)
+
+// Insecure Sockets Layer cipher operations.
+const (
+    islEnd         = 0x00
+    islReverseBits = 0x01
+    islXor         = 0x02
+    islXorPos      = 0x03
+    islAdd         = 0x04
+    islAddPos      = 0x05
+)
+
+type islOp struct {
+    code byte
+    arg  byte
+}
+
+// islSpec is a cipher spec. Its methods are a deliberately plain reference
+// implementation: one byte at a time, one operation at a time, with the
+// stream position passed in explicitly.
+type islSpec []islOp
+
+func (s islSpec) bytes() []byte {
+    var b []byte
+    for _, op := range s {
+        b = append(b, op.code)
+        if op.code == islXor || op.code == islAdd {
+            b = append(b, op.arg)
+        }
+    }
+    return append(b, islEnd)
+}
+
+func reverseBits(b byte) byte {
+    var r byte
+    for i := 0; i < 8; i++ {
+        r = r<<1 | b>>i&1
+    }
+    return r
+}
+
+func (s islSpec) encode(b byte, pos int) byte {
+    for _, op := range s {
+        switch op.code {
+        case islReverseBits:
+            b = reverseBits(b)
+        case islXor:
+            b ^= op.arg
+        case islXorPos:
+            b ^= byte(pos)
+        case islAdd:
+            b += op.arg
+        case islAddPos:
+            b += byte(pos)
+        }
+    }
+    return b
+}
+
+func (s islSpec) decode(b byte, pos int) byte {
+    for i := len(s) - 1; i >= 0; i-- {
+        switch op := s[i]; op.code {
+        case islReverseBits:
+            b = reverseBits(b)
+        case islXor:
+            b ^= op.arg
+        case islXorPos:
+            b ^= byte(pos)
+        case islAdd:
+            b -= op.arg
+        case islAddPos:
+            b -= byte(pos)
+        }
+    }
+    return b
+}
+
+// isNoop reports whether the spec leaves every byte unchanged at every
+// position. Positions only matter mod 256, so checking 256 of them is
+// exhaustive.
+func (s islSpec) isNoop() bool {
+    for pos := 0; pos < 256; pos++ {
+        for b := 0; b < 256; b++ {
+            if s.encode(byte(b), pos) != byte(b) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// checkRoundTrip asserts decode(encode(x)) == x for every byte at every
+// position, catching mistakes in the reference itself.
+func (s islSpec) checkRoundTrip() error {
+    for pos := 0; pos < 256; pos++ {
+        for b := 0; b < 256; b++ {
+            if got := s.decode(s.encode(byte(b), pos), pos); got != byte(b) {
+                return fmt.Errorf("spec %x: decode(encode(%d)) = %d at position %d", s.bytes(), b, got, pos)
+            }
+        }
+    }
+    return nil
+}
+
+// randomISLSpec returns a random spec. One in ten is built from pairs that
+// cancel out, since servers must spot no-op specs and random ones rarely
+// are.
+func randomISLSpec(rng *rand.Rand) islSpec {
+    if rng.Intn(10) == 0 {
+        var spec islSpec
+        for n := 1 + rng.Intn(3); n > 0; n-- {
+            op := islOp{code: []byte{islReverseBits, islXor, islXorPos}[rng.Intn(3)], arg: byte(rng.Intn(256))}
+            spec = append(spec, op, op)
+        }
+        return spec
+    }
+
+    spec := make(islSpec, 1+rng.Intn(6))
+    for i := range spec {
+        spec[i] = islOp{code: byte(1 + rng.Intn(5)), arg: byte(rng.Intn(256))}
+    }
+    return spec
+}
+
+// randomToyLine returns a request line and the toy the server should pick.
+// Counts are distinct so there is a single right answer.
+func randomToyLine(rng *rand.Rand) (string, string) {
+    toys := []string{"car", "dog on a string", "rocking horse", "kite", "yo-yo", "train set"}
+    n := 1 + rng.Intn(5)
+    counts := rng.Perm(1000)[:n]
+    parts := make([]string, n)
+    best := 0
+    for i := range parts {
+        parts[i] = fmt.Sprintf("%dx %s", counts[i], toys[rng.Intn(len(toys))])
+        if counts[i] > counts[best] {
+            best = i
+        }
+    }
+    return strings.Join(parts, ","), parts[best]
+}
+
+// islSession runs one connection: a random spec, then random requests
+// (fragmented as configured), each reply decoded and checked.
+func islSession(addr string, rng *rand.Rand, lines int, timeout time.Duration, frag *fragmentOptions) error {
+    spec := randomISLSpec(rng)
+    if err := spec.checkRoundTrip(); err != nil {
+        return err
+    }
+
+    conn, err := dialPolicy.Dial("tcp", addr, timeout)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(timeout))
+    conn = frag.wrap(conn, rand.New(rand.NewSource(rng.Int63())))
+
+    if _, err := conn.Write(spec.bytes()); err != nil {
+        return err
+    }
+
+    // A no-op cipher must be refused without a reply.
+    if spec.isNoop() {
+        n, err := conn.Read(make([]byte, 1))
+        if n > 0 || !errors.Is(err, io.EOF) {
+            return fmt.Errorf("spec %x is a no-op but the server did not just disconnect (read %d, %v)", spec.bytes(), n, err)
+        }
+        return nil
+    }
+
+    var plain []byte
+    want := make([]string, lines)
+    for i := range want {
+        line, best := randomToyLine(rng)
+        plain = append(plain, line+"\n"...)
+        want[i] = best
+    }
+    wire := make([]byte, len(plain))
+    for pos, b := range plain {
+        wire[pos] = spec.encode(b, pos)
+    }
+    go conn.Write(wire)
+
+    reader := bufio.NewReader(conn)
+    var got bytes.Buffer
+    pos := 0
+    for i := 0; i < lines; i++ {
+        got.Reset()
+        for {
+            b, err := reader.ReadByte()
+            if err != nil {
+                return fmt.Errorf("spec %x: reading reply %d: %w", spec.bytes(), i+1, err)
+            }
+            b = spec.decode(b, pos)
+            pos++
+            if b == '\n' {
+                break
+            }
+            got.WriteByte(b)
+        }
+        if got.String() != want[i] {
+            return fmt.Errorf("spec %x: reply %d is %q, want %q", spec.bytes(), i+1, got.String(), want[i])
+        }
+    }
+    return nil
+}
+
+// runISLFuzz cross-checks an Insecure Sockets Layer server against the
+// reference cipher above, using random specs and payloads.
+func runISLFuzz(args []string) error {
+    fs := flag.NewFlagSet("isl-fuzz", flag.ExitOnError)
+    addr := fs.String("addr", "127.0.0.1:65432", "Insecure Sockets Layer server address")
+    sessions := fs.Int("sessions", 200, "number of connections, each with a fresh random spec")
+    lines := fs.Int("lines", 20, "requests per connection")
+    seed := seedFlag(fs)
+    timeout := fs.Duration("timeout", retry.ReplyTimeout, "deadline for each connection")
+    frag := fragmentFlags(fs, 64)
+    fs.Parse(args)
+
+    fmt.Printf("[FUZZ] seed %d\n", *seed)
+    rng := rand.New(rand.NewSource(*seed))
+
+    failures := 0
+    for i := 0; i < *sessions; i++ {
+        if err := islSession(*addr, rng, *lines, *timeout, frag); err != nil {
+            failures++
+            fmt.Printf("[FAIL] session %d: %v\n", i+1, err)
+        }
+    }
+
+    fmt.Printf("[RESULT] %d/%d sessions passed\n", *sessions-failures, *sessions)
+    if failures > 0 {
+        return seedError(fmt.Errorf("%d sessions failed", failures), *seed)
+    }
+    fmt.Println("[RESULT] PASS")
+    return nil
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "os"
+    "os/signal"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "../../lib-go/retry"
+    "../../lib-go/signals"
+)
+
+// errBadReply marks a reply that arrived but was wrong.
+var errBadReply = errors.New("bad reply")
+
+func badReply(format string, args ...any) error {
+    return fmt.Errorf("%w: %s", errBadReply, fmt.Sprintf(format, args...))
+}
+
+// loadSession is one virtual user's connection. step sends one request and
+// waits for its reply; the load tool times each call.
+type loadSession interface {
+    step() error
+}
+
+// loadGenerator produces traffic for one protocol. start runs any
+// handshake on a fresh connection and returns the session to drive.
+type loadGenerator struct {
+    network string
+    start   func(conn net.Conn, rng *rand.Rand) (loadSession, error)
+}
+
+// loadGenerators maps a problem name to its traffic generator. Supporting
+// another protocol is a matter of adding it here.
+var loadGenerators = map[string]loadGenerator{
+    "smoke-test":             {"tcp", startEchoLoad},
+    "prime-time":             {"tcp", startPrimeLoad},
+    "means-to-an-end":        {"tcp", startPricesLoad},
+    "unusual-db":             {"udp", startKVLoad},
+    "job-centre":             {"tcp", startJobLoad},
+    "VCS":                    {"tcp", startVCSLoad},
+    "insecure-sockets-layer": {"tcp", startISLLoad},
+}
+
+// --- Generators ---
+
+// echoLoad sends random bytes and expects them straight back.
+type echoLoad struct {
+    conn net.Conn
+    rng  *rand.Rand
+}
+
+func startEchoLoad(conn net.Conn, rng *rand.Rand) (loadSession, error) {
+    return &echoLoad{conn, rng}, nil
+}
+
+func (l *echoLoad) step() error {
+    data := make([]byte, 1+l.rng.Intn(1024))
+    l.rng.Read(data)
+    if _, err := l.conn.Write(data); err != nil {
+        return err
+    }
+    got := make([]byte, len(data))
+    if _, err := io.ReadFull(l.conn, got); err != nil {
+        return err
+    }
+    if string(got) != string(data) {
+        return badReply("echo differs")
+    }
+    return nil
+}
+
+// primeLoad asks whether random numbers are prime and checks the answers.
+type primeLoad struct {
+    conn   net.Conn
+    reader *bufio.Reader
+    rng    *rand.Rand
+}
+
+func startPrimeLoad(conn net.Conn, rng *rand.Rand) (loadSession, error) {
+    return &primeLoad{conn, bufio.NewReader(conn), rng}, nil
+}
+
+func isPrime(n int64) bool {
+    if n < 2 {
+        return false
+    }
+    for d := int64(2); d*d <= n; d++ {
+        if n%d == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+func (l *primeLoad) step() error {
+    n := l.rng.Int63n(1 << 24)
+    if _, err := fmt.Fprintf(l.conn, "{\"method\":\"isPrime\",\"number\":%d}\n", n); err != nil {
+        return err
+    }
+    line, err := l.reader.ReadBytes('\n')
+    if err != nil {
+        return err
+    }
+    var resp struct {
+        Method string `json:"method"`
+        Prime  bool   `json:"prime"`
+    }
+    if err := json.Unmarshal(line, &resp); err != nil || resp.Method != "isPrime" {
+        return badReply("%q", line)
+    }
+    if resp.Prime != isPrime(n) {
+        return badReply("isPrime(%d) = %v", n, resp.Prime)
+    }
+    return nil
+}
+
+// pricesLoad inserts a price and queries the mean of everything so far.
+type pricesLoad struct {
+    conn net.Conn
+    rng  *rand.Rand
+    ts   int32
+}
+
+func startPricesLoad(conn net.Conn, rng *rand.Rand) (loadSession, error) {
+    return &pricesLoad{conn: conn, rng: rng, ts: int32(rng.Intn(1 << 20))}, nil
+}
+
+func (l *pricesLoad) step() error {
+    l.ts++
+    var msg [18]byte
+    msg[0] = 'I'
+    binary.BigEndian.PutUint32(msg[1:], uint32(l.ts))
+    binary.BigEndian.PutUint32(msg[5:], uint32(l.rng.Int31n(10000)))
+    msg[9] = 'Q'
+    binary.BigEndian.PutUint32(msg[14:], uint32(l.ts))
+    if _, err := l.conn.Write(msg[:]); err != nil {
+        return err
+    }
+    var mean [4]byte
+    _, err := io.ReadFull(l.conn, mean[:])
+    return err
+}
+
+// kvLoad inserts a key over UDP and reads it back. A lost datagram shows
+// up as a timeout.
+type kvLoad struct {
+    conn net.Conn
+    rng  *rand.Rand
+}
+
+func startKVLoad(conn net.Conn, rng *rand.Rand) (loadSession, error) {
+    return &kvLoad{conn, rng}, nil
+}
+
+func (l *kvLoad) step() error {
+    key := fmt.Sprintf("load-%x", l.rng.Int63())
+    want := fmt.Sprintf("%s=%x", key, l.rng.Int63())
+    if _, err := l.conn.Write([]byte(want)); err != nil {
+        return err
+    }
+    if _, err := l.conn.Write([]byte(key)); err != nil {
+        return err
+    }
+    buf := make([]byte, 1000)
+    n, err := l.conn.Read(buf)
+    if err != nil {
+        return err
+    }
+    if string(buf[:n]) != want {
+        return badReply("retrieved %q, want %q", buf[:n], want)
+    }
+    return nil
+}
+
+// jobLoad puts a job on a private queue, takes it back and deletes it.
+type jobLoad struct {
+    conn   net.Conn
+    reader *bufio.Reader
+    queue  string
+}
+
+func startJobLoad(conn net.Conn, rng *rand.Rand) (loadSession, error) {
+    return &jobLoad{conn, bufio.NewReader(conn), fmt.Sprintf("load-%x", rng.Int63())}, nil
+}
+
+// jobReply is the part of a job centre response the generator looks at.
+type jobReply struct {
+    Status string `json:"status"`
+    ID     int64  `json:"id"`
+}
+
+func (l *jobLoad) call(req string) (jobReply, error) {
+    if _, err := l.conn.Write([]byte(req + "\n")); err != nil {
+        return jobReply{}, err
+    }
+    line, err := l.reader.ReadBytes('\n')
+    if err != nil {
+        return jobReply{}, err
+    }
+    var resp jobReply
+    if err := json.Unmarshal(line, &resp); err != nil || resp.Status != "ok" {
+        return jobReply{}, badReply("%q", line)
+    }
+    return resp, nil
+}
+
+func (l *jobLoad) step() error {
+    if _, err := l.call(fmt.Sprintf(`{"request":"put","queue":%q,"pri":1,"job":{}}`, l.queue)); err != nil {
+        return err
+    }
+    resp, err := l.call(fmt.Sprintf(`{"request":"get","queues":[%q]}`, l.queue))
+    if err != nil {
+        return err
+    }
+    _, err = l.call(fmt.Sprintf(`{"request":"delete","id":%d}`, resp.ID))
+    return err
+}
+
+// vcsLoad stores a new revision of a file and reads it back.
+type vcsLoad struct {
+    conn   net.Conn
+    reader *bufio.Reader
+    rng    *rand.Rand
+    path   string
+}
+
+func startVCSLoad(conn net.Conn, rng *rand.Rand) (loadSession, error) {
+    l := &vcsLoad{conn, bufio.NewReader(conn), rng, fmt.Sprintf("/load/%x.txt", rng.Int63())}
+    if err := l.expect("READY"); err != nil {
+        return nil, err
+    }
+    return l, nil
+}
+
+// expect reads one line and checks it starts with prefix.
+func (l *vcsLoad) expect(prefix string) error {
+    line, err := l.reader.ReadString('\n')
+    if err != nil {
+        return err
+    }
+    if !strings.HasPrefix(line, prefix) {
+        return badReply("%q, want %s", line, prefix)
+    }
+    return nil
+}
+
+func (l *vcsLoad) step() error {
+    data := fmt.Sprintf("revision %x\n", l.rng.Int63())
+    if _, err := fmt.Fprintf(l.conn, "PUT %s %d\n%sGET %s\n", l.path, len(data), data, l.path); err != nil {
+        return err
+    }
+    for _, prefix := range []string{"OK r", "READY", fmt.Sprintf("OK %d", len(data))} {
+        if err := l.expect(prefix); err != nil {
+            return err
+        }
+    }
+    got := make([]byte, len(data))
+    if _, err := io.ReadFull(l.reader, got); err != nil {
+        return err
+    }
+    if string(got) != data {
+        return badReply("GET returned %q, want %q", got, data)
+    }
+    return l.expect("READY")
+}
+
+// islLoad sends toy requests under a random cipher.
+type islLoad struct {
+    conn   net.Conn
+    reader *bufio.Reader
+    rng    *rand.Rand
+    spec   islSpec
+    inPos  int
+    outPos int
+}
+
+func startISLLoad(conn net.Conn, rng *rand.Rand) (loadSession, error) {
+    spec := randomISLSpec(rng)
+    for spec.isNoop() {
+        spec = randomISLSpec(rng)
+    }
+    if _, err := conn.Write(spec.bytes()); err != nil {
+        return nil, err
+    }
+    return &islLoad{conn: conn, reader: bufio.NewReader(conn), rng: rng, spec: spec}, nil
+}
+
+func (l *islLoad) step() error {
+    line, want := randomToyLine(l.rng)
+    wire := []byte(line + "\n")
+    for i, b := range wire {
+        wire[i] = l.spec.encode(b, l.outPos)
+        l.outPos++
+    }
+    if _, err := l.conn.Write(wire); err != nil {
+        return err
+    }
+
+    var got []byte
+    for {
+        b, err := l.reader.ReadByte()
+        if err != nil {
+            return err
+        }
+        b = l.spec.decode(b, l.inPos)
+        l.inPos++
+        if b == '\n' {
+            break
+        }
+        got = append(got, b)
+    }
+    if string(got) != want {
+        return badReply("%q, want %q", got, want)
+    }
+    return nil
+}
+
+// --- Profiles ---
+
+// loadProfile gives the number of concurrent users wanted at time t into
+// a run of length total, peaking at users.
+type loadProfile func(t, total time.Duration, users int) int
+
+var loadProfiles = map[string]loadProfile{
+    // steady runs every user for the whole test.
+    "steady": func(t, total time.Duration, users int) int {
+        return users
+    },
+    // ramp adds users evenly over the first half, then holds.
+    "ramp": func(t, total time.Duration, users int) int {
+        if t >= total/2 {
+            return users
+        }
+        return max(1, int(int64(users)*int64(t)/int64(total/2)))
+    },
+    // spike runs a quarter of the users, with all of them for the middle
+    // fifth of the test.
+    "spike": func(t, total time.Duration, users int) int {
+        if t >= total*2/5 && t < total*3/5 {
+            return users
+        }
+        return max(1, users/4)
+    },
+}
+
+// --- Running ---
+
+// loadStats collects the results of every user.
+type loadStats struct {
+    mu        sync.Mutex
+    dials     int
+    dialFails int
+    requests  int
+    failures  int
+    chaos     int // requests cut off on purpose by -chaos
+    errors    map[string]int
+    latencies []time.Duration
+}
+
+// errorClass buckets an error for the report.
+func errorClass(err error) string {
+    var netErr net.Error
+    switch {
+    case errors.Is(err, errBadReply):
+        return "bad-reply"
+    case errors.As(err, &netErr) && netErr.Timeout():
+        return "timeout"
+    case errors.Is(err, syscall.ECONNREFUSED):
+        return "refused"
+    case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+        return "reset"
+    case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+        return "closed"
+    }
+    return "other"
+}
+
+func (s *loadStats) dial(err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.dials++
+    if err != nil {
+        s.dialFails++
+        s.errors["dial-"+errorClass(err)]++
+    }
+}
+
+func (s *loadStats) request(d time.Duration, err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.requests++
+    if errors.Is(err, errChaos) {
+        s.chaos++
+        return
+    }
+    if err != nil {
+        s.failures++
+        s.errors[errorClass(err)]++
+        return
+    }
+    s.latencies = append(s.latencies, d)
+}
+
+// errChaos is what a user sees after cutting off its own connection.
+var errChaos = errors.New("connection cut off by -chaos")
+
+// chaosConn abandons a write part way through with probability prob, either
+// resetting the connection or closing it, so the server is left holding
+// half a message.
+type chaosConn struct {
+    net.Conn
+    prob float64
+    rng  *rand.Rand
+}
+
+func (c *chaosConn) Write(p []byte) (int, error) {
+    if len(p) == 0 || c.prob <= 0 || c.rng.Float64() >= c.prob {
+        return c.Conn.Write(p)
+    }
+    n, _ := c.Conn.Write(p[:c.rng.Intn(len(p))])
+    if c.rng.Intn(2) == 0 {
+        resetConn(c.Conn)
+    } else {
+        c.Conn.Close()
+    }
+    return n, errChaos
+}
+
+// loadUser is one virtual user. It keeps reconnecting and sending requests
+// until its slot is no longer wanted.
+func loadUser(id int, gen loadGenerator, o *loadOptions, rng *rand.Rand,
+    active *atomic.Int64, running *atomic.Bool, stats *loadStats, wg *sync.WaitGroup) {
+    defer wg.Done()
+    defer running.Store(false)
+    wanted := func() bool { return int64(id) < active.Load() }
+
+    for wanted() {
+        conn, err := net.DialTimeout(gen.network, o.addr, o.timeout)
+        var sess loadSession
+        var chaos *chaosConn
+        if err == nil {
+            conn.SetDeadline(time.Now().Add(o.timeout))
+            chaos = &chaosConn{Conn: conn, rng: rng}
+            sess, err = gen.start(chaos, rng)
+        }
+        stats.dial(err)
+        if err != nil {
+            if conn != nil {
+                conn.Close()
+            }
+            time.Sleep(100 * time.Millisecond)
+            continue
+        }
+
+        // Handshakes are left alone; only requests get cut off.
+        chaos.prob = o.chaos
+        for i := 0; i < o.perConn && wanted(); i++ {
+            conn.SetDeadline(time.Now().Add(o.timeout))
+            start := time.Now()
+            err := sess.step()
+            stats.request(time.Since(start), err)
+            if err != nil {
+                break
+            }
+            time.Sleep(o.think)
+        }
+        conn.Close()
+    }
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    return sorted[min(len(sorted)-1, int(p*float64(len(sorted))))]
+}
+
+func (s *loadStats) report(elapsed time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    success := 100.0
+    if s.dials > 0 {
+        success = 100 * float64(s.dials-s.dialFails) / float64(s.dials)
+    }
+    fmt.Printf("[RESULT] connections: %d/%d succeeded (%.1f%%)\n", s.dials-s.dialFails, s.dials, success)
+    ok := s.requests - s.failures - s.chaos
+    fmt.Printf("[RESULT] requests: %d ok, %d failed, %d cut off, %.1f/s\n",
+        ok, s.failures, s.chaos, float64(ok)/elapsed.Seconds())
+
+    sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+    fmt.Printf("[LATENCY] p50=%v p90=%v p99=%v max=%v\n",
+        percentile(s.latencies, 0.50), percentile(s.latencies, 0.90),
+        percentile(s.latencies, 0.99), percentile(s.latencies, 1))
+
+    classes := make([]string, 0, len(s.errors))
+    for k := range s.errors {
+        classes = append(classes, k)
+    }
+    sort.Strings(classes)
+    for _, k := range classes {
+        fmt.Printf("[ERRORS] %s=%d\n", k, s.errors[k])
+    }
+}
+
+// loadOptions are the flags shared by the tools that drive a generator.
+type loadOptions struct {
+    addr    string
+    users   int
+    perConn int
+    think   time.Duration
+    timeout time.Duration
+    chaos   float64
+    seed    *int64
+}
+
+// loadFlags registers the shared flags. The number of users is left to the
+// caller, which names it.
+func loadFlags(fs *flag.FlagSet) *loadOptions {
+    o := &loadOptions{}
+    fs.StringVar(&o.addr, "addr", "127.0.0.1:65432", "server address")
+    fs.IntVar(&o.perConn, "requests", 100, "requests per connection before reconnecting")
+    fs.DurationVar(&o.think, "think", 10*time.Millisecond, "pause between a user's requests")
+    fs.DurationVar(&o.timeout, "timeout", retry.ReplyTimeout, "deadline for connecting and for each request")
+    fs.Float64Var(&o.chaos, "chaos", 0, "probability per request of resetting or closing the connection part way through sending it")
+    o.seed = seedFlag(fs)
+    return o
+}
+
+// generatorArg returns the generator named by a command's one argument.
+func generatorArg(fs *flag.FlagSet) (string, loadGenerator, error) {
+    if fs.NArg() != 1 {
+        names := make([]string, 0, len(loadGenerators))
+        for name := range loadGenerators {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        return "", loadGenerator{}, fmt.Errorf("usage: protohackers %s [flags] <%s>", fs.Name(), strings.Join(names, "|"))
+    }
+    gen, ok := loadGenerators[fs.Arg(0)]
+    if !ok {
+        return "", loadGenerator{}, fmt.Errorf("no load generator for %q", fs.Arg(0))
+    }
+    return fs.Arg(0), gen, nil
+}
+
+func (s *loadStats) requestCount() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.requests
+}
+
+// driveLoad runs users following profile for duration, or until
+// interrupted. tick is called about every interval with the time so far
+// and the current number of users.
+func driveLoad(gen loadGenerator, o *loadOptions, profile loadProfile, duration, interval time.Duration,
+    tick func(elapsed time.Duration, users int, stats *loadStats)) (*loadStats, time.Duration) {
+    rng := rand.New(rand.NewSource(*o.seed))
+
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, signals.Shutdown()...)
+    defer signal.Stop(c)
+
+    stats := &loadStats{errors: make(map[string]int)}
+    var active atomic.Int64
+    var wg sync.WaitGroup
+    running := make([]atomic.Bool, o.users)
+
+    begin := time.Now()
+    ticker := time.NewTicker(100 * time.Millisecond)
+    defer ticker.Stop()
+    lastTick := begin
+run:
+    for {
+        elapsed := time.Since(begin)
+        if elapsed >= duration {
+            break
+        }
+
+        // Users above the target notice and leave; empty slots below it
+        // get a new user.
+        target := profile(elapsed, duration, o.users)
+        active.Store(int64(target))
+        for i := 0; i < target; i++ {
+            if running[i].Load() {
+                continue
+            }
+            running[i].Store(true)
+            wg.Add(1)
+            go loadUser(i, gen, o, rand.New(rand.NewSource(rng.Int63())), &active, &running[i], stats, &wg)
+        }
+
+        if time.Since(lastTick) >= interval {
+            tick(elapsed, target, stats)
+            lastTick = time.Now()
+        }
+
+        select {
+        case <-ticker.C:
+        case <-c:
+            break run
+        }
+    }
+
+    elapsed := time.Since(begin)
+    active.Store(0)
+    wg.Wait()
+    return stats, elapsed
+}
+
+// runLoad drives a server with many concurrent users following a load
+// profile and reports throughput, latency and what went wrong.
+func runLoad(args []string) error {
+    fs := flag.NewFlagSet("load", flag.ExitOnError)
+    o := loadFlags(fs)
+    fs.IntVar(&o.users, "users", 50, "peak number of concurrent users")
+    profileName := fs.String("profile", "steady", "load profile: steady, ramp or spike")
+    duration := fs.Duration("duration", 30*time.Second, "length of the run")
+    fs.Parse(args)
+
+    name, gen, err := generatorArg(fs)
+    if err != nil {
+        return err
+    }
+    profile, ok := loadProfiles[*profileName]
+    if !ok {
+        return fmt.Errorf("unknown profile %q", *profileName)
+    }
+    if o.users < 1 || o.perConn < 1 {
+        return errors.New("users and requests must be positive")
+    }
+
+    fmt.Printf("[LOAD] %s at %s: %s profile, %d users, %v (seed %d)\n",
+        name, o.addr, *profileName, o.users, *duration, *o.seed)
+
+    lastRequests := 0
+    stats, elapsed := driveLoad(gen, o, profile, *duration, time.Second,
+        func(elapsed time.Duration, users int, stats *loadStats) {
+            requests := stats.requestCount()
+            fmt.Printf("[PROGRESS] %5.1fs users=%d requests/s=%d\n",
+                elapsed.Seconds(), users, requests-lastRequests)
+            lastRequests = requests
+        })
+    stats.report(elapsed)
+    return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "flag"
+    "fmt"
+    "math/rand"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "../../lib-go/golden"
+    "../../lib-go/signals"
+)
+
+// An LRCP trace is a timed capture of the datagrams between one client and
+// a line reversal server:
+//
+//    # lost ack: the server must retransmit after its timeout
+//    0 > "/connect/1234/"
+//    3 < "/ack/1234/0/"
+//    5 > "/data/1234/0/hello\n/"
+//    3012 < "/data/1234/0/olleh\n/"
+//
+// The first field is milliseconds since the trace began. > datagrams are
+// sent at that time. < datagrams must arrive in order, each no later than
+// its time plus the replay's -slack; other datagrams in between, such as
+// extra acks, are allowed. Datagrams are Go quoted strings.
+//
+// Recorded traces for the line reversal server live in lrcp/, e.g.
+//
+//    protohackers lrcp-trace replay -addr 127.0.0.1:65432 lrcp
+
+// datagram is one line of a trace.
+type datagram struct {
+    at   time.Duration
+    send bool
+    data []byte
+}
+
+func parseLRCPTrace(path string) ([]datagram, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var trace []datagram
+    scanner := bufio.NewScanner(f)
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        fields := strings.SplitN(line, " ", 3)
+        if len(fields) != 3 || (fields[1] != ">" && fields[1] != "<") {
+            return nil, fmt.Errorf("%s:%d: want <ms> >|< <datagram>", path, n)
+        }
+        ms, err := strconv.Atoi(fields[0])
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+        }
+        data, err := strconv.Unquote(fields[2])
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+        }
+        trace = append(trace, datagram{at: time.Duration(ms) * time.Millisecond, send: fields[1] == ">", data: []byte(data)})
+    }
+    return trace, scanner.Err()
+}
+
+// remapSessions gives every session in the trace a fresh random number, so
+// replays do not collide with sessions the server still remembers.
+func remapSessions(trace []datagram, rng *rand.Rand) {
+    ids := make(map[string]string)
+    for i := range trace {
+        parts := bytes.SplitN(trace[i].data, []byte("/"), 4)
+        if len(parts) < 4 || len(parts[0]) != 0 {
+            continue
+        }
+        old := string(parts[2])
+        if _, err := strconv.ParseUint(old, 10, 31); err != nil {
+            continue
+        }
+        if ids[old] == "" {
+            ids[old] = strconv.Itoa(rng.Intn(1 << 31))
+        }
+        parts[2] = []byte(ids[old])
+        trace[i].data = bytes.Join(parts, []byte("/"))
+    }
+}
+
+type arrival struct {
+    at   time.Time
+    data []byte
+}
+
+// replayLRCPTrace plays trace against addr, checking the expected
+// datagrams arrive in order and in time.
+func replayLRCPTrace(addr string, trace []datagram, slack time.Duration, verbose bool) error {
+    conn, err := net.Dial("udp", addr)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    received := make(chan arrival, 1024)
+    go func() {
+        buf := make([]byte, 1500)
+        for {
+            n, err := conn.Read(buf)
+            if err != nil {
+                close(received)
+                return
+            }
+            received <- arrival{time.Now(), append([]byte(nil), buf[:n]...)}
+        }
+    }()
+
+    begin := time.Now()
+    for i, d := range trace {
+        if d.send {
+            time.Sleep(time.Until(begin.Add(d.at)))
+            if verbose {
+                fmt.Printf("    %6d > %q\n", time.Since(begin).Milliseconds(), d.data)
+            }
+            if _, err := conn.Write(d.data); err != nil {
+                return fmt.Errorf("line %d: %w", i+1, err)
+            }
+            continue
+        }
+
+        deadline := time.After(time.Until(begin.Add(d.at + slack)))
+        var others []string
+    wait:
+        for {
+            select {
+            case a, ok := <-received:
+                if !ok {
+                    return fmt.Errorf("datagram %d: socket closed", i+1)
+                }
+                if verbose {
+                    fmt.Printf("    %6d < %q\n", a.at.Sub(begin).Milliseconds(), a.data)
+                }
+                if bytes.Equal(a.data, d.data) {
+                    break wait
+                }
+                others = append(others, strconv.Quote(string(a.data)))
+            case <-deadline:
+                got := "nothing"
+                if len(others) > 0 {
+                    got = strings.Join(others, ", ")
+                }
+                return fmt.Errorf("datagram %d: %q not received by %v (got %s)", i+1, d.data, d.at+slack, got)
+            }
+        }
+    }
+    return nil
+}
+
+// lrcpRecorder relays clients to the server and writes every datagram to a
+// trace.
+type lrcpRecorder struct {
+    listener *net.UDPConn
+    upstream *net.UDPAddr
+
+    mu       sync.Mutex
+    out      *os.File
+    begin    time.Time
+    sessions map[string]*net.UDPConn
+}
+
+func (r *lrcpRecorder) log(send bool, data []byte) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.begin.IsZero() {
+        r.begin = time.Now()
+    }
+    dir := "<"
+    if send {
+        dir = ">"
+    }
+    fmt.Fprintf(r.out, "%d %s %s\n", time.Since(r.begin).Milliseconds(), dir, strconv.QuoteToASCII(string(data)))
+}
+
+func (r *lrcpRecorder) session(client *net.UDPAddr) (*net.UDPConn, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    key := client.String()
+    if up := r.sessions[key]; up != nil {
+        return up, nil
+    }
+    up, err := net.DialUDP("udp", nil, r.upstream)
+    if err != nil {
+        return nil, err
+    }
+    r.sessions[key] = up
+    go func() {
+        buf := make([]byte, 1500)
+        for {
+            n, err := up.Read(buf)
+            if err != nil {
+                return
+            }
+            r.log(false, buf[:n])
+            r.listener.WriteToUDP(buf[:n], client)
+        }
+    }()
+    return up, nil
+}
+
+func runLRCPRecord(args []string) error {
+    fs := flag.NewFlagSet("lrcp-trace record", flag.ExitOnError)
+    listen := fs.String("listen", "127.0.0.1:65433", "address for the client to send to")
+    upstream := fs.String("upstream", "127.0.0.1:65432", "line reversal server to record")
+    out := fs.String("out", "trace.txt", "trace file to write")
+    fs.Parse(args)
+
+    upAddr, err := net.ResolveUDPAddr("udp", *upstream)
+    if err != nil {
+        return err
+    }
+    laddr, err := net.ResolveUDPAddr("udp", *listen)
+    if err != nil {
+        return err
+    }
+    listener, err := net.ListenUDP("udp", laddr)
+    if err != nil {
+        return err
+    }
+    f, err := os.Create(*out)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    fmt.Fprintf(f, "# recorded from %s on %s\n", *upstream, time.Now().Format(time.RFC3339))
+
+    r := &lrcpRecorder{listener: listener, upstream: upAddr, out: f, sessions: make(map[string]*net.UDPConn)}
+    fmt.Printf("[LISTENING] Recording %s -> %s into %s\n", *listen, *upstream, *out)
+
+    signals.OnShutdown(func() {
+        listener.Close()
+    })
+
+    buf := make([]byte, 1500)
+    for {
+        n, client, err := listener.ReadFromUDP(buf)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                break
+            }
+            return err
+        }
+        up, err := r.session(client)
+        if err != nil {
+            fmt.Printf("[ERROR] %v\n", err)
+            continue
+        }
+        r.log(true, buf[:n])
+        up.Write(buf[:n])
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for _, up := range r.sessions {
+        up.Close()
+    }
+    return nil
+}
+
+func runLRCPReplay(args []string) error {
+    fs := flag.NewFlagSet("lrcp-trace replay", flag.ExitOnError)
+    addr := fs.String("addr", "127.0.0.1:65432", "line reversal server to check")
+    slack := fs.Duration("slack", 500*time.Millisecond, "how late an expected datagram may arrive")
+    remap := fs.Bool("remap", true, "replace session numbers with fresh random ones")
+    verbose := fs.Bool("v", false, "print every datagram")
+    seed := seedFlag(fs)
+    fs.Parse(args)
+
+    rng := rand.New(rand.NewSource(*seed))
+    paths, err := golden.Paths(fs.Args())
+    if err != nil {
+        return err
+    }
+    if len(paths) == 0 {
+        return errors.New("no traces given")
+    }
+
+    failed := 0
+    for _, path := range paths {
+        trace, err := parseLRCPTrace(path)
+        if err == nil {
+            if *remap {
+                remapSessions(trace, rng)
+            }
+            if *verbose {
+                fmt.Printf("[REPLAY] %s\n", path)
+            }
+            err = replayLRCPTrace(*addr, trace, *slack, *verbose)
+        }
+        if err != nil {
+            failed++
+            fmt.Printf("[FAIL] %s: %v\n", path, err)
+        } else {
+            fmt.Printf("[OK] %s\n", path)
+        }
+    }
+
+    fmt.Printf("[RESULT] %d/%d traces replayed\n", len(paths)-failed, len(paths))
+    if failed > 0 {
+        return seedError(fmt.Errorf("%d traces failed", failed), *seed)
+    }
+    return nil
+}
+
+// runLRCPTrace records LRCP traffic as timed traces, or replays traces
+// against a line reversal server.
+func runLRCPTrace(args []string) error {
+    if len(args) > 0 {
+        switch args[0] {
+        case "record":
+            return runLRCPRecord(args[1:])
+        case "replay":
+            return runLRCPReplay(args[1:])
+        }
+    }
+    return errors.New("usage: protohackers lrcp-trace record|replay [flags] [traces...]")
+}
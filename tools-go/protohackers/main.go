@@ -0,0 +1,80 @@
+// Command protohackers bundles the developer tooling used to exercise the
+// solutions in sol-go and sol-py (soak tests, load generators, ...).
+//
+// Build it from this directory with:
+//
+//    GO111MODULE=off go build -o protohackers .
+//
+// The solutions are built the same way. GOPATH mode is needed for the
+// relative imports of the shared packages in lib-go, and a package build
+// (rather than a list of files) for the per-system files to be picked by
+// their build constraints.
+package main
+
+import (
+    "fmt"
+    "os"
+
+    "../../lib-go/clock"
+    "../../lib-go/retry"
+)
+
+// dialPolicy retries every connection the commands open to a server under
+// test or a proxy's upstream, so each copes the same way with a server
+// that is slow to start or briefly refuses connections. load and stress
+// dial directly: their job is to count failures, not to paper over them.
+var dialPolicy = retry.DialPolicy(clock.Real)
+
+// command is a single protohackers subcommand.
+type command struct {
+    name  string
+    usage string
+    run   func(args []string) error
+}
+
+// commands lists every subcommand, in the order they are shown in the usage.
+var commands = []command{
+    {"chat-soak", "soak-test a budget chat server with a swarm of bots", runChatSoak},
+    {"mock-authority", "serve a scripted fake pest control Authority", runMockAuthority},
+    {"isl-fuzz", "fuzz an Insecure Sockets Layer server against a reference cipher", runISLFuzz},
+    {"fault-proxy", "proxy TCP through injected latency, fragmentation and resets", runFaultProxy},
+    {"udp-impair", "relay UDP with seeded drops, duplicates, reordering and delay", runUDPImpair},
+    {"golden", "record golden transcripts, or replay them and diff the server's output", runGolden},
+    {"load", "generate ramp, steady or spike load against any solution", runLoad},
+    {"stress", "hold a fixed request rate and report latency percentiles as JSON or CSV", runStress},
+    {"conform", "run every problem's golden transcripts and print a pass/fail matrix", runConform},
+    {"soak", "drive a solution for a long time and watch it for leaks", runSoak},
+    {"slow-client", "check slow or stalled readers do not hold up other clients", runSlowClient},
+    {"mitm-check", "check the mob-in-the-middle proxy against a reference chat server", runMITMCheck},
+    {"lrcp-trace", "record or replay timed LRCP packet traces against the line reversal server", runLRCPTrace},
+}
+
+func printUsage() {
+    fmt.Fprintln(os.Stderr, "usage: protohackers <command> [flags]")
+    fmt.Fprintln(os.Stderr, "\ncommands:")
+    for _, c := range commands {
+        fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.usage)
+    }
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        printUsage()
+        os.Exit(2)
+    }
+
+    for _, c := range commands {
+        if c.name != os.Args[1] {
+            continue
+        }
+        if err := c.run(os.Args[2:]); err != nil {
+            fmt.Printf("[ERROR] %s: %v\n", c.name, err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+    printUsage()
+    os.Exit(2)
+}
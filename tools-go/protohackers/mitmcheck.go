@@ -0,0 +1,296 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "math/rand"
+    "net"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+
+    "../../lib-go/retry"
+)
+
+// tonyAddress is what the proxy must substitute for every Boguscoin address.
+const tonyAddress = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+var boguscoinPattern = regexp.MustCompile(`^7[a-zA-Z0-9]{25,34}$`)
+
+// rewriteBoguscoin is the reference rewrite: every space-delimited token
+// that is a Boguscoin address becomes Tony's.
+func rewriteBoguscoin(msg string) string {
+    tokens := strings.Split(msg, " ")
+    for i, t := range tokens {
+        if boguscoinPattern.MatchString(t) {
+            tokens[i] = tonyAddress
+        }
+    }
+    return strings.Join(tokens, " ")
+}
+
+// --- Reference budget chat server ---
+
+// chatRoom is a minimal budget chat server for the proxy to sit in front
+// of, so the check does not depend on chat.protohackers.com. It fragments
+// its writes like the clients do, so the proxy has to reassemble lines
+// coming from either side.
+type chatRoom struct {
+    mu    sync.Mutex
+    users map[string]net.Conn
+}
+
+func (r *chatRoom) broadcast(from, line string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for name, conn := range r.users {
+        if name != from {
+            conn.Write([]byte(line + "\n"))
+        }
+    }
+}
+
+var chatNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]{1,16}$`)
+
+func (r *chatRoom) serve(conn net.Conn) {
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+
+    conn.Write([]byte("Welcome to budgetchat! What shall I call you?\n"))
+    line, err := reader.ReadString('\n')
+    name := strings.TrimSpace(line)
+    if err != nil || !chatNamePattern.MatchString(name) {
+        conn.Write([]byte("* Invalid name\n"))
+        return
+    }
+
+    r.mu.Lock()
+    if _, taken := r.users[name]; taken {
+        r.mu.Unlock()
+        conn.Write([]byte("* Name taken\n"))
+        return
+    }
+    present := make([]string, 0, len(r.users))
+    for n := range r.users {
+        present = append(present, n)
+    }
+    r.users[name] = conn
+    r.mu.Unlock()
+
+    conn.Write([]byte("* The room contains: " + strings.Join(present, ", ") + "\n"))
+    r.broadcast(name, "* "+name+" has entered the room")
+    defer func() {
+        r.mu.Lock()
+        delete(r.users, name)
+        r.mu.Unlock()
+        r.broadcast(name, "* "+name+" has left the room")
+    }()
+
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return
+        }
+        r.broadcast(name, "["+name+"] "+strings.TrimSuffix(line, "\n"))
+    }
+}
+
+func startChatRoom(addr string, frag *fragmentOptions, rng *rand.Rand) (net.Listener, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    room := &chatRoom{users: make(map[string]net.Conn)}
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go room.serve(&lockedConn{Conn: frag.wrap(conn, rand.New(rand.NewSource(rng.Int63())))})
+        }
+    }()
+    return listener, nil
+}
+
+// lockedConn serializes writes, so a broadcast fragmented into pieces is
+// not interleaved with another one.
+type lockedConn struct {
+    net.Conn
+    mu sync.Mutex
+}
+
+func (c *lockedConn) Write(p []byte) (int, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.Conn.Write(p)
+}
+
+// --- Scripted users ---
+
+type chatUser struct {
+    name    string
+    conn    net.Conn
+    reader  *bufio.Reader
+    timeout time.Duration
+}
+
+func dialChatUser(addr, name string, timeout time.Duration, frag *fragmentOptions, rng *rand.Rand) (*chatUser, error) {
+    conn, err := dialPolicy.Dial("tcp", addr, timeout)
+    if err != nil {
+        return nil, err
+    }
+    u := &chatUser{name: name, conn: frag.wrap(conn, rng), reader: bufio.NewReader(conn), timeout: timeout}
+    conn.SetDeadline(time.Now().Add(timeout))
+    if err := joinChat(u.conn, u.reader, name); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("%s joining: %w", name, err)
+    }
+    return u, nil
+}
+
+func (u *chatUser) say(msg string) error {
+    u.conn.SetWriteDeadline(time.Now().Add(u.timeout))
+    _, err := u.conn.Write([]byte(msg + "\n"))
+    return err
+}
+
+// hear returns the next chat message, skipping room announcements.
+func (u *chatUser) hear() (string, error) {
+    u.conn.SetReadDeadline(time.Now().Add(u.timeout))
+    for {
+        line, err := u.reader.ReadString('\n')
+        if err != nil {
+            return "", err
+        }
+        if !strings.HasPrefix(line, "* ") {
+            return strings.TrimSuffix(line, "\n"), nil
+        }
+    }
+}
+
+// mitmCase is one message to send through the proxy.
+type mitmCase struct {
+    desc string
+    msg  string
+}
+
+// randomAddress returns a valid Boguscoin address.
+func randomAddress(rng *rand.Rand) string {
+    const alnum = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+    b := []byte{'7'}
+    for n := 25 + rng.Intn(10); n > 0; n-- {
+        b = append(b, alnum[rng.Intn(len(alnum))])
+    }
+    return string(b)
+}
+
+func mitmCases(rng *rand.Rand) []mitmCase {
+    addr := randomAddress(rng)
+    cases := []mitmCase{
+        {"plain message", "Hi alice, how are you?"},
+        {"address alone", addr},
+        {"address at the start", addr + " is my address"},
+        {"address in the middle", "Please send the payment of 750 Boguscoins to " + addr + " thanks"},
+        {"address at the end", "Send refunds to " + addr},
+        {"two addresses", addr + " " + randomAddress(rng)},
+        {"shortest address", "7" + strings.Repeat("a", 25)},
+        {"longest address", "7" + strings.Repeat("b", 34)},
+        {"too short", "7" + strings.Repeat("c", 24)},
+        {"too long", "7" + strings.Repeat("d", 35)},
+        {"wrong first character", "8" + addr[1:]},
+        {"not alphanumeric", addr[:10] + "-" + addr[11:]},
+        {"glued to a word", "x" + addr},
+        {"followed by punctuation", addr + "."},
+        {"double spaces", "to  " + addr + "  now"},
+    }
+    for i := 0; i < 10; i++ {
+        words := []string{"pay", "me", randomAddress(rng), "or", "7abc", "now", randomAddress(rng)[:20]}
+        rng.Shuffle(len(words), func(i, j int) { words[i], words[j] = words[j], words[i] })
+        cases = append(cases, mitmCase{"random mix", strings.Join(words[:2+rng.Intn(len(words)-2)], " ")})
+    }
+    return cases
+}
+
+// checkDirection sends every case from one user and checks what the other
+// hears.
+func checkDirection(from, to *chatUser, cases []mitmCase, label string) []string {
+    var failures []string
+    for _, c := range cases {
+        if err := from.say(c.msg); err != nil {
+            return append(failures, fmt.Sprintf("%s: %s sending: %v", label, from.name, err))
+        }
+        want := fmt.Sprintf("[%s] %s", from.name, rewriteBoguscoin(c.msg))
+        got, err := to.hear()
+        if err != nil {
+            return append(failures, fmt.Sprintf("%s: %s: %s waiting for %q: %v", label, c.desc, to.name, want, err))
+        }
+        if got != want {
+            failures = append(failures, fmt.Sprintf("%s: %s:\n    sent %q\n    want %q\n    got  %q", label, c.desc, c.msg, want, got))
+        }
+    }
+    return failures
+}
+
+// runMITMCheck puts the mob-in-the-middle proxy between scripted users
+// and a reference chat server, and checks addresses are rewritten in both
+// directions and nothing else is touched.
+func runMITMCheck(args []string) error {
+    fs := flag.NewFlagSet("mitm-check", flag.ExitOnError)
+    proxy := fs.String("proxy", "", "an already running proxy to check; its upstream must be -chat")
+    chatAddr := fs.String("chat", "127.0.0.1:16963", "address for the reference chat server")
+    listen := fs.String("listen", "127.0.0.1:65434", "address for the proxy started here to listen on")
+    solDir := fs.String("sol", "../../sol-go", "directory of Go solutions, used when -proxy is empty")
+    timeout := fs.Duration("timeout", retry.ReplyTimeout, "how long to wait for each message")
+    frag := fragmentFlags(fs, 3)
+    seed := seedFlag(fs)
+    fs.Parse(args)
+
+    fmt.Printf("[MITM] seed %d\n", *seed)
+    rng := rand.New(rand.NewSource(*seed))
+
+    chat, err := startChatRoom(*chatAddr, frag, rand.New(rand.NewSource(rng.Int63())))
+    if err != nil {
+        return err
+    }
+    defer chat.Close()
+
+    if *proxy == "" {
+        server, err := localServer(*solDir, "mob-in-the-middle", "tcp", *listen, *timeout,
+            "-listen", *listen, "-upstream", chat.Addr().String())
+        if err != nil {
+            return err
+        }
+        defer stopServer(server)
+        *proxy = *listen
+    }
+
+    // The victim talks through the proxy with fragmented writes; the
+    // bystander talks to the chat server directly.
+    victim, err := dialChatUser(*proxy, "victim", *timeout, frag, rand.New(rand.NewSource(rng.Int63())))
+    if err != nil {
+        return seedError(err, *seed)
+    }
+    defer victim.conn.Close()
+    bystander, err := dialChatUser(chat.Addr().String(), "bystander", *timeout, &fragmentOptions{}, nil)
+    if err != nil {
+        return seedError(err, *seed)
+    }
+    defer bystander.conn.Close()
+
+    cases := mitmCases(rng)
+    failures := checkDirection(victim, bystander, cases, "victim to server")
+    failures = append(failures, checkDirection(bystander, victim, cases, "server to victim")...)
+
+    for _, f := range failures {
+        fmt.Printf("[FAIL] %s\n", f)
+    }
+    fmt.Printf("[RESULT] %d/%d messages arrived as expected\n", 2*len(cases)-len(failures), 2*len(cases))
+    if len(failures) > 0 {
+        return seedError(fmt.Errorf("%d messages did not arrive as expected", len(failures)), *seed)
+    }
+    fmt.Println("[RESULT] PASS")
+    return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "../../lib-go/signals"
+)
+
+// Pest control message types, as in sol-go/pest-control.
+const (
+    pestHello             = 0x50
+    pestError             = 0x51
+    pestOK                = 0x52
+    pestDialAuthority     = 0x53
+    pestTargetPopulations = 0x54
+    pestCreatePolicy      = 0x55
+    pestDeletePolicy      = 0x56
+    pestPolicyResult      = 0x57
+)
+
+// readPestMessage reads one framed message and returns its type and
+// payload, checking the length and checksum.
+func readPestMessage(r *bufio.Reader) (byte, []byte, error) {
+    var header [5]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return 0, nil, err
+    }
+    length := binary.BigEndian.Uint32(header[1:])
+    if length < 6 || length > 1<<20 {
+        return 0, nil, fmt.Errorf("bad length %d", length)
+    }
+    body := make([]byte, length-5)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return 0, nil, err
+    }
+    var sum byte
+    for _, b := range header {
+        sum += b
+    }
+    for _, b := range body {
+        sum += b
+    }
+    if sum != 0 {
+        return 0, nil, errors.New("bad checksum")
+    }
+    return header[0], body[:len(body)-1], nil
+}
+
+func writePestMessage(w io.Writer, typ byte, payload []byte) error {
+    buf := []byte{typ}
+    buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)+6))
+    buf = append(buf, payload...)
+    var sum byte
+    for _, b := range buf {
+        sum += b
+    }
+    _, err := w.Write(append(buf, -sum))
+    return err
+}
+
+func appendPestStr(b []byte, s string) []byte {
+    b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+    return append(b, s...)
+}
+
+// pestRange is a target population range in an authority script.
+type pestRange struct {
+    Min uint32 `json:"min"`
+    Max uint32 `json:"max"`
+}
+
+// authorityScript configures the mock Authority. Example:
+//
+//    {
+//        "sites": {"12345": {"long-tailed rat": {"min": 0, "max": 10}}},
+//        "random_sites": false,
+//        "delay": "50ms",
+//        "fail": {"dial": 0, "create": 0.1, "delete": 0},
+//        "seed": 1
+//    }
+type authorityScript struct {
+    // Sites maps a site ID to its target populations.
+    Sites map[string]map[string]pestRange `json:"sites"`
+
+    // RandomSites makes up targets for sites not in Sites instead of
+    // answering with an Error.
+    RandomSites bool `json:"random_sites"`
+
+    // Delay is added before every response, e.g. "100ms".
+    Delay string `json:"delay"`
+
+    // Fail is the probability that a DialAuthority, CreatePolicy or
+    // DeletePolicy is answered with an Error.
+    Fail map[string]float64 `json:"fail"`
+
+    Seed int64 `json:"seed"`
+}
+
+// mockAuthority is a scripted stand-in for pestcontrol.protohackers.com.
+type mockAuthority struct {
+    script authorityScript
+    delay  time.Duration
+
+    mu       sync.Mutex
+    rng      *rand.Rand
+    targets  map[uint32]map[string]pestRange
+    nextID   uint32
+    policies map[uint32]map[uint32]mockPolicy // site -> policy ID -> policy
+    stats    map[string]int
+}
+
+type mockPolicy struct {
+    species string
+    action  byte
+}
+
+func (m *mockAuthority) count(what string) {
+    m.mu.Lock()
+    m.stats[what]++
+    m.mu.Unlock()
+}
+
+// fail reports whether this request should be answered with an Error.
+func (m *mockAuthority) fail(what string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.rng.Float64() < m.script.Fail[what] {
+        m.stats["failed_"+what]++
+        return true
+    }
+    return false
+}
+
+// siteTargets returns the targets for a site, inventing them if allowed.
+func (m *mockAuthority) siteTargets(site uint32) (map[string]pestRange, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if t, ok := m.targets[site]; ok {
+        return t, true
+    }
+    if !m.script.RandomSites {
+        return nil, false
+    }
+    t := make(map[string]pestRange)
+    for i, n := 0, 1+m.rng.Intn(4); i < n; i++ {
+        lo := uint32(m.rng.Intn(20))
+        t[fmt.Sprintf("species-%d", m.rng.Intn(10))] = pestRange{Min: lo, Max: lo + uint32(m.rng.Intn(20))}
+    }
+    m.targets[site] = t
+    return t, true
+}
+
+// serve handles one connection from the solution under test.
+func (m *mockAuthority) serve(conn net.Conn) {
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+
+    reply := func(typ byte, payload []byte) error {
+        time.Sleep(m.delay)
+        return writePestMessage(conn, typ, payload)
+    }
+    replyError := func(msg string) error {
+        return reply(pestError, appendPestStr(nil, msg))
+    }
+
+    // Policies are only kept while the connection that created them lives.
+    var site uint32
+    var created []uint32
+    defer func() {
+        m.mu.Lock()
+        for _, id := range created {
+            delete(m.policies[site], id)
+        }
+        m.mu.Unlock()
+    }()
+
+    greeted, dialed := false, false
+    for {
+        typ, payload, err := readPestMessage(reader)
+        if err != nil {
+            return
+        }
+
+        switch {
+        case typ == pestHello:
+            m.count("hello")
+            greeted = true
+            hello := binary.BigEndian.AppendUint32(appendPestStr(nil, "pestcontrol"), 1)
+            err = reply(pestHello, hello)
+
+        case !greeted:
+            err = replyError("expected Hello")
+
+        case typ == pestDialAuthority && !dialed && len(payload) == 4:
+            m.count("dial")
+            site = binary.BigEndian.Uint32(payload)
+            targets, ok := m.siteTargets(site)
+            if !ok || m.fail("dial") {
+                err = replyError(fmt.Sprintf("no authority for site %d", site))
+                break
+            }
+            dialed = true
+            species := make([]string, 0, len(targets))
+            for s := range targets {
+                species = append(species, s)
+            }
+            sort.Strings(species)
+            resp := binary.BigEndian.AppendUint32(nil, site)
+            resp = binary.BigEndian.AppendUint32(resp, uint32(len(species)))
+            for _, s := range species {
+                resp = appendPestStr(resp, s)
+                resp = binary.BigEndian.AppendUint32(resp, targets[s].Min)
+                resp = binary.BigEndian.AppendUint32(resp, targets[s].Max)
+            }
+            err = reply(pestTargetPopulations, resp)
+
+        case typ == pestCreatePolicy && dialed && len(payload) >= 5:
+            m.count("create")
+            n := binary.BigEndian.Uint32(payload)
+            if uint64(len(payload)) != 4+uint64(n)+1 {
+                err = replyError("malformed CreatePolicy")
+                break
+            }
+            if m.fail("create") {
+                err = replyError("induced failure")
+                break
+            }
+            p := mockPolicy{species: string(payload[4 : 4+n]), action: payload[4+n]}
+            m.mu.Lock()
+            m.nextID++
+            id := m.nextID
+            if m.policies[site] == nil {
+                m.policies[site] = make(map[uint32]mockPolicy)
+            }
+            m.policies[site][id] = p
+            m.mu.Unlock()
+            created = append(created, id)
+            err = reply(pestPolicyResult, binary.BigEndian.AppendUint32(nil, id))
+
+        case typ == pestDeletePolicy && dialed && len(payload) == 4:
+            m.count("delete")
+            id := binary.BigEndian.Uint32(payload)
+            if m.fail("delete") {
+                err = replyError("induced failure")
+                break
+            }
+            m.mu.Lock()
+            _, ok := m.policies[site][id]
+            delete(m.policies[site], id)
+            m.mu.Unlock()
+            if !ok {
+                m.count("bad_delete")
+                err = replyError(fmt.Sprintf("no such policy %d", id))
+                break
+            }
+            err = reply(pestOK, nil)
+
+        default:
+            m.count("unexpected")
+            err = replyError(fmt.Sprintf("unexpected message 0x%02x", typ))
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+// report prints the request counts and every live policy. A site with two
+// live policies for one species means the solution under test raced.
+func (m *mockAuthority) report() bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    names := make([]string, 0, len(m.stats))
+    for k := range m.stats {
+        names = append(names, k)
+    }
+    sort.Strings(names)
+    for _, k := range names {
+        fmt.Printf("[STATS] %s=%d\n", k, m.stats[k])
+    }
+
+    ok := true
+    for site, policies := range m.policies {
+        seen := make(map[string]bool)
+        for id, p := range policies {
+            fmt.Printf("[POLICY] site %d: policy %d %s 0x%02x\n", site, id, p.species, p.action)
+            if seen[p.species] {
+                fmt.Printf("[ERROR] site %d has more than one policy for %s\n", site, p.species)
+                ok = false
+            }
+            seen[p.species] = true
+        }
+    }
+    return ok
+}
+
+// runMockAuthority serves a fake Authority until interrupted, then reports
+// what the solution under test left behind.
+func runMockAuthority(args []string) error {
+    fs := flag.NewFlagSet("mock-authority", flag.ExitOnError)
+    listen := fs.String("listen", "127.0.0.1:20547", "address to listen on")
+    scriptPath := fs.String("script", "", "JSON authority script (every site gets random targets if empty)")
+    seed := fs.Int64("seed", 0, "random seed, overriding the script's")
+    fs.Parse(args)
+
+    script := authorityScript{RandomSites: true, Seed: 1}
+    if *scriptPath != "" {
+        data, err := os.ReadFile(*scriptPath)
+        if err != nil {
+            return err
+        }
+        script = authorityScript{}
+        if err := json.Unmarshal(data, &script); err != nil {
+            return fmt.Errorf("parsing %s: %w", *scriptPath, err)
+        }
+    }
+
+    if *seed != 0 {
+        script.Seed = *seed
+    }
+    m := &mockAuthority{
+        script:   script,
+        rng:      rand.New(rand.NewSource(script.Seed)),
+        targets:  make(map[uint32]map[string]pestRange),
+        policies: make(map[uint32]map[uint32]mockPolicy),
+        stats:    make(map[string]int),
+    }
+    if script.Delay != "" {
+        d, err := time.ParseDuration(script.Delay)
+        if err != nil {
+            return fmt.Errorf("delay: %w", err)
+        }
+        m.delay = d
+    }
+    for id, targets := range script.Sites {
+        site, err := strconv.ParseUint(id, 10, 32)
+        if err != nil {
+            return fmt.Errorf("site %q: %w", id, err)
+        }
+        m.targets[uint32(site)] = targets
+    }
+
+    listener, err := net.Listen("tcp", *listen)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("[LISTENING] Mock Authority listening on %s (seed %d)\n", *listen, script.Seed)
+
+    signals.OnShutdown(func() {
+        listener.Close()
+    })
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if !errors.Is(err, net.ErrClosed) {
+                return err
+            }
+            break
+        }
+        go m.serve(conn)
+    }
+
+    if !m.report() {
+        return errors.New("duplicate policies left behind")
+    }
+    return nil
+}
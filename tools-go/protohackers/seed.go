@@ -0,0 +1,22 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "time"
+)
+
+// seedFlag registers the -seed flag every randomized tool takes. Given the
+// same seed and the same server behaviour a run makes the same choices, so
+// tools print the seed when they start and when they fail.
+func seedFlag(fs *flag.FlagSet) *int64 {
+    return fs.Int64("seed", time.Now().UnixNano(), "random seed (defaults to the clock; printed so a run can be repeated)")
+}
+
+// seedError annotates a failure with the seed that reproduces it.
+func seedError(err error, seed int64) error {
+    if err == nil {
+        return nil
+    }
+    return fmt.Errorf("%w (reproduce with -seed %d)", err, seed)
+}
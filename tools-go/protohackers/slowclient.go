@@ -0,0 +1,338 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "fmt"
+    "math/rand"
+    "net"
+    "os"
+    "os/signal"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "../../lib-go/retry"
+    "../../lib-go/signals"
+)
+
+// slowClient keeps sending to the server while reading its replies at a
+// trickle, or not at all. A well-behaved server either holds it back
+// (its writes block once the socket buffers fill) or drops it, and keeps
+// serving everybody else either way.
+type slowClient struct {
+    id       int
+    conn     net.Conn
+    readRate int // bytes per second, 0 to never read
+
+    mu          sync.Mutex
+    sent        int
+    read        int
+    blockedAt   time.Duration // when a write first stalled, 0 if never
+    closedAt    time.Duration // when the server dropped us, 0 if never
+    closeReason error
+}
+
+func (c *slowClient) closed(since time.Time, err error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closedAt == 0 {
+        c.closedAt = time.Since(since)
+        c.closeReason = err
+    }
+}
+
+// writeLoop sends next() over and over. A write that makes no progress for
+// a second counts as the server pushing back; the unsent rest of the
+// request is retried so the stream stays well formed.
+func (c *slowClient) writeLoop(begin time.Time, stop <-chan struct{}, next func() []byte) {
+    var pending []byte
+    for {
+        select {
+        case <-stop:
+            return
+        default:
+        }
+        if len(pending) == 0 {
+            pending = next()
+        }
+        c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+        n, err := c.conn.Write(pending)
+        pending = pending[n:]
+        c.mu.Lock()
+        c.sent += n
+        var netErr net.Error
+        timedOut := errors.As(err, &netErr) && netErr.Timeout()
+        if timedOut && c.blockedAt == 0 {
+            c.blockedAt = time.Since(begin)
+        }
+        c.mu.Unlock()
+        if err != nil && !timedOut {
+            c.closed(begin, err)
+            return
+        }
+    }
+}
+
+// readLoop reads at most readRate bytes a second.
+func (c *slowClient) readLoop(begin time.Time, stop <-chan struct{}) {
+    if c.readRate <= 0 {
+        return
+    }
+    buf := make([]byte, max(1, c.readRate/10))
+    ticker := time.NewTicker(100 * time.Millisecond)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+        c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+        n, err := c.conn.Read(buf)
+        c.mu.Lock()
+        c.read += n
+        c.mu.Unlock()
+        var netErr net.Error
+        if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+            c.closed(begin, err)
+            return
+        }
+    }
+}
+
+func (c *slowClient) String() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    s := fmt.Sprintf("slow client %d: sent %d bytes, read %d", c.id, c.sent, c.read)
+    if c.blockedAt > 0 {
+        s += fmt.Sprintf(", held back after %v", c.blockedAt.Round(time.Millisecond))
+    }
+    if c.closedAt > 0 {
+        s += fmt.Sprintf(", dropped after %v (%v)", c.closedAt.Round(time.Millisecond), c.closeReason)
+    } else {
+        s += ", still connected"
+    }
+    return s
+}
+
+// slowTraffic is how slow clients and the probe talk to one protocol.
+type slowTraffic struct {
+    // join runs any handshake for a new slow client.
+    join func(conn net.Conn, reader *bufio.Reader, name string) error
+    // request returns the bytes of the next request to pipeline.
+    request func(rng *rand.Rand) []byte
+    // probe starts a well-behaved client and returns a function timing one
+    // exchange with the server.
+    probe func(addr string, timeout time.Duration) (func() error, error)
+}
+
+var slowTraffics = map[string]slowTraffic{
+    "prime-time": {
+        join: func(net.Conn, *bufio.Reader, string) error { return nil },
+        request: func(rng *rand.Rand) []byte {
+            return fmt.Appendf(nil, "{\"method\":\"isPrime\",\"number\":%d}\n", rng.Int63n(1<<24))
+        },
+        probe: func(addr string, timeout time.Duration) (func() error, error) {
+            conn, err := dialPolicy.Dial("tcp", addr, timeout)
+            if err != nil {
+                return nil, err
+            }
+            sess, _ := startPrimeLoad(conn, rand.New(rand.NewSource(1)))
+            return func() error {
+                conn.SetDeadline(time.Now().Add(timeout))
+                return sess.step()
+            }, nil
+        },
+    },
+    "budget-chat": {
+        join: joinChat,
+        request: func(rng *rand.Rand) []byte {
+            return fmt.Appendf(nil, "%s\n", strings.Repeat("x", 1+rng.Intn(200)))
+        },
+        probe: chatProbe,
+    },
+}
+
+// joinChat reads the welcome, sends name and reads the room list.
+func joinChat(conn net.Conn, reader *bufio.Reader, name string) error {
+    if _, err := reader.ReadString('\n'); err != nil {
+        return fmt.Errorf("reading welcome: %w", err)
+    }
+    if _, err := fmt.Fprintf(conn, "%s\n", name); err != nil {
+        return err
+    }
+    if _, err := reader.ReadString('\n'); err != nil {
+        return fmt.Errorf("reading room list: %w", err)
+    }
+    return nil
+}
+
+// chatProbe joins two well-behaved users; each exchange is one of them
+// speaking and the other hearing it.
+func chatProbe(addr string, timeout time.Duration) (func() error, error) {
+    var conns [2]net.Conn
+    var readers [2]*bufio.Reader
+    for i, name := range []string{"probesender", "probelistener"} {
+        conn, err := dialPolicy.Dial("tcp", addr, timeout)
+        if err != nil {
+            return nil, err
+        }
+        conn.SetDeadline(time.Now().Add(timeout))
+        conns[i], readers[i] = conn, bufio.NewReader(conn)
+        if err := joinChat(conn, readers[i], name); err != nil {
+            return nil, err
+        }
+    }
+    // Both users keep draining what the server sends them so neither is a
+    // slow client itself; the listener passes on the probe's pings.
+    heard := make(chan string, 16)
+    for i := range conns {
+        go func(i int) {
+            conns[i].SetReadDeadline(time.Time{})
+            for {
+                line, err := readers[i].ReadString('\n')
+                if err != nil {
+                    if i == 1 {
+                        close(heard)
+                    }
+                    return
+                }
+                if i == 1 && strings.HasPrefix(line, "[probesender] ping ") {
+                    heard <- line
+                }
+            }
+        }(i)
+    }
+
+    seq := 0
+    return func() error {
+        seq++
+        conns[0].SetWriteDeadline(time.Now().Add(timeout))
+        if _, err := fmt.Fprintf(conns[0], "ping %d\n", seq); err != nil {
+            return err
+        }
+        want := fmt.Sprintf("[probesender] ping %d\n", seq)
+        deadline := time.After(timeout)
+        for {
+            select {
+            case line, ok := <-heard:
+                if !ok {
+                    return errors.New("the server dropped a probe user")
+                }
+                if line == want {
+                    return nil
+                }
+            case <-deadline:
+                return fmt.Errorf("%q not delivered within %v", strings.TrimSpace(want), timeout)
+            }
+        }
+    }, nil
+}
+
+// runSlowClient connects clients that read slowly or never while still
+// sending, and checks that a well-behaved client is served promptly.
+func runSlowClient(args []string) error {
+    fs := flag.NewFlagSet("slow-client", flag.ExitOnError)
+    addr := fs.String("addr", "127.0.0.1:65432", "server address")
+    clients := fs.Int("clients", 10, "number of slow clients")
+    readRate := fs.Int("read-rate", 0, "bytes per second each slow client reads (0 to never read)")
+    duration := fs.Duration("duration", 20*time.Second, "length of the run")
+    interval := fs.Duration("probe-interval", 100*time.Millisecond, "pause between the probe's exchanges")
+    timeout := fs.Duration("timeout", retry.ReplyTimeout, "how long the probe waits for each exchange")
+    seed := seedFlag(fs)
+    fs.Parse(args)
+
+    var names []string
+    for name := range slowTraffics {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    if fs.NArg() != 1 {
+        return fmt.Errorf("usage: protohackers slow-client [flags] <%s>", strings.Join(names, "|"))
+    }
+    traffic, ok := slowTraffics[fs.Arg(0)]
+    if !ok {
+        return fmt.Errorf("no slow client traffic for %q", fs.Arg(0))
+    }
+
+    fmt.Printf("[SLOW] %d clients reading %d bytes/s from %s (seed %d)\n", *clients, *readRate, *addr, *seed)
+    rng := rand.New(rand.NewSource(*seed))
+
+    stop := make(chan struct{})
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, signals.Shutdown()...)
+    defer signal.Stop(c)
+
+    var wg sync.WaitGroup
+    begin := time.Now()
+    slow := make([]*slowClient, 0, *clients)
+    for i := 0; i < *clients; i++ {
+        conn, err := dialPolicy.Dial("tcp", *addr, *timeout)
+        if err != nil {
+            close(stop)
+            return seedError(fmt.Errorf("connecting slow client %d: %w", i, err), *seed)
+        }
+        defer conn.Close()
+        conn.SetDeadline(time.Now().Add(*timeout))
+        if err := traffic.join(conn, bufio.NewReader(conn), fmt.Sprintf("slow%04d", i)); err != nil {
+            close(stop)
+            return seedError(fmt.Errorf("slow client %d: %w", i, err), *seed)
+        }
+        conn.SetDeadline(time.Time{})
+
+        sc := &slowClient{id: i, conn: conn, readRate: *readRate}
+        slow = append(slow, sc)
+        clientRng := rand.New(rand.NewSource(rng.Int63()))
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            sc.writeLoop(begin, stop, func() []byte { return traffic.request(clientRng) })
+        }()
+        go func() {
+            defer wg.Done()
+            sc.readLoop(begin, stop)
+        }()
+    }
+
+    probe, err := traffic.probe(*addr, *timeout)
+    if err != nil {
+        close(stop)
+        return seedError(fmt.Errorf("starting probe: %w", err), *seed)
+    }
+
+    var latencies []time.Duration
+    failures := 0
+run:
+    for time.Since(begin) < *duration {
+        start := time.Now()
+        if err := probe(); err != nil {
+            failures++
+            fmt.Printf("[FAIL] probe after %v: %v\n", time.Since(begin).Round(time.Millisecond), err)
+            break
+        }
+        latencies = append(latencies, time.Since(start))
+        select {
+        case <-time.After(*interval):
+        case <-c:
+            break run
+        }
+    }
+    close(stop)
+    wg.Wait()
+
+    for _, sc := range slow {
+        fmt.Printf("[SLOW] %s\n", sc)
+    }
+    sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+    fmt.Printf("[PROBE] %d exchanges, %d failed: p50=%v p99=%v max=%v\n", len(latencies), failures,
+        percentile(latencies, 0.50), percentile(latencies, 0.99), percentile(latencies, 1))
+
+    if failures > 0 {
+        return seedError(errors.New("the server stopped serving the probe"), *seed)
+    }
+    fmt.Println("[RESULT] PASS")
+    return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// procSample is one reading of the server's resource use. Fields that
+// could not be read are -1.
+type procSample struct {
+    rssKB      int
+    fds        int
+    threads    int
+    goroutines int
+    heapBytes  int
+}
+
+// sampleProcess reads the server's memory, threads and open files from
+// /proc, and its heap and goroutines from its expvar endpoint if given.
+func sampleProcess(pid int, varsURL string) procSample {
+    s := procSample{-1, -1, -1, -1, -1}
+
+    if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid)); err == nil {
+        for _, line := range strings.Split(string(data), "\n") {
+            key, value, _ := strings.Cut(line, ":")
+            fields := strings.Fields(value)
+            if len(fields) == 0 {
+                continue
+            }
+            switch key {
+            case "VmRSS":
+                s.rssKB, _ = strconv.Atoi(fields[0])
+            case "Threads":
+                s.threads, _ = strconv.Atoi(fields[0])
+            }
+        }
+    }
+    if fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid)); err == nil {
+        s.fds = len(fds)
+    }
+
+    if varsURL != "" {
+        client := http.Client{Timeout: 2 * time.Second}
+        if resp, err := client.Get(varsURL); err == nil {
+            var vars struct {
+                Goroutines *int `json:"goroutines"`
+                Memstats   struct {
+                    HeapAlloc int `json:"HeapAlloc"`
+                } `json:"memstats"`
+            }
+            if json.NewDecoder(resp.Body).Decode(&vars) == nil {
+                s.heapBytes = vars.Memstats.HeapAlloc
+                if vars.Goroutines != nil {
+                    s.goroutines = *vars.Goroutines
+                }
+            }
+            resp.Body.Close()
+        }
+    }
+    return s
+}
+
+func (s procSample) String() string {
+    field := func(name string, v int) string {
+        if v < 0 {
+            return name + "=?"
+        }
+        return fmt.Sprintf("%s=%d", name, v)
+    }
+    return strings.Join([]string{
+        field("rss_kb", s.rssKB),
+        field("fds", s.fds),
+        field("threads", s.threads),
+        field("goroutines", s.goroutines),
+        field("heap", s.heapBytes),
+    }, " ")
+}
+
+// leaks compares the server once the load has gone away with how it was
+// before the load started. Connections are closed by then, so their file
+// descriptors and goroutines should be gone too.
+func leaks(before, after procSample, slack int) []string {
+    var found []string
+    check := func(name string, b, a int) {
+        if b >= 0 && a >= 0 && a > b+slack {
+            found = append(found, fmt.Sprintf("%s grew from %d to %d", name, b, a))
+        }
+    }
+    check("fds", before.fds, after.fds)
+    check("goroutines", before.goroutines, after.goroutines)
+    return found
+}
+
+// runSoak drives one solution with its traffic generator for a long time
+// while watching the server process for leaks. With -chaos, some clients
+// vanish mid-message; the rest must still get correct replies.
+func runSoak(args []string) error {
+    fs := flag.NewFlagSet("soak", flag.ExitOnError)
+    o := loadFlags(fs)
+    fs.IntVar(&o.users, "conns", 20, "number of concurrent connections")
+    duration := fs.Duration("duration", 10*time.Minute, "length of the run")
+    interval := fs.Duration("interval", 10*time.Second, "how often to sample the server")
+    settle := fs.Duration("settle", 5*time.Second, "how long to let the server clean up after the load stops")
+    slack := fs.Int("slack", 5, "fds or goroutines that may be left over before it counts as a leak")
+    pid := fs.Int("pid", 0, "server process to watch (0 to build and start the Go solution)")
+    solDir := fs.String("sol", "../../sol-go", "directory of Go solutions, used when -pid is 0")
+    admin := fs.String("admin", "", "the server's admin address, for heap and goroutine counts (passed on as -admin when starting the solution)")
+    fs.Parse(args)
+
+    name, gen, err := generatorArg(fs)
+    if err != nil {
+        return err
+    }
+    if o.users < 1 || o.perConn < 1 {
+        return errors.New("conns and requests must be positive")
+    }
+
+    varsURL := ""
+    if *admin != "" {
+        varsURL = "http://" + *admin + "/debug/vars"
+    }
+    if *pid == 0 {
+        var serverArgs []string
+        if *admin != "" {
+            serverArgs = []string{"-admin", *admin}
+        }
+        server, err := localServer(*solDir, name, gen.network, o.addr, o.timeout, serverArgs...)
+        if err != nil {
+            return err
+        }
+        defer stopServer(server)
+        *pid = server.Process.Pid
+    }
+
+    fmt.Printf("[SOAK] %s at %s (pid %d): %d connections for %v (seed %d)\n",
+        name, o.addr, *pid, o.users, *duration, *o.seed)
+    before := sampleProcess(*pid, varsURL)
+    fmt.Printf("[SAMPLE] before %s\n", before)
+
+    var first, last procSample
+    stats, elapsed := driveLoad(gen, o, loadProfiles["steady"], *duration, *interval,
+        func(elapsed time.Duration, users int, stats *loadStats) {
+            last = sampleProcess(*pid, varsURL)
+            if first == (procSample{}) {
+                first = last
+            }
+            fmt.Printf("[SAMPLE] %6.0fs requests=%d %s\n", elapsed.Seconds(), stats.requestCount(), last)
+        })
+    stats.report(elapsed)
+
+    time.Sleep(*settle)
+    after := sampleProcess(*pid, varsURL)
+    fmt.Printf("[SAMPLE] after  %s\n", after)
+
+    found := leaks(before, after, *slack)
+    if bad := stats.errors["bad-reply"]; bad > 0 {
+        found = append(found, fmt.Sprintf("%d wrong replies", bad))
+    }
+    if first.rssKB > 0 && last.rssKB > 2*first.rssKB {
+        found = append(found, fmt.Sprintf("rss grew from %d kB to %d kB under steady load", first.rssKB, last.rssKB))
+    }
+    for _, f := range found {
+        fmt.Printf("[PROBLEM] %s\n", f)
+    }
+    if len(found) > 0 {
+        return seedError(fmt.Errorf("%d problems found", len(found)), *o.seed)
+    }
+    fmt.Println("[RESULT] PASS")
+    return nil
+}
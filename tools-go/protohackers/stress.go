@@ -0,0 +1,297 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "math/rand"
+    "net"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "../../lib-go/retry"
+    "../../lib-go/signals"
+)
+
+// stressBucket holds the requests scheduled in one second of a run.
+type stressBucket struct {
+    latencies []time.Duration
+    errors    int
+    dropped   int // requests that never left because every connection was busy
+}
+
+// stressStats records every request by the second it was scheduled in.
+type stressStats struct {
+    mu      sync.Mutex
+    begin   time.Time
+    buckets []stressBucket
+    classes map[string]int
+}
+
+func (s *stressStats) bucket(at time.Time) *stressBucket {
+    i := int(at.Sub(s.begin) / time.Second)
+    for len(s.buckets) <= i {
+        s.buckets = append(s.buckets, stressBucket{})
+    }
+    return &s.buckets[i]
+}
+
+// done records a request scheduled at scheduled. Latency is measured from
+// when the request should have been sent, not when it was, so a server
+// that falls behind is charged for the queueing it causes.
+func (s *stressStats) done(scheduled time.Time, err error) {
+    d := time.Since(scheduled)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    b := s.bucket(scheduled)
+    if err != nil {
+        b.errors++
+        s.classes[errorClass(err)]++
+        return
+    }
+    b.latencies = append(b.latencies, d)
+}
+
+func (s *stressStats) drop(scheduled time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.bucket(scheduled).dropped++
+    s.classes["dropped"]++
+}
+
+// latencySummary is a set of percentiles in milliseconds.
+type latencySummary struct {
+    P50 float64 `json:"p50_ms"`
+    P95 float64 `json:"p95_ms"`
+    P99 float64 `json:"p99_ms"`
+    Max float64 `json:"max_ms"`
+}
+
+func summarize(latencies []time.Duration) latencySummary {
+    sorted := append([]time.Duration(nil), latencies...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+    ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+    return latencySummary{
+        P50: ms(percentile(sorted, 0.50)),
+        P95: ms(percentile(sorted, 0.95)),
+        P99: ms(percentile(sorted, 0.99)),
+        Max: ms(percentile(sorted, 1)),
+    }
+}
+
+// stressSecond is one row of the report's time series.
+type stressSecond struct {
+    Second  int            `json:"second"`
+    OK      int            `json:"ok"`
+    Errors  int            `json:"errors"`
+    Dropped int            `json:"dropped"`
+    Latency latencySummary `json:"latency"`
+}
+
+// stressReport is written by -report, as JSON or, for a .csv file, as the
+// per-second series.
+type stressReport struct {
+    Problem      string         `json:"problem"`
+    Addr         string         `json:"addr"`
+    Seed         int64          `json:"seed"`
+    TargetRate   float64        `json:"target_rate"`
+    AchievedRate float64        `json:"achieved_rate"`
+    Duration     float64        `json:"duration_s"`
+    Requests     int            `json:"requests"`
+    Errors       int            `json:"errors"`
+    ErrorRate    float64        `json:"error_rate"`
+    ErrorClasses map[string]int `json:"error_classes"`
+    Latency      latencySummary `json:"latency"`
+    Seconds      []stressSecond `json:"seconds"`
+}
+
+func (s *stressStats) report(r *stressReport, elapsed time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var all []time.Duration
+    for i, b := range s.buckets {
+        all = append(all, b.latencies...)
+        r.Errors += b.errors + b.dropped
+        r.Seconds = append(r.Seconds, stressSecond{
+            Second:  i,
+            OK:      len(b.latencies),
+            Errors:  b.errors,
+            Dropped: b.dropped,
+            Latency: summarize(b.latencies),
+        })
+    }
+    r.Requests = len(all) + r.Errors
+    if r.Requests > 0 {
+        r.ErrorRate = float64(r.Errors) / float64(r.Requests)
+    }
+    r.Duration = elapsed.Seconds()
+    r.AchievedRate = float64(len(all)) / elapsed.Seconds()
+    r.ErrorClasses = s.classes
+    r.Latency = summarize(all)
+}
+
+func writeStressReport(path string, r *stressReport) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    if filepath.Ext(path) != ".csv" {
+        enc := json.NewEncoder(f)
+        enc.SetIndent("", "  ")
+        return enc.Encode(r)
+    }
+
+    w := csv.NewWriter(f)
+    w.Write([]string{"second", "ok", "errors", "dropped", "p50_ms", "p95_ms", "p99_ms", "max_ms"})
+    ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+    for _, s := range r.Seconds {
+        w.Write([]string{
+            strconv.Itoa(s.Second), strconv.Itoa(s.OK), strconv.Itoa(s.Errors), strconv.Itoa(s.Dropped),
+            ms(s.Latency.P50), ms(s.Latency.P95), ms(s.Latency.P99), ms(s.Latency.Max),
+        })
+    }
+    w.Flush()
+    return w.Error()
+}
+
+// stressWorker owns one connection and sends a request for every tick it
+// takes off the schedule, reconnecting after an error.
+func stressWorker(gen loadGenerator, addr string, timeout time.Duration, rng *rand.Rand,
+    schedule <-chan time.Time, stats *stressStats) {
+    var conn net.Conn
+    var sess loadSession
+    defer func() {
+        if conn != nil {
+            conn.Close()
+        }
+    }()
+
+    for scheduled := range schedule {
+        var err error
+        if sess == nil {
+            conn, err = net.DialTimeout(gen.network, addr, timeout)
+            if err == nil {
+                conn.SetDeadline(time.Now().Add(timeout))
+                sess, err = gen.start(conn, rng)
+            }
+        }
+        if err == nil {
+            conn.SetDeadline(time.Now().Add(timeout))
+            err = sess.step()
+        }
+        stats.done(scheduled, err)
+        if err != nil {
+            if conn != nil {
+                conn.Close()
+            }
+            conn, sess = nil, nil
+        }
+    }
+}
+
+// runStress holds a fixed request rate against a solution, whether or not
+// it keeps up, and reports latency and errors for capacity planning.
+func runStress(args []string) error {
+    fs := flag.NewFlagSet("stress", flag.ExitOnError)
+    addr := fs.String("addr", "127.0.0.1:65432", "server address")
+    rate := fs.Float64("rate", 1000, "requests per second to hold")
+    conns := fs.Int("conns", 50, "connections to spread the requests over")
+    duration := fs.Duration("duration", 30*time.Second, "length of the run")
+    timeout := fs.Duration("timeout", retry.ReplyTimeout, "deadline for connecting and for each request")
+    reportPath := fs.String("report", "", "write a report to this file: CSV per-second series if it ends in .csv, JSON otherwise")
+    seed := seedFlag(fs)
+    fs.Parse(args)
+
+    name, gen, err := generatorArg(fs)
+    if err != nil {
+        return err
+    }
+    if *rate <= 0 || *conns < 1 {
+        return errors.New("rate and conns must be positive")
+    }
+
+    fmt.Printf("[STRESS] %s at %s: %.0f requests/s over %d connections for %v (seed %d)\n",
+        name, *addr, *rate, *conns, *duration, *seed)
+    rng := rand.New(rand.NewSource(*seed))
+
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, signals.Shutdown()...)
+    defer signal.Stop(c)
+
+    // The schedule holds at most a second of backlog; past that the
+    // connections are hopelessly behind and requests are dropped.
+    stats := &stressStats{begin: time.Now(), classes: make(map[string]int)}
+    schedule := make(chan time.Time, int(*rate)+1)
+    var wg sync.WaitGroup
+    for i := 0; i < *conns; i++ {
+        wg.Add(1)
+        workerRng := rand.New(rand.NewSource(rng.Int63()))
+        go func() {
+            defer wg.Done()
+            stressWorker(gen, *addr, *timeout, workerRng, schedule, stats)
+        }()
+    }
+
+    interval := time.Duration(float64(time.Second) / *rate)
+    next := stats.begin
+    end := stats.begin.Add(*duration)
+    progress := stats.begin.Add(time.Second)
+run:
+    for next.Before(end) {
+        if wait := time.Until(next); wait > 0 {
+            select {
+            case <-time.After(wait):
+            case <-c:
+                break run
+            }
+        }
+        // Catch up on every request due by now.
+        for now := time.Now(); !next.After(now) && next.Before(end); next = next.Add(interval) {
+            select {
+            case schedule <- next:
+            default:
+                stats.drop(next)
+            }
+        }
+        if time.Now().After(progress) {
+            fmt.Printf("[PROGRESS] %5.1fs backlog=%d\n", time.Since(stats.begin).Seconds(), len(schedule))
+            progress = progress.Add(time.Second)
+        }
+    }
+    close(schedule)
+    wg.Wait()
+    elapsed := time.Since(stats.begin)
+
+    r := &stressReport{Problem: name, Addr: *addr, Seed: *seed, TargetRate: *rate}
+    stats.report(r, elapsed)
+    fmt.Printf("[RESULT] %d requests, %.1f/s achieved of %.0f/s, error rate %.2f%%\n",
+        r.Requests, r.AchievedRate, r.TargetRate, 100*r.ErrorRate)
+    fmt.Printf("[LATENCY] p50=%.3fms p95=%.3fms p99=%.3fms max=%.3fms\n",
+        r.Latency.P50, r.Latency.P95, r.Latency.P99, r.Latency.Max)
+    classes := make([]string, 0, len(r.ErrorClasses))
+    for k := range r.ErrorClasses {
+        classes = append(classes, k)
+    }
+    sort.Strings(classes)
+    for _, k := range classes {
+        fmt.Printf("[ERRORS] %s=%d\n", k, r.ErrorClasses[k])
+    }
+
+    if *reportPath != "" {
+        if err := writeStressReport(*reportPath, r); err != nil {
+            return err
+        }
+        fmt.Printf("[REPORT] %s\n", *reportPath)
+    }
+    return nil
+}
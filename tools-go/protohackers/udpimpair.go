@@ -0,0 +1,190 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "math/rand"
+    "net"
+    "sync"
+    "time"
+
+    "../../lib-go/signals"
+)
+
+// impairConfig describes what happens to each datagram, in each direction.
+type impairConfig struct {
+    drop      float64       // probability a datagram is lost
+    duplicate float64       // probability a datagram is delivered twice
+    reorder   float64       // probability a datagram is held back behind later ones
+    delay     time.Duration // added to every datagram
+    jitter    time.Duration // random extra delay, up to this much
+    holdBack  time.Duration // extra delay for reordered datagrams
+}
+
+// udpImpairer relays datagrams between clients and an upstream UDP server,
+// losing, duplicating, reordering and delaying them. All randomness comes
+// from one seeded source so a run can be repeated.
+type udpImpairer struct {
+    listener *net.UDPConn
+    upstream *net.UDPAddr
+    cfg      impairConfig
+
+    mu       sync.Mutex
+    rng      *rand.Rand
+    sessions map[string]*net.UDPConn // client address -> socket to upstream
+    stats    map[string]int
+}
+
+// plan decides the fate of one datagram: when to deliver each copy of it,
+// or no copies if it is dropped.
+func (u *udpImpairer) plan() []time.Duration {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+
+    u.stats["datagrams"]++
+    if u.rng.Float64() < u.cfg.drop {
+        u.stats["dropped"]++
+        return nil
+    }
+
+    copies := 1
+    if u.rng.Float64() < u.cfg.duplicate {
+        u.stats["duplicated"]++
+        copies = 2
+    }
+    delays := make([]time.Duration, copies)
+    for i := range delays {
+        d := u.cfg.delay
+        if u.cfg.jitter > 0 {
+            d += time.Duration(u.rng.Int63n(int64(u.cfg.jitter)))
+        }
+        if u.rng.Float64() < u.cfg.reorder {
+            u.stats["reordered"]++
+            d += u.cfg.holdBack
+        }
+        delays[i] = d
+    }
+    return delays
+}
+
+// relay sends data through the impairments using send.
+func (u *udpImpairer) relay(data []byte, send func([]byte)) {
+    data = append([]byte(nil), data...)
+    for _, d := range u.plan() {
+        if d == 0 {
+            send(data)
+        } else {
+            time.AfterFunc(d, func() { send(data) })
+        }
+    }
+}
+
+// session returns the upstream socket for a client, creating it and its
+// return path on first contact.
+func (u *udpImpairer) session(client *net.UDPAddr) (*net.UDPConn, error) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+
+    key := client.String()
+    if up := u.sessions[key]; up != nil {
+        return up, nil
+    }
+    up, err := net.DialUDP("udp", nil, u.upstream)
+    if err != nil {
+        return nil, err
+    }
+    u.sessions[key] = up
+    fmt.Printf("[SESSION] %s <-> %s\n", key, u.upstream)
+
+    go func() {
+        buf := make([]byte, 65536)
+        for {
+            n, err := up.Read(buf)
+            if err != nil {
+                if !errors.Is(err, net.ErrClosed) {
+                    fmt.Printf("[ERROR] Reading upstream for %s: %v\n", key, err)
+                }
+                return
+            }
+            u.relay(buf[:n], func(b []byte) { u.listener.WriteToUDP(b, client) })
+        }
+    }()
+    return up, nil
+}
+
+func (u *udpImpairer) report() {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    fmt.Printf("[STATS] datagrams=%d dropped=%d duplicated=%d reordered=%d sessions=%d\n",
+        u.stats["datagrams"], u.stats["dropped"], u.stats["duplicated"], u.stats["reordered"], len(u.sessions))
+}
+
+// runUDPImpair relays UDP between clients and a server over a simulated
+// lossy network, for exercising LRCP retransmission and the like.
+func runUDPImpair(args []string) error {
+    fs := flag.NewFlagSet("udp-impair", flag.ExitOnError)
+    listen := fs.String("listen", "127.0.0.1:65433", "address for clients to send to")
+    upstream := fs.String("upstream", "127.0.0.1:65432", "UDP server to relay to")
+    var cfg impairConfig
+    fs.Float64Var(&cfg.drop, "drop", 0, "probability a datagram is lost")
+    fs.Float64Var(&cfg.duplicate, "duplicate", 0, "probability a datagram is delivered twice")
+    fs.Float64Var(&cfg.reorder, "reorder", 0, "probability a datagram is held back behind later ones")
+    fs.DurationVar(&cfg.delay, "delay", 0, "delay added to every datagram")
+    fs.DurationVar(&cfg.jitter, "jitter", 0, "random extra delay per datagram, up to this much")
+    fs.DurationVar(&cfg.holdBack, "hold-back", 50*time.Millisecond, "extra delay for reordered datagrams")
+    seed := seedFlag(fs)
+    fs.Parse(args)
+
+    upAddr, err := net.ResolveUDPAddr("udp", *upstream)
+    if err != nil {
+        return err
+    }
+    laddr, err := net.ResolveUDPAddr("udp", *listen)
+    if err != nil {
+        return err
+    }
+    listener, err := net.ListenUDP("udp", laddr)
+    if err != nil {
+        return err
+    }
+
+    u := &udpImpairer{
+        listener: listener,
+        upstream: upAddr,
+        cfg:      cfg,
+        rng:      rand.New(rand.NewSource(*seed)),
+        sessions: make(map[string]*net.UDPConn),
+        stats:    make(map[string]int),
+    }
+    fmt.Printf("[LISTENING] UDP impairer on %s -> %s (seed %d)\n", *listen, *upstream, *seed)
+
+    signals.OnShutdown(func() {
+        listener.Close()
+    })
+
+    buf := make([]byte, 65536)
+    for {
+        n, client, err := listener.ReadFromUDP(buf)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                break
+            }
+            return err
+        }
+        up, err := u.session(client)
+        if err != nil {
+            fmt.Printf("[ERROR] %v\n", err)
+            continue
+        }
+        u.relay(buf[:n], func(b []byte) { up.Write(b) })
+    }
+
+    u.mu.Lock()
+    for _, up := range u.sessions {
+        up.Close()
+    }
+    u.mu.Unlock()
+    u.report()
+    return nil
+}